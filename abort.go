@@ -0,0 +1,74 @@
+package mqttbmlatency
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// abortMonitor stops a run early once failures cross a configured threshold,
+// so a doomed run fails fast with a reason instead of producing misleading totals
+type abortMonitor struct {
+	maxFailureRatio float64 // 0 disables
+	maxDisconnects  int64   // 0 disables
+	minMessages     int64   // messages required before the ratio is checked
+
+	published   int64 // accessed atomically
+	failures    int64
+	disconnects int64
+
+	once    sync.Once
+	tripped int32
+	reason  string
+}
+
+func newAbortMonitor(cfg *Config) *abortMonitor {
+	if cfg.MaxFailureRatio <= 0 && cfg.MaxDisconnects <= 0 {
+		return nil
+	}
+	min := cfg.AbortMinMessages
+	if min <= 0 {
+		min = 100
+	}
+	return &abortMonitor{
+		maxFailureRatio: cfg.MaxFailureRatio,
+		maxDisconnects:  cfg.MaxDisconnects,
+		minMessages:     min,
+	}
+}
+
+// publish accounts one publish attempt
+func (a *abortMonitor) publish(failed bool) {
+	total := atomic.AddInt64(&a.published, 1)
+	failures := atomic.LoadInt64(&a.failures)
+	if failed {
+		failures = atomic.AddInt64(&a.failures, 1)
+	}
+	if a.maxFailureRatio > 0 && total >= a.minMessages {
+		if ratio := float64(failures) / float64(total); ratio > a.maxFailureRatio {
+			a.trip(fmt.Sprintf("publish failure ratio %.3f%% exceeded limit of %.3f%% (%v/%v)",
+				ratio*100, a.maxFailureRatio*100, failures, total))
+		}
+	}
+}
+
+// disconnect accounts one lost connection of any client
+func (a *abortMonitor) disconnect() {
+	n := atomic.AddInt64(&a.disconnects, 1)
+	if a.maxDisconnects > 0 && n > a.maxDisconnects {
+		a.trip(fmt.Sprintf("%v disconnects exceeded limit of %v", n, a.maxDisconnects))
+	}
+}
+
+func (a *abortMonitor) trip(reason string) {
+	a.once.Do(func() {
+		a.reason = reason
+		atomic.StoreInt32(&a.tripped, 1)
+		log.Printf("Aborting benchmark: %v\n", reason)
+	})
+}
+
+func (a *abortMonitor) aborted() bool {
+	return a != nil && atomic.LoadInt32(&a.tripped) == 1
+}
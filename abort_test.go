@@ -0,0 +1,61 @@
+package mqttbmlatency
+
+import (
+	"testing"
+)
+
+func TestAbortMonitorDisabled(t *testing.T) {
+	a := newAbortMonitor(&Config{AbortMinMessages: 10})
+	if a != nil {
+		t.Fatal("monitor without thresholds")
+	}
+	if a.aborted() {
+		t.Error("nil monitor aborted")
+	}
+}
+
+func TestAbortFailureRatio(t *testing.T) {
+	tests := []struct {
+		name     string
+		min      int64
+		failures []bool
+		aborted  bool
+	}{
+		{"failures before the minimum", 10, []bool{true, true, true, true, true, true, true, true, true}, false},
+		{"ratio exceeded at the minimum", 10, []bool{true, true, false, false, false, false, false, false, false, false}, true},
+		{"ratio at the limit", 10, []bool{true, false, false, false, false, false, false, false, false, false}, false},
+		{"default minimum", 0, []bool{true, true, true, true, true, true, true, true, true, true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAbortMonitor(&Config{MaxFailureRatio: 0.1, AbortMinMessages: tt.min})
+			for _, failed := range tt.failures {
+				a.publish(failed)
+			}
+			if a.aborted() != tt.aborted {
+				t.Fatalf("aborted %v, want %v", a.aborted(), tt.aborted)
+			}
+			if tt.aborted && a.reason != "publish failure ratio 20.000% exceeded limit of 10.000% (2/10)" {
+				t.Errorf("reason %q", a.reason)
+			}
+		})
+	}
+}
+
+func TestAbortDisconnects(t *testing.T) {
+	a := newAbortMonitor(&Config{MaxDisconnects: 2})
+	a.disconnect()
+	a.disconnect()
+	if a.aborted() {
+		t.Fatal("aborted at the disconnect limit")
+	}
+	a.disconnect()
+	if !a.aborted() || a.reason != "3 disconnects exceeded limit of 2" {
+		t.Fatalf("aborted %v, reason %q", a.aborted(), a.reason)
+	}
+	// the first reason stays
+	a.disconnect()
+	if a.reason != "3 disconnects exceeded limit of 2" {
+		t.Errorf("reason %q", a.reason)
+	}
+}
@@ -0,0 +1,97 @@
+package mqttbmlatency
+
+import (
+	"math"
+	"sync"
+)
+
+// accumulator keeps running statistics of a stream of samples in O(1) memory,
+// using Welford's algorithm for the variance
+type accumulator struct {
+	count int64
+	mean  float64
+	m2    float64
+	min   float64
+	max   float64
+}
+
+func (a *accumulator) add(v float64) {
+	if a.count == 0 || v < a.min {
+		a.min = v
+	}
+	if a.count == 0 || v > a.max {
+		a.max = v
+	}
+	a.count++
+	delta := v - a.mean
+	a.mean += delta / float64(a.count)
+	a.m2 += delta * (v - a.mean)
+}
+
+// merge combines b into a as if all of b's samples had been added to a
+func (a *accumulator) merge(b accumulator) {
+	if b.count == 0 {
+		return
+	}
+	if a.count == 0 {
+		*a = b
+		return
+	}
+	n := a.count + b.count
+	delta := b.mean - a.mean
+	a.mean += delta * float64(b.count) / float64(n)
+	a.m2 += b.m2 + delta*delta*float64(a.count)*float64(b.count)/float64(n)
+	a.min = math.Min(a.min, b.min)
+	a.max = math.Max(a.max, b.max)
+	a.count = n
+}
+
+// summarize returns the statistics of values
+func summarize(values []float64) *accumulator {
+	a := &accumulator{}
+	for _, v := range values {
+		a.add(v)
+	}
+	return a
+}
+
+func (a *accumulator) sum() float64 {
+	return a.mean * float64(a.count)
+}
+
+// std returns the sample standard deviation
+func (a *accumulator) std() float64 {
+	if a.count < 2 {
+		return 0
+	}
+	return math.Sqrt(a.m2 / float64(a.count-1))
+}
+
+// window is an accumulator shared between a client and a reader that
+// periodically takes and resets it
+type window struct {
+	mu       sync.Mutex
+	acc      accumulator
+	failures int64
+}
+
+func (w *window) add(v float64) {
+	w.mu.Lock()
+	w.acc.add(v)
+	w.mu.Unlock()
+}
+
+func (w *window) fail() {
+	w.mu.Lock()
+	w.failures++
+	w.mu.Unlock()
+}
+
+// take returns the window's statistics and starts a new window
+func (w *window) take() (accumulator, int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	acc, failures := w.acc, w.failures
+	w.acc, w.failures = accumulator{}, 0
+	return acc, failures
+}
@@ -0,0 +1,76 @@
+package mqttbmlatency
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAccumulatorAdd(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		count  int64
+		mean   float64
+		std    float64
+		min    float64
+		max    float64
+	}{
+		{"empty", nil, 0, 0, 0, 0, 0},
+		{"single", []float64{3}, 1, 3, 0, 3, 3},
+		{"negative", []float64{-2, -4}, 2, -3, math.Sqrt2, -4, -2},
+		{"sample std", []float64{2, 4, 4, 4, 5, 5, 7, 9}, 8, 5, math.Sqrt(32.0 / 7), 2, 9},
+		{"large offset", []float64{1e9 + 4, 1e9 + 7, 1e9 + 13, 1e9 + 16}, 4, 1e9 + 10, math.Sqrt(30), 1e9 + 4, 1e9 + 16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := summarize(tt.values)
+			if a.count != tt.count {
+				t.Errorf("count = %d, want %d", a.count, tt.count)
+			}
+			if !near(a.mean, tt.mean, 1e-9) {
+				t.Errorf("mean = %v, want %v", a.mean, tt.mean)
+			}
+			if !near(a.std(), tt.std, 1e-9) {
+				t.Errorf("std = %v, want %v", a.std(), tt.std)
+			}
+			if a.min != tt.min || a.max != tt.max {
+				t.Errorf("min, max = %v, %v, want %v, %v", a.min, a.max, tt.min, tt.max)
+			}
+			if !near(a.sum(), tt.mean*float64(tt.count), 1e-6) {
+				t.Errorf("sum = %v, want %v", a.sum(), tt.mean*float64(tt.count))
+			}
+		})
+	}
+}
+
+func TestAccumulatorMerge(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []float64
+	}{
+		{"both empty", nil, nil},
+		{"empty into", nil, []float64{1, 2, 3}},
+		{"into empty", []float64{1, 2, 3}, nil},
+		{"disjoint", []float64{1, 2, 3}, []float64{10, 20}},
+		{"overlapping", []float64{5, -1, 8, 2}, []float64{3, 3, 9}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := summarize(tt.a)
+			got.merge(*summarize(tt.b))
+			want := summarize(append(append([]float64{}, tt.a...), tt.b...))
+			if got.count != want.count || got.min != want.min || got.max != want.max {
+				t.Errorf("merged = %+v, want %+v", *got, *want)
+			}
+			if !near(got.mean, want.mean, 1e-9) || !near(got.std(), want.std(), 1e-9) {
+				t.Errorf("mean, std = %v, %v, want %v, %v", got.mean, got.std(), want.mean, want.std())
+			}
+		})
+	}
+}
+
+// near reports whether got is within tolerance of want, relative to want
+// when want is large
+func near(got, want, tolerance float64) bool {
+	return math.Abs(got-want) <= tolerance*math.Max(1, math.Abs(want))
+}
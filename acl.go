@@ -0,0 +1,241 @@
+package mqttbmlatency
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Outcomes of an ACL attempt
+const (
+	ACLGranted      = "granted"      // the broker accepted the subscription
+	ACLRefused      = "refused"      // SUBACK failure return code
+	ACLDelivered    = "delivered"    // the message came back on a granted subscription
+	ACLDropped      = "dropped"      // acknowledged, but not delivered on a granted subscription
+	ACLAcked        = "acked"        // acknowledged, delivery unknown because the subscription was refused
+	ACLDisconnected = "disconnected" // the broker closed the connection
+	ACLTimeout      = "timeout"      // no reply within ACLTest.Timeout
+)
+
+// ACLTest makes a share of the clients also subscribe and publish to a topic
+// they are not authorized for, to record how the broker enforces its ACL
+type ACLTest struct {
+	Topic    string        // a topic the clients are not authorized for
+	Fraction float64       // share of the clients that try, default all
+	Attempts int           // attempts per client, each on a new connection, default 1
+	Timeout  time.Duration // wait this long for each reply, default 5s
+}
+
+// ACLResults count the broker's responses to unauthorized subscribes and
+// publishes, by outcome
+type ACLResults struct {
+	Topic           string                 `json:"topic"`
+	Clients         int                    `json:"clients"`
+	Subscribe       map[string]*ACLOutcome `json:"subscribe"`
+	Publish         map[string]*ACLOutcome `json:"publish"`
+	ConnectFailures int64                  `json:"connect_failures,omitempty"`
+}
+
+// ACLOutcome is how often an outcome occurred and how long the broker took
+// to respond with it, from sending the packet to its reply or disconnect.
+// Timeouts have no latency.
+type ACLOutcome struct {
+	Count       int64   `json:"count"`
+	LatencyMin  float64 `json:"latency_min,omitempty"`
+	LatencyMax  float64 `json:"latency_max,omitempty"`
+	LatencyMean float64 `json:"latency_mean,omitempty"`
+}
+
+func (t *ACLTest) clients(total int) int {
+	if t.Fraction <= 0 {
+		return total
+	}
+	return int(math.Ceil(t.Fraction * float64(total)))
+}
+
+func (t *ACLTest) attempts() int {
+	if t.Attempts > 0 {
+		return t.Attempts
+	}
+	return 1
+}
+
+func (t *ACLTest) timeout() time.Duration {
+	if t.Timeout > 0 {
+		return t.Timeout
+	}
+	return 5 * time.Second
+}
+
+// aclTester runs the attempts of all chosen clients alongside the benchmark
+type aclTester struct {
+	cfg   *Config
+	conns []*BackendOptions
+
+	mu        sync.Mutex
+	subscribe map[string]*accumulator
+	publish   map[string]*accumulator
+	res       *ACLResults
+	wg        sync.WaitGroup
+}
+
+func newACLTester(cfg *Config, clients int, creds []*Credentials, localAddr func(int) net.IP, certs *certSet) *aclTester {
+	t := &aclTester{
+		cfg:       cfg,
+		subscribe: make(map[string]*accumulator),
+		publish:   make(map[string]*accumulator),
+		res:       &ACLResults{Topic: cfg.ACL.Topic, Clients: cfg.ACL.clients(clients)},
+	}
+	for i := 0; i < t.res.Clients; i++ {
+		t.conns = append(t.conns, &BackendOptions{
+			Broker:    cfg.Broker,
+			ClientID:  derivedID(creds[i].ClientID, "-acl"),
+			Username:  creds[i].Username,
+			Password:  creds[i].Password,
+			KeepAlive: time.Duration(cfg.KeepAlive) * time.Second,
+			Transport: newTransport(cfg, localAddr(i), certs.pub(i)),
+		})
+	}
+	return t
+}
+
+func (t *aclTester) begin() {
+	for i, opts := range t.conns {
+		t.wg.Add(1)
+		go func(i int, opts *BackendOptions) {
+			defer t.wg.Done()
+			for k := 0; k < t.cfg.ACL.attempts(); k++ {
+				t.attempt(i, opts)
+			}
+		}(i, opts)
+	}
+}
+
+// close waits for the outstanding attempts and returns the results
+func (t *aclTester) close() *ACLResults {
+	t.wg.Wait()
+	t.res.Subscribe = aclOutcomes(t.subscribe)
+	t.res.Publish = aclOutcomes(t.publish)
+	return t.res
+}
+
+func aclOutcomes(accs map[string]*accumulator) map[string]*ACLOutcome {
+	outcomes := make(map[string]*ACLOutcome, len(accs))
+	for name, a := range accs {
+		outcomes[name] = &ACLOutcome{Count: a.count, LatencyMin: a.min, LatencyMax: a.max, LatencyMean: a.mean}
+	}
+	return outcomes
+}
+
+// record adds an outcome, with its latency unless it timed out
+func (t *aclTester) record(accs map[string]*accumulator, outcome string, latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	a := accs[outcome]
+	if a == nil {
+		a = &accumulator{}
+		accs[outcome] = a
+	}
+	if outcome == ACLTimeout {
+		a.count++
+		return
+	}
+	a.add(latency.Seconds() * 1000) // in milliseconds
+}
+
+// attempt connects with the identity of client i, subscribes to the
+// forbidden topic and publishes to it at QoS 1
+func (t *aclTester) attempt(i int, base *BackendOptions) {
+	timeout := t.cfg.ACL.timeout()
+	lost := make(chan bool)
+	var lostOnce sync.Once
+	tag := make([]byte, 12)
+	binary.BigEndian.PutUint32(tag, uint32(i))
+	binary.BigEndian.PutUint64(tag[4:], uint64(time.Now().UnixNano()))
+	delivered := make(chan bool, 1)
+
+	opts := *base
+	opts.ClientID = clientID(opts.ClientID, i)
+	opts.OnLost = func(err error) { lostOnce.Do(func() { close(lost) }) }
+	opts.OnMessage = func(topic string, qos byte, payload []byte) {
+		if string(payload) == string(tag) {
+			select {
+			case delivered <- true:
+			default:
+			}
+		}
+	}
+	conn, err := MinimalBackend{}.Connect(&opts)
+	if err != nil {
+		log.Printf("ACL client %v had error connecting to the broker: %v\n", i, err)
+		t.mu.Lock()
+		t.res.ConnectFailures++
+		t.mu.Unlock()
+		return
+	}
+	defer conn.Disconnect()
+
+	// wait runs op and classifies how it ended
+	wait := func(op func() error) (string, time.Duration, error) {
+		start := time.Now()
+		done := make(chan error, 1)
+		go func() { done <- op() }()
+		select {
+		case err := <-done:
+			select {
+			case <-lost:
+				return ACLDisconnected, time.Since(start), err
+			default:
+			}
+			if errors.Is(err, errConnClosed) {
+				return ACLDisconnected, time.Since(start), err
+			}
+			return "", time.Since(start), err
+		case <-lost:
+			return ACLDisconnected, time.Since(start), nil
+		case <-time.After(timeout):
+			return ACLTimeout, timeout, nil
+		}
+	}
+
+	outcome, latency, err := wait(func() error { return conn.Subscribe(map[string]byte{t.cfg.ACL.Topic: 1}) })
+	if outcome == "" {
+		switch {
+		case err == nil:
+			outcome = ACLGranted
+		case errors.Is(err, errSubscribeRefused):
+			outcome = ACLRefused
+		default:
+			outcome = ACLDisconnected
+		}
+	}
+	t.record(t.subscribe, outcome, latency)
+	if outcome == ACLDisconnected {
+		return
+	}
+	granted := outcome == ACLGranted
+
+	start := time.Now()
+	outcome, latency, err = wait(func() error { return conn.Publish(t.cfg.ACL.Topic, 1, tag) })
+	if outcome == "" && err != nil {
+		outcome = ACLDisconnected
+	}
+	if outcome == "" {
+		outcome = ACLAcked
+		if granted {
+			select {
+			case <-delivered:
+				outcome, latency = ACLDelivered, time.Since(start)
+			case <-lost:
+				outcome, latency = ACLDisconnected, time.Since(start)
+			case <-time.After(timeout):
+				outcome = ACLDropped
+			}
+		}
+	}
+	t.record(t.publish, outcome, latency)
+}
@@ -0,0 +1,299 @@
+package mqttbmlatency
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// AgentHeartbeat is published by an agent to <ResultsTopic>/heartbeat every
+// Config.ResultsHeartbeat until its results are out
+type AgentHeartbeat struct {
+	Seq  int64     `json:"seq"`
+	Sent time.Time `json:"sent"`
+}
+
+// agentBeat publishes the heartbeats of an agent on a connection of its own,
+// so that a collector sees the agent alive through runs of any length
+type agentBeat struct {
+	stop chan bool
+	done chan bool
+}
+
+func startAgentBeat(cfg *Config) *agentBeat {
+	c, err := dialResults(cfg, fmt.Sprintf("mqtt-agent-%v", time.Now().UnixNano()))
+	if err != nil {
+		log.Printf("Failed to connect the heartbeat of %v: %v\n", cfg.ResultsTopic, err)
+		return nil
+	}
+	clock := clockOrSystem(cfg.Clock)
+	b := &agentBeat{stop: make(chan bool), done: make(chan bool)}
+	go func() {
+		defer close(b.done)
+		defer c.disconnect()
+		ticker := clock.NewTicker(cfg.ResultsHeartbeat)
+		defer ticker.Stop()
+		for seq := int64(1); ; seq++ {
+			payload, _ := json.Marshal(&AgentHeartbeat{Seq: seq, Sent: clock.Now()})
+			c.publish(cfg.ResultsTopic+heartbeatSuffix, 0, false, payload)
+			select {
+			case <-b.stop:
+				return
+			case <-ticker.C():
+			}
+		}
+	}()
+	return b
+}
+
+// close stops the heartbeats once the last one is out
+func (b *agentBeat) close() {
+	if b == nil {
+		return
+	}
+	close(b.stop)
+	<-b.done
+}
+
+// Collect describes how CollectResults gathers the results of distributed
+// agents, each a benchmark run with its own Config.ResultsTopic
+type Collect struct {
+	Broker   string        // where the agents publish, their Config.ResultsBroker
+	Username string        // optional
+	Password string        // optional
+	Topics   []string      // the results topic of every agent
+	Timeout  time.Duration // exclude an agent that sent neither heartbeat nor results for this long
+	Deadline time.Duration // exclude the agents still running this long into the collection, 0 waits while they beat
+	Format   string        // of the merged results, as Config.Format
+	Clock    Clock         // time source, the system clock when nil
+	Quiet    bool
+}
+
+// AgentStatus describes how one agent of a collection fared
+type AgentStatus struct {
+	Topic      string  `json:"topic"`
+	Reported   bool    `json:"reported"`            // its results were merged
+	Missing    bool    `json:"missing,omitempty"`   // excluded without results
+	Heartbeats int64   `json:"heartbeats"`          // received from the agent
+	LastSeen   float64 `json:"last_seen,omitempty"` // seconds into the collection of its last heartbeat or results
+	Error      string  `json:"error,omitempty"`     // why it is missing, or why its results could not be merged
+}
+
+func (col *Collect) validate() error {
+	u, err := parseBroker(col.Broker)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "udp" || u.Scheme == "mqttsn" {
+		return errors.New("results cannot be collected over MQTT-SN")
+	}
+	if len(col.Topics) == 0 {
+		return errors.New("a collection needs the results topic of every agent")
+	}
+	seen := make(map[string]bool)
+	for _, topic := range col.Topics {
+		if topic == "" || strings.ContainsAny(topic, "+#") {
+			return fmt.Errorf("invalid results topic %q", topic)
+		}
+		if seen[topic] {
+			return fmt.Errorf("results topic %v is listed twice", topic)
+		}
+		seen[topic] = true
+	}
+	if col.Timeout <= 0 {
+		return errors.New("a collection needs a timeout")
+	}
+	if col.Deadline < 0 {
+		return errors.New("the collection deadline must not be negative")
+	}
+	return nil
+}
+
+// agent is the state of one agent during a collection
+type agent struct {
+	status  *AgentStatus
+	seen    time.Time
+	results *JSONResults
+	done    bool // reported or excluded
+}
+
+// collector tracks the agents of a collection
+type collector struct {
+	col     *Collect
+	clock   Clock
+	start   time.Time
+	mu      sync.Mutex
+	agents  map[string]*agent // by results topic
+	changed chan bool         // signalled whenever an agent is done
+}
+
+// CollectResults waits for the agents listed in col to publish their results
+// and merges them like MergeResults. Start it before the agents: results
+// retained from earlier runs are ignored. An agent that sends neither
+// heartbeat nor results for col.Timeout is excluded, so a crashed agent does
+// not hold up the others; excluded agents and results that cannot be merged
+// are marked in the agents section and make the exit code ExitMissing. An
+// error comes with ExitConfig if col could not run, and with ExitMissing if
+// no agent's results could be merged.
+func CollectResults(col *Collect) ([]byte, int, error) {
+	if err := col.validate(); err != nil {
+		return nil, ExitConfig, err
+	}
+	c := newCollector(col)
+	filters := make(map[string]byte)
+	for _, topic := range col.Topics {
+		filters[topic] = 1
+		filters[topic+heartbeatSuffix] = 0
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(col.Broker).
+		SetClientID(fmt.Sprintf("mqtt-collector-%v", time.Now().UnixNano())).
+		SetCleanSession(true).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			if token := client.SubscribeMultiple(filters, c.received); token.Wait() && token.Error() != nil {
+				log.Printf("COLLECTOR had error subscribing to the results: %v\n", token.Error())
+			}
+		}).
+		SetConnectionLostHandler(func(client mqtt.Client, reason error) {
+			log.Printf("COLLECTOR lost connection to the broker: %v. Will reconnect...\n", reason.Error())
+		})
+	if col.Username != "" && col.Password != "" {
+		opts.SetUsername(col.Username)
+		opts.SetPassword(col.Password)
+	}
+	setTransport(opts, col.Broker, nil)
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, ExitConfig, fmt.Errorf("failed to connect the collector: %v", token.Error())
+	}
+	c.wait()
+	client.Disconnect(250)
+
+	var names []string
+	var shards []*JSONResults
+	statuses := make([]*AgentStatus, len(col.Topics))
+	c.mu.Lock()
+	for i, topic := range col.Topics {
+		a := c.agents[topic]
+		statuses[i] = a.status
+		if a.results != nil {
+			names = append(names, topic)
+			shards = append(shards, a.results)
+		}
+	}
+	c.mu.Unlock()
+	if len(shards) == 0 {
+		return nil, ExitMissing, errors.New("no agent reported results")
+	}
+	merged := mergeShards(names, shards)
+	merged.Agents = statuses
+	data, err := encodeResults(col.Format, merged)
+	if err != nil {
+		return nil, ExitConfig, err
+	}
+	return data, merged.ExitCode(), nil
+}
+
+// newCollector starts the collection of col's agents, all seen at its start
+func newCollector(col *Collect) *collector {
+	clock := clockOrSystem(col.Clock)
+	c := &collector{col: col, clock: clock, start: clock.Now(), agents: make(map[string]*agent), changed: make(chan bool, 1)}
+	for _, topic := range col.Topics {
+		c.agents[topic] = &agent{status: &AgentStatus{Topic: topic}, seen: c.start}
+	}
+	return c
+}
+
+// received handles the results and heartbeats of the agents
+func (c *collector) received(client mqtt.Client, msg mqtt.Message) {
+	if msg.Retained() {
+		return
+	}
+	now := c.clock.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if a := c.agents[msg.Topic()]; a != nil {
+		if a.done {
+			return
+		}
+		a.seen, a.done = now, true
+		a.status.LastSeen = now.Sub(c.start).Seconds()
+		jr, err := loadShard(msg.Topic(), msg.Payload())
+		if err != nil {
+			a.status.Error = err.Error()
+			log.Printf("COLLECTOR could not merge the results of %v: %v\n", msg.Topic(), err)
+		} else {
+			a.results = jr
+			a.status.Reported = true
+			if !c.col.Quiet {
+				log.Printf("COLLECTOR received the results of %v\n", msg.Topic())
+			}
+		}
+		c.signal()
+		return
+	}
+	if a := c.agents[strings.TrimSuffix(msg.Topic(), heartbeatSuffix)]; a != nil && !a.done {
+		a.seen = now
+		a.status.Heartbeats++
+		a.status.LastSeen = now.Sub(c.start).Seconds()
+	}
+}
+
+func (c *collector) signal() {
+	select {
+	case c.changed <- true:
+	default:
+	}
+}
+
+// wait returns once every agent reported or was excluded
+func (c *collector) wait() {
+	tick := c.col.Timeout / 10
+	if tick > time.Second {
+		tick = time.Second
+	}
+	ticker := c.clock.NewTicker(tick)
+	defer ticker.Stop()
+	for !c.settled(c.clock.Now()) {
+		select {
+		case <-c.changed:
+		case <-ticker.C():
+		}
+	}
+}
+
+// settled excludes the agents that timed out at now and reports whether all
+// agents are done
+func (c *collector) settled(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	past := c.col.Deadline > 0 && now.Sub(c.start) >= c.col.Deadline
+	all := true
+	for _, topic := range c.col.Topics {
+		a := c.agents[topic]
+		if a.done {
+			continue
+		}
+		switch {
+		case now.Sub(a.seen) >= c.col.Timeout:
+			a.status.Error = fmt.Sprintf("no heartbeat or results for %v", c.col.Timeout)
+		case past:
+			a.status.Error = fmt.Sprintf("still running after %v", c.col.Deadline)
+		default:
+			all = false
+			continue
+		}
+		a.done, a.status.Missing = true, true
+		log.Printf("COLLECTOR excluded %v: %v\n", topic, a.status.Error)
+	}
+	return all
+}
@@ -0,0 +1,162 @@
+package mqttbmlatency
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/brunobevilaquaa/mqtt-bm-latency/broker"
+)
+
+// fakeMessage is a message delivered to the collector
+type fakeMessage struct {
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+func (m *fakeMessage) Duplicate() bool   { return false }
+func (m *fakeMessage) Qos() byte         { return 0 }
+func (m *fakeMessage) Retained() bool    { return m.retained }
+func (m *fakeMessage) Topic() string     { return m.topic }
+func (m *fakeMessage) MessageID() uint16 { return 0 }
+func (m *fakeMessage) Payload() []byte   { return m.payload }
+func (m *fakeMessage) Ack()              {}
+
+// shardPayload returns the results of a run of two clients as an agent
+// publishes them
+func shardPayload(t *testing.T) []byte {
+	data, err := json.Marshal(&JSONResults{
+		Unit: "ms",
+		PubRuns: []*PubResults{
+			{ID: 0, Successes: 10, PubTimeMin: 1, PubTimeMax: 2, PubTimeMean: 1.5},
+			{ID: 1, Successes: 10, PubTimeMin: 1, PubTimeMax: 3, PubTimeMean: 2},
+		},
+		SubRuns: []*SubResults{
+			{ID: 0, Received: 10, FwdLatencyMin: 2, FwdLatencyMax: 4, FwdLatencyMean: 3},
+			{ID: 1, Received: 9, FwdLatencyMin: 2, FwdLatencyMax: 5, FwdLatencyMean: 4},
+		},
+		PubTotals: &TotalPubResults{Successes: 20},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCollectorExcludesAgents(t *testing.T) {
+	timeout := 5 * time.Second
+	tests := []struct {
+		name     string
+		deadline time.Duration
+		beats    time.Duration // heartbeat every second up to this long
+		report   time.Duration
+		run      time.Duration // how long to collect
+		settled  bool
+		reported bool
+		error    string
+	}{
+		{"reports", 0, time.Hour, 3 * time.Second, 4 * time.Second, true, true, ""},
+		{"never seen", 0, 0, 0, timeout, true, false, "no heartbeat or results for 5s"},
+		{"alive until the timeout", 0, 0, 0, timeout - time.Second, false, false, ""},
+		{"dies", 0, 10 * time.Second, 0, 10*time.Second + timeout, true, false, "no heartbeat or results for 5s"},
+		{"dead short of the timeout", 0, 10 * time.Second, 0, 10*time.Second + timeout - time.Second, false, false, ""},
+		{"beats without reporting", 0, time.Hour, 0, time.Minute, false, false, ""},
+		{"beats past the deadline", 20 * time.Second, time.Hour, 0, 20 * time.Second, true, false, "still running after 20s"},
+		{"reports before the deadline", 20 * time.Second, time.Hour, 10 * time.Second, 20 * time.Second, true, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			c := newCollector(&Collect{Topics: []string{"agent"}, Timeout: timeout, Deadline: tt.deadline, Clock: clock, Quiet: true})
+			settled := false
+			for elapsed := time.Second; elapsed <= tt.run && !settled; elapsed += time.Second {
+				clock.Advance(time.Second)
+				// a retained heartbeat from an earlier run does not count
+				c.received(nil, &fakeMessage{topic: "agent" + heartbeatSuffix, retained: true})
+				if elapsed <= tt.beats {
+					c.received(nil, &fakeMessage{topic: "agent" + heartbeatSuffix})
+				}
+				if tt.report > 0 && elapsed == tt.report {
+					c.received(nil, &fakeMessage{topic: "agent", payload: shardPayload(t)})
+				}
+				settled = c.settled(clock.Now())
+			}
+
+			status := c.agents["agent"].status
+			if settled != tt.settled || status.Reported != tt.reported || status.Error != tt.error {
+				t.Errorf("settled %v, reported %v, error %q, want %v, %v, %q",
+					settled, status.Reported, status.Error, tt.settled, tt.reported, tt.error)
+			}
+			if status.Missing != (tt.settled && !tt.reported) {
+				t.Errorf("missing %v", status.Missing)
+			}
+			beats := tt.beats
+			if tt.run < beats {
+				beats = tt.run
+			}
+			if want := int64(beats / time.Second); tt.report == 0 && status.Heartbeats != want {
+				t.Errorf("%d heartbeats counted, want %d", status.Heartbeats, want)
+			}
+		})
+	}
+}
+
+func TestCollectResults(t *testing.T) {
+	b := broker.New()
+	addr, err := b.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// the reporting agent publishes until the collector is done, as the
+	// collector may not have subscribed yet
+	opts := mqtt.NewClientOptions().AddBroker("tcp://" + addr).SetClientID("agent-a")
+	agent := mqtt.NewClient(opts)
+	if token := agent.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("connect: %v", token.Error())
+	}
+	defer agent.Disconnect(0)
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		payload := shardPayload(t)
+		for {
+			agent.Publish("results/a", 1, false, payload).Wait()
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}()
+
+	data, code, err := CollectResults(&Collect{
+		Broker:  "tcp://" + addr,
+		Topics:  []string{"results/a", "results/b"},
+		Timeout: 300 * time.Millisecond,
+		Quiet:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != ExitMissing {
+		t.Errorf("exit code %d, want %d", code, ExitMissing)
+	}
+	var jr JSONResults
+	if err := json.Unmarshal(data, &jr); err != nil {
+		t.Fatal(err)
+	}
+	if len(jr.Agents) != 2 || !jr.Agents[0].Reported || !jr.Agents[1].Missing ||
+		!strings.Contains(jr.Agents[1].Error, "no heartbeat or results") {
+		t.Fatalf("agents %s", data)
+	}
+	if len(jr.PubRuns) != 2 || jr.PubTotals.Successes != 20 || jr.SubTotals.TotalReceived != 19 {
+		t.Errorf("merged %d publishers with %d successes and %d received, want 2 with 20 and 19",
+			len(jr.PubRuns), jr.PubTotals.Successes, jr.SubTotals.TotalReceived)
+	}
+}
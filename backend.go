@@ -0,0 +1,457 @@
+package mqttbmlatency
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	"github.com/brunobevilaquaa/mqtt-bm-latency/internal/packet"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Backend opens the connections of publishers and subscribers in place of the
+// built-in Eclipse Paho client, to use other client libraries or to measure
+// the overhead of the client library itself. Backends do not reconnect: a lost
+// connection fails the rest of the client's messages.
+type Backend interface {
+	Name() string // reported with the results
+	Connect(opts *BackendOptions) (BackendConn, error)
+}
+
+// BackendOptions describe one connection opened through a Backend
+type BackendOptions struct {
+	Broker    string
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+	Timeout   time.Duration                                // wait for acknowledgements, 0 for the backend's default
+	Transport *Transport                                   // socket settings, may be nil
+	Aliases   bool                                         // publishers only: name repeated topics by MQTT 5 topic alias
+	OnMessage func(topic string, qos byte, payload []byte) // subscribers and requesting publishers, called from one goroutine
+	Ingress   string                                       // subscribers only: MQTT 5 user property passed to OnIngress
+	OnIngress func(value string)                           // called right before OnMessage with the Ingress property, "" without
+	Window    uint16                                       // subscribers only: the MQTT 5 Receive Maximum, in QoS 1 and 2 messages, 0 for 65535
+	SubOpts   *SubscribeOptions                            // subscribers only: MQTT 5 options of every subscription, may be nil
+	Respond   bool                                         // subscribers only: echo every message naming an MQTT 5 Response Topic to it, with its Correlation Data
+	OnLost    func(err error)
+}
+
+// BackendConn is one connected client of a Backend
+type BackendConn interface {
+	// Publish sends payload and returns once the QoS handshake completed
+	Publish(topic string, qos byte, payload []byte) error
+	// Subscribe subscribes to all filters and returns once the broker acknowledged them
+	Subscribe(filters map[string]byte) error
+	// Disconnect closes the connection once its callbacks returned, so it
+	// must not be called from OnMessage or OnLost
+	Disconnect()
+}
+
+// GrantReporter is optionally implemented by a BackendConn that can tell the
+// QoS the broker granted for each filter of its last subscription, so that
+// subscribers report downgraded subscriptions
+type GrantReporter interface {
+	Granted() map[string]byte
+}
+
+// AliasReporter is optionally implemented by a BackendConn that publishes by
+// MQTT 5 topic aliases, so that publishers report the bytes they saved
+type AliasReporter interface {
+	AliasMaximum() uint16 // granted by the broker, 0 if it allows no aliases
+	// LastAlias describes the last publish: whether the topic alias alone
+	// named its topic, the size of its PUBLISH packet and the bytes the
+	// alias saved, which is negative when the alias was assigned
+	LastAlias() (aliased bool, wire, saved int)
+}
+
+// Requester is optionally implemented by a BackendConn that sends MQTT 5
+// requests. Request/response mode needs it when clients use a Backend.
+type Requester interface {
+	// Request publishes payload like Publish, naming responseTopic as its
+	// Response Topic and carrying correlation as its Correlation Data
+	Request(topic string, qos byte, payload []byte, responseTopic string, correlation []byte) error
+}
+
+var (
+	errSubscribeRefused = errors.New("subscription refused")
+	errConnClosed       = errors.New("connection closed")
+	errNoPingresp       = errors.New("no PINGRESP from the broker within the keep alive period")
+)
+
+// minimalTimeout bounds the wait for an acknowledgement when the options
+// set no timeout
+const minimalTimeout = 30 * time.Second
+
+// MinimalBackend is a small MQTT 3.1.1 client without reconnects, persistence
+// or routing. It supports TCP, TLS, QUIC and Unix socket brokers, QoS 0 to 2,
+// and honors Transport settings and the packet log.
+type MinimalBackend struct{}
+
+func (MinimalBackend) Name() string { return "minimal" }
+
+// MQTT 3.1.1 fixed header bytes
+const (
+	mqttConnect     = 0x10
+	mqttConnack     = 0x20
+	mqttPublish     = 0x30
+	mqttPuback      = 0x40
+	mqttPubrec      = 0x50
+	mqttPubrel      = 0x62 // reserved flags 0010
+	mqttPubcomp     = 0x70
+	mqttSubscribe   = 0x82
+	mqttSuback      = 0x90
+	mqttPingreq     = 0xC0
+	mqttPingresp    = 0xD0
+	mqttDisconnect  = 0xE0
+	mqttCleanSess   = 0x02
+	mqttPasswordSet = 0x40
+	mqttUsernameSet = 0x80
+)
+
+// minimalConn is a connection of MinimalBackend
+type minimalConn struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	keepAlive time.Duration
+	timeout   time.Duration
+	onMessage func(topic string, qos byte, payload []byte)
+	onLost    func(err error)
+	wg        sync.WaitGroup // the read and ping loops
+	pinging   int32          // a PINGREQ is unanswered, accessed atomically
+
+	wmu     sync.Mutex // serializes packets written by publishers and the read loop
+	mu      sync.Mutex
+	msgID   uint16
+	pending map[uint16]chan []byte // replies keyed by packet ID
+	done    chan bool
+	granted map[string]byte // by the last SUBACK
+}
+
+// dialBackend opens the socket of a backend connection over TCP, TLS, QUIC or
+// a Unix socket, honoring the Transport settings of opts
+func dialBackend(client string, opts *BackendOptions) (net.Conn, *Transport, error) {
+	u, err := url.Parse(opts.Broker)
+	if err != nil {
+		return nil, nil, err
+	}
+	t := opts.Transport
+	if t == nil {
+		t = &Transport{}
+	}
+	options := mqtt.ClientOptions{ConnectTimeout: t.ConnectTimeout, TLSConfig: t.tlsConfig("")}
+	var conn net.Conn
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts", "tcps":
+		conn, err = t.logged(t.open)(u, options)
+	case "unix":
+		conn, err = t.logged(dialUnix)(u, options)
+	case "quic":
+		conn, err = t.logged(t.openQUIC(t.session()))(u, options)
+	default:
+		return nil, nil, fmt.Errorf("the %v client does not support %v brokers", client, u.Scheme)
+	}
+	return conn, t, err
+}
+
+func (MinimalBackend) Connect(opts *BackendOptions) (BackendConn, error) {
+	conn, t, err := dialBackend("minimal", opts)
+	if err != nil {
+		return nil, err
+	}
+	c := &minimalConn{
+		conn:      conn,
+		r:         bufio.NewReader(conn),
+		keepAlive: opts.KeepAlive,
+		timeout:   opts.Timeout,
+		onMessage: opts.OnMessage,
+		onLost:    opts.OnLost,
+		pending:   make(map[uint16]chan []byte),
+		done:      make(chan bool),
+	}
+
+	// CONNECT: protocol name and level, flags, keep alive, then the payload
+	flags := byte(mqttCleanSess)
+	if opts.Username != "" {
+		flags |= mqttUsernameSet
+	}
+	if opts.Password != "" {
+		flags |= mqttPasswordSet
+	}
+	pkt := packet.AppendString(nil, "MQTT")
+	pkt = append(pkt, 4, flags, 0, 0)
+	binary.BigEndian.PutUint16(pkt[len(pkt)-2:], uint16(opts.KeepAlive.Seconds()))
+	pkt = packet.AppendString(pkt, opts.ClientID)
+	if opts.Username != "" {
+		pkt = packet.AppendString(pkt, opts.Username)
+	}
+	if opts.Password != "" {
+		pkt = packet.AppendString(pkt, opts.Password)
+	}
+	if t.ConnectTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(t.ConnectTimeout))
+	}
+	if err := c.send(mqttConnect, pkt); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	header, body, err := packet.Read(c.r)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if header&0xF0 != mqttConnack || len(body) < 2 {
+		conn.Close()
+		return nil, errors.New("no CONNACK from the broker")
+	}
+	if body[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("connection refused, return code %v", body[1])
+	}
+	conn.SetDeadline(time.Time{})
+
+	if c.timeout <= 0 {
+		c.timeout = minimalTimeout
+	}
+	c.wg.Add(1)
+	go c.readLoop()
+	if opts.KeepAlive > 0 {
+		c.wg.Add(1)
+		go c.pingLoop()
+	}
+	return c, nil
+}
+
+func (c *minimalConn) Publish(topic string, qos byte, payload []byte) error {
+	// the payload is written as it is, never copied into the packet
+	pkt := packet.AppendString(make([]byte, 0, 4+len(topic)), topic)
+	var id uint16
+	if qos > 0 {
+		id = c.nextID()
+		pkt = append(pkt, byte(id>>8), byte(id))
+	}
+	header := byte(mqttPublish) | qos<<1
+	if qos == 0 {
+		return c.send(header, pkt, payload)
+	}
+	if _, err := c.exchange(id, header, pkt, payload); err != nil {
+		return err
+	}
+	if qos == 1 {
+		return nil
+	}
+	_, err := c.exchange(id, mqttPubrel, []byte{byte(id >> 8), byte(id)})
+	return err
+}
+
+func (c *minimalConn) Subscribe(filters map[string]byte) error {
+	id := c.nextID()
+	pkt := []byte{byte(id >> 8), byte(id)}
+	order := make([]string, 0, len(filters))
+	for f, qos := range filters {
+		pkt = append(packet.AppendString(pkt, f), qos)
+		order = append(order, f)
+	}
+	reply, err := c.exchange(id, mqttSubscribe, pkt)
+	if err != nil {
+		return err
+	}
+	// the return codes follow the order of the filters
+	c.granted = make(map[string]byte, len(order))
+	for i, code := range reply[2:] {
+		if i < len(order) {
+			c.granted[order[i]] = code
+		}
+		if code == 0x80 {
+			return errSubscribeRefused
+		}
+	}
+	return nil
+}
+
+func (c *minimalConn) Granted() map[string]byte {
+	return c.granted
+}
+
+func (c *minimalConn) Disconnect() {
+	c.send(mqttDisconnect, nil)
+	c.close()
+	c.wg.Wait()
+}
+
+// close closes the connection, reporting whether it was still open
+func (c *minimalConn) close() bool {
+	c.mu.Lock()
+	open := true
+	select {
+	case <-c.done:
+		open = false
+	default:
+		close(c.done)
+	}
+	c.mu.Unlock()
+	c.conn.Close()
+	return open
+}
+
+// lose closes a connection the broker dropped or stopped answering on, and
+// reports it unless the client disconnected first
+func (c *minimalConn) lose(err error) {
+	if c.close() && c.onLost != nil {
+		c.onLost(err)
+	}
+}
+
+func (c *minimalConn) nextID() uint16 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.msgID++
+	if c.msgID == 0 {
+		c.msgID = 1
+	}
+	return c.msgID
+}
+
+// exchange sends a packet and waits for the reply carrying the same packet
+// ID, for at most the connection's timeout
+func (c *minimalConn) exchange(id uint16, header byte, pkt ...[]byte) ([]byte, error) {
+	ch := make(chan []byte, 1)
+	c.mu.Lock()
+	c.pending[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+	if err := c.send(header, pkt...); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case reply := <-ch:
+		return reply, nil
+	case <-c.done:
+		return nil, errConnClosed
+	case <-timer.C:
+		return nil, errTimeout
+	}
+}
+
+// send writes a packet whose body is the concatenation of parts
+func (c *minimalConn) send(header byte, parts ...[]byte) error {
+	n := 0
+	for _, p := range parts {
+		n += len(p)
+	}
+	pkt := packet.AppendLength([]byte{header}, n)
+	if len(parts) > 0 && len(parts[0]) < 1024 {
+		// one write for the fixed header and the small first part
+		pkt = append(pkt, parts[0]...)
+		parts = parts[1:]
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.conn.Write(pkt); err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if _, err := c.conn.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *minimalConn) reply(id uint16, body []byte) {
+	c.mu.Lock()
+	ch, ok := c.pending[id]
+	c.mu.Unlock()
+	if ok {
+		select {
+		case ch <- body:
+		default:
+		}
+	}
+}
+
+func (c *minimalConn) readLoop() {
+	defer c.wg.Done()
+	for {
+		header, body, err := packet.Read(c.r)
+		if err != nil {
+			c.lose(err)
+			return
+		}
+		switch header & 0xF0 {
+		case mqttPublish:
+			c.handlePublish(header, body)
+		case mqttPuback, mqttPubrec, mqttPubcomp, mqttSuback:
+			if len(body) >= 2 {
+				c.reply(binary.BigEndian.Uint16(body), body)
+			}
+		case mqttPubrel & 0xF0:
+			if len(body) >= 2 {
+				c.send(mqttPubcomp, body[:2])
+			}
+		case mqttPingresp:
+			atomic.StoreInt32(&c.pinging, 0)
+		}
+	}
+}
+
+func (c *minimalConn) handlePublish(header byte, body []byte) {
+	qos := (header >> 1) & 0x03
+	if len(body) < 2 {
+		return
+	}
+	end := 2 + int(binary.BigEndian.Uint16(body))
+	if qos > 0 {
+		end += 2
+	}
+	if end > len(body) {
+		return
+	}
+	topic := string(body[2 : 2+int(binary.BigEndian.Uint16(body))])
+	switch qos {
+	case 1:
+		c.send(mqttPuback, body[end-2:end])
+	case 2:
+		c.send(mqttPubrec, body[end-2:end])
+	}
+	if c.onMessage != nil {
+		c.onMessage(topic, qos, body[end:])
+	}
+}
+
+// pingLoop sends a PINGREQ every keep alive period, and gives up on the
+// connection when the previous one is still unanswered
+func (c *minimalConn) pingLoop() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !atomic.CompareAndSwapInt32(&c.pinging, 0, 1) {
+				c.lose(errNoPingresp)
+				return
+			}
+			if err := c.send(mqttPingreq, nil); err != nil {
+				log.Printf("MQTT ping failed: %v\n", err)
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package mqttbmlatency
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brunobevilaquaa/mqtt-bm-latency/internal/packet"
+)
+
+// silentBroker accepts one connection, acknowledges its CONNECT and then
+// reads everything without answering
+func silentBroker(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if _, _, err := packet.Read(r); err != nil {
+			return
+		}
+		conn.Write([]byte{mqttConnack, 2, 0, 0})
+		for {
+			if _, _, err := packet.Read(r); err != nil {
+				return
+			}
+		}
+	}()
+	return "tcp://" + l.Addr().String()
+}
+
+func TestMinimalTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		op   func(BackendConn) error
+	}{
+		{"publish qos 1", func(c BackendConn) error { return c.Publish("t", 1, []byte("x")) }},
+		{"publish qos 2", func(c BackendConn) error { return c.Publish("t", 2, []byte("x")) }},
+		{"subscribe", func(c BackendConn) error { return c.Subscribe(map[string]byte{"t": 1}) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := MinimalBackend{}.Connect(&BackendOptions{Broker: silentBroker(t), ClientID: "timeout", Timeout: 50 * time.Millisecond})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Disconnect()
+			start := time.Now()
+			if err := tt.op(conn); !errors.Is(err, errTimeout) {
+				t.Errorf("got %v, want %v", err, errTimeout)
+			}
+			if d := time.Since(start); d > 5*time.Second {
+				t.Errorf("gave up after %v", d)
+			}
+		})
+	}
+}
+
+func TestMinimalMissingPingresp(t *testing.T) {
+	lost := make(chan error, 1)
+	conn, err := MinimalBackend{}.Connect(&BackendOptions{
+		Broker:    silentBroker(t),
+		ClientID:  "ping",
+		KeepAlive: 50 * time.Millisecond,
+		OnLost:    func(err error) { lost <- err },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+	select {
+	case err := <-lost:
+		if err != errNoPingresp {
+			t.Errorf("lost with %v, want %v", err, errNoPingresp)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("missing PINGRESP went unnoticed")
+	}
+	if err := conn.Publish("t", 1, []byte("x")); err == nil {
+		t.Error("published on a lost connection")
+	}
+}
+
+func TestMinimalDisconnectJoinsReader(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		packet.Read(r)
+		conn.Write([]byte{mqttConnack, 2, 0, 0})
+		// deliver messages until the client goes away
+		pkt := append(packet.AppendLength([]byte{mqttPublish}, 3), packet.AppendString(nil, "t")...)
+		pkt = append(pkt, 'x')
+		for {
+			if _, err := conn.Write(pkt); err != nil {
+				return
+			}
+		}
+	}()
+
+	var handled int32
+	received := make(chan bool, 1)
+	conn, err := MinimalBackend{}.Connect(&BackendOptions{
+		Broker:   "tcp://" + l.Addr().String(),
+		ClientID: "join",
+		OnMessage: func(topic string, qos byte, payload []byte) {
+			atomic.AddInt32(&handled, 1)
+			select {
+			case received <- true:
+			default:
+			}
+			time.Sleep(time.Millisecond)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-received
+	conn.Disconnect()
+	n := atomic.LoadInt32(&handled)
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt32(&handled); got != n {
+		t.Errorf("%d messages handled after Disconnect returned", got-n)
+	}
+}
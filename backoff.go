@@ -0,0 +1,62 @@
+package mqttbmlatency
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff describes how clients retry a failed initial connection
+type Backoff struct {
+	Retries int           // attempts after the first one; 0 disables retrying
+	Initial time.Duration // delay before the first retry
+	Max     time.Duration // upper bound of a single delay, 0 for none
+	Factor  float64       // growth per retry, defaults to 2
+	Jitter  float64       // randomize each delay by up to this fraction (0..1)
+}
+
+// delay returns how long to wait before the given retry (starting at 1),
+// drawing the jitter from rng
+func (b *Backoff) delay(retry int, rng *rand.Rand) time.Duration {
+	factor := b.Factor
+	if factor <= 0 {
+		factor = 2
+	}
+	d := float64(b.Initial)
+	for i := 1; i < retry; i++ {
+		d *= factor
+		if b.Max > 0 && d > float64(b.Max) {
+			break
+		}
+	}
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rng.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// connectWithRetry calls connect until it succeeds or b's retries are used up,
+// sleeping on clock in between. It returns the number of retries made and the
+// last error. Without rng the jitter is drawn from a source seeded with the
+// current time.
+func connectWithRetry(clock Clock, b *Backoff, rng *rand.Rand, connect func() error, onRetry func(retry int, err error)) (int, error) {
+	err := connect()
+	if b == nil {
+		return 0, err
+	}
+	if rng == nil && b.Jitter > 0 {
+		rng = rand.New(rand.NewSource(clock.Now().UnixNano()))
+	}
+	retry := 0
+	for err != nil && retry < b.Retries {
+		retry++
+		if onRetry != nil {
+			onRetry(retry, err)
+		}
+		clock.Sleep(b.delay(retry, rng))
+		err = connect()
+	}
+	return retry, err
+}
@@ -0,0 +1,101 @@
+package mqttbmlatency
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff Backoff
+		delays  []time.Duration // for retries 1, 2, ...
+	}{
+		{"default factor", Backoff{Initial: 100 * time.Millisecond},
+			[]time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond}},
+		{"factor", Backoff{Initial: 10 * time.Millisecond, Factor: 3},
+			[]time.Duration{10 * time.Millisecond, 30 * time.Millisecond, 90 * time.Millisecond}},
+		{"capped", Backoff{Initial: 100 * time.Millisecond, Max: 300 * time.Millisecond},
+			[]time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}},
+		{"initial above the cap", Backoff{Initial: time.Second, Max: 500 * time.Millisecond},
+			[]time.Duration{500 * time.Millisecond, 500 * time.Millisecond}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, want := range tt.delays {
+				if got := tt.backoff.delay(i+1, nil); got != want {
+					t.Errorf("retry %d: delay %v, want %v", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := &Backoff{Initial: 100 * time.Millisecond, Max: 400 * time.Millisecond, Jitter: 0.25}
+	rng := rand.New(rand.NewSource(1))
+	for retry := 1; retry <= 6; retry++ {
+		base := b.Initial << uint(retry-1)
+		if base > b.Max {
+			base = b.Max
+		}
+		low, high := time.Duration(float64(base)*0.75), time.Duration(float64(base)*1.25)
+		for i := 0; i < 100; i++ {
+			if d := b.delay(retry, rng); d < low || d > high {
+				t.Fatalf("retry %d: delay %v outside %v-%v", retry, d, low, high)
+			}
+		}
+	}
+
+	// the same seed draws the same delays
+	a, c := rand.New(rand.NewSource(7)), rand.New(rand.NewSource(7))
+	for retry := 1; retry <= 4; retry++ {
+		if da, dc := b.delay(retry, a), b.delay(retry, c); da != dc {
+			t.Errorf("retry %d: delays %v and %v with the same seed", retry, da, dc)
+		}
+	}
+}
+
+func TestConnectWithRetry(t *testing.T) {
+	fail := errors.New("refused")
+	tests := []struct {
+		name     string
+		backoff  *Backoff
+		failures int // connect attempts failing before one succeeds
+		retries  int
+		slept    time.Duration
+		err      error
+	}{
+		{"no policy", nil, 1, 0, 0, fail},
+		{"first attempt", &Backoff{Retries: 3, Initial: time.Second}, 0, 0, 0, nil},
+		{"succeeds on a retry", &Backoff{Retries: 3, Initial: time.Second}, 2, 2, 3 * time.Second, nil},
+		{"retries used up", &Backoff{Retries: 2, Initial: time.Second, Max: 1500 * time.Millisecond}, 5, 2, 2500 * time.Millisecond, fail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			start := clock.Now()
+			attempts, calls := 0, 0
+			retries, err := connectWithRetry(clock, tt.backoff, rand.New(rand.NewSource(1)), func() error {
+				attempts++
+				if attempts <= tt.failures {
+					return fail
+				}
+				return nil
+			}, func(retry int, err error) {
+				calls++
+			})
+			if retries != tt.retries || err != tt.err {
+				t.Errorf("%d retries, error %v, want %d, %v", retries, err, tt.retries, tt.err)
+			}
+			if calls != tt.retries {
+				t.Errorf("onRetry called %d times, want %d", calls, tt.retries)
+			}
+			if slept := clock.Now().Sub(start); slept != tt.slept {
+				t.Errorf("slept %v on the clock, want %v", slept, tt.slept)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package mqttbmlatency
+
+const (
+	backpressureSamples = 100 // acknowledgements averaged at either end of the run
+	backpressureTrend   = 2.0 // latest over baseline mean that counts as backpressure
+)
+
+// ackTrend compares the mean acknowledgement latency at the end of a run with
+// its mean at the start, in constant memory
+type ackTrend struct {
+	first accumulator
+	last  [backpressureSamples]float64
+	n     int
+}
+
+func (t *ackTrend) add(latency float64) {
+	if t.n < backpressureSamples {
+		t.first.add(latency)
+	}
+	t.last[t.n%backpressureSamples] = latency
+	t.n++
+}
+
+// ratio returns the latest mean over the baseline mean, or 0 until both
+// windows are full and apart
+func (t *ackTrend) ratio() float64 {
+	if t.n < 2*backpressureSamples || t.first.mean <= 0 {
+		return 0
+	}
+	var sum float64
+	for _, l := range t.last {
+		sum += l
+	}
+	return sum / backpressureSamples / t.first.mean
+}
+
+// hand passes m to the publisher and counts the time the generator waited
+// because the publisher was still blocked on earlier acknowledgements. The
+// first hand-off also waits for the connection and is not counted.
+func (c *PubClient) hand(ch chan *Message, m *Message) {
+	c.chaos.hold()
+	start := c.clock.Now()
+	ch <- m
+	if c.handed > 0 {
+		c.blocked += c.clock.Now().Sub(start)
+	}
+	c.handed++
+}
@@ -0,0 +1,38 @@
+package mqttbmlatency
+
+import (
+	"log"
+	"time"
+)
+
+// BarrierResults describe the start barrier publishing waited on: every
+// subscriber had its SUBACK or failed, then Config.SettleDelay passed
+type BarrierResults struct {
+	Subscribers int     `json:"subscribers"`
+	Confirmed   int     `json:"confirmed"` // subscriptions acknowledged by the broker
+	Wait        float64 `json:"wait"`      // seconds from starting the subscribers to the last SUBACK or failure
+	Settle      float64 `json:"settle,omitempty"`
+}
+
+// awaitSubscribers blocks until all subscribers reported on subDone, then
+// sleeps the settle delay before publishing may start
+func awaitSubscribers(clock Clock, subDone chan bool, subscribers int, settle time.Duration, start time.Time, quiet bool) *BarrierResults {
+	res := &BarrierResults{Subscribers: subscribers}
+	for i := 0; i < subscribers; i++ {
+		if <-subDone {
+			res.Confirmed++
+		}
+	}
+	res.Wait = clock.Now().Sub(start).Seconds()
+	if !quiet {
+		log.Printf("all subscribe job done.\n")
+	}
+	if res.Confirmed < subscribers {
+		log.Printf("%v of %v subscriptions were not confirmed\n", subscribers-res.Confirmed, subscribers)
+	}
+	if settle > 0 {
+		clock.Sleep(settle)
+		res.Settle = settle.Seconds()
+	}
+	return res
+}
@@ -0,0 +1,67 @@
+package mqttbmlatency
+
+// LatencyBreakdown splits the forward latency using reference subscribers
+// connected to the broker over loopback, e.g. with the benchmark running on
+// the broker host. Their latency covers the publish path and the broker's
+// processing; what the real subscribers take beyond that is attributed to the
+// network between the broker and them.
+//
+// A broker that stamps messages on arrival with an MQTT 5 user property
+// splits the latency itself, into the path from the publisher to the broker
+// and the path on to the subscriber, given clocks in sync with the broker's.
+type LatencyBreakdown struct {
+	Reference   string       `json:"reference_broker,omitempty"`
+	Received    int64        `json:"reference_received,omitempty"`
+	BrokerMean  float64      `json:"broker_latency_mean,omitempty"` // publish path and broker processing
+	BrokerPct   *Percentiles `json:"broker_latency_percentiles,omitempty"`
+	NetworkMean float64      `json:"network_latency_mean,omitempty"` // egress path to the subscribers
+	BrokerShare float64      `json:"broker_share,omitempty"`         // of the mean forward latency
+
+	IngressProperty string       `json:"ingress_property,omitempty"`
+	Stamped         int64        `json:"stamped,omitempty"`              // messages that carried a valid ingress timestamp
+	Unstamped       int64        `json:"unstamped,omitempty"`            // messages that did not
+	IngressMean     float64      `json:"ingress_latency_mean,omitempty"` // publisher to broker
+	IngressPct      *Percentiles `json:"ingress_latency_percentiles,omitempty"`
+	EgressMean      float64      `json:"egress_latency_mean,omitempty"` // broker to subscriber
+	EgressPct       *Percentiles `json:"egress_latency_percentiles,omitempty"`
+	ProcessingMean  float64      `json:"processing_latency_mean,omitempty"` // reference latency beyond the ingress, with both
+}
+
+// weightedLatency is the mean forward latency over all messages of results
+func weightedLatency(results []*SubResults) (mean float64, received int64) {
+	var sum float64
+	for _, res := range results {
+		sum += res.FwdLatencyMean * float64(res.Received)
+		received += res.Received
+	}
+	if received > 0 {
+		mean = sum / float64(received)
+	}
+	return mean, received
+}
+
+func calculateBreakdown(reference, property string, refresults, subresults []*SubResults) *LatencyBreakdown {
+	b := &LatencyBreakdown{Reference: reference}
+	if reference != "" {
+		b.addReference(refresults, subresults)
+	}
+	if property != "" {
+		b.addIngress(property, subresults)
+	}
+	return b
+}
+
+// addReference splits the latency using the reference subscribers
+func (b *LatencyBreakdown) addReference(refresults, subresults []*SubResults) {
+	digests := make([]*digest, len(refresults))
+	for i, res := range refresults {
+		digests[i] = res.digest
+	}
+	b.BrokerPct = mergeDigests(digests).percentiles()
+	b.BrokerMean, b.Received = weightedLatency(refresults)
+	fwdMean, _ := weightedLatency(subresults)
+	b.NetworkMean = fwdMean - b.BrokerMean
+	if fwdMean > 0 {
+		b.BrokerShare = b.BrokerMean / fwdMean
+	}
+}
@@ -0,0 +1,375 @@
+// Package broker is a minimal in-memory MQTT 3.1.1 broker for smoke tests and
+// hermetic self-tests of the benchmark. It supports QoS 0-2, '+' and '#'
+// wildcards and clean sessions only; retained messages, wills and persistent
+// sessions are not implemented.
+package broker
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brunobevilaquaa/mqtt-bm-latency/internal/packet"
+)
+
+// MQTT control packet types
+const (
+	connect     = 1
+	connack     = 2
+	publish     = 3
+	puback      = 4
+	pubrec      = 5
+	pubrel      = 6
+	pubcomp     = 7
+	subscribe   = 8
+	suback      = 9
+	unsubscribe = 10
+	unsuback    = 11
+	pingreq     = 12
+	pingresp    = 13
+	disconnect  = 14
+)
+
+// Broker accepts MQTT connections and routes messages between them
+type Broker struct {
+	// Logger receives connection errors; nil discards them
+	Logger *log.Logger
+
+	mu       sync.Mutex
+	listener net.Listener
+	sessions map[*session]bool // every open connection, connected or not
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// New returns a broker that is not listening yet
+func New() *Broker {
+	return &Broker{sessions: make(map[*session]bool)}
+}
+
+// Listen starts serving on addr (e.g. "127.0.0.1:0") in the background and
+// returns the address actually bound
+func (b *Broker) Listen(addr string) (string, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	b.mu.Lock()
+	b.listener = l
+	b.mu.Unlock()
+	b.wg.Add(1)
+	go b.serve(l)
+	return l.Addr().String(), nil
+}
+
+// Close stops listening and drops all connections
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	l := b.listener
+	b.closed = true
+	for s := range b.sessions {
+		s.conn.Close()
+	}
+	b.mu.Unlock()
+	var err error
+	if l != nil {
+		err = l.Close()
+	}
+	b.wg.Wait()
+	return err
+}
+
+func (b *Broker) serve(l net.Listener) {
+	defer b.wg.Done()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		s := &session{
+			broker:   b,
+			conn:     conn,
+			w:        bufio.NewWriter(conn),
+			subs:     make(map[string]byte),
+			inflight: make(map[uint16]bool),
+		}
+		if !b.add(s) {
+			conn.Close()
+			return
+		}
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			defer b.remove(s)
+			if err := s.serve(); err != nil && err != io.EOF && b.Logger != nil {
+				b.Logger.Printf("broker: %v: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// add tracks s so that Close can drop it, false once the broker is closed
+func (b *Broker) add(s *session) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return false
+	}
+	b.sessions[s] = true
+	return true
+}
+
+func (b *Broker) remove(s *session) {
+	b.mu.Lock()
+	delete(b.sessions, s)
+	b.mu.Unlock()
+}
+
+// route delivers a message to every session subscribed to topic, at the
+// lower of the publish and subscription QoS
+func (b *Broker) route(topic string, qos byte, payload []byte) {
+	b.mu.Lock()
+	targets := make(map[*session]byte)
+	for s := range b.sessions {
+		if granted, ok := s.matches(topic); ok {
+			if granted > qos {
+				granted = qos
+			}
+			targets[s] = granted
+		}
+	}
+	b.mu.Unlock()
+	for s, q := range targets {
+		s.deliver(topic, q, payload)
+	}
+}
+
+// session is a single client connection
+type session struct {
+	broker *Broker
+	conn   net.Conn
+
+	wmu   sync.Mutex
+	w     *bufio.Writer
+	msgID uint16
+
+	smu  sync.Mutex
+	subs map[string]byte // topic filter -> granted QoS
+
+	inflight map[uint16]bool // incoming QoS 2 message IDs awaiting PUBREL
+}
+
+func (s *session) serve() error {
+	defer s.conn.Close()
+	r := bufio.NewReader(s.conn)
+
+	header, body, err := packet.Read(r)
+	if err != nil {
+		return err
+	}
+	if header>>4 != connect {
+		return errors.New("expected CONNECT")
+	}
+	keepAlive, err := parseConnect(body)
+	if err != nil {
+		s.write(connack<<4, []byte{0, 1}) // unacceptable protocol version
+		return err
+	}
+	if err := s.write(connack<<4, []byte{0, 0}); err != nil {
+		return err
+	}
+
+	for {
+		if keepAlive > 0 {
+			s.conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		}
+		header, body, err := packet.Read(r)
+		if err != nil {
+			return err
+		}
+		switch header >> 4 {
+		case publish:
+			err = s.handlePublish(header, body)
+		case puback, pubcomp:
+			// outgoing QoS 1/2 flows complete, nothing is retransmitted
+		case pubrec:
+			if len(body) >= 2 {
+				err = s.write(pubrel<<4|0x02, body[:2])
+			}
+		case pubrel:
+			if len(body) >= 2 {
+				delete(s.inflight, uint16(body[0])<<8|uint16(body[1]))
+				err = s.write(pubcomp<<4, body[:2])
+			}
+		case subscribe:
+			err = s.handleSubscribe(body)
+		case unsubscribe:
+			err = s.handleUnsubscribe(body)
+		case pingreq:
+			err = s.write(pingresp<<4, nil)
+		case disconnect:
+			return nil
+		default:
+			return errors.New("unexpected packet type")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *session) handlePublish(header byte, body []byte) error {
+	qos := (header >> 1) & 0x03
+	topic, rest, err := packet.ReadString(body)
+	if err != nil {
+		return err
+	}
+	var id []byte
+	if qos > 0 {
+		if len(rest) < 2 {
+			return errors.New("malformed PUBLISH")
+		}
+		id, rest = rest[:2], rest[2:]
+	}
+	payload := append([]byte(nil), rest...)
+
+	switch qos {
+	case 0:
+		s.broker.route(topic, qos, payload)
+	case 1:
+		s.broker.route(topic, qos, payload)
+		return s.write(puback<<4, id)
+	case 2:
+		mid := uint16(id[0])<<8 | uint16(id[1])
+		if !s.inflight[mid] {
+			s.inflight[mid] = true
+			s.broker.route(topic, qos, payload)
+		}
+		return s.write(pubrec<<4, id)
+	}
+	return nil
+}
+
+func (s *session) handleSubscribe(body []byte) error {
+	if len(body) < 2 {
+		return errors.New("malformed SUBSCRIBE")
+	}
+	id, rest := body[:2], body[2:]
+	codes := []byte{}
+	for len(rest) > 0 {
+		filter, r, err := packet.ReadString(rest)
+		if err != nil || len(r) < 1 {
+			return errors.New("malformed SUBSCRIBE")
+		}
+		qos := r[0] & 0x03
+		if qos > 2 {
+			qos = 2
+		}
+		rest = r[1:]
+		s.smu.Lock()
+		s.subs[filter] = qos
+		s.smu.Unlock()
+		codes = append(codes, qos)
+	}
+	return s.write(suback<<4, append(append([]byte(nil), id...), codes...))
+}
+
+func (s *session) handleUnsubscribe(body []byte) error {
+	if len(body) < 2 {
+		return errors.New("malformed UNSUBSCRIBE")
+	}
+	id, rest := body[:2], body[2:]
+	for len(rest) > 0 {
+		filter, r, err := packet.ReadString(rest)
+		if err != nil {
+			return err
+		}
+		rest = r
+		s.smu.Lock()
+		delete(s.subs, filter)
+		s.smu.Unlock()
+	}
+	return s.write(unsuback<<4, id)
+}
+
+// matches returns the highest QoS granted to a filter matching topic
+func (s *session) matches(topic string) (byte, bool) {
+	s.smu.Lock()
+	defer s.smu.Unlock()
+	var best byte
+	found := false
+	for filter, qos := range s.subs {
+		if match(filter, topic) {
+			if !found || qos > best {
+				best = qos
+			}
+			found = true
+		}
+	}
+	return best, found
+}
+
+func (s *session) deliver(topic string, qos byte, payload []byte) {
+	body := packet.AppendString(nil, topic)
+	s.wmu.Lock()
+	if qos > 0 {
+		s.msgID++
+		if s.msgID == 0 {
+			s.msgID = 1
+		}
+		body = append(body, byte(s.msgID>>8), byte(s.msgID))
+	}
+	body = append(body, payload...)
+	err := s.writeLocked(publish<<4|qos<<1, body)
+	s.wmu.Unlock()
+	if err != nil {
+		s.conn.Close()
+	}
+}
+
+func (s *session) write(header byte, body []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return s.writeLocked(header, body)
+}
+
+func (s *session) writeLocked(header byte, body []byte) error {
+	s.w.Write(packet.AppendLength([]byte{header}, len(body)))
+	s.w.Write(body)
+	return s.w.Flush()
+}
+
+// parseConnect validates a CONNECT body and returns the keep alive period
+func parseConnect(body []byte) (time.Duration, error) {
+	name, rest, err := packet.ReadString(body)
+	if err != nil {
+		return 0, err
+	}
+	if len(rest) < 4 || !(name == "MQTT" && rest[0] == 4 || name == "MQIsdp" && rest[0] == 3) {
+		return 0, errors.New("unsupported protocol version")
+	}
+	return time.Duration(int(rest[2])<<8|int(rest[3])) * time.Second, nil
+}
+
+// match reports whether topic matches the subscription filter
+func match(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if level != "+" && level != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
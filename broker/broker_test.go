@@ -0,0 +1,122 @@
+package broker
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestRoundTrip(t *testing.T) {
+	b := New()
+	addr, err := b.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	tests := []struct {
+		name   string
+		pubQoS byte
+		subQoS byte
+	}{
+		{"qos 0", 0, 0},
+		{"qos 1", 1, 1},
+		{"qos 2", 2, 2},
+		{"downgraded", 2, 1},
+		{"wildcard", 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topic := "test/" + tt.name
+			filter := topic
+			if tt.name == "wildcard" {
+				filter = "test/+"
+			}
+			got := make(chan mqtt.Message, 10)
+			sub := dial(t, addr, tt.name+"-sub")
+			defer sub.Disconnect(0)
+			if token := sub.Subscribe(filter, tt.subQoS, func(_ mqtt.Client, m mqtt.Message) { got <- m }); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+				t.Fatalf("subscribe: %v", token.Error())
+			}
+			pub := dial(t, addr, tt.name+"-pub")
+			defer pub.Disconnect(0)
+			for i := 0; i < 3; i++ {
+				if token := pub.Publish(topic, tt.pubQoS, false, fmt.Sprint(i)); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+					t.Fatalf("publish: %v", token.Error())
+				}
+			}
+
+			want := tt.pubQoS
+			if tt.subQoS < want {
+				want = tt.subQoS
+			}
+			for i := 0; i < 3; i++ {
+				select {
+				case m := <-got:
+					if m.Topic() != topic || string(m.Payload()) != fmt.Sprint(i) || m.Qos() != want {
+						t.Errorf("got %q %q at QoS %d, want %q %q at QoS %d", m.Topic(), m.Payload(), m.Qos(), topic, fmt.Sprint(i), want)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("message %d not delivered", i)
+				}
+			}
+		})
+	}
+}
+
+func TestCloseWithoutConnect(t *testing.T) {
+	b := New()
+	addr, err := b.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond) // let the broker accept it
+
+	closed := make(chan error, 1)
+	go func() { closed <- b.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waits on a connection that never sent CONNECT")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a/b/c", true},
+		{"#", "a", true},
+		{"a/b/c", "a/b", false},
+	}
+	for _, tt := range tests {
+		if got := match(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("match(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func dial(t *testing.T, addr, id string) mqtt.Client {
+	t.Helper()
+	c := mqtt.NewClient(mqtt.NewClientOptions().AddBroker("tcp://" + addr).SetClientID(id).SetAutoReconnect(false))
+	if token := c.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("connect: %v", token.Error())
+	}
+	return c
+}
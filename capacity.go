@@ -0,0 +1,134 @@
+package mqttbmlatency
+
+import (
+	"log"
+	"time"
+)
+
+// minRateShare is the share of the target rate a step has to achieve to pass;
+// below it the publishers could not keep up, whatever the latency
+const minRateShare = 0.95
+
+// CapacitySearch looks for the highest global publish rate at which
+// Config.SLA still holds, running a short measurement window per rate
+type CapacitySearch struct {
+	MinRate   float64       // lowest rate to try, assumed to pass when 0
+	MaxRate   float64       // highest rate to try
+	Window    time.Duration // length of each measurement, default 10s
+	Precision float64       // stop once the bracket is narrower than this share of the rate, default 0.05
+	MaxSteps  int           // most measurements to run, default 10
+}
+
+// CapacityResults are exported instead of JSONResults by a capacity search
+type CapacityResults struct {
+	Capacity float64           `json:"capacity_msgs_per_sec"` // highest passing rate, 0 if none passed
+	Steps    []*CapacityStep   `json:"steps"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Unit     string            `json:"latency_unit"`
+}
+
+// CapacityStep is one measurement window of the search
+type CapacityStep struct {
+	Rate       float64      `json:"target_msgs_per_sec"`
+	MsgsPerSec float64      `json:"total_msgs_per_sec"`
+	Passed     bool         `json:"passed"`
+	Results    *JSONResults `json:"results"`
+}
+
+func (cs *CapacitySearch) window() time.Duration {
+	if cs.Window > 0 {
+		return cs.Window
+	}
+	return 10 * time.Second
+}
+
+func (cs *CapacitySearch) precision() float64 {
+	if cs.Precision > 0 {
+		return cs.Precision
+	}
+	return 0.05
+}
+
+func (cs *CapacitySearch) maxSteps() int {
+	if cs.MaxSteps > 0 {
+		return cs.MaxSteps
+	}
+	return 10
+}
+
+// searchCapacity measures MinRate and MaxRate of cfg.Capacity, then bisects
+// between the highest passing and the lowest failing rate. A step passes when
+// every SLA check passed, the run was not aborted and the publishers reached
+// the target rate. Connect failures end the search.
+func searchCapacity(cfg *Config) (*CapacityResults, error) {
+	cs := cfg.Capacity
+	clock := clockOrSystem(cfg.Clock)
+	cr := &CapacityResults{Labels: cfg.Labels, Unit: "ms"}
+
+	var err error
+	measure := func(rate float64) (bool, bool) {
+		if len(cr.Steps) > 0 && cfg.CoolDown > 0 {
+			clock.Sleep(cfg.CoolDown)
+		}
+		if !cfg.Quiet {
+			log.Printf("Measuring %.1f msgs/s for %v..\n", rate, cs.window())
+		}
+		step := *cfg
+		step.Capacity = nil
+		step.GlobalRate = rate
+		step.live = nil // every step measures one fixed rate
+		step.Duration = cs.window()
+		var jr *JSONResults
+		if jr, err = benchmark(&step); err != nil {
+			return false, true
+		}
+
+		s := &CapacityStep{Rate: rate, MsgsPerSec: jr.PubTotals.TotalMsgsPerSec, Results: jr}
+		s.Passed = !jr.Aborted && s.MsgsPerSec >= minRateShare*rate
+		for _, c := range jr.SLA {
+			s.Passed = s.Passed && c.Passed
+		}
+		cr.Steps = append(cr.Steps, s)
+		if !cfg.Quiet {
+			log.Printf("%.1f msgs/s target, %.1f achieved, passed: %v\n", rate, s.MsgsPerSec, s.Passed)
+		}
+		return s.Passed, jr.ExitCode() == ExitConnect
+	}
+	// a step that could not run fails the search, connect failures only end it
+	finished := func() (*CapacityResults, error) {
+		if err != nil {
+			return nil, err
+		}
+		return cr, nil
+	}
+
+	lo, hi := cs.MinRate, cs.MaxRate
+	if lo > 0 {
+		passed, failed := measure(lo)
+		if !passed || failed {
+			return finished()
+		}
+	}
+	passed, failed := measure(hi)
+	if failed {
+		return finished()
+	}
+	if passed {
+		cr.Capacity = hi
+		return cr, nil
+	}
+	for len(cr.Steps) < cs.maxSteps() && hi-lo > cs.precision()*hi {
+		rate := (lo + hi) / 2
+		passed, failed := measure(rate)
+		if failed {
+			break
+		}
+		if passed {
+			lo = rate
+		} else {
+			hi = rate
+		}
+	}
+	cr.Capacity = lo
+	return finished()
+}
@@ -0,0 +1,82 @@
+package mqttbmlatency
+
+import (
+	"testing"
+	"time"
+)
+
+// capacityConfig searches the capacity of a loop broker whose every publish
+// takes delay, so that one publisher tops out at 1/delay messages per second
+func capacityConfig(delay time.Duration, cs *CapacitySearch) *Config {
+	clock := newFakeClock()
+	return &Config{
+		Broker:    "tcp://loop:1883",
+		Topic:     "capacity",
+		Backend:   &loopBackend{clock: clock, delay: delay},
+		Clock:     clock,
+		Clients:   1,
+		Size:      64,
+		KeepAlive: 30,
+		Capacity:  cs,
+		Quiet:     true,
+	}
+}
+
+func TestCapacitySearch(t *testing.T) {
+	// 1ms per publish allows 1000 msgs/s, which passes targets up to 1000/0.95
+	limit := 1000 / minRateShare
+	cr, err := searchCapacity(capacityConfig(time.Millisecond, &CapacitySearch{
+		MinRate:   100,
+		MaxRate:   4000,
+		Window:    time.Second,
+		Precision: 0.02,
+		MaxSteps:  20,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.Capacity > limit || cr.Capacity < (1-0.02)*limit-1 {
+		t.Errorf("capacity %.1f msgs/s, want just below %.1f", cr.Capacity, limit)
+	}
+	if len(cr.Steps) < 3 || cr.Steps[0].Rate != 100 || !cr.Steps[0].Passed || cr.Steps[1].Rate != 4000 || cr.Steps[1].Passed {
+		t.Fatalf("steps did not start with the passing MinRate and the failing MaxRate")
+	}
+	highest := 0.0
+	for _, s := range cr.Steps {
+		if s.Passed != (s.Rate <= limit) {
+			t.Errorf("%.1f msgs/s passed %v at %.1f achieved", s.Rate, s.Passed, s.MsgsPerSec)
+		}
+		if s.Passed && s.Rate > highest {
+			highest = s.Rate
+		}
+	}
+	if cr.Capacity != highest {
+		t.Errorf("capacity %.1f msgs/s, want the highest passing rate %.1f", cr.Capacity, highest)
+	}
+}
+
+func TestCapacitySearchBounds(t *testing.T) {
+	tests := []struct {
+		name     string
+		search   CapacitySearch
+		capacity float64
+		steps    int
+	}{
+		{"max rate passes", CapacitySearch{MinRate: 100, MaxRate: 500}, 500, 2},
+		{"max rate alone", CapacitySearch{MaxRate: 500}, 500, 1},
+		{"min rate fails", CapacitySearch{MinRate: 2000, MaxRate: 4000}, 0, 1},
+		{"step limit", CapacitySearch{MinRate: 100, MaxRate: 4000, MaxSteps: 5}, 587.5, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.search.Window = time.Second
+			cr, err := searchCapacity(capacityConfig(time.Millisecond, &tt.search))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cr.Capacity != tt.capacity || len(cr.Steps) != tt.steps {
+				t.Errorf("capacity %.1f msgs/s after %d steps, want %.1f after %d", cr.Capacity, len(cr.Steps), tt.capacity, tt.steps)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package mqttbmlatency
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// certSet holds the client certificates of Config.CertDir, one per
+// connection: publisher i uses certificate i and subscriber i certificate
+// clients+i, because brokers such as AWS IoT reject a certificate shared
+// across connections
+type certSet struct {
+	certs   []tls.Certificate
+	clients int
+}
+
+// loadCertDir loads the client certificates in dir, sorted by file name.
+// A certificate is either a name.key file with a matching name.crt or
+// name.pem, or a single .pem file holding both the certificate and its key.
+func loadCertDir(dir string) ([]tls.Certificate, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]bool)
+	for _, e := range entries {
+		if !e.IsDir() {
+			files[e.Name()] = true
+		}
+	}
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var certs []tls.Certificate
+	paired := make(map[string]bool)
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		switch ext := filepath.Ext(name); ext {
+		case ".p12", ".pfx":
+			// the standard library has no PKCS#12 decoder
+			return nil, fmt.Errorf("%v: PKCS#12 bundles are not supported, convert them to PEM with openssl pkcs12 -nodes", path)
+		case ".key":
+			stem := strings.TrimSuffix(name, ext)
+			certName := stem + ".crt"
+			if !files[certName] {
+				certName = stem + ".pem"
+			}
+			if !files[certName] {
+				return nil, fmt.Errorf("%v has no matching .crt or .pem certificate", path)
+			}
+			cert, err := tls.LoadX509KeyPair(filepath.Join(dir, certName), path)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", path, err)
+			}
+			paired[certName] = true
+			certs = append(certs, cert)
+		}
+	}
+	// combined files, certificate and key in one .pem
+	for _, name := range names {
+		if filepath.Ext(name) != ".pem" || paired[name] {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		cert, err := tls.LoadX509KeyPair(path, path)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// newCertSet loads dir and checks that it holds a certificate for every
+// connection of clients publishers and subscribers
+func newCertSet(dir string, clients int) (*certSet, error) {
+	certs, err := loadCertDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) < 2*clients {
+		return nil, fmt.Errorf("%v holds %v certificates, %v publishers and subscribers need %v", dir, len(certs), clients, 2*clients)
+	}
+	return &certSet{certs: certs, clients: clients}, nil
+}
+
+// pub returns the certificate of publisher i, nil without a cert directory
+func (s *certSet) pub(i int) *tls.Certificate {
+	if s == nil {
+		return nil
+	}
+	return &s.certs[i]
+}
+
+// sub returns the certificate of subscriber i, nil without a cert directory
+func (s *certSet) sub(i int) *tls.Certificate {
+	if s == nil {
+		return nil
+	}
+	return &s.certs[s.clients+i]
+}
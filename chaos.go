@@ -0,0 +1,182 @@
+package mqttbmlatency
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Chaos actions
+const (
+	ChaosDisconnect = "disconnect" // drop the connections of a share of the clients, which then reconnect
+	ChaosPause      = "pause"      // hold publishing back for a while
+)
+
+// ChaosAction is one step of a chaos scenario, performed At into publishing
+type ChaosAction struct {
+	At       time.Duration
+	Action   string        // ChaosDisconnect or ChaosPause
+	Role     string        // clients to disconnect, RoleSubscriber (default) or RolePublisher
+	Fraction float64       // share of the clients disconnected, default all
+	Duration time.Duration // length of a pause
+}
+
+// ChaosEvent records a performed chaos action
+type ChaosEvent struct {
+	Time     float64 `json:"time"` // seconds into publishing
+	Action   string  `json:"action"`
+	Role     string  `json:"role,omitempty"`
+	Clients  int     `json:"clients,omitempty"`  // connections dropped
+	Duration float64 `json:"duration,omitempty"` // seconds paused
+}
+
+// chaosScript performs the actions of Config.Chaos. It tracks the latest
+// connection of every client so it can drop them from under the client,
+// like a failing network would.
+type chaosScript struct {
+	actions []ChaosAction
+	soak    *soakMonitor // receives a marker for every action
+	clock   Clock
+	quiet   bool
+	paused  int64 // unix nanos until which publishing is held, accessed atomically
+
+	mu     sync.Mutex
+	conns  map[string][]net.Conn // by role, indexed by client
+	start  time.Time
+	events []*ChaosEvent
+	timers []Timer
+}
+
+func newChaosScript(actions []ChaosAction, clients int, soak *soakMonitor, clock Clock, quiet bool) *chaosScript {
+	return &chaosScript{
+		actions: actions,
+		soak:    soak,
+		clock:   clock,
+		quiet:   quiet,
+		conns: map[string][]net.Conn{
+			RolePublisher:  make([]net.Conn, clients),
+			RoleSubscriber: make([]net.Conn, clients),
+		},
+	}
+}
+
+func (a *ChaosAction) validate(scheme string) error {
+	if a.At < 0 || a.Fraction < 0 || a.Fraction > 1 {
+		return errors.New("chaos actions need a non-negative offset and a fraction between 0 and 1")
+	}
+	switch a.Action {
+	case ChaosDisconnect:
+		if a.Role != "" && a.Role != RolePublisher && a.Role != RoleSubscriber {
+			return fmt.Errorf("chaos disconnects apply to %q or %q clients, not %q", RolePublisher, RoleSubscriber, a.Role)
+		}
+		switch scheme {
+		case "ws", "wss", "udp", "mqttsn":
+			return fmt.Errorf("chaos disconnects do not support %v brokers", scheme)
+		}
+	case ChaosPause:
+		if a.Duration <= 0 {
+			return errors.New("a chaos pause needs a duration")
+		}
+	default:
+		return fmt.Errorf("unknown chaos action %q", a.Action)
+	}
+	return nil
+}
+
+// attach returns a copy of t whose connections are tracked as those of
+// client id in role
+func (s *chaosScript) attach(t *Transport, role string, id int) *Transport {
+	if s == nil {
+		return t
+	}
+	attached := &Transport{}
+	if t != nil {
+		*attached = *t
+	}
+	attached.track = func(conn net.Conn) {
+		s.mu.Lock()
+		s.conns[role][id] = conn
+		s.mu.Unlock()
+	}
+	return attached
+}
+
+// begin schedules the actions relative to the start of publishing
+func (s *chaosScript) begin(start time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.start = start
+	for _, a := range s.actions {
+		a := a
+		s.timers = append(s.timers, s.clock.AfterFunc(start.Add(a.At).Sub(s.clock.Now()), func() { s.perform(a) }))
+	}
+}
+
+func (s *chaosScript) perform(a ChaosAction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ev := &ChaosEvent{Time: s.clock.Now().Sub(s.start).Seconds(), Action: a.Action}
+	switch a.Action {
+	case ChaosDisconnect:
+		ev.Role = a.Role
+		if ev.Role == "" {
+			ev.Role = RoleSubscriber
+		}
+		conns := s.conns[ev.Role]
+		n := len(conns)
+		if a.Fraction > 0 {
+			n = int(math.Ceil(a.Fraction * float64(n)))
+		}
+		for _, conn := range conns[:n] {
+			if conn != nil {
+				conn.Close()
+				ev.Clients++
+			}
+		}
+	case ChaosPause:
+		ev.Duration = a.Duration.Seconds()
+		atomic.StoreInt64(&s.paused, s.clock.Now().Add(a.Duration).UnixNano())
+	}
+	s.events = append(s.events, ev)
+	s.soak.mark(ev.marker())
+	if !s.quiet {
+		log.Printf("CHAOS %v at %.1fs\n", ev.marker(), ev.Time)
+	}
+}
+
+// marker describes the event in the snapshot file
+func (ev *ChaosEvent) marker() string {
+	if ev.Action == ChaosDisconnect {
+		return fmt.Sprintf("%v %v %v", ev.Action, ev.Clients, ev.Role)
+	}
+	return fmt.Sprintf("%v %v", ev.Action, time.Duration(ev.Duration*float64(time.Second)))
+}
+
+// hold blocks a publisher while publishing is paused
+func (s *chaosScript) hold() {
+	if s == nil {
+		return
+	}
+	for {
+		d := time.Unix(0, atomic.LoadInt64(&s.paused)).Sub(s.clock.Now())
+		if d <= 0 {
+			return
+		}
+		s.clock.Sleep(d)
+	}
+}
+
+// close cancels the actions not yet performed and returns the performed ones
+func (s *chaosScript) close() []*ChaosEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.timers {
+		t.Stop()
+	}
+	return s.events
+}
@@ -0,0 +1,90 @@
+package mqttbmlatency
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+)
+
+// Checkpoint is the progress of a staged run, rewritten to
+// Config.CheckpointFile after every completed stage
+type Checkpoint struct {
+	Stages    []Stage        `json:"stages"`
+	Completed []*JSONResults `json:"completed"` // one run per completed stage, in order
+}
+
+// loadCheckpoint reads the checkpoint at path, returning nil when there is none
+func loadCheckpoint(path string) (*Checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cp := &Checkpoint{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+func (cp *Checkpoint) save(path string) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return writeOutput(path, data)
+}
+
+// checkpointed runs every stage of cfg as a run of its own and checkpoints
+// the results after each one. Stages found in an existing checkpoint of the
+// same load profile are not run again. Statistics cannot be merged across
+// runs, so the stages are reported like repeated runs.
+func checkpointed(cfg *Config) (*RepeatResults, error) {
+	cp, err := loadCheckpoint(cfg.CheckpointFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint %v: %v", cfg.CheckpointFile, err)
+	}
+	if cp == nil {
+		cp = &Checkpoint{Stages: cfg.Stages}
+	} else if !reflect.DeepEqual(cp.Stages, cfg.Stages) {
+		return nil, fmt.Errorf("checkpoint %v belongs to a different load profile", cfg.CheckpointFile)
+	} else if !cfg.Quiet {
+		log.Printf("Resuming after stage %v/%v from %v.\n", len(cp.Completed), len(cfg.Stages), cfg.CheckpointFile)
+	}
+
+	aborted := false
+	for k := len(cp.Completed); k < len(cfg.Stages); k++ {
+		if !cfg.Quiet {
+			log.Printf("Starting stage %v/%v..\n", k+1, len(cfg.Stages))
+		}
+		stage := *cfg
+		stage.Stages = cfg.Stages[k : k+1]
+		jr, err := benchmark(&stage)
+		if err != nil {
+			return nil, err
+		}
+		for _, st := range jr.StageRuns {
+			st.Stage = k
+		}
+		cp.Completed = append(cp.Completed, jr)
+		if jr.Aborted {
+			// not checkpointed, so resuming runs the stage again
+			log.Printf("Stage %v/%v aborted: %v. Skipping remaining stages.\n", k+1, len(cfg.Stages), jr.Reason)
+			aborted = true
+			break
+		}
+		if err := cp.save(cfg.CheckpointFile); err != nil {
+			log.Printf("Failed to write checkpoint %v: %v\n", cfg.CheckpointFile, err)
+		}
+	}
+	if !aborted {
+		os.Remove(cfg.CheckpointFile)
+	}
+
+	return &RepeatResults{Runs: cp.Completed, Summary: summarizeRuns(cp.Completed), Labels: cfg.Labels, Unit: "ms"}, nil
+}
@@ -0,0 +1,50 @@
+package mqttbmlatency
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// checksumSize is the length of the trailer of a payload
+func checksumSize(kind string) int {
+	if kind == "xxhash" {
+		return 8
+	}
+	return 4
+}
+
+func validChecksum(name string) error {
+	switch name {
+	case "", "crc32", "xxhash":
+		return nil
+	}
+	return fmt.Errorf("unsupported checksum %q", name)
+}
+
+// checksum returns the trailer of payload for kind, crc32 or xxhash
+func checksum(kind string, payload []byte) []byte {
+	sum := make([]byte, checksumSize(kind))
+	if kind == "xxhash" {
+		binary.BigEndian.PutUint64(sum, xxh64(payload))
+	} else {
+		binary.BigEndian.PutUint32(sum, crc32.ChecksumIEEE(payload))
+	}
+	return sum
+}
+
+// appendChecksum appends the checksum of payload to it
+func appendChecksum(kind string, payload []byte) []byte {
+	return append(payload, checksum(kind, payload)...)
+}
+
+// verifyChecksum returns payload without its trailer and whether the
+// trailer matched the payload
+func verifyChecksum(kind string, payload []byte) ([]byte, bool) {
+	size := checksumSize(kind)
+	if len(payload) < size {
+		return payload, false
+	}
+	n := len(payload) - size
+	return payload[:n], string(checksum(kind, payload[:n])) == string(payload[n:])
+}
@@ -0,0 +1,62 @@
+package mqttbmlatency
+
+import (
+	"time"
+)
+
+// Clock is the time source of publishers, subscribers and the run itself.
+// Tests can substitute a fake clock to drive latency calculation, pacing and
+// drain timeouts deterministically.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	AfterFunc(d time.Duration, f func()) Timer // calls f in its own goroutine after d
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a call scheduled by Clock.AfterFunc
+type Timer interface {
+	Stop() bool // false if the call already happened or was stopped
+}
+
+// Ticker delivers the time on C every period until stopped, dropping ticks
+// for slow receivers
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time        { return time.Now() }
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	t *time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time { return t.t.C }
+func (t systemTicker) Stop()               { t.t.Stop() }
+
+// clockOrSystem returns c, or the system clock when c is nil
+func clockOrSystem(c Clock) Clock {
+	if c == nil {
+		return systemClock{}
+	}
+	return c
+}
+
+// sleepUntil sleeps on clock until t
+func sleepUntil(clock Clock, t time.Time) {
+	if d := t.Sub(clock.Now()); d > 0 {
+		clock.Sleep(d)
+	}
+}
@@ -0,0 +1,363 @@
+package mqttbmlatency
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when advanced. Sleep advances it, so code sleeping on
+// it runs without delay, and timers and tickers fire as it passes them.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	at     time.Time
+	f      func()         // AfterFunc timers
+	period time.Duration  // tickers
+	c      chan time.Time // tickers
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1600000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) { c.Advance(d) }
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.schedule(&fakeTimer{clock: c, at: c.Now().Add(d), f: f})
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	return fakeTicker{c.schedule(&fakeTimer{clock: c, at: c.Now().Add(d), period: d, c: make(chan time.Time, 1)})}
+}
+
+func (c *fakeClock) schedule(t *fakeTimer) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, firing the timers due on the way in
+// order. AfterFunc calls run synchronously.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	for {
+		sort.Slice(c.timers, func(i, j int) bool { return c.timers[i].at.Before(c.timers[j].at) })
+		if len(c.timers) == 0 || c.timers[0].at.After(target) {
+			break
+		}
+		t := c.timers[0]
+		c.now = t.at
+		if t.period > 0 {
+			select {
+			case t.c <- t.at:
+			default:
+			}
+			t.at = t.at.Add(t.period)
+			continue
+		}
+		c.timers = c.timers[1:]
+		c.mu.Unlock()
+		t.f()
+		c.mu.Lock()
+	}
+	c.now = target
+	c.mu.Unlock()
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	for i, other := range t.clock.timers {
+		if other == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+// fakeTicker adapts a fakeTimer to Ticker, whose Stop returns nothing
+type fakeTicker struct{ *fakeTimer }
+
+func (t fakeTicker) Stop() { t.fakeTimer.Stop() }
+
+func TestFakeClock(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	var fired []time.Duration
+	clock.AfterFunc(30*time.Millisecond, func() { fired = append(fired, clock.Now().Sub(start)) })
+	stopped := clock.AfterFunc(20*time.Millisecond, func() { t.Error("stopped timer fired") })
+	if !stopped.Stop() {
+		t.Error("Stop of a pending timer returned false")
+	}
+	ticker := clock.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	clock.Sleep(25 * time.Millisecond)
+	if got := (<-ticker.C()).Sub(start); got != 10*time.Millisecond {
+		t.Errorf("first tick at %v, want 10ms", got) // the second one was dropped
+	}
+	clock.Advance(10 * time.Millisecond)
+	if got := clock.Now().Sub(start); got != 35*time.Millisecond {
+		t.Errorf("clock at %v, want 35ms", got)
+	}
+	if len(fired) != 1 || fired[0] != 30*time.Millisecond {
+		t.Errorf("timer fired at %v, want [30ms]", fired)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		idle  time.Duration // before the measured calls, after a first one
+		calls int
+		want  time.Duration
+	}{
+		{"unlimited", 0, 0, 0, 1000, 0},
+		{"paced", 100, 1, 0, 11, 100 * time.Millisecond},
+		{"no credit without idling", 100, 5, 0, 5, 40 * time.Millisecond},
+		{"burst after idling", 100, 5, time.Second, 5, 0},
+		{"paced after the burst", 100, 5, time.Second, 8, 30 * time.Millisecond},
+		{"short idle", 100, 5, 20 * time.Millisecond, 4, 20 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			l := newRateLimiter(clock, tt.rate, tt.burst)
+			if tt.idle > 0 {
+				l.wait()
+				clock.Advance(tt.idle)
+			}
+			start := clock.Now()
+			for i := 0; i < tt.calls; i++ {
+				l.wait()
+			}
+			if got := clock.Now().Sub(start); got != tt.want {
+				t.Errorf("%d calls took %v, want %v", tt.calls, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDrainSettle(t *testing.T) {
+	tests := []struct {
+		name    string
+		drain   Drain
+		until   time.Duration // messages keep arriving until then
+		done    bool
+		wait    time.Duration
+		drained bool
+	}{
+		{"already quiet", Drain{}, 0, false, time.Second, true},
+		{"nothing outstanding", Drain{}, time.Hour, true, 0, true},
+		{"stops", Drain{Quiet: 100 * time.Millisecond}, 300 * time.Millisecond, false, 400 * time.Millisecond, true},
+		{"times out", Drain{Quiet: 100 * time.Millisecond, Timeout: 200 * time.Millisecond}, time.Hour, false, 200 * time.Millisecond, false},
+		{"default timeout", Drain{}, time.Hour, false, 30 * time.Second, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			start := clock.Now()
+			count := func() int64 {
+				if elapsed := clock.Now().Sub(start); elapsed < tt.until {
+					return int64(elapsed)
+				}
+				return int64(tt.until)
+			}
+			wait, drained := tt.drain.settle(clock, count, func() bool { return tt.done })
+			if wait != tt.wait || drained != tt.drained {
+				t.Errorf("settle = %v, %v, want %v, %v", wait, drained, tt.wait, tt.drained)
+			}
+		})
+	}
+}
+
+// loopBackend delivers every message to all subscribers from within
+// Publish, after advancing the clock by delay
+type loopBackend struct {
+	clock *fakeClock
+	delay time.Duration
+
+	mu   sync.Mutex
+	subs []func(topic string, qos byte, payload []byte)
+}
+
+type loopConn struct {
+	b    *loopBackend
+	opts *BackendOptions
+}
+
+func (*loopBackend) Name() string { return "loop" }
+
+func (b *loopBackend) Connect(opts *BackendOptions) (BackendConn, error) {
+	return &loopConn{b, opts}, nil
+}
+
+func (c *loopConn) Publish(topic string, qos byte, payload []byte) error {
+	c.b.clock.Advance(c.b.delay)
+	c.b.mu.Lock()
+	subs := append([]func(string, byte, []byte){}, c.b.subs...)
+	c.b.mu.Unlock()
+	for _, deliver := range subs {
+		deliver(topic, qos, append([]byte(nil), payload...))
+	}
+	return nil
+}
+
+func (c *loopConn) Subscribe(filters map[string]byte) error {
+	c.b.mu.Lock()
+	c.b.subs = append(c.b.subs, c.opts.OnMessage)
+	c.b.mu.Unlock()
+	return nil
+}
+
+func (c *loopConn) Disconnect() {}
+
+func TestLatencyCalculation(t *testing.T) {
+	tests := []struct {
+		name  string
+		qos   int
+		delay time.Duration
+		want  float64 // in milliseconds
+	}{
+		{"qos 0", 0, 5 * time.Millisecond, 5},
+		{"qos 1", 1, 250 * time.Microsecond, 0.25},
+		{"qos 2", 2, 2 * time.Second, 2000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			data, code := RunWithExitCode(&Config{
+				Broker:    "tcp://loop:1883",
+				Topic:     "latency",
+				Backend:   &loopBackend{clock: clock, delay: tt.delay},
+				Clock:     clock,
+				Clients:   1,
+				Count:     10,
+				Size:      64,
+				PubQoS:    tt.qos,
+				SubQoS:    tt.qos,
+				KeepAlive: 30,
+				Quiet:     true,
+			})
+			if code != 0 {
+				t.Fatalf("exit code %d: %s", code, data)
+			}
+			var res JSONResults
+			if err := json.Unmarshal(data, &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.SubTotals.TotalReceived != 10 {
+				t.Fatalf("received %d of 10 messages", res.SubTotals.TotalReceived)
+			}
+			sub := res.SubRuns[0]
+			if !near(sub.FwdLatencyMin, tt.want, 1e-9) || !near(sub.FwdLatencyMax, tt.want, 1e-9) || !near(sub.FwdLatencyMean, tt.want, 1e-9) {
+				t.Errorf("forward latency min, max, mean = %v, %v, %v, want %v", sub.FwdLatencyMin, sub.FwdLatencyMax, sub.FwdLatencyMean, tt.want)
+			}
+			if !near(res.PubTotals.PubTimeMeanAvg, tt.want, 1e-9) {
+				t.Errorf("publish time %v, want %v", res.PubTotals.PubTimeMeanAvg, tt.want)
+			}
+		})
+	}
+}
+
+func TestChaosPause(t *testing.T) {
+	clock := newFakeClock()
+	s := newChaosScript([]ChaosAction{
+		{At: 100 * time.Millisecond, Action: ChaosPause, Duration: time.Second},
+		{At: time.Minute, Action: ChaosPause, Duration: time.Second},
+	}, 1, nil, clock, true)
+	start := clock.Now()
+	s.begin(start)
+	s.hold()
+	if clock.Now() != start {
+		t.Fatal("publishing held before the pause")
+	}
+	clock.Advance(100 * time.Millisecond)
+	s.hold()
+	if got := clock.Now().Sub(start); got != 1100*time.Millisecond {
+		t.Errorf("held until %v, want 1.1s", got)
+	}
+	events := s.close()
+	if len(events) != 1 || events[0].Time != 0.1 || events[0].Duration != 1 {
+		t.Fatalf("events %+v, want a pause of 1s at 0.1s", events)
+	}
+	clock.Advance(time.Hour)
+	if len(s.events) != 1 {
+		t.Error("an action fired after close")
+	}
+}
+
+func TestOutageReconnects(t *testing.T) {
+	clock := newFakeClock()
+	m := newOutageMonitor(&Outage{At: time.Second}, clock, true)
+	start := clock.Now()
+	m.begin(start)
+	clock.Advance(time.Second)
+	m.disconnected("pub-0")
+	m.disconnected("sub-0")
+	clock.Advance(200 * time.Millisecond)
+	m.reconnected("pub-0")
+	clock.Advance(200 * time.Millisecond)
+	m.reconnected("sub-0")
+	m.reconnected("sub-1") // never lost
+
+	res := calculateOutageResults(m, nil, nil)
+	if res.Disconnects != 2 || res.Reconnects != 2 {
+		t.Errorf("disconnects, reconnects = %d, %d, want 2, 2", res.Disconnects, res.Reconnects)
+	}
+	if !near(res.ReconnectTimeMean, 300, 1e-9) || !near(res.ReconnectTimeMax, 400, 1e-9) {
+		t.Errorf("reconnect time mean, max = %v, %v, want 300, 400", res.ReconnectTimeMean, res.ReconnectTimeMax)
+	}
+	if !near(res.WindowStart, 1, 1e-9) || !near(res.WindowEnd, 1.4, 1e-9) {
+		t.Errorf("window %v to %v, want 1 to 1.4", res.WindowStart, res.WindowEnd)
+	}
+}
+
+// TestZeroRunTime runs on a clock that never moves while publishing, so the
+// publishers report no run time to derive their rates from
+func TestZeroRunTime(t *testing.T) {
+	clock := newFakeClock()
+	data, code := RunWithExitCode(&Config{
+		Broker:    "tcp://loop:1883",
+		Topic:     "frozen",
+		Backend:   &loopBackend{clock: clock},
+		Clock:     clock,
+		Clients:   1,
+		Count:     10,
+		Size:      64,
+		KeepAlive: 30,
+		Quiet:     true,
+	})
+	if code != ExitOK {
+		t.Fatalf("exit code %d: %s", code, data)
+	}
+	var res JSONResults
+	if err := json.Unmarshal(data, &res); err != nil {
+		t.Fatal(err)
+	}
+	pub := res.PubRuns[0]
+	if pub.Successes != 10 || pub.RunTime != 0 || pub.PubsPerSec != 0 || pub.BlockedRatio != 0 {
+		t.Errorf("%d published in %vs at %v msgs/s, blocked %v, want 10 in 0s at 0 msgs/s", pub.Successes, pub.RunTime, pub.PubsPerSec, pub.BlockedRatio)
+	}
+}
@@ -0,0 +1,117 @@
+package mqttbmlatency
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"time"
+)
+
+// defaultMaxClockError is the clock error above which a run warns that
+// forward latencies across hosts cannot be trusted
+const defaultMaxClockError = time.Millisecond
+
+// ntpEpochOffset is the number of seconds between 1900 and 1970
+const ntpEpochOffset = 2208988800
+
+// ClockSync describes how well the local clock was synchronized before the
+// run. Forward latency across hosts is only as accurate as both clocks.
+// Times are in milliseconds.
+type ClockSync struct {
+	Synchronized bool    `json:"synchronized"`         // the kernel considers the clock synchronized
+	Offset       float64 `json:"offset"`               // kernel estimate of the remaining offset
+	MaxError     float64 `json:"max_error"`            // kernel bound of the clock error
+	EstError     float64 `json:"estimated_error"`      // kernel estimate of the clock error
+	Server       string  `json:"ntp_server,omitempty"` // queried with SNTP, see Config.NTPServer
+	ServerOffset float64 `json:"ntp_offset,omitempty"`
+	ServerDelay  float64 `json:"ntp_delay,omitempty"`
+	Dispersion   float64 `json:"ntp_root_dispersion,omitempty"`
+	Error        string  `json:"error,omitempty"`
+	Warning      string  `json:"warning,omitempty"`
+}
+
+// checkClock gathers the kernel's view of clock sync and, with a server, the
+// offset measured against it, warning when either exceeds cfg.MaxClockError
+func checkClock(cfg *Config) *ClockSync {
+	cs := &ClockSync{}
+	if err := kernelClockSync(cs); err != nil {
+		cs.Error = err.Error()
+	}
+	if cfg.NTPServer != "" {
+		cs.Server = cfg.NTPServer
+		if err := querySNTP(cfg.NTPServer, cs); err != nil {
+			cs.Error = err.Error()
+		}
+	}
+
+	limit := cfg.MaxClockError
+	if limit == 0 {
+		limit = defaultMaxClockError
+	}
+	ms := float64(limit) / float64(time.Millisecond)
+	switch {
+	case cs.Error == "" && cfg.NTPServer == "" && !cs.Synchronized:
+		cs.Warning = "the clock is not synchronized"
+	case cs.MaxError > ms && cfg.NTPServer == "":
+		cs.Warning = "the clock error may exceed the limit"
+	case cfg.NTPServer != "" && cs.Error == "" && math.Abs(cs.ServerOffset) > ms:
+		cs.Warning = "the clock is off from the NTP server by more than the limit"
+	}
+	if cs.Warning != "" {
+		log.Printf("Clock check: %v (max error %.3f ms, offset %.3f ms); forward latencies across hosts are unreliable\n", cs.Warning, cs.MaxError, cs.ServerOffset)
+	} else if cs.Error != "" && !cfg.Quiet {
+		log.Printf("Clock check failed: %v\n", cs.Error)
+	}
+	return cs
+}
+
+// querySNTP measures the offset of the local clock from server with one
+// SNTP request
+func querySNTP(server string, cs *ClockSync) error {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	conn, err := net.DialTimeout("udp", server, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := make([]byte, 48)
+	req[0] = 0x23 // no leap warning, version 4, client mode
+	t1 := time.Now()
+	putNTPTime(req[40:], t1)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	t4 := time.Now()
+	if err != nil {
+		return err
+	}
+	if n < 48 || resp[0]&0x07 != 4 || resp[1] == 0 {
+		return errors.New("invalid SNTP response")
+	}
+	t2, t3 := ntpTime(resp[32:]), ntpTime(resp[40:])
+	offset := (t2.Sub(t1) + t3.Sub(t4)) / 2
+	delay := t4.Sub(t1) - t3.Sub(t2)
+	cs.ServerOffset = float64(offset) / float64(time.Millisecond)
+	cs.ServerDelay = float64(delay) / float64(time.Millisecond)
+	cs.Dispersion = float64(binary.BigEndian.Uint32(resp[8:])) / 65536 * 1000
+	return nil
+}
+
+func putNTPTime(b []byte, t time.Time) {
+	binary.BigEndian.PutUint32(b, uint32(t.Unix()+ntpEpochOffset))
+	binary.BigEndian.PutUint32(b[4:], uint32((int64(t.Nanosecond())<<32)/1e9))
+}
+
+func ntpTime(b []byte) time.Time {
+	sec := int64(binary.BigEndian.Uint32(b)) - ntpEpochOffset
+	frac := int64(binary.BigEndian.Uint32(b[4:]))
+	return time.Unix(sec, (frac*1e9)>>32)
+}
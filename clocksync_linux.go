@@ -0,0 +1,27 @@
+package mqttbmlatency
+
+import "syscall"
+
+const (
+	timeError = 5      // adjtimex state of an unsynchronized clock
+	staNano   = 0x2000 // the offset is in nanoseconds rather than microseconds
+)
+
+// kernelClockSync reads the clock discipline state that NTP daemons and chrony
+// maintain in the kernel
+func kernelClockSync(cs *ClockSync) error {
+	var tx syscall.Timex
+	state, err := syscall.Adjtimex(&tx)
+	if err != nil {
+		return err
+	}
+	cs.Synchronized = state != timeError
+	offset := float64(tx.Offset) / 1000 // microseconds
+	if tx.Status&staNano != 0 {
+		offset /= 1000
+	}
+	cs.Offset = offset
+	cs.MaxError = float64(tx.Maxerror) / 1000
+	cs.EstError = float64(tx.Esterror) / 1000
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package mqttbmlatency
+
+import "errors"
+
+// kernelClockSync is only implemented on Linux; elsewhere use Config.NTPServer
+func kernelClockSync(cs *ClockSync) error {
+	return errors.New("the kernel clock state is only available on Linux")
+}
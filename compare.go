@@ -0,0 +1,122 @@
+package mqttbmlatency
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// CompareResults are exported instead of JSONResults when a run targets several brokers
+type CompareResults struct {
+	Runs       []*BrokerResults  `json:"broker runs"`
+	Comparison []*BrokerSummary  `json:"comparison"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Unit       string            `json:"latency_unit"`
+}
+
+// BrokerResults holds the full results of one broker
+type BrokerResults struct {
+	Broker  string       `json:"broker"`
+	Results *JSONResults `json:"results"`
+}
+
+// BrokerSummary is one row of the side-by-side comparison
+type BrokerSummary struct {
+	Broker          string  `json:"broker"`
+	MsgsPerSec      float64 `json:"total_msgs_per_sec"`
+	PubRatio        float64 `json:"publish_success_ratio"`
+	FwdRatio        float64 `json:"fwd_success_ratio"`
+	PubTimeMean     float64 `json:"pub_time_mean_avg"`
+	FwdLatencyMean  float64 `json:"fwd_latency_mean_avg"`
+	FwdLatencyP50   float64 `json:"fwd_latency_p50"`
+	FwdLatencyP99   float64 `json:"fwd_latency_p99"`
+	ConnectTimeMean float64 `json:"connect_time_mean"`
+	Aborted         bool    `json:"aborted,omitempty"`
+}
+
+// compareBrokers runs the workload of cfg against every broker of
+// cfg.Brokers, concurrently or one after the other. All runs share one seed so
+// they offer identical traffic.
+func compareBrokers(cfg *Config) (*CompareResults, error) {
+	if err := cfg.validateComparison(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	base := *cfg
+	base.Brokers = nil
+	if base.Seed == 0 {
+		base.Seed = time.Now().UnixNano()
+	}
+
+	cfgs := make([]*Config, len(cfg.Brokers))
+	for i, b := range cfg.Brokers {
+		c := base
+		c.Broker = b
+		if base.SizeDist != nil {
+			// every run builds its own size classes in benchmark
+			dist := *base.SizeDist
+			c.SizeDist = &dist
+		}
+		if err := c.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid configuration for broker %v: %v", b, err)
+		}
+		cfgs[i] = &c
+	}
+
+	cr := &CompareResults{Runs: make([]*BrokerResults, len(cfgs)), Labels: cfg.Labels, Unit: "ms"}
+	errs := make([]error, len(cfgs))
+	run := func(i int) {
+		if !cfg.Quiet {
+			log.Printf("Starting run against %v..\n", cfgs[i].Broker)
+		}
+		jr, err := benchmark(cfgs[i])
+		if err != nil {
+			errs[i] = fmt.Errorf("broker %v: %v", cfgs[i].Broker, err)
+			return
+		}
+		cr.Runs[i] = &BrokerResults{Broker: cfgs[i].Broker, Results: jr}
+	}
+	if cfg.Concurrent {
+		var wg sync.WaitGroup
+		for i := range cfgs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				run(i)
+			}(i)
+		}
+		wg.Wait()
+	} else {
+		for i := range cfgs {
+			if run(i); errs[i] != nil {
+				break
+			}
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, br := range cr.Runs {
+		jr := br.Results
+		s := &BrokerSummary{
+			Broker:          br.Broker,
+			MsgsPerSec:      jr.PubTotals.TotalMsgsPerSec,
+			PubRatio:        jr.PubTotals.PubRatio,
+			FwdRatio:        jr.SubTotals.TotalFwdRatio,
+			PubTimeMean:     jr.PubTotals.PubTimeMeanAvg,
+			FwdLatencyMean:  jr.SubTotals.FwdLatencyMeanAvg,
+			ConnectTimeMean: jr.PubTotals.ConnectTimeMean,
+			Aborted:         jr.Aborted,
+		}
+		if p := jr.SubTotals.FwdLatencyPct; p != nil {
+			s.FwdLatencyP50 = p.P50
+			s.FwdLatencyP99 = p.P99
+		}
+		cr.Comparison = append(cr.Comparison, s)
+	}
+
+	return cr, nil
+}
@@ -0,0 +1,49 @@
+package mqttbmlatency
+
+import (
+	"testing"
+
+	"github.com/brunobevilaquaa/mqtt-bm-latency/broker"
+)
+
+// TestConcurrentComparisonSizeDist runs two brokers at once with one size
+// distribution; run it with -race, as every run builds its own size classes
+func TestConcurrentComparisonSizeDist(t *testing.T) {
+	var brokers []string
+	for i := 0; i < 2; i++ {
+		b := broker.New()
+		addr, err := b.Listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		brokers = append(brokers, "tcp://"+addr)
+	}
+
+	dist := &SizeDist{Min: 10, Max: 5000}
+	cr, err := compareBrokers(&Config{
+		Brokers:    brokers,
+		Concurrent: true,
+		Topic:      "compare",
+		Clients:    2,
+		Count:      20,
+		Size:       64,
+		SizeDist:   dist,
+		KeepAlive:  30,
+		Quiet:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dist.bounds != nil {
+		t.Error("the runs prepared the caller's size distribution")
+	}
+	for _, br := range cr.Runs {
+		if len(br.Results.SizeRuns) == 0 {
+			t.Errorf("broker %v has no size classes", br.Broker)
+		}
+		if got := br.Results.SubTotals.TotalReceived; got != 40 {
+			t.Errorf("broker %v received %d messages, want 40", br.Broker, got)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package mqttbmlatency
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// CompressionResults describes the effect of payload compression on one
+// publisher or, in the totals, on all of them
+type CompressionResults struct {
+	Algorithm        string  `json:"algorithm"`
+	RawBytes         int64   `json:"raw_bytes"`
+	WireBytes        int64   `json:"wire_bytes"`
+	Ratio            float64 `json:"ratio"`              // raw / wire
+	CompressTimeMean float64 `json:"compress_time_mean"` // in milliseconds
+	RawBytesPerSec   float64 `json:"raw_bytes_per_sec"`
+	WireBytesPerSec  float64 `json:"wire_bytes_per_sec"`
+
+	compressTime accumulator
+}
+
+func validCompression(name string) error {
+	switch name {
+	case "", "gzip", "deflate":
+		return nil
+	case "zstd":
+		return fmt.Errorf("zstd compression needs a codec outside the standard library, which this build does not include; use gzip or deflate")
+	}
+	return fmt.Errorf("unsupported compression %q", name)
+}
+
+// compressor compresses the payloads of one publisher, reusing its writer
+type compressor struct {
+	name string
+	buf  bytes.Buffer
+	w    interface {
+		io.WriteCloser
+		Reset(io.Writer)
+	}
+}
+
+func newCompressor(name string) *compressor {
+	c := &compressor{name: name}
+	switch name {
+	case "gzip":
+		c.w = gzip.NewWriter(&c.buf)
+	case "deflate":
+		c.w, _ = flate.NewWriter(&c.buf, flate.DefaultCompression)
+	default:
+		return nil
+	}
+	return c
+}
+
+func (c *compressor) compress(p []byte) []byte {
+	c.buf.Reset()
+	c.w.Reset(&c.buf)
+	c.w.Write(p)
+	c.w.Close()
+	return append([]byte(nil), c.buf.Bytes()...)
+}
+
+// decompress restores a payload compressed with the named algorithm
+func decompress(name string, p []byte) ([]byte, error) {
+	var r io.ReadCloser
+	switch name {
+	case "gzip":
+		var err error
+		if r, err = gzip.NewReader(bytes.NewReader(p)); err != nil {
+			return nil, err
+		}
+	case "deflate":
+		r = flate.NewReader(bytes.NewReader(p))
+	default:
+		return p, nil
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// add accounts one published message
+func (cr *CompressionResults) add(raw, wire int, d time.Duration) {
+	cr.RawBytes += int64(raw)
+	cr.WireBytes += int64(wire)
+	cr.compressTime.add(d.Seconds() * 1000)
+}
+
+// finish derives the ratio and rates once all messages were accounted for
+func (cr *CompressionResults) finish(runTime float64) {
+	if cr.WireBytes > 0 {
+		cr.Ratio = float64(cr.RawBytes) / float64(cr.WireBytes)
+	}
+	cr.CompressTimeMean = cr.compressTime.mean
+	if runTime > 0 {
+		cr.RawBytesPerSec = float64(cr.RawBytes) / runTime
+		cr.WireBytesPerSec = float64(cr.WireBytes) / runTime
+	}
+}
+
+func calculateCompressionResults(pubresults []*PubResults, runTime float64) *CompressionResults {
+	var total *CompressionResults
+	for _, res := range pubresults {
+		if res.Compression == nil {
+			continue
+		}
+		if total == nil {
+			total = &CompressionResults{Algorithm: res.Compression.Algorithm}
+		}
+		total.RawBytes += res.Compression.RawBytes
+		total.WireBytes += res.Compression.WireBytes
+		total.compressTime.merge(res.Compression.compressTime)
+	}
+	if total != nil {
+		total.finish(runTime)
+	}
+	return total
+}
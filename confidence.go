@@ -0,0 +1,51 @@
+package mqttbmlatency
+
+import (
+	"math"
+)
+
+// Interval is a two-sided 95% confidence interval of a mean
+type Interval struct {
+	Low  float64 `json:"low"`
+	High float64 `json:"high"`
+}
+
+// t95 holds the two-sided 95% critical values of Student's t distribution
+// for 1 to 30 degrees of freedom
+var t95 = [...]float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+// tCritical95 returns the critical value for df degrees of freedom. Beyond
+// the table it takes the value of the lowest df of each range, which errs
+// towards a wider interval.
+func tCritical95(df int) float64 {
+	switch {
+	case df <= len(t95):
+		return t95[df-1]
+	case df <= 40:
+		return 2.042 // df 30
+	case df <= 60:
+		return 2.021 // df 40
+	case df <= 120:
+		return 2.000 // df 60
+	}
+	return 1.980 // df 120
+}
+
+// confidence95 returns the 95% confidence interval of the mean of values,
+// treating them as independent samples, or nil with fewer than two samples.
+// The totals leave out clients without messages, whose latencies are unset.
+func confidence95(values []float64) *Interval {
+	var a accumulator
+	for _, v := range values {
+		a.add(v)
+	}
+	if a.count < 2 {
+		return nil
+	}
+	h := tCritical95(int(a.count)-1) * a.std() / math.Sqrt(float64(a.count))
+	return &Interval{Low: a.mean - h, High: a.mean + h}
+}
@@ -0,0 +1,75 @@
+package mqttbmlatency
+
+import (
+	"math"
+	"testing"
+)
+
+func TestConfidence95(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		want   *Interval
+	}{
+		{"empty", nil, nil},
+		{"single", []float64{3}, nil},
+		{"two", []float64{4, 6}, &Interval{5 - 12.706, 5 + 12.706}},
+		{"three", []float64{1, 2, 3}, &Interval{2 - 4.303/math.Sqrt(3), 2 + 4.303/math.Sqrt(3)}},
+		{"identical", []float64{7, 7, 7, 7}, &Interval{7, 7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := confidence95(tt.values)
+			if (got == nil) != (tt.want == nil) {
+				t.Fatalf("confidence95 = %+v, want %+v", got, tt.want)
+			}
+			if got != nil && (!near(got.Low, tt.want.Low, 1e-9) || !near(got.High, tt.want.High, 1e-9)) {
+				t.Errorf("confidence95 = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTCritical95(t *testing.T) {
+	// past the table, a range takes the value of its lowest df
+	for _, tt := range []struct {
+		df   int
+		want float64
+	}{
+		{1, 12.706}, {30, 2.042}, {31, 2.042}, {40, 2.042}, {41, 2.021},
+		{60, 2.021}, {61, 2.000}, {120, 2.000}, {121, 1.980}, {100000, 1.980},
+	} {
+		if got := tCritical95(tt.df); got != tt.want {
+			t.Errorf("tCritical95(%d) = %v, want %v", tt.df, got, tt.want)
+		}
+	}
+}
+
+func TestConfidence95LeavesOutEmptySubscribers(t *testing.T) {
+	tests := []struct {
+		name string
+		subs []*SubResults
+		want *Interval
+	}{
+		{"two of three", []*SubResults{
+			{ID: 0, Received: 10, FwdLatencyMean: 4},
+			{ID: 1},
+			{ID: 2, Received: 10, FwdLatencyMean: 6},
+		}, &Interval{5 - 12.706, 5 + 12.706}},
+		{"one of two", []*SubResults{
+			{ID: 0, Received: 10, FwdLatencyMean: 4},
+			{ID: 1},
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := calculateSubscribeResults(tt.subs, nil).FwdLatencyMeanCI
+			if (got == nil) != (tt.want == nil) {
+				t.Fatalf("interval = %+v, want %+v", got, tt.want)
+			}
+			if got != nil && (!near(got.Low, tt.want.Low, 1e-9) || !near(got.High, tt.want.High, 1e-9)) {
+				t.Errorf("interval = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package mqttbmlatency
+
+import (
+	"sync"
+	"time"
+)
+
+// Connection events of a client
+const (
+	EventConnected   = "connected"
+	EventLost        = "lost"
+	EventReconnected = "reconnected"
+)
+
+// ConnEvent is one entry of a client's connection log
+type ConnEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Reason string    `json:"reason,omitempty"` // why the connection was lost
+}
+
+// connLog records when a client connected and lost its connection, to
+// attribute disconnects and compute the client's uptime
+type connLog struct {
+	mu     sync.Mutex
+	clock  Clock
+	events []*ConnEvent
+	first  time.Time // first connect
+	since  time.Time // connected since, zero while down
+	up     time.Duration
+	drops  int // lost connections
+}
+
+func newConnLog(clock Clock) *connLog {
+	return &connLog{clock: clock}
+}
+
+func (l *connLog) add(event string, reason error) {
+	now := l.clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := &ConnEvent{Time: now, Event: event}
+	switch event {
+	case EventLost:
+		e.Reason = reason.Error()
+		l.drops++
+		if !l.since.IsZero() {
+			l.up += now.Sub(l.since)
+			l.since = time.Time{}
+		}
+	default:
+		if l.first.IsZero() {
+			l.first = now
+		}
+		if l.since.IsZero() {
+			l.since = now
+		}
+	}
+	l.events = append(l.events, e)
+}
+
+func (l *connLog) connected()        { l.add(EventConnected, nil) }
+func (l *connLog) reconnected()      { l.add(EventReconnected, nil) }
+func (l *connLog) lost(reason error) { l.add(EventLost, reason) }
+
+// state returns how many connections the client lost so far and for how
+// long it has been connected at now, 0 while it is down
+func (l *connLog) state(now time.Time) (int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.since.IsZero() {
+		return l.drops, 0
+	}
+	return l.drops, now.Sub(l.since)
+}
+
+// results returns the log and the share of the time from the first connect
+// until now that the client was connected, 0 if it never connected. A log of
+// a single connect is left out.
+func (l *connLog) results() ([]*ConnEvent, float64) {
+	now := l.clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.first.IsZero() {
+		return nil, 0
+	}
+	up := l.up
+	if !l.since.IsZero() {
+		up += now.Sub(l.since)
+	}
+	uptime := 1.0
+	if total := now.Sub(l.first); total > 0 {
+		uptime = up.Seconds() / total.Seconds()
+	}
+	if len(l.events) == 1 {
+		return nil, uptime
+	}
+	return l.events, uptime
+}
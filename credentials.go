@@ -0,0 +1,109 @@
+package mqttbmlatency
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Credentials is one device identity of a credentials file
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Token    string `json:"token"`     // used as the password when Password is empty
+	ClientID string `json:"client_id"` // optional, generated when empty
+}
+
+// LoadCredentials reads the identities in path. A .json file holds an array
+// of Credentials. Any other file is CSV with the columns username, password
+// and an optional client ID; a header row starting with "username" and lines
+// starting with # are skipped.
+func LoadCredentials(path string) ([]*Credentials, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var creds []*Credentials
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		if err := json.NewDecoder(f).Decode(&creds); err != nil {
+			return nil, err
+		}
+	} else {
+		r := csv.NewReader(f)
+		r.FieldsPerRecord = -1
+		r.Comment = '#'
+		r.TrimLeadingSpace = true
+		for line := 1; ; line++ {
+			rec, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if line == 1 && strings.EqualFold(rec[0], "username") {
+				continue
+			}
+			if len(rec) < 2 || len(rec) > 3 {
+				return nil, fmt.Errorf("line %v: want username, password and an optional client ID", line)
+			}
+			c := &Credentials{Username: rec[0], Password: rec[1]}
+			if len(rec) == 3 {
+				c.ClientID = rec[2]
+			}
+			creds = append(creds, c)
+		}
+	}
+	for _, c := range creds {
+		if c.Password == "" {
+			c.Password = c.Token
+		}
+	}
+	if len(creds) == 0 {
+		return nil, errors.New("no credentials found")
+	}
+	return creds, nil
+}
+
+// assignCredentials returns the identity of every client. Clients beyond the
+// number of identities reuse them round-robin, unless they carry client IDs,
+// which brokers do not let two connections share.
+func assignCredentials(creds []*Credentials, clients int) ([]*Credentials, error) {
+	if len(creds) < clients {
+		for _, c := range creds {
+			if c.ClientID != "" {
+				return nil, fmt.Errorf("%v identities with client IDs for %v clients", len(creds), clients)
+			}
+		}
+	}
+	assigned := make([]*Credentials, clients)
+	for i := range assigned {
+		assigned[i] = creds[i%len(creds)]
+	}
+	return assigned, nil
+}
+
+// clientID returns the configured client ID, or generates a unique one
+func clientID(configured string, id int) string {
+	if configured != "" {
+		return configured
+	}
+	return fmt.Sprintf("mqtt-benchmark-%v-%v", time.Now(), id)
+}
+
+// derivedID derives the client ID of a subscriber from its identity, as the
+// publisher of the same index connects with the identity's client ID
+func derivedID(clientID string, suffix string) string {
+	if clientID == "" {
+		return ""
+	}
+	return clientID + suffix
+}
@@ -0,0 +1,69 @@
+package mqttbmlatency
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// a Friday
+	from := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"@hourly", time.Date(2026, 1, 2, 1, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2026, 1, 4, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 1, 2, 0, 15, 0, 0, time.UTC)},
+		{"30 9-17/4 * * *", time.Date(2026, 1, 2, 9, 30, 0, 0, time.UTC)},
+
+		// only one day field restricted: that field decides
+		{"0 0 * * 5", time.Date(2026, 1, 9, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * *", time.Date(2026, 1, 13, 0, 0, 0, 0, time.UTC)},
+		{"0 0 */1 * 5", time.Date(2026, 1, 9, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1-31 * 5", time.Date(2026, 1, 9, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * */1", time.Date(2026, 1, 13, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 1-7", time.Date(2026, 1, 13, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 0-6", time.Date(2026, 1, 13, 0, 0, 0, 0, time.UTC)},
+		// both restricted: either one matches
+		{"0 0 13 * 5", time.Date(2026, 1, 9, 0, 0, 0, 0, time.UTC)},
+		{"0 0 5 * 2", time.Date(2026, 1, 5, 0, 0, 0, 0, time.UTC)},
+		// 7 is Sunday too
+		{"0 0 * * 7", time.Date(2026, 1, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			s, err := parseCron(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.next(from); !got.Equal(tt.want) {
+				t.Errorf("next run at %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@yearly",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("%q parsed", spec)
+		}
+	}
+}
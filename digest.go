@@ -0,0 +1,173 @@
+package mqttbmlatency
+
+import (
+	"math"
+	"sort"
+)
+
+// digestCompression trades digest size for accuracy; 100 keeps a digest of
+// millions of samples at a few hundred centroids with tail percentiles within
+// a fraction of a percent
+const digestCompression = 100
+
+// Percentiles summarizes a latency distribution, in milliseconds
+type Percentiles struct {
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	P999 float64 `json:"p99_9"`
+}
+
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// digest is a merging t-digest: it estimates quantiles of a stream in bounded
+// memory, most accurately at the tails, and digests of several clients can be
+// merged into one of the whole run
+type digest struct {
+	centroids []centroid // sorted by mean
+	buf       []centroid // unmerged samples
+	count     float64
+	min       float64
+	max       float64
+}
+
+func newDigest() *digest {
+	return &digest{buf: make([]centroid, 0, 5*digestCompression)}
+}
+
+func (d *digest) add(v float64) {
+	d.addCentroid(centroid{v, 1})
+}
+
+func (d *digest) addCentroid(c centroid) {
+	if d.count == 0 || c.mean < d.min {
+		d.min = c.mean
+	}
+	if d.count == 0 || c.mean > d.max {
+		d.max = c.mean
+	}
+	d.count += c.weight
+	d.buf = append(d.buf, c)
+	if len(d.buf) == cap(d.buf) {
+		d.compress()
+	}
+}
+
+// merge adds all of b's samples to d
+func (d *digest) merge(b *digest) {
+	if b == nil || b.count == 0 {
+		return
+	}
+	min, max := b.min, b.max
+	for _, c := range b.centroids {
+		d.addCentroid(c)
+	}
+	for _, c := range b.buf {
+		d.addCentroid(c)
+	}
+	// centroid means lie within the extremes, which must survive the merge
+	d.min = math.Min(d.min, min)
+	d.max = math.Max(d.max, max)
+}
+
+// compress merges the buffered samples into the centroids, keeping every
+// centroid below 4·n·q·(1-q)/δ samples so that the tails stay fine grained
+func (d *digest) compress() {
+	if len(d.buf) == 0 {
+		return
+	}
+	all := append(d.centroids, d.buf...)
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+
+	merged := make([]centroid, 0, 2*digestCompression)
+	cur := all[0]
+	var before float64 // weight left of cur
+	for _, c := range all[1:] {
+		w := cur.weight + c.weight
+		q := (before + w/2) / d.count
+		if w <= 4*d.count*q*(1-q)/digestCompression {
+			cur.mean += (c.mean - cur.mean) * c.weight / w
+			cur.weight = w
+			continue
+		}
+		merged = append(merged, cur)
+		before += cur.weight
+		cur = c
+	}
+	d.centroids = append(merged, cur)
+	d.buf = d.buf[:0]
+}
+
+// quantile estimates the q-quantile (0..1), 0 for an empty digest
+func (d *digest) quantile(q float64) float64 {
+	d.compress()
+	cs := d.centroids
+	switch {
+	case d.count == 0:
+		return 0
+	case len(cs) == 1:
+		return cs[0].mean
+	}
+	index := q * d.count
+	if index < cs[0].weight/2 {
+		return d.min + (cs[0].mean-d.min)*index/(cs[0].weight/2)
+	}
+	center := cs[0].weight / 2 // cumulative weight at the center of cs[i]
+	for i := 0; i < len(cs)-1; i++ {
+		next := center + (cs[i].weight+cs[i+1].weight)/2
+		if index <= next {
+			return cs[i].mean + (cs[i+1].mean-cs[i].mean)*(index-center)/(next-center)
+		}
+		center = next
+	}
+	last := cs[len(cs)-1]
+	if rest := d.count - center; rest > 0 {
+		return last.mean + (d.max-last.mean)*math.Min(1, (index-center)/rest)
+	}
+	return last.mean
+}
+
+// trimmedMean estimates the mean after dropping fraction of the samples at each end
+func (d *digest) trimmedMean(fraction float64) float64 {
+	d.compress()
+	lo, hi := fraction*d.count, (1-fraction)*d.count
+	var sum, weight, seen float64
+	for _, c := range d.centroids {
+		w := math.Min(seen+c.weight, hi) - math.Max(seen, lo)
+		if w > 0 {
+			sum += c.mean * w
+			weight += w
+		}
+		seen += c.weight
+	}
+	if weight == 0 {
+		return 0
+	}
+	return sum / weight
+}
+
+func (d *digest) percentiles() *Percentiles {
+	if d == nil || d.count == 0 {
+		return nil
+	}
+	return &Percentiles{
+		P50:  d.quantile(0.5),
+		P90:  d.quantile(0.9),
+		P95:  d.quantile(0.95),
+		P99:  d.quantile(0.99),
+		P999: d.quantile(0.999),
+	}
+}
+
+// mergeDigests returns a digest of all samples of ds
+func mergeDigests(ds []*digest) *digest {
+	all := newDigest()
+	for _, d := range ds {
+		all.merge(d)
+	}
+	return all
+}
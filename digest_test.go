@@ -0,0 +1,150 @@
+package mqttbmlatency
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestDigestQuantile(t *testing.T) {
+	tests := []struct {
+		name string
+		q    float64
+		want float64
+	}{
+		{"min", 0, 0},
+		{"p50", 0.5, 50000},
+		{"p90", 0.9, 90000},
+		{"p99", 0.99, 99000},
+		{"p99.9", 0.999, 99900},
+		{"max", 1, 99999},
+	}
+	d := newDigest()
+	for _, v := range rand.New(rand.NewSource(1)).Perm(100000) {
+		d.add(float64(v))
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// uniform samples: a rank error of 0.1% is 100
+			if got := d.quantile(tt.q); got < tt.want-100 || got > tt.want+100 {
+				t.Errorf("quantile(%v) = %v, want %v ± 100", tt.q, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDigestSmall(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		q      float64
+		want   float64
+	}{
+		{"empty", nil, 0.5, 0},
+		{"single", []float64{7}, 0.99, 7},
+		{"equal", []float64{4, 4, 4, 4}, 0.9, 4},
+		{"two", []float64{1, 3}, 0.5, 2},
+		{"min", []float64{5, 1, 9}, 0, 1},
+		{"max", []float64{5, 1, 9}, 1, 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDigest()
+			for _, v := range tt.values {
+				d.add(v)
+			}
+			if got := d.quantile(tt.q); !near(got, tt.want, 1e-9) {
+				t.Errorf("quantile(%v) = %v, want %v", tt.q, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDigestTrimmedMean(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   []float64
+		fraction float64
+		want     float64
+	}{
+		{"empty", nil, 0.1, 0},
+		{"untrimmed", []float64{1, 2, 3, 4}, 0, 2.5},
+		{"outliers", []float64{-1000, 1, 2, 3, 4, 5, 6, 7, 8, 1000}, 0.1, 4.5},
+		{"all trimmed", []float64{1, 2}, 0.5, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDigest()
+			for _, v := range tt.values {
+				d.add(v)
+			}
+			if got := d.trimmedMean(tt.fraction); !near(got, tt.want, 1e-9) {
+				t.Errorf("trimmedMean(%v) = %v, want %v", tt.fraction, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDigestCompress(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples int
+	}{
+		{"below buffer", 10},
+		{"one buffer", 5 * digestCompression},
+		{"many buffers", 200000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDigest()
+			for i := 0; i < tt.samples; i++ {
+				d.add(float64(i))
+			}
+			d.compress()
+			if len(d.buf) != 0 {
+				t.Errorf("%d samples left in the buffer", len(d.buf))
+			}
+			if len(d.centroids) > 10*digestCompression {
+				t.Errorf("%d centroids, want at most %d", len(d.centroids), 10*digestCompression)
+			}
+			if !sort.SliceIsSorted(d.centroids, func(i, j int) bool { return d.centroids[i].mean < d.centroids[j].mean }) {
+				t.Error("centroids not sorted by mean")
+			}
+			var weight float64
+			for _, c := range d.centroids {
+				q := (weight + c.weight/2) / d.count
+				if limit := 4 * d.count * q * (1 - q) / digestCompression; c.weight > 1 && c.weight > limit {
+					t.Errorf("centroid at q %v weighs %v, above %v", q, c.weight, limit)
+				}
+				weight += c.weight
+			}
+			if weight != float64(tt.samples) || d.count != float64(tt.samples) {
+				t.Errorf("weight %v, count %v, want %d", weight, d.count, tt.samples)
+			}
+			if d.min != 0 || d.max != float64(tt.samples-1) {
+				t.Errorf("min, max = %v, %v, want 0, %d", d.min, d.max, tt.samples-1)
+			}
+		})
+	}
+}
+
+func TestDigestMerge(t *testing.T) {
+	all, parts := newDigest(), []*digest{newDigest(), newDigest(), nil, newDigest()}
+	for i, v := range rand.New(rand.NewSource(2)).Perm(30000) {
+		all.add(float64(v))
+		if p := parts[i%len(parts)]; p != nil {
+			p.add(float64(v))
+		} else {
+			parts[0].add(float64(v))
+		}
+	}
+	merged := mergeDigests(parts)
+	if merged.count != all.count || merged.min != all.min || merged.max != all.max {
+		t.Fatalf("merged count, min, max = %v, %v, %v, want %v, %v, %v", merged.count, merged.min, merged.max, all.count, all.min, all.max)
+	}
+	for _, q := range []float64{0.5, 0.9, 0.99, 0.999} {
+		if got, want := merged.quantile(q), all.quantile(q); got < want-60 || got > want+60 {
+			t.Errorf("merged quantile(%v) = %v, want %v ± 60", q, got, want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package mqttbmlatency
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Drain makes every run, and every stage of a load profile, first wait until
+// the broker stopped delivering messages on the benchmark topics, so the
+// queues left behind by one load do not distort the next
+type Drain struct {
+	Quiet   time.Duration // no message for this long counts as drained, default 1s
+	Timeout time.Duration // give up waiting after this long, default 30s
+}
+
+// DrainResults describe the wait for a drained broker before a run
+type DrainResults struct {
+	Wait    float64 `json:"wait"`          // seconds
+	Late    int64   `json:"late_messages"` // left over messages received while waiting
+	Drained bool    `json:"drained"`
+	Error   string  `json:"error,omitempty"`
+}
+
+func (d *Drain) quiet() time.Duration {
+	if d.Quiet > 0 {
+		return d.Quiet
+	}
+	return time.Second
+}
+
+func (d *Drain) timeout() time.Duration {
+	if d.Timeout > 0 {
+		return d.Timeout
+	}
+	return 30 * time.Second
+}
+
+// settle polls count until it did not change for the quiet period, or done
+// reports that nothing is outstanding. It returns how long it waited and
+// whether the messages stopped before the timeout.
+func (d *Drain) settle(clock Clock, count func() int64, done func() bool) (time.Duration, bool) {
+	start := clock.Now()
+	last, changed := count(), start
+	for {
+		now := clock.Now()
+		if done() || now.Sub(changed) >= d.quiet() {
+			return now.Sub(start), true
+		}
+		if now.Sub(start) >= d.timeout() {
+			return now.Sub(start), false
+		}
+		clock.Sleep(10 * time.Millisecond)
+		if n := count(); n != last {
+			last, changed = n, clock.Now()
+		}
+	}
+}
+
+// drainTopics subscribes to the benchmark topics on a connection of its own
+// and waits until no message arrived for the quiet period
+func drainTopics(cfg *Config, clock Clock, filters map[string]byte, localAddr net.IP, certs *certSet) *DrainResults {
+	var late int64
+	onMessage := func() { atomic.AddInt64(&late, 1) }
+	disconnect, err := drainConnect(cfg, filters, newTransport(cfg, localAddr, certs.sub(0)), onMessage)
+	if err != nil {
+		log.Printf("DRAIN failed to connect: %v\n", err)
+		return &DrainResults{Error: err.Error()}
+	}
+	defer disconnect()
+
+	wait, drained := cfg.Drain.settle(clock, func() int64 { return atomic.LoadInt64(&late) }, func() bool { return false })
+	res := &DrainResults{Wait: wait.Seconds(), Late: atomic.LoadInt64(&late), Drained: drained}
+	if !drained {
+		log.Printf("DRAIN messages still arriving after %v, %v so far\n", cfg.Drain.timeout(), res.Late)
+	} else if !cfg.Quiet && res.Late > 0 {
+		log.Printf("DRAIN %v left over messages drained in %v\n", res.Late, wait)
+	}
+	return res
+}
+
+// drainConnect opens the draining connection through cfg.Backend or paho and
+// subscribes to filters, returning its disconnect function
+func drainConnect(cfg *Config, filters map[string]byte, transport *Transport, onMessage func()) (func(), error) {
+	ka := time.Duration(cfg.KeepAlive) * time.Second
+	id := fmt.Sprintf("mqtt-drain-%v", time.Now().UnixNano())
+	if cfg.Backend != nil {
+		conn, err := cfg.Backend.Connect(&BackendOptions{
+			Broker:    cfg.Broker,
+			ClientID:  id,
+			Username:  cfg.Username,
+			Password:  cfg.Password,
+			KeepAlive: ka,
+			Transport: transport,
+			OnMessage: func(topic string, qos byte, payload []byte) { onMessage() },
+			OnLost:    func(reason error) {},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := conn.Subscribe(filters); err != nil {
+			conn.Disconnect()
+			return nil, err
+		}
+		return conn.Disconnect, nil
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(id).
+		SetCleanSession(true).
+		SetKeepAlive(ka)
+	if cfg.Username != "" && cfg.Password != "" {
+		opts.SetUsername(cfg.Username)
+		opts.SetPassword(cfg.Password)
+	}
+	setTransport(opts, cfg.Broker, transport)
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	token := client.SubscribeMultiple(filters, func(client mqtt.Client, msg mqtt.Message) { onMessage() })
+	if token.Wait() && token.Error() != nil {
+		client.Disconnect(250)
+		return nil, token.Error()
+	}
+	return func() { client.Disconnect(250) }, nil
+}
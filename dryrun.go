@@ -0,0 +1,216 @@
+package mqttbmlatency
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+import (
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const dryRunTimeout = 10 * time.Second
+
+// Plan describes what a run would do, as reported by a dry run
+type Plan struct {
+	Broker           string     `json:"broker"`
+	Addresses        []string   `json:"resolved_addresses"`
+	Clients          int        `json:"clients"`
+	Topics           []string   `json:"topics"`
+	PubQoS           int        `json:"pub_qos"`
+	SubQoS           int        `json:"sub_qos"`
+	QoSMix           []int      `json:"qos_mix,omitempty"`
+	MsgSize          int        `json:"message_size"`
+	LoadShape        string     `json:"load_shape"`
+	ExpectedMessages int64      `json:"expected_messages"` // 0 when bounded by time only
+	Duration         float64    `json:"duration,omitempty"`
+	LocalAddrs       []string   `json:"local_addresses,omitempty"`
+	Resources        *Resources `json:"resources"`
+	RoundTrip        float64    `json:"round_trip_ms"`
+	Error            string     `json:"error,omitempty"`
+}
+
+// dryRun resolves the broker, performs a single publish/subscribe round trip
+// and returns the effective plan without running the load
+func dryRun(cfg *Config, topics []string, traces map[string][]*TraceRecord) *Plan {
+	p := &Plan{
+		Broker:    cfg.Broker,
+		Clients:   len(topics),
+		Topics:    topics,
+		PubQoS:    cfg.PubQoS,
+		SubQoS:    cfg.SubQoS,
+		QoSMix:    cfg.QoSMix,
+		Resources: estimateResources(cfg, len(topics)),
+		MsgSize:   cfg.Size,
+	}
+
+	switch {
+	case traces != nil:
+		p.LoadShape = "replay " + cfg.ReplayFile
+		for _, recs := range traces {
+			p.ExpectedMessages += int64(len(recs))
+		}
+	case len(cfg.Stages) > 0:
+		p.LoadShape = fmt.Sprintf("%v stages", len(cfg.Stages))
+		for _, st := range cfg.Stages {
+			p.ExpectedMessages += int64(st.Rate * st.Duration.Seconds())
+			p.Duration += st.Duration.Seconds()
+		}
+	case cfg.Duration > 0:
+		p.Duration = cfg.Duration.Seconds()
+	default:
+		p.ExpectedMessages = totalCount(cfg, len(topics))
+	}
+	if p.LoadShape == "" {
+		switch {
+		case cfg.Burst != nil:
+			p.LoadShape = fmt.Sprintf("bursts of %v every %v, %v apart", cfg.Burst.Size, cfg.Burst.Gap, cfg.Burst.Interval)
+		case cfg.PoissonMean > 0:
+			p.LoadShape = fmt.Sprintf("poisson, mean gap %v", cfg.PoissonMean)
+		default:
+			p.LoadShape = "back to back"
+		}
+	}
+
+	err := func() error {
+		if !cfg.SkipPreflight {
+			if err := p.Resources.check(); err != nil {
+				return err
+			}
+		}
+		if len(cfg.LocalAddrs) > 0 {
+			ips, err := resolveLocalAddrs(cfg.LocalAddrs, brokerFamilies(cfg))
+			if err != nil {
+				return err
+			}
+			for _, ip := range ips {
+				p.LocalAddrs = append(p.LocalAddrs, ip.String())
+			}
+		}
+		addrs, err := resolveBroker(cfg.Broker)
+		if err != nil {
+			return err
+		}
+		p.Addresses = addrs
+		rtt, err := roundTrip(cfg, topics[0]+"-dryrun")
+		if err != nil {
+			return err
+		}
+		p.RoundTrip = rtt.Seconds() * 1000 // in milliseconds
+		return nil
+	}()
+	if err != nil {
+		p.Error = err.Error()
+	}
+
+	if !cfg.Quiet {
+		if err != nil {
+			log.Printf("Dry run against %v failed: %v\n", cfg.Broker, err)
+		} else {
+			log.Printf("Dry run against %v succeeded, round trip %.3f ms\n", cfg.Broker, p.RoundTrip)
+		}
+	}
+
+	return p
+}
+
+func resolveBroker(broker string) ([]string, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "unix" {
+		path := u.Host + u.Path
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+		return []string{path}, nil
+	}
+	return net.LookupHost(u.Hostname())
+}
+
+// roundTrip publishes a single message to topic and waits until it is received back
+func roundTrip(cfg *Config, topic string) (time.Duration, error) {
+	received := make(chan time.Duration, 1)
+	onMessage := func(topic string, qos byte, payload []byte) {
+		if sent, _, ok := decodePayload(payload); ok {
+			select {
+			case received <- time.Duration(time.Now().UnixNano() - sent):
+			default:
+			}
+		}
+	}
+	ka, _ := time.ParseDuration(strconv.Itoa(cfg.KeepAlive) + "s")
+
+	if isMQTTSN(cfg.Broker) {
+		client, err := dialMQTTSN(cfg.Broker, snClientID(-1), ka, onMessage, nil)
+		if err != nil {
+			return 0, err
+		}
+		defer client.disconnect()
+		if _, err := client.subscribe(topic, byte(cfg.SubQoS)); err != nil {
+			return 0, err
+		}
+		id, err := client.register(topic)
+		if err != nil {
+			return 0, err
+		}
+		if err := client.publish(id, byte(cfg.PubQoS), encodePayload(time.Now(), 0, cfg.Size, nil)); err != nil {
+			return 0, err
+		}
+	} else {
+		opts := mqtt.NewClientOptions().
+			AddBroker(cfg.Broker).
+			SetClientID(fmt.Sprintf("mqtt-benchmark-dryrun-%v", time.Now())).
+			SetCleanSession(true).
+			SetKeepAlive(ka).
+			SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
+				onMessage(msg.Topic(), msg.Qos(), msg.Payload())
+			})
+		if cfg.Username != "" && cfg.Password != "" {
+			opts.SetUsername(cfg.Username)
+			opts.SetPassword(cfg.Password)
+		}
+		var cert *tls.Certificate
+		if cfg.CertDir != "" {
+			certs, err := loadCertDir(cfg.CertDir)
+			if err != nil {
+				return 0, err
+			}
+			if len(certs) == 0 {
+				return 0, fmt.Errorf("no client certificates in %v", cfg.CertDir)
+			}
+			cert = &certs[0]
+		}
+		setTransport(opts, cfg.Broker, newTransport(cfg, nil, cert))
+		client := mqtt.NewClient(opts)
+		if token := client.Connect(); token.Wait() && token.Error() != nil {
+			return 0, token.Error()
+		}
+		defer client.Disconnect(250)
+		if token := client.Subscribe(topic, byte(cfg.SubQoS), nil); token.Wait() && token.Error() != nil {
+			return 0, token.Error()
+		}
+		token := client.Publish(topic, byte(cfg.PubQoS), false, encodePayload(time.Now(), 0, cfg.Size, nil))
+		if !token.WaitTimeout(dryRunTimeout) {
+			return 0, errors.New("timed out waiting for the publish to complete")
+		}
+		if token.Error() != nil {
+			return 0, token.Error()
+		}
+	}
+
+	select {
+	case rtt := <-received:
+		return rtt, nil
+	case <-time.After(dryRunTimeout):
+		return 0, errors.New("test message was not received back")
+	}
+}
@@ -0,0 +1,87 @@
+package mqttbmlatency
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+)
+
+import (
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Error classes used as keys of the per-client error breakdown
+const (
+	ErrConnectRefused = "connect_refused"
+	ErrConnectTimeout = "connect_timeout"
+	ErrAuthFailure    = "auth_failure"
+	ErrPublishTimeout = "publish_timeout"
+	ErrAckTimeout     = "ack_timeout"
+	ErrDisconnect     = "disconnect"
+	ErrSubscribe      = "subscribe_failure"
+	ErrInvalid        = "invalid_message" // rejected by Hooks.OnReceive
+	ErrOther          = "other"
+)
+
+// errTimeout is returned by a publish whose token did not complete in time
+var errTimeout = errors.New("timed out waiting for the broker")
+
+// ErrorCounts breaks failures down by error class
+type ErrorCounts map[string]int64
+
+func (e ErrorCounts) add(class string, n int64) {
+	if n != 0 {
+		e[class] += n
+	}
+}
+
+func (e ErrorCounts) merge(other ErrorCounts) {
+	for class, n := range other {
+		e.add(class, n)
+	}
+}
+
+// classifyConnectError maps an error returned while connecting to an error class
+func classifyConnectError(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, packets.ErrorRefusedBadUsernameOrPassword), errors.Is(err, packets.ErrorRefusedNotAuthorised):
+		return ErrAuthFailure
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, packets.ErrorRefusedServerUnavailable),
+		errors.Is(err, packets.ErrorRefusedIDRejected), errors.Is(err, packets.ErrorRefusedBadProtocolVersion):
+		return ErrConnectRefused
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrConnectTimeout
+	}
+	// paho flattens some errors into strings
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "not authorized"), strings.Contains(msg, "bad user name or password"):
+		return ErrAuthFailure
+	case strings.Contains(msg, "connection refused"):
+		return ErrConnectRefused
+	case strings.Contains(msg, "timeout"), strings.Contains(msg, "timed out"):
+		return ErrConnectTimeout
+	}
+	return ErrOther
+}
+
+// classifyPublishError maps an error returned while publishing with qos to an error class
+func classifyPublishError(err error, qos byte) string {
+	switch {
+	case errors.Is(err, errTimeout):
+		if qos > 0 {
+			return ErrAckTimeout
+		}
+		return ErrPublishTimeout
+	case errors.Is(err, mqtt.ErrNotConnected):
+		return ErrDisconnect
+	}
+	msg := strings.ToLower(err.Error())
+	if strings.Contains(msg, "connection lost") || strings.Contains(msg, "not connected") || strings.Contains(msg, "connection closed") {
+		return ErrDisconnect
+	}
+	return ErrOther
+}
@@ -0,0 +1,88 @@
+package mqttbmlatency
+
+// Process exit codes, for programs wrapping Run to hand on to their callers.
+// When several apply, the most severe wins, in the order ExitConnect,
+// ExitAborted, ExitMissing, ExitSLA and ExitLoss. ExitConfig comes without
+// results, as the run could not take place.
+const (
+	ExitOK      = 0
+	ExitConfig  = 2 // invalid configuration or unreadable input files
+	ExitConnect = 3 // a client could not connect or subscribe, or the dry run failed
+	ExitAborted = 4 // the run was aborted by MaxFailureRatio or MaxDisconnects
+	ExitSLA     = 5 // an SLA limit was violated
+	ExitLoss    = 6 // some published messages were not forwarded, even late
+	ExitMissing = 7 // agents of a collection sent no results that could be merged, see CollectResults
+)
+
+// exitPriority orders the exit codes from most to least severe
+var exitPriority = []int{ExitConnect, ExitAborted, ExitMissing, ExitSLA, ExitLoss}
+
+// worseExit returns the more severe of two exit codes
+func worseExit(a, b int) int {
+	for _, code := range exitPriority {
+		if a == code || b == code {
+			return code
+		}
+	}
+	return ExitOK
+}
+
+// ExitCode classifies the outcome of the run
+func (jr *JSONResults) ExitCode() int {
+	for _, errs := range []ErrorCounts{jr.PubTotals.Errors, jr.SubTotals.Errors} {
+		for _, class := range []string{ErrConnectRefused, ErrConnectTimeout, ErrAuthFailure, ErrSubscribe} {
+			if errs[class] > 0 {
+				return ExitConnect
+			}
+		}
+	}
+	if jr.Aborted {
+		return ExitAborted
+	}
+	for _, a := range jr.Agents {
+		if !a.Reported {
+			return ExitMissing
+		}
+	}
+	for _, c := range jr.SLA {
+		if !c.Passed {
+			return ExitSLA
+		}
+	}
+	if jr.SubTotals.TotalReceived+jr.SubTotals.Late < jr.SubTotals.TotalPublished {
+		return ExitLoss
+	}
+	return ExitOK
+}
+
+// ExitCode is the most severe outcome of all runs
+func (rr *RepeatResults) ExitCode() int {
+	code := ExitOK
+	for _, jr := range rr.Runs {
+		code = worseExit(code, jr.ExitCode())
+	}
+	return code
+}
+
+// ExitCode is ExitConnect if a measurement could not connect and ExitSLA if
+// no rate passed. Failed measurements above the capacity are expected.
+func (cr *CapacityResults) ExitCode() int {
+	for _, s := range cr.Steps {
+		if s.Results.ExitCode() == ExitConnect {
+			return ExitConnect
+		}
+	}
+	if cr.Capacity == 0 {
+		return ExitSLA
+	}
+	return ExitOK
+}
+
+// ExitCode is the most severe outcome of all brokers
+func (cr *CompareResults) ExitCode() int {
+	code := ExitOK
+	for _, br := range cr.Runs {
+		code = worseExit(code, br.Results.ExitCode())
+	}
+	return code
+}
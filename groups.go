@@ -0,0 +1,56 @@
+package mqttbmlatency
+
+import (
+	"fmt"
+	"net"
+)
+
+// ClientGroup binds a block of clients to their own source addresses, so a
+// multi-homed load generator emulates traffic from several network segments
+type ClientGroup struct {
+	Name       string   // reported with every client of the group
+	Clients    int      // number of consecutive clients in the group
+	LocalAddrs []string // source IPs or interface names, like Config.LocalAddrs
+}
+
+// groupPlan maps client indexes to their group and source address
+type groupPlan struct {
+	groups []ClientGroup
+	ips    [][]net.IP
+}
+
+func newGroupPlan(groups []ClientGroup, families ipFamilies) (*groupPlan, error) {
+	p := &groupPlan{groups: groups, ips: make([][]net.IP, len(groups))}
+	for k, g := range groups {
+		ips, err := resolveLocalAddrs(g.LocalAddrs, families)
+		if err != nil {
+			return nil, fmt.Errorf("group %v: %v", g.Name, err)
+		}
+		p.ips[k] = ips
+	}
+	return p, nil
+}
+
+// lookup returns the group index and source address of client i, or -1 for
+// clients beyond all groups
+func (p *groupPlan) lookup(i int) (int, net.IP) {
+	first := 0
+	for k, g := range p.groups {
+		if i < first+g.Clients {
+			return k, p.ips[k][(i-first)%len(p.ips[k])]
+		}
+		first += g.Clients
+	}
+	return -1, nil
+}
+
+// name returns the group name of client i, if it belongs to a group
+func (p *groupPlan) name(i int) string {
+	if p == nil {
+		return ""
+	}
+	if k, _ := p.lookup(i); k >= 0 {
+		return p.groups[k].Name
+	}
+	return ""
+}
@@ -0,0 +1,243 @@
+package mqttbmlatency
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const heartbeatSuffix = "/heartbeat"
+
+// HeartbeatResults describes the heartbeats sent during publishing. Bulk
+// statistics average a short broker freeze away; the stalls pinpoint it.
+type HeartbeatResults struct {
+	Topic       string       `json:"topic"`
+	Sent        int64        `json:"sent"`
+	Received    int64        `json:"received"`
+	Lost        int64        `json:"lost"` // unanswered for more than an interval when publishing ended
+	LatencyMin  float64      `json:"latency_min"`
+	LatencyMax  float64      `json:"latency_max"`
+	LatencyMean float64      `json:"latency_mean"`
+	LatencyStd  float64      `json:"latency_std"`
+	LatencyPct  *Percentiles `json:"latency_percentiles,omitempty"`
+	MaxGap      float64      `json:"max_gap"` // longest time between two received heartbeats, in seconds
+	Stalls      []*Stall     `json:"stalls,omitempty"`
+	Error       string       `json:"error,omitempty"`
+}
+
+// Stall is a period in which heartbeats took longer than the heartbeat
+// interval to come back, in seconds into publishing
+type Stall struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Late  int     `json:"late_heartbeats"`
+}
+
+// heartbeat publishes a sequence number on its own topic every interval and
+// subscribes to it on the same connection, timing each one against its send time
+type heartbeat struct {
+	cfg       *Config
+	clock     Clock
+	topic     string
+	transport *Transport
+	res       *HeartbeatResults
+	stop      chan bool
+	wg        sync.WaitGroup
+
+	mu      sync.Mutex
+	start   time.Time
+	sent    map[uint32]time.Time
+	latency accumulator
+	digest  *digest
+	last    time.Time // arrival of the latest heartbeat
+	stall   *Stall
+}
+
+func heartbeatTopic(cfg *Config) string {
+	if cfg.HeartbeatTopic != "" {
+		return cfg.HeartbeatTopic
+	}
+	return cfg.Topic + heartbeatSuffix
+}
+
+func newHeartbeat(cfg *Config, clock Clock, localAddr net.IP, certs *certSet) *heartbeat {
+	topic := heartbeatTopic(cfg)
+	return &heartbeat{
+		cfg:       cfg,
+		clock:     clock,
+		topic:     topic,
+		transport: newTransport(cfg, localAddr, certs.pub(0)),
+		res:       &HeartbeatResults{Topic: topic},
+		stop:      make(chan bool),
+		sent:      make(map[uint32]time.Time),
+		digest:    newDigest(),
+	}
+}
+
+// begin connects and sends heartbeats until close, timed from start
+func (h *heartbeat) begin(start time.Time) {
+	h.start = start
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		h.run()
+	}()
+}
+
+// close stops the heartbeats and returns their results
+func (h *heartbeat) close() *HeartbeatResults {
+	close(h.stop)
+	h.wg.Wait()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, sent := range h.sent {
+		if h.clock.Now().Sub(sent) > h.cfg.Heartbeat {
+			h.res.Lost++
+		}
+	}
+	h.res.LatencyMin = h.latency.min
+	h.res.LatencyMax = h.latency.max
+	h.res.LatencyMean = h.latency.mean
+	h.res.LatencyStd = h.latency.std()
+	h.res.LatencyPct = h.digest.percentiles()
+	return h.res
+}
+
+func (h *heartbeat) run() {
+	publish, disconnect, err := h.connect()
+	if err != nil {
+		log.Printf("HEARTBEAT had error connecting to the broker: %v\n", err)
+		h.res.Error = err.Error()
+		return
+	}
+	defer disconnect()
+
+	ticker := h.clock.NewTicker(h.cfg.Heartbeat)
+	defer ticker.Stop()
+	var seq uint32
+	for {
+		select {
+		case <-ticker.C():
+			seq++
+			payload := make([]byte, 4)
+			binary.BigEndian.PutUint32(payload, seq)
+			h.mu.Lock()
+			h.sent[seq] = h.clock.Now()
+			h.res.Sent++
+			h.mu.Unlock()
+			publish(payload)
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+// connect opens the heartbeat connection with the client library of the
+// benchmark clients and subscribes to the heartbeat topic. Heartbeats use
+// QoS 0, so a frozen broker shows up as late heartbeats instead of retries.
+func (h *heartbeat) connect() (func(payload []byte), func(), error) {
+	ka := time.Duration(h.cfg.KeepAlive) * time.Second
+	id := fmt.Sprintf("mqtt-heartbeat-%v", time.Now().UnixNano())
+	if h.cfg.Backend != nil {
+		conn, err := h.cfg.Backend.Connect(&BackendOptions{
+			Broker:    h.cfg.Broker,
+			ClientID:  id,
+			Username:  h.cfg.Username,
+			Password:  h.cfg.Password,
+			KeepAlive: ka,
+			Transport: h.transport,
+			OnMessage: func(topic string, qos byte, payload []byte) { h.received(payload) },
+			OnLost: func(reason error) {
+				log.Printf("HEARTBEAT lost connection to the broker: %v\n", reason.Error())
+			},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := conn.Subscribe(map[string]byte{h.topic: 0}); err != nil {
+			conn.Disconnect()
+			return nil, nil, err
+		}
+		return func(payload []byte) { conn.Publish(h.topic, 0, payload) }, conn.Disconnect, nil
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(h.cfg.Broker).
+		SetClientID(id).
+		SetCleanSession(true).
+		SetAutoReconnect(true).
+		SetKeepAlive(ka).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			client.Subscribe(h.topic, 0, func(client mqtt.Client, msg mqtt.Message) {
+				h.received(msg.Payload())
+			})
+		}).
+		SetConnectionLostHandler(func(client mqtt.Client, reason error) {
+			log.Printf("HEARTBEAT lost connection to the broker: %v. Will reconnect...\n", reason.Error())
+		})
+	if h.cfg.Username != "" && h.cfg.Password != "" {
+		opts.SetUsername(h.cfg.Username)
+		opts.SetPassword(h.cfg.Password)
+	}
+	setTransport(opts, h.cfg.Broker, h.transport)
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return nil, nil, err
+	}
+	return func(payload []byte) { client.Publish(h.topic, 0, false, payload) }, func() { client.Disconnect(250) }, nil
+}
+
+// received times the heartbeat carrying payload and extends or closes the
+// current stall
+func (h *heartbeat) received(payload []byte) {
+	now := h.clock.Now()
+	if len(payload) < 4 {
+		return
+	}
+	seq := binary.BigEndian.Uint32(payload)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sent, ok := h.sent[seq]
+	if !ok {
+		return
+	}
+	delete(h.sent, seq)
+	ms := now.Sub(sent).Seconds() * 1000
+	h.latency.add(ms)
+	h.digest.add(ms)
+	h.res.Received++
+	if !h.last.IsZero() {
+		if gap := now.Sub(h.last).Seconds(); gap > h.res.MaxGap {
+			h.res.MaxGap = gap
+		}
+	}
+	h.last = now
+
+	if now.Sub(sent) <= h.cfg.Heartbeat {
+		h.stall = nil
+		return
+	}
+	start, end := sent.Sub(h.start).Seconds(), now.Sub(h.start).Seconds()
+	if h.stall != nil && start <= h.stall.End {
+		// heartbeats queued behind the same freeze arrive together
+		if end > h.stall.End {
+			h.stall.End = end
+		}
+		h.stall.Late++
+		return
+	}
+	h.stall = &Stall{Start: start, End: end, Late: 1}
+	h.res.Stalls = append(h.res.Stalls, h.stall)
+	if !h.cfg.Quiet {
+		log.Printf("HEARTBEAT late by %.0f ms at %.1f seconds into publishing\n", ms, start)
+	}
+}
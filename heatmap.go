@@ -0,0 +1,75 @@
+package mqttbmlatency
+
+import (
+	"sort"
+	"time"
+)
+
+// defaultHeatmapBounds step 1-2-5 from 0.1ms to 10s
+var defaultHeatmapBounds = []float64{
+	0.1, 0.2, 0.5, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000,
+}
+
+// Heatmap counts forward latencies by arrival time and latency, the matrix
+// behind the classic latency heatmap
+type Heatmap struct {
+	Interval time.Duration // width of a time bucket, default 1s
+	Bounds   []float64     // ascending upper bounds of the latency buckets in milliseconds, default 1-2-5 steps from 0.1ms to 10s
+}
+
+// HeatmapResults hold one row per time bucket, counted from the start of
+// subscribing, and one column per latency bucket. The last column counts the
+// latencies above the last bound.
+type HeatmapResults struct {
+	Interval float64   `json:"interval"` // seconds per row
+	Bounds   []float64 `json:"latency_bounds"`
+	Counts   [][]int64 `json:"counts"`
+}
+
+// heatmap is shared by the subscribers of a run, which count into their own
+// matrices
+type heatmap struct {
+	start    int64 // unix nanos
+	interval time.Duration
+	bounds   []float64
+}
+
+func newHeatmap(h *Heatmap, start time.Time) *heatmap {
+	hm := &heatmap{start: start.UnixNano(), interval: h.Interval, bounds: h.Bounds}
+	if hm.interval <= 0 {
+		hm.interval = time.Second
+	}
+	if len(hm.bounds) == 0 {
+		hm.bounds = defaultHeatmapBounds
+	}
+	return hm
+}
+
+// add counts a latency received at unix nanos recv into counts, growing it as needed
+func (hm *heatmap) add(counts [][]int64, recv int64, latency float64) [][]int64 {
+	row := int(time.Duration(recv-hm.start) / hm.interval)
+	if row < 0 {
+		row = 0
+	}
+	for len(counts) <= row {
+		counts = append(counts, make([]int64, len(hm.bounds)+1))
+	}
+	counts[row][sort.SearchFloat64s(hm.bounds, latency)]++
+	return counts
+}
+
+// results merges the matrices of all subscribers
+func (hm *heatmap) results(subresults []*SubResults) *HeatmapResults {
+	res := &HeatmapResults{Interval: hm.interval.Seconds(), Bounds: hm.bounds}
+	for _, sr := range subresults {
+		for len(res.Counts) < len(sr.heat) {
+			res.Counts = append(res.Counts, make([]int64, len(hm.bounds)+1))
+		}
+		for row, counts := range sr.heat {
+			for col, n := range counts {
+				res.Counts[row][col] += n
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,88 @@
+package mqttbmlatency
+
+// Client roles passed to hooks
+const (
+	RolePublisher  = "pub"
+	RoleSubscriber = "sub"
+)
+
+// Hooks are called by publishers and subscribers as they run, for custom
+// metrics, fault injection or per-message validation. They run on the
+// clients' own goroutines, so they must be safe for concurrent use, and a
+// hook that blocks holds up its client. Any hook may be nil.
+type Hooks struct {
+	// OnConnect is called after every successful connect and reconnect
+	OnConnect func(role string, id int)
+	// OnSubscribe is called once a subscriber's filters were acknowledged,
+	// again after every resubscribe
+	OnSubscribe func(id int, filters map[string]byte)
+	// OnPublish is called once a publish completed or failed, see Message.Error
+	OnPublish func(id int, m *Message)
+	// OnReceive is called with every received payload, after decompression.
+	// A non-nil error counts the message as invalid under ErrInvalid; it is
+	// still timed.
+	OnReceive func(id int, topic string, payload []byte) error
+	// OnError is called for failed connects, subscribes and publishes, lost
+	// connections and invalid messages
+	OnError func(role string, id int, err error)
+}
+
+func (h *Hooks) connect(role string, id int) {
+	if h != nil && h.OnConnect != nil {
+		h.OnConnect(role, id)
+	}
+}
+
+func (h *Hooks) subscribe(id int, filters map[string]byte) {
+	if h != nil && h.OnSubscribe != nil {
+		h.OnSubscribe(id, filters)
+	}
+}
+
+func (h *Hooks) publish(id int, m *Message) {
+	if h != nil && h.OnPublish != nil {
+		h.OnPublish(id, m)
+	}
+}
+
+// receive validates payload, reporting a rejection to OnError as well
+func (h *Hooks) receive(id int, topic string, payload []byte) error {
+	if h == nil || h.OnReceive == nil {
+		return nil
+	}
+	err := h.OnReceive(id, topic, payload)
+	if err != nil {
+		h.fail(RoleSubscriber, id, err)
+	}
+	return err
+}
+
+func (h *Hooks) fail(role string, id int, err error) {
+	if h != nil && h.OnError != nil {
+		h.OnError(role, id, err)
+	}
+}
+
+// connected reports the outcome of the first connect to Connect and the hooks
+func (c *PubClient) connected(err error) {
+	c.life.connected(err)
+	if err != nil {
+		c.Hooks.fail(RolePublisher, c.ID, err)
+	} else {
+		c.conns.connected()
+		c.Hooks.connect(RolePublisher, c.ID)
+	}
+}
+
+// connected reports the outcome of connecting and subscribing to Connect and
+// the hooks
+func (c *SubClient) connected(err error) {
+	c.life.connected(err)
+	if err != nil {
+		c.Hooks.fail(RoleSubscriber, c.ID, err)
+		return
+	}
+	c.conns.connected()
+	c.Hooks.connect(RoleSubscriber, c.ID)
+	c.Hooks.subscribe(c.ID, c.filters())
+}
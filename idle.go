@@ -0,0 +1,88 @@
+package mqttbmlatency
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// idleParallel caps how many idle subscribers connect at once
+const idleParallel = 100
+
+// IdleResults describe the fleet of idle subscribers kept connected during
+// the run, see Config.IdleSubscribers
+type IdleResults struct {
+	Clients         int     `json:"clients"`
+	Connected       int64   `json:"connected"`
+	ConnectFailures int64   `json:"connect_failures,omitempty"`
+	ConnectTime     float64 `json:"connect_time"`   // seconds to connect the whole fleet
+	Lost            int64   `json:"lost,omitempty"` // connections the broker closed before the run ended
+}
+
+// idleFleet holds connections that subscribe to a topic of their own and
+// then do nothing, so the broker keeps their sessions while the active
+// clients are measured
+type idleFleet struct {
+	conns []BackendConn
+	lost  int64 // updated atomically by the connection lost handlers
+	res   *IdleResults
+}
+
+// connectIdle connects and subscribes n idle clients through the minimal
+// client, returning once all of them are connected or failed. Idle client i
+// shares the certificate of subscriber i modulo clients.
+func connectIdle(cfg *Config, n, clients int, localAddr func(int) net.IP, certs *certSet) *idleFleet {
+	f := &idleFleet{conns: make([]BackendConn, n), res: &IdleResults{Clients: n}}
+	start := time.Now()
+	slots := make(chan bool, idleParallel)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		slots <- true
+		go func(i int) {
+			defer func() { <-slots; wg.Done() }()
+			conn, err := MinimalBackend{}.Connect(&BackendOptions{
+				Broker:    cfg.Broker,
+				ClientID:  fmt.Sprintf("mqtt-idle-%v-%v", start.UnixNano(), i),
+				Username:  cfg.Username,
+				Password:  cfg.Password,
+				KeepAlive: time.Duration(cfg.KeepAlive) * time.Second,
+				Transport: newTransport(cfg, localAddr(i), certs.sub(i%clients)),
+				OnMessage: func(topic string, qos byte, payload []byte) {},
+				OnLost:    func(err error) { atomic.AddInt64(&f.lost, 1) },
+			})
+			if err == nil {
+				if err = conn.Subscribe(map[string]byte{fmt.Sprintf("%v/idle/%v", cfg.Topic, i): 0}); err != nil {
+					conn.Disconnect()
+				}
+			}
+			if err != nil {
+				log.Printf("IDLE SUBSCRIBER %v had error connecting to the broker: %v\n", i, err)
+				atomic.AddInt64(&f.res.ConnectFailures, 1)
+				return
+			}
+			f.conns[i] = conn
+			atomic.AddInt64(&f.res.Connected, 1)
+		}(i)
+	}
+	wg.Wait()
+	f.res.ConnectTime = time.Since(start).Seconds()
+	if !cfg.Quiet {
+		log.Printf("%v of %v idle subscribers connected in %v\n", f.res.Connected, n, time.Since(start))
+	}
+	return f
+}
+
+// close disconnects the fleet and returns its results
+func (f *idleFleet) close() *IdleResults {
+	for _, conn := range f.conns {
+		if conn != nil {
+			conn.Disconnect()
+		}
+	}
+	f.res.Lost = atomic.LoadInt64(&f.lost)
+	return f.res
+}
@@ -0,0 +1,65 @@
+package mqttbmlatency
+
+import "strconv"
+
+// parseIngress reads a broker ingress timestamp in unix milliseconds, whole
+// or with a fraction, into unix nanoseconds
+func parseIngress(v string) (int64, bool) {
+	ms, err := strconv.ParseFloat(v, 64)
+	if err != nil || ms <= 0 {
+		return 0, false
+	}
+	return int64(ms * 1e6), true
+}
+
+// addIngress splits the latency of one message at the timestamp the broker
+// stamped it with on arrival, counting messages without a valid one
+func (res *SubResults) addIngress(stamp string, sendTime, recvTime int64) {
+	at, ok := parseIngress(stamp)
+	if !ok {
+		res.Unstamped++
+		return
+	}
+	if res.ingressDigest == nil {
+		res.ingressDigest = newDigest()
+		res.egressDigest = newDigest()
+	}
+	in := float64(at-sendTime) / 1000000 // in milliseconds
+	out := float64(recvTime-at) / 1000000
+	res.ingress.add(in)
+	res.ingressDigest.add(in)
+	res.egress.add(out)
+	res.egressDigest.add(out)
+}
+
+func (res *SubResults) finishIngress() {
+	res.IngressMean = res.ingress.mean
+	res.EgressMean = res.egress.mean
+}
+
+// addIngress totals the split at the broker's ingress timestamp across all
+// subscribers. With a reference broker too, the broker's processing time is
+// what the reference subscribers take beyond the ingress.
+func (b *LatencyBreakdown) addIngress(property string, subresults []*SubResults) {
+	b.IngressProperty = property
+	var ingress, egress accumulator
+	var ingressDigests, egressDigests []*digest
+	for _, res := range subresults {
+		b.Unstamped += res.Unstamped
+		ingress.merge(res.ingress)
+		egress.merge(res.egress)
+		ingressDigests = append(ingressDigests, res.ingressDigest)
+		egressDigests = append(egressDigests, res.egressDigest)
+	}
+	b.Stamped = ingress.count
+	if b.Stamped == 0 {
+		return
+	}
+	b.IngressMean = ingress.mean
+	b.IngressPct = mergeDigests(ingressDigests).percentiles()
+	b.EgressMean = egress.mean
+	b.EgressPct = mergeDigests(egressDigests).percentiles()
+	if b.Reference != "" {
+		b.ProcessingMean = b.BrokerMean - b.IngressMean
+	}
+}
@@ -0,0 +1,95 @@
+package mqttbmlatency
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseIngress(t *testing.T) {
+	tests := []struct {
+		value string
+		at    int64
+		ok    bool
+	}{
+		{"1600000000000", 1600000000000 * 1e6, true},
+		{"1600000000000.5", 1600000000000*1e6 + 500000, true},
+		{"", 0, false},
+		{"0", 0, false},
+		{"-5", 0, false},
+		{"yesterday", 0, false},
+	}
+	for _, tt := range tests {
+		at, ok := parseIngress(tt.value)
+		if ok != tt.ok || (ok && (at-tt.at > 1000 || tt.at-at > 1000)) {
+			t.Errorf("parseIngress(%q) = %v, %v, want %v, %v", tt.value, at, ok, tt.at, tt.ok)
+		}
+	}
+}
+
+func TestIngressSplit(t *testing.T) {
+	const messages = 5
+	tests := []struct {
+		name      string
+		ingress   func(i int) time.Duration // publisher to broker
+		egress    func(i int) time.Duration // broker to subscriber
+		stamp     bool
+		unstamped int64
+	}{
+		{"even", func(int) time.Duration { return 3 * time.Millisecond }, func(int) time.Duration { return 2 * time.Millisecond }, true, 0},
+		{"varying", func(i int) time.Duration { return time.Duration(i+1) * time.Millisecond },
+			func(i int) time.Duration { return time.Duration(2*i+1) * 250 * time.Microsecond }, true, 0},
+		{"unstamped", func(int) time.Duration { return time.Millisecond }, func(int) time.Duration { return time.Millisecond }, false, messages},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			backend := &windowBackend{}
+			c := &SubClient{SubTopic: "split", PubQoS: 1, SubQoS: 1, Quiet: true, Backend: backend, Ingress: "ingress-ts", clock: clock}
+			if err := c.Connect(); err != nil {
+				t.Fatal(err)
+			}
+			if backend.opts.Ingress != "ingress-ts" || backend.opts.OnIngress == nil {
+				t.Fatalf("ingress property %q not requested from the backend", backend.opts.Ingress)
+			}
+			var wantIn, wantOut float64
+			for i := 0; i < messages; i++ {
+				sent := clock.Now()
+				clock.Advance(tt.ingress(i))
+				stamp := ""
+				if tt.stamp {
+					stamp = strconv.FormatFloat(float64(clock.Now().UnixNano())/1e6, 'f', 6, 64)
+				}
+				clock.Advance(tt.egress(i))
+				backend.opts.OnIngress(stamp)
+				backend.opts.OnMessage("split", 1, encodePayload(sent, int64(i), 16, nil))
+				wantIn += float64(tt.ingress(i)) / 1e6 / messages
+				wantOut += float64(tt.egress(i)) / 1e6 / messages
+			}
+			c.Stop()
+			res, err := c.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var b LatencyBreakdown
+			b.addIngress("ingress-ts", []*SubResults{res})
+			if b.Unstamped != tt.unstamped || b.Stamped != messages-tt.unstamped {
+				t.Fatalf("%d stamped, %d unstamped, want %d, %d", b.Stamped, b.Unstamped, messages-tt.unstamped, tt.unstamped)
+			}
+			if !tt.stamp {
+				return
+			}
+			// a stamp in float milliseconds is good to a microsecond
+			if !near(res.IngressMean, wantIn, 1e-3) || !near(res.EgressMean, wantOut, 1e-3) {
+				t.Errorf("ingress, egress means = %v, %v, want %v, %v", res.IngressMean, res.EgressMean, wantIn, wantOut)
+			}
+			// the two legs add up to the forward latency
+			if !near(res.IngressMean+res.EgressMean, res.FwdLatencyMean, 1e-6) {
+				t.Errorf("ingress %v plus egress %v, forward latency %v", res.IngressMean, res.EgressMean, res.FwdLatencyMean)
+			}
+			if !near(b.IngressMean+b.EgressMean, res.FwdLatencyMean, 1e-6) || b.IngressPct == nil || b.EgressPct == nil {
+				t.Errorf("breakdown ingress %v plus egress %v, forward latency %v", b.IngressMean, b.EgressMean, res.FwdLatencyMean)
+			}
+		})
+	}
+}
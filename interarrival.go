@@ -0,0 +1,44 @@
+package mqttbmlatency
+
+import "time"
+
+// addGap records the time between two received messages, in milliseconds
+func (res *SubResults) addGap(gap float64, stall time.Duration) {
+	if res.gapDigest == nil {
+		res.gapDigest = newDigest()
+	}
+	res.gaps.add(gap)
+	res.gapDigest.add(gap)
+	if gap > stall.Seconds()*1000 {
+		res.Stalls++
+	}
+}
+
+// finishGaps fills in the inter-arrival statistics of res
+func (res *SubResults) finishGaps() {
+	if res.gaps.count == 0 {
+		return
+	}
+	res.GapMean = res.gaps.mean
+	res.GapMax = res.gaps.max
+	res.GapPct = res.gapDigest.percentiles()
+}
+
+// calculateInterArrival totals the gaps between received messages across
+// all subscribers
+func calculateInterArrival(subtotals *TotalSubResults, subresults []*SubResults) {
+	var gaps accumulator
+	var digests []*digest
+	for _, res := range subresults {
+		gaps.merge(res.gaps)
+		if res.gapDigest != nil {
+			digests = append(digests, res.gapDigest)
+		}
+		subtotals.Stalls += res.Stalls
+	}
+	if gaps.count > 0 {
+		subtotals.GapMean = gaps.mean
+		subtotals.GapMax = gaps.max
+		subtotals.GapPct = mergeDigests(digests).percentiles()
+	}
+}
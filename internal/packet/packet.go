@@ -0,0 +1,88 @@
+// Package packet encodes and decodes the parts of MQTT 3.1.1 packets shared by
+// the built-in client, the ping probes and the embedded broker: the remaining
+// length of the fixed header and length-prefixed strings.
+package packet
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	errMalformedLength = errors.New("malformed remaining length")
+	errMalformedString = errors.New("malformed string")
+)
+
+// Reader is read from byte by byte for the fixed header and in bulk for the body
+type Reader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// Read reads one packet, returning its first header byte and its body
+func Read(r Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := ReadLength(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// ReadLength reads the variable length remaining length of a fixed header
+func ReadLength(r io.ByteReader) (int, error) {
+	n, shift := 0, uint(0)
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		n |= int(b&0x7F) << shift
+		if b&0x80 == 0 {
+			return n, nil
+		}
+		shift += 7
+	}
+	return 0, errMalformedLength
+}
+
+// AppendLength appends n encoded as a remaining length
+func AppendLength(b []byte, n int) []byte {
+	for {
+		d := byte(n & 0x7F)
+		n >>= 7
+		if n > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+// AppendString appends s with its two byte length prefix
+func AppendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// ReadString returns the length-prefixed string at the start of b and the
+// bytes after it
+func ReadString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errMalformedString
+	}
+	n := int(b[0])<<8 | int(b[1])
+	if len(b) < 2+n {
+		return "", nil, errMalformedString
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
@@ -0,0 +1,74 @@
+package packet
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestLength(t *testing.T) {
+	tests := []struct {
+		n       int
+		encoded []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7F}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xFF, 0x7F}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{268435455, []byte{0xFF, 0xFF, 0xFF, 0x7F}},
+	}
+	for _, tt := range tests {
+		if got := AppendLength(nil, tt.n); !bytes.Equal(got, tt.encoded) {
+			t.Errorf("AppendLength(%d) = %x, want %x", tt.n, got, tt.encoded)
+		}
+		if got, err := ReadLength(bytes.NewReader(tt.encoded)); err != nil || got != tt.n {
+			t.Errorf("ReadLength(%x) = %d, %v, want %d", tt.encoded, got, err, tt.n)
+		}
+	}
+	if _, err := ReadLength(bytes.NewReader([]byte{0x80, 0x80, 0x80, 0x80, 0x01})); err != errMalformedLength {
+		t.Errorf("five length bytes: %v, want %v", err, errMalformedLength)
+	}
+	if _, err := ReadLength(bytes.NewReader([]byte{0x80})); err != io.EOF {
+		t.Errorf("truncated length: %v, want EOF", err)
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want string
+		rest []byte
+		err  error
+	}{
+		{"empty", []byte{0, 0}, "", []byte{}, nil},
+		{"with rest", []byte{0, 2, 'a', '/', 9}, "a/", []byte{9}, nil},
+		{"short prefix", []byte{0}, "", nil, errMalformedString},
+		{"short string", []byte{0, 3, 'a'}, "", nil, errMalformedString},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, rest, err := ReadString(tt.in)
+			if s != tt.want || !bytes.Equal(rest, tt.rest) || err != tt.err {
+				t.Errorf("ReadString = %q, %x, %v, want %q, %x, %v", s, rest, err, tt.want, tt.rest, tt.err)
+			}
+			if err == nil && !bytes.Equal(AppendString(nil, s), tt.in[:len(tt.in)-len(rest)]) {
+				t.Errorf("AppendString(%q) = %x", s, AppendString(nil, s))
+			}
+		})
+	}
+}
+
+func TestRead(t *testing.T) {
+	body := bytes.Repeat([]byte{7}, 200)
+	pkt := append(AppendLength([]byte{0x30}, len(body)), body...)
+	header, got, err := Read(bufio.NewReader(bytes.NewReader(append(pkt, 0xC0, 0x00))))
+	if err != nil || header != 0x30 || !bytes.Equal(got, body) {
+		t.Errorf("Read = %x, %d bytes, %v", header, len(got), err)
+	}
+	if _, _, err := Read(bytes.NewReader(pkt[:100])); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated body: %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
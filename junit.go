@@ -0,0 +1,140 @@
+package mqttbmlatency
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type junitSuites struct {
+	XMLName xml.Name      `xml:"testsuites"`
+	Suites  []*junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name       string           `xml:"name,attr"`
+	Tests      int              `xml:"tests,attr"`
+	Failures   int              `xml:"failures,attr"`
+	Time       float64          `xml:"time,attr"`
+	Properties []*junitProperty `xml:"properties>property,omitempty"` // the run labels
+	Cases      []*junitCase     `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+}
+
+func (s *junitSuite) add(name string, seconds float64, failure string, kind string) {
+	tc := &junitCase{Name: name, Classname: s.Name, Time: seconds}
+	if failure != "" {
+		tc.Failure = &junitFailure{Message: failure, Type: kind}
+		s.Failures++
+	}
+	s.Tests++
+	s.Cases = append(s.Cases, tc)
+}
+
+// JUnit renders the results as JUnit XML so CI servers show regressions in
+// their test views. Every SLA limit and every client run is a test case: a
+// publisher fails on failed publishes, a subscriber on lost or reordered
+// messages.
+func (jr *JSONResults) JUnit() []byte {
+	return marshalJUnit(jr.junitSuites(""))
+}
+
+// JUnit renders every run as its own set of test suites
+func (rr *RepeatResults) JUnit() []byte {
+	var suites []*junitSuite
+	for i, jr := range rr.Runs {
+		suites = append(suites, jr.junitSuites("run "+strconv.Itoa(i+1)+" ")...)
+	}
+	return marshalJUnit(suites)
+}
+
+// JUnit renders the test suites of every measurement of the search
+func (cr *CapacityResults) JUnit() []byte {
+	var suites []*junitSuite
+	for i, s := range cr.Steps {
+		suites = append(suites, s.Results.junitSuites("step "+strconv.Itoa(i+1)+" ")...)
+	}
+	return marshalJUnit(suites)
+}
+
+// JUnit renders the test suites of every broker, named after the broker
+func (cr *CompareResults) JUnit() []byte {
+	var suites []*junitSuite
+	for _, br := range cr.Runs {
+		suites = append(suites, br.Results.junitSuites(br.Broker+" ")...)
+	}
+	return marshalJUnit(suites)
+}
+
+func (jr *JSONResults) junitSuites(prefix string) []*junitSuite {
+	var suites []*junitSuite
+	runTime := jr.PubTotals.TotalRunTime
+
+	if len(jr.SLA) > 0 || jr.Aborted {
+		sla := &junitSuite{Name: prefix + "sla", Time: runTime}
+		if jr.Aborted {
+			sla.add("completed", runTime, "run aborted: "+jr.Reason, "aborted")
+		}
+		for _, c := range jr.SLA {
+			failure := ""
+			if !c.Passed {
+				failure = fmt.Sprintf("%v is %.4g, limit %.4g", c.Name, c.Value, c.Limit)
+			}
+			sla.add(c.Name, runTime, failure, "sla")
+		}
+		suites = append(suites, sla)
+	}
+
+	pubs := &junitSuite{Name: prefix + "publishers", Time: runTime}
+	for _, r := range jr.PubRuns {
+		failure := ""
+		if r.Failures > 0 {
+			failure = fmt.Sprintf("%v of %v publishes failed", r.Failures, r.Successes+r.Failures)
+		} else if r.Successes == 0 {
+			failure = "nothing was published"
+		}
+		pubs.add("publisher "+strconv.Itoa(r.ID), r.RunTime, failure, "publish")
+	}
+	subs := &junitSuite{Name: prefix + "subscribers", Time: runTime}
+	for _, r := range jr.SubRuns {
+		failure := ""
+		if r.Received < r.Published {
+			failure = fmt.Sprintf("received %v of %v messages", r.Received, r.Published)
+		} else if r.OutOfOrder > 0 {
+			failure = fmt.Sprintf("%v messages arrived out of publish order", r.OutOfOrder)
+		} else if len(r.Errors) > 0 {
+			failure = "subscriber could not connect or subscribe"
+		}
+		subs.add("subscriber "+strconv.Itoa(r.ID), runTime, failure, "forward")
+	}
+	suites = append(suites, pubs, subs)
+	for _, s := range suites {
+		for _, kv := range labelList(jr.Labels) {
+			k, v, _ := strings.Cut(kv, "=")
+			s.Properties = append(s.Properties, &junitProperty{Name: k, Value: v})
+		}
+	}
+	return suites
+}
+
+func marshalJUnit(suites []*junitSuite) []byte {
+	data, _ := xml.MarshalIndent(&junitSuites{Suites: suites}, "", "  ")
+	return append([]byte(xml.Header), data...)
+}
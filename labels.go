@@ -0,0 +1,41 @@
+package mqttbmlatency
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// labelList returns the labels as sorted key=value pairs
+func labelList(labels map[string]string) []string {
+	list := make([]string, 0, len(labels))
+	for k, v := range labels {
+		list = append(list, k+"="+v)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// validateLabels keeps labels usable as DogStatsD tags and in key=value lists
+func validateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if k == "" || strings.ContainsAny(k, "=") {
+			return errors.New("label keys must not be empty or contain '='")
+		}
+		if strings.ContainsAny(k+v, ",|#\n") {
+			return errors.New("labels must not contain ',', '|', '#' or line breaks")
+		}
+	}
+	return nil
+}
+
+// mdLabels writes the labels and latency unit lines of a Markdown report
+func mdLabels(b *bytes.Buffer, labels map[string]string, unit string) {
+	if len(labels) > 0 {
+		b.WriteString("**Labels:** `" + strings.Join(labelList(labels), "`, `") + "`\n\n")
+	}
+	if unit != "" {
+		b.WriteString("Latencies in " + unit + ".\n\n")
+	}
+}
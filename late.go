@@ -0,0 +1,71 @@
+package mqttbmlatency
+
+import "sync/atomic"
+
+// Late window states of a subscriber
+const (
+	lateNone   = iota // measuring
+	lateWindow        // past the cutoff, counting late messages
+	lateClosed        // results handed on, ignoring messages still in flight
+)
+
+// cutoff ends the measurement window of the subscriber: messages arriving
+// from now on are counted as late instead of received
+func (c *SubClient) cutoff() {
+	atomic.StoreInt32(&c.late, lateWindow)
+}
+
+func (c *SubClient) pastCutoff() bool {
+	return atomic.LoadInt32(&c.late) != lateNone
+}
+
+// recordLate adds a late message to res unless the results were closed. The
+// handler may still be running when the client disconnects.
+func (c *SubClient) recordLate(res *SubResults, latency float64) {
+	c.lateMu.Lock()
+	defer c.lateMu.Unlock()
+	if atomic.LoadInt32(&c.late) == lateWindow {
+		res.addLate(latency)
+	}
+}
+
+// closeLate stops recordLate from touching the results
+func (c *SubClient) closeLate() {
+	c.lateMu.Lock()
+	defer c.lateMu.Unlock()
+	if atomic.LoadInt32(&c.late) == lateWindow {
+		atomic.StoreInt32(&c.late, lateClosed)
+	}
+}
+
+// addLate records a message that arrived after the cutoff
+func (res *SubResults) addLate(latency float64) {
+	if res.lateDigest == nil {
+		res.lateDigest = newDigest()
+	}
+	res.late.add(latency)
+	res.lateDigest.add(latency)
+	res.Late = res.late.count
+}
+
+// calculateLateResults totals the late messages of all subscribers. Messages
+// that were neither received in time nor late are lost.
+func calculateLateResults(subtotals *TotalSubResults, subresults []*SubResults) {
+	var late accumulator
+	var digests []*digest
+	for _, res := range subresults {
+		late.merge(res.late)
+		if res.lateDigest != nil {
+			digests = append(digests, res.lateDigest)
+		}
+	}
+	subtotals.Late = late.count
+	if late.count > 0 {
+		subtotals.LateLatencyMean = late.mean
+		subtotals.LateLatencyMax = late.max
+		subtotals.LateLatencyPct = mergeDigests(digests).percentiles()
+	}
+	if lost := subtotals.TotalPublished - subtotals.TotalReceived - subtotals.Late; lost > 0 {
+		subtotals.Lost = lost
+	}
+}
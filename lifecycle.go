@@ -0,0 +1,147 @@
+package mqttbmlatency
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// lifecycle is the state of a client driven through its exported
+// Connect, Run, Stop and Results methods instead of by a benchmark run
+type lifecycle struct {
+	ready    chan error // connect outcome
+	start    chan bool  // closed by Run
+	stop     chan bool  // closed by Stop
+	stopOnce sync.Once
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{
+		ready: make(chan error, 1),
+		start: make(chan bool),
+		stop:  make(chan bool),
+	}
+}
+
+// connected reports the outcome of connecting to Connect
+func (l *lifecycle) connected(err error) {
+	if l != nil {
+		l.ready <- err
+	}
+}
+
+// wait blocks until Run or Stop was called
+func (l *lifecycle) wait() {
+	if l == nil {
+		return
+	}
+	select {
+	case <-l.start:
+	case <-l.stop:
+	}
+}
+
+func (l *lifecycle) stopped() bool {
+	if l == nil {
+		return false
+	}
+	select {
+	case <-l.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *lifecycle) close() {
+	l.stopOnce.Do(func() { close(l.stop) })
+}
+
+var errNotConnected = errors.New("client is not connected, call Connect first")
+
+// Connect connects the publisher to its broker, retrying as its Backoff
+// allows, and returns once it is ready to publish. After a failed Connect,
+// Run still completes and reports every message as failed.
+func (c *PubClient) Connect() error {
+	c.life = newLifecycle()
+	c.resCh = make(chan *PubResults, 1)
+	go c.run(c.resCh)
+	return <-c.life.ready
+}
+
+// Run publishes MsgCount messages, or for Duration, and returns the results
+// once every publish completed. Stop ends it early. Run may be called once.
+func (c *PubClient) Run() (*PubResults, error) {
+	if c.life == nil {
+		return nil, errNotConnected
+	}
+	close(c.life.start)
+	c.results = <-c.resCh
+	return c.results, nil
+}
+
+// Stop stops generating messages; Run returns once the publishes in flight
+// completed. It may be called from any goroutine, and more than once.
+func (c *PubClient) Stop() {
+	if c.life != nil {
+		c.life.close()
+	}
+}
+
+// Results returns the results of the finished Run, nil before
+func (c *PubClient) Results() *PubResults {
+	return c.results
+}
+
+// halted reports whether the generator should stop early
+func (c *PubClient) halted() bool {
+	return c.abort.aborted() || c.life.stopped()
+}
+
+// Connect connects the subscriber to its broker and subscribes, returning
+// once messages are being received
+func (c *SubClient) Connect() error {
+	c.life = newLifecycle()
+	c.resCh = make(chan *SubResults, 1)
+	go c.run(c.resCh, make(chan bool, 1), c.life.stop)
+	return <-c.life.ready
+}
+
+// Run receives messages until Stop is called, then disconnects and returns
+// the results
+func (c *SubClient) Run() (*SubResults, error) {
+	if c.life == nil {
+		return nil, errNotConnected
+	}
+	c.results = <-c.resCh
+	return c.results, nil
+}
+
+// Stop ends receiving; Run returns the results. It may be called from any
+// goroutine, and more than once.
+func (c *SubClient) Stop() {
+	if c.life != nil {
+		c.life.close()
+	}
+}
+
+// Results returns the results of the finished Run, nil before
+func (c *SubClient) Results() *SubResults {
+	return c.results
+}
+
+// subscribeError summarizes why a subscriber could not connect or subscribe
+// from the error classes in its results, nil if there are none
+func subscribeError(id int, errs ErrorCounts) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	classes := make([]string, 0, len(errs))
+	for class := range errs {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	return fmt.Errorf("subscriber %v failed to connect or subscribe: %v", id, strings.Join(classes, ", "))
+}
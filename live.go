@@ -0,0 +1,168 @@
+package mqttbmlatency
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// errNotPublishing is returned for settings sent before a run started
+// publishing or after it finished
+var errNotPublishing = errors.New("benchmark is not publishing")
+
+// LiveSettings change a running benchmark without restarting its clients,
+// see Server. Fields left out keep their value.
+type LiveSettings struct {
+	Rate *float64 `json:"rate,omitempty"` // total messages per second across all publishers, 0 for no limit
+	Size *int     `json:"size,omitempty"` // payload size in bytes
+}
+
+// liveControls carry settings changed through the server into the runs of
+// one job. Changes hold for the rest of the job, including later repeats, and
+// reach every run publishing at the time, such as concurrent broker comparisons.
+type liveControls struct {
+	size int64 // payload size, -1 while unchanged, accessed atomically
+
+	mu      sync.Mutex
+	runs    []*liveRun // attached runs, in the order they started publishing
+	rate    float64
+	rateSet bool
+}
+
+// liveRun is the state of one publishing run the controls act on
+type liveRun struct {
+	cfg     *Config
+	limiter *rateLimiter // shared by all publishers of the run
+	sizes   *sizeCheck
+	soak    *soakMonitor // receives a marker for every change
+}
+
+func newLiveControls() *liveControls {
+	return &liveControls{size: -1}
+}
+
+// tunesRate tells whether cfg leaves the rate to a shared limiter that live
+// settings may change
+func tunesRate(cfg *Config) bool {
+	if len(cfg.Stages) > 0 || cfg.ReplayFile != "" {
+		return false
+	}
+	for _, t := range cfg.Tenants {
+		if t.Rate > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// attach makes the controls act on a run that is about to publish
+func (l *liveControls) attach(cfg *Config, limiter *rateLimiter, sizes *sizeCheck, soak *soakMonitor) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.runs = append(l.runs, &liveRun{cfg: cfg, limiter: limiter, sizes: sizes, soak: soak})
+	if l.rateSet && limiter != nil {
+		limiter.setRate(l.rate)
+	}
+	if n := atomic.LoadInt64(&l.size); n >= 0 {
+		sizes.allow(int(n))
+	}
+}
+
+// detach ends the run of cfg; changes are rejected while no run is attached
+func (l *liveControls) detach(cfg *Config) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, r := range l.runs {
+		if r.cfg == cfg {
+			l.runs = append(l.runs[:i], l.runs[i+1:]...)
+			return
+		}
+	}
+}
+
+// apply changes the settings of the attached runs and returns them
+func (l *liveControls) apply(s *LiveSettings) (*LiveSettings, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.runs) == 0 {
+		return nil, errNotPublishing
+	}
+	if s.Rate != nil && *s.Rate < 0 {
+		return nil, errors.New("the rate must not be negative")
+	}
+	if s.Size != nil && *s.Size < 0 {
+		return nil, errors.New("the size must not be negative")
+	}
+	// checked for every run before any changes, so all runs agree
+	for _, r := range l.runs {
+		if s.Rate != nil && r.limiter == nil {
+			return nil, errors.New("load profiles, replays and tenant rates set the rate themselves")
+		}
+		if s.Size != nil && (r.cfg.SizeDist != nil || r.cfg.ReplayFile != "") {
+			return nil, errors.New("size distributions and replays set the size themselves")
+		}
+	}
+
+	if s.Rate != nil {
+		l.rate, l.rateSet = *s.Rate, true
+		for _, r := range l.runs {
+			r.limiter.setRate(l.rate)
+		}
+		l.changed(fmt.Sprintf("rate %v/s", l.rate))
+	}
+	if s.Size != nil {
+		// allowed before publishers switch, so no subscriber sees a mismatch
+		for _, r := range l.runs {
+			r.sizes.allow(*s.Size)
+		}
+		atomic.StoreInt64(&l.size, int64(*s.Size))
+		l.changed(fmt.Sprintf("size %vB", *s.Size))
+	}
+	return l.current(), nil
+}
+
+// changed must be called with the lock held
+func (l *liveControls) changed(marker string) {
+	for _, r := range l.runs {
+		r.soak.mark(marker)
+	}
+	if !l.runs[0].cfg.Quiet {
+		log.Printf("LIVE %v\n", marker)
+	}
+}
+
+// current must be called with the lock held; the runs of a job only differ
+// in their broker, so the first one speaks for all
+func (l *liveControls) current() *LiveSettings {
+	cfg := l.runs[0].cfg
+	s := new(LiveSettings)
+	if l.rateSet {
+		rate := l.rate
+		s.Rate = &rate
+	} else if cfg.GlobalRate > 0 {
+		rate := cfg.GlobalRate
+		s.Rate = &rate
+	}
+	size := l.sizeOr(cfg.Size)
+	s.Size = &size
+	return s
+}
+
+// sizeOr returns the changed payload size, or size while it is unchanged
+func (l *liveControls) sizeOr(size int) int {
+	if l == nil {
+		return size
+	}
+	if n := atomic.LoadInt64(&l.size); n >= 0 {
+		return int(n)
+	}
+	return size
+}
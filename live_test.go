@@ -0,0 +1,56 @@
+package mqttbmlatency
+
+import (
+	"testing"
+	"time"
+)
+
+// TestLiveControlsConcurrentRuns changes two runs of one job publishing at
+// the same time, as a concurrent broker comparison does
+func TestLiveControlsConcurrentRuns(t *testing.T) {
+	l := newLiveControls()
+	clock := systemClock{}
+	first, second := &Config{Broker: "tcp://a:1883", Size: 64}, &Config{Broker: "tcp://b:1883", Size: 64}
+	firstLimiter, secondLimiter := newRateLimiter(clock, 0, 0), newRateLimiter(clock, 0, 0)
+	firstSizes, secondSizes := newSizeCheck(64, nil, nil), newSizeCheck(64, nil, nil)
+	l.attach(first, firstLimiter, firstSizes, nil)
+	l.attach(second, secondLimiter, secondSizes, nil)
+
+	rate, size := 100.0, 128
+	current, err := l.apply(&LiveSettings{Rate: &rate, Size: &size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *current.Rate != rate || *current.Size != size {
+		t.Errorf("current settings %v/s and %vB, want %v/s and %vB", *current.Rate, *current.Size, rate, size)
+	}
+	want := float64(time.Second) / rate
+	for i, limiter := range []*rateLimiter{firstLimiter, secondLimiter} {
+		if limiter.interval != want {
+			t.Errorf("run %d publishes every %vns, want %vns", i, limiter.interval, want)
+		}
+	}
+	for i, sizes := range []*sizeCheck{firstSizes, secondSizes} {
+		if mismatch, _ := sizes.check(size); mismatch {
+			t.Errorf("run %d does not accept %vB payloads", i, size)
+		}
+	}
+
+	// the second run keeps publishing after the first one finished
+	l.detach(first)
+	rate = 50
+	if _, err := l.apply(&LiveSettings{Rate: &rate}); err != nil {
+		t.Fatal(err)
+	}
+	if want := float64(time.Second) / rate; secondLimiter.interval != want {
+		t.Errorf("second run publishes every %vns, want %vns", secondLimiter.interval, want)
+	}
+	if firstLimiter.interval == secondLimiter.interval {
+		t.Error("the finished run was changed")
+	}
+
+	l.detach(second)
+	if _, err := l.apply(&LiveSettings{Rate: &rate}); err != errNotPublishing {
+		t.Errorf("settings without runs: %v, want %v", err, errNotPublishing)
+	}
+}
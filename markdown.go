@@ -0,0 +1,187 @@
+package mqttbmlatency
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// Markdown renders the results as GitHub-flavored Markdown tables, for pasting
+// into pull requests and issues. Latencies are in milliseconds.
+func (jr *JSONResults) Markdown() []byte {
+	var b bytes.Buffer
+	b.WriteString("## Benchmark results\n\n")
+	mdLabels(&b, jr.Labels, jr.Unit)
+	if jr.Aborted {
+		fmt.Fprintf(&b, "**Aborted:** %v\n\n", jr.Reason)
+	}
+	b.WriteString("| msgs/s | published | failed | received | loss | pub mean | fwd mean | fwd p50 | fwd p99 |\n")
+	b.WriteString("|---:|---:|---:|---:|---:|---:|---:|---:|---:|\n")
+	pub, sub := jr.PubTotals, jr.SubTotals
+	fmt.Fprintf(&b, "| %.1f | %v | %v | %v | %v | %.3f | %.3f | %v | %v |\n",
+		pub.TotalMsgsPerSec, pub.Successes, pub.Failures, sub.TotalReceived, mdLoss(sub.TotalFwdRatio),
+		pub.PubTimeMeanAvg, sub.FwdLatencyMeanAvg, mdPct(sub.FwdLatencyPct, 50), mdPct(sub.FwdLatencyPct, 99))
+
+	if len(jr.SLA) > 0 {
+		b.WriteString("\n### SLA\n\n")
+		b.WriteString("| check | limit | value | result |\n")
+		b.WriteString("|---|---:|---:|---|\n")
+		for _, c := range jr.SLA {
+			result := "pass"
+			if !c.Passed {
+				result = "**FAIL**"
+			}
+			fmt.Fprintf(&b, "| %v | %.3f | %.3f | %v |\n", c.Name, c.Limit, c.Value, result)
+		}
+	}
+	if len(jr.StageRuns) > 0 {
+		b.WriteString("\n### Stages\n\n")
+		b.WriteString("| stage | target rate | duration (s) | published | received | loss | pub mean | fwd mean | fwd max |\n")
+		b.WriteString("|---:|---:|---:|---:|---:|---:|---:|---:|---:|\n")
+		for _, st := range jr.StageRuns {
+			fmt.Fprintf(&b, "| %v | %.1f | %.1f | %v | %v | %v | %.3f | %.3f | %.3f |\n",
+				st.Stage, st.Rate, st.Duration, st.Published, st.Received, mdLoss(st.FwdRatio),
+				st.PubTimeMean, st.FwdLatencyMean, st.FwdLatencyMax)
+		}
+	}
+	if len(jr.QoSRuns) > 0 {
+		b.WriteString("\n### QoS levels\n\n")
+		b.WriteString("| QoS | clients | msgs/s | published | failed | received | loss | pub mean | fwd mean | fwd p50 | fwd p99 |\n")
+		b.WriteString("|---:|---:|---:|---:|---:|---:|---:|---:|---:|---:|---:|\n")
+		for _, q := range jr.QoSRuns {
+			pub, sub := q.PubTotals, q.SubTotals
+			if sub == nil {
+				sub = &TotalSubResults{}
+			}
+			fmt.Fprintf(&b, "| %v | %v | %.1f | %v | %v | %v | %v | %.3f | %.3f | %v | %v |\n",
+				q.QoS, q.Clients, pub.TotalMsgsPerSec, pub.Successes, pub.Failures, sub.TotalReceived, mdLoss(sub.TotalFwdRatio),
+				pub.PubTimeMeanAvg, sub.FwdLatencyMeanAvg, mdPct(sub.FwdLatencyPct, 50), mdPct(sub.FwdLatencyPct, 99))
+		}
+	}
+	if len(jr.Tenants) > 0 {
+		b.WriteString("\n### Tenants\n\n")
+		b.WriteString("| tenant | clients | msgs/s | published | failed | received | loss | pub mean | fwd mean | fwd p50 | fwd p99 |\n")
+		b.WriteString("|---|---:|---:|---:|---:|---:|---:|---:|---:|---:|---:|\n")
+		for _, t := range jr.Tenants {
+			pub, sub := t.PubTotals, t.SubTotals
+			fmt.Fprintf(&b, "| %v | %v | %.1f | %v | %v | %v | %v | %.3f | %.3f | %v | %v |\n",
+				t.Tenant, t.Clients, pub.TotalMsgsPerSec, pub.Successes, pub.Failures, sub.TotalReceived, mdLoss(sub.TotalFwdRatio),
+				pub.PubTimeMeanAvg, sub.FwdLatencyMeanAvg, mdPct(sub.FwdLatencyPct, 50), mdPct(sub.FwdLatencyPct, 99))
+		}
+	}
+	if len(jr.SizeRuns) > 0 {
+		b.WriteString("\n### Message sizes\n\n")
+		b.WriteString("| size (bytes) | published | received | loss | pub mean | fwd mean | fwd max |\n")
+		b.WriteString("|---:|---:|---:|---:|---:|---:|---:|\n")
+		for _, sr := range jr.SizeRuns {
+			fmt.Fprintf(&b, "| %v-%v | %v | %v | %v | %.3f | %.3f | %.3f |\n",
+				sr.MinSize, sr.MaxSize, sr.Published, sr.Received, mdLoss(sr.FwdRatio),
+				sr.PubTimeMean, sr.FwdLatencyMean, sr.FwdLatencyMax)
+		}
+	}
+	if len(jr.Agents) > 0 {
+		b.WriteString("\n### Agents\n\n")
+		b.WriteString("| agent | heartbeats | last seen (s) | status |\n")
+		b.WriteString("|---|---:|---:|---|\n")
+		for _, a := range jr.Agents {
+			status := "reported"
+			if !a.Reported {
+				status = "**MISSING**: " + a.Error
+			}
+			fmt.Fprintf(&b, "| %v | %v | %.1f | %v |\n", a.Topic, a.Heartbeats, a.LastSeen, status)
+		}
+	}
+	return b.Bytes()
+}
+
+// Markdown renders the summary across runs followed by one row per run
+func (rr *RepeatResults) Markdown() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "## Benchmark results, %v runs\n\n", rr.Summary.Runs)
+	mdLabels(&b, rr.Labels, rr.Unit)
+	b.WriteString("| metric | mean | std | best | worst | 95% CI |\n")
+	b.WriteString("|---|---:|---:|---:|---:|---:|\n")
+	for _, row := range []struct {
+		name string
+		rs   *RunStats
+	}{
+		{"msgs/s", rr.Summary.MsgsPerSec},
+		{"pub mean", rr.Summary.PubTime},
+		{"fwd mean", rr.Summary.FwdLatency},
+		{"fwd ratio", rr.Summary.FwdRatio},
+	} {
+		ci := "-"
+		if row.rs.CI != nil {
+			ci = fmt.Sprintf("%.3f-%.3f", row.rs.CI.Low, row.rs.CI.High)
+		}
+		fmt.Fprintf(&b, "| %v | %.3f | %.3f | %.3f | %.3f | %v |\n",
+			row.name, row.rs.Mean, row.rs.Std, row.rs.Best, row.rs.Worst, ci)
+	}
+
+	b.WriteString("\n### Runs\n\n")
+	b.WriteString("| run | msgs/s | published | received | loss | pub mean | fwd mean | fwd p50 | fwd p99 |\n")
+	b.WriteString("|---:|---:|---:|---:|---:|---:|---:|---:|---:|\n")
+	for i, jr := range rr.Runs {
+		pub, sub := jr.PubTotals, jr.SubTotals
+		fmt.Fprintf(&b, "| %v | %.1f | %v | %v | %v | %.3f | %.3f | %v | %v |\n",
+			i+1, pub.TotalMsgsPerSec, pub.Successes, sub.TotalReceived, mdLoss(sub.TotalFwdRatio),
+			pub.PubTimeMeanAvg, sub.FwdLatencyMeanAvg, mdPct(sub.FwdLatencyPct, 50), mdPct(sub.FwdLatencyPct, 99))
+	}
+	return b.Bytes()
+}
+
+// Markdown renders the capacity found followed by one row per measurement
+func (cr *CapacityResults) Markdown() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "## Capacity search, %.1f msgs/s sustained\n\n", cr.Capacity)
+	mdLabels(&b, cr.Labels, cr.Unit)
+	b.WriteString("| step | target msgs/s | msgs/s | loss | pub p99 | fwd p50 | fwd p99 | passed |\n")
+	b.WriteString("|---:|---:|---:|---:|---:|---:|---:|---|\n")
+	for i, s := range cr.Steps {
+		pub, sub := s.Results.PubTotals, s.Results.SubTotals
+		fmt.Fprintf(&b, "| %v | %.1f | %.1f | %v | %v | %v | %v | %v |\n",
+			i+1, s.Rate, s.MsgsPerSec, mdLoss(sub.TotalFwdRatio), mdPct(pub.PubTimePct, 99),
+			mdPct(sub.FwdLatencyPct, 50), mdPct(sub.FwdLatencyPct, 99), s.Passed)
+	}
+	return b.Bytes()
+}
+
+// Markdown renders the side-by-side comparison of the brokers
+func (cr *CompareResults) Markdown() []byte {
+	var b bytes.Buffer
+	b.WriteString("## Broker comparison\n\n")
+	mdLabels(&b, cr.Labels, cr.Unit)
+	b.WriteString("| broker | msgs/s | publish ratio | loss | pub mean | fwd mean | fwd p50 | fwd p99 | connect mean |\n")
+	b.WriteString("|---|---:|---:|---:|---:|---:|---:|---:|---:|\n")
+	for _, s := range cr.Comparison {
+		broker := "`" + s.Broker + "`"
+		if s.Aborted {
+			broker += " (aborted)"
+		}
+		fmt.Fprintf(&b, "| %v | %.1f | %.3f | %v | %.3f | %.3f | %.3f | %.3f | %.3f |\n",
+			broker, s.MsgsPerSec, s.PubRatio, mdLoss(s.FwdRatio), s.PubTimeMean, s.FwdLatencyMean,
+			s.FwdLatencyP50, s.FwdLatencyP99, s.ConnectTimeMean)
+	}
+	return b.Bytes()
+}
+
+// mdLoss formats the share of messages not forwarded as a percentage
+func mdLoss(fwdRatio float64) string {
+	loss := 1 - fwdRatio
+	if loss < 0 {
+		loss = 0
+	}
+	return strconv.FormatFloat(loss*100, 'f', 2, 64) + "%"
+}
+
+// mdPct formats percentile q of p, or a dash if there were no samples
+func mdPct(p *Percentiles, q int) string {
+	if p == nil {
+		return "-"
+	}
+	v := p.P50
+	if q == 99 {
+		v = p.P99
+	}
+	return strconv.FormatFloat(v, 'f', 3, 64)
+}
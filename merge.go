@@ -0,0 +1,183 @@
+package mqttbmlatency
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ClientDigests are the latency digests of one client, included in the
+// results with Config.ExportDigests so that MergeResults can combine the
+// percentiles of several shards exactly
+type ClientDigests struct {
+	Latency *DigestData `json:"latency,omitempty"` // publish time or forward latency
+	Ack     *DigestData `json:"ack,omitempty"`
+	RTT     *DigestData `json:"rtt,omitempty"`
+}
+
+// DigestData is a t-digest as its centroids, pairs of mean and weight, in
+// milliseconds whatever Config.LatencyUnit says
+type DigestData struct {
+	Count     float64      `json:"count"`
+	Min       float64      `json:"min"`
+	Max       float64      `json:"max"`
+	Centroids [][2]float64 `json:"centroids"`
+}
+
+func (d *digest) export() *DigestData {
+	if d == nil || d.count == 0 {
+		return nil
+	}
+	d.compress()
+	data := &DigestData{Count: d.count, Min: d.min, Max: d.max, Centroids: make([][2]float64, len(d.centroids))}
+	for i, c := range d.centroids {
+		data.Centroids[i] = [2]float64{c.mean, c.weight}
+	}
+	return data
+}
+
+func (data *DigestData) digest() *digest {
+	if data == nil {
+		return nil
+	}
+	d := newDigest()
+	for _, c := range data.Centroids {
+		d.centroids = append(d.centroids, centroid{c[0], c[1]})
+	}
+	d.count, d.min, d.max = data.Count, data.Min, data.Max
+	return d
+}
+
+// exportDigests fills in the digests of every client
+func exportDigests(pubresults []*PubResults, subresults []*SubResults) {
+	for _, res := range pubresults {
+		res.Digests = &ClientDigests{Latency: res.digest.export(), Ack: res.ackDigest.export(), RTT: res.rttDigest.export()}
+	}
+	for _, res := range subresults {
+		res.Digests = &ClientDigests{Latency: res.digest.export()}
+	}
+}
+
+// MergeResults combines the JSON results of several shards of one benchmark,
+// run at the same time from different hosts with distinct topics, into the
+// results of the whole benchmark in format. Client IDs are renumbered in the
+// order of paths. The publish and receive totals are computed from the
+// clients of all shards, so ratios and counts are exact; percentiles are
+// exact only if every shard ran with Config.ExportDigests, and are left out
+// otherwise. Breakdowns, heatmaps and the other sections are not merged.
+func MergeResults(paths []string, format string) ([]byte, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no results to merge")
+	}
+	shards := make([]*JSONResults, len(paths))
+	for i, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if shards[i], err = loadShard(path, data); err != nil {
+			return nil, err
+		}
+	}
+	return encodeResults(format, mergeShards(paths, shards))
+}
+
+// loadShard decodes the JSON results of the shard called name
+func loadShard(name string, data []byte) (*JSONResults, error) {
+	jr := new(JSONResults)
+	if err := json.Unmarshal(data, jr); err != nil {
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+	if len(jr.PubRuns) == 0 || len(jr.SubRuns) == 0 || jr.PubTotals == nil {
+		return nil, fmt.Errorf("%v holds no single run in JSON", name)
+	}
+	if jr.Unit != "ms" {
+		return nil, fmt.Errorf("%v reports latencies in %q, shards need the default milliseconds", name, jr.Unit)
+	}
+	return jr, nil
+}
+
+// mergeShards combines the results of the shards called names, see MergeResults
+func mergeShards(names []string, shards []*JSONResults) *JSONResults {
+	merged := &JSONResults{Unit: "ms"}
+	digests := true
+	pooled := false
+	var runTime float64
+	downgraded := 0
+	for k, jr := range shards {
+		// client i of this shard follows the clients of the earlier shards
+		offset := len(merged.PubRuns)
+		for _, res := range jr.PubRuns {
+			res.ID += offset
+			if res.Digests == nil {
+				digests = false
+			} else {
+				res.digest, res.ackDigest, res.rttDigest = res.Digests.Latency.digest(), res.Digests.Ack.digest(), res.Digests.RTT.digest()
+			}
+		}
+		for _, res := range jr.SubRuns {
+			res.ID += offset
+			if res.Digests == nil {
+				digests = false
+			} else {
+				res.digest = res.Digests.Latency.digest()
+			}
+		}
+		merged.PubRuns = append(merged.PubRuns, jr.PubRuns...)
+		merged.SubRuns = append(merged.SubRuns, jr.SubRuns...)
+
+		// the shards ran side by side, so the longest one is the run time
+		if jr.PubTotals.TotalRunTime > runTime {
+			runTime = jr.PubTotals.TotalRunTime
+		}
+		pooled = pooled || jr.TopicPool != nil
+		if jr.SubTotals != nil {
+			downgraded += jr.SubTotals.Downgraded
+		}
+		if jr.Aborted && !merged.Aborted {
+			merged.Aborted, merged.Reason = true, fmt.Sprintf("%v: %v", names[k], jr.Reason)
+		}
+		if merged.Labels == nil {
+			merged.Labels = jr.Labels
+		}
+		if merged.Backend == "" {
+			merged.Backend = jr.Backend
+		}
+	}
+	if !digests {
+		for _, res := range merged.PubRuns {
+			res.digest, res.ackDigest, res.rttDigest = nil, nil, nil
+		}
+		for _, res := range merged.SubRuns {
+			res.digest = nil
+		}
+	}
+
+	published := make([]int64, len(merged.SubRuns))
+	for i, res := range merged.SubRuns {
+		published[i] = res.Published
+	}
+	merged.PubTotals = calculatePublishResults(merged.PubRuns, time.Duration(runTime*float64(time.Second)))
+	merged.SubTotals = calculateSubscribeResults(merged.SubRuns, merged.PubRuns)
+	merged.SubTotals.Downgraded = downgraded
+	if pooled {
+		// pool topics spread the messages over the subscribers, which each
+		// shard already accounted for
+		merged.SubTotals.TotalPublished = 0
+		for i, res := range merged.SubRuns {
+			res.Published = published[i]
+			res.FwdRatio = 0
+			if res.Published > 0 {
+				res.FwdRatio = float64(res.Received) / float64(res.Published)
+			}
+			merged.SubTotals.TotalPublished += res.Published
+		}
+		merged.SubTotals.TotalFwdRatio = 0
+		if merged.SubTotals.TotalPublished > 0 {
+			merged.SubTotals.TotalFwdRatio = float64(merged.SubTotals.TotalReceived) / float64(merged.SubTotals.TotalPublished)
+		}
+	}
+	return merged
+}
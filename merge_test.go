@@ -0,0 +1,133 @@
+package mqttbmlatency
+
+import (
+	"math"
+	"testing"
+)
+
+// TestMergeShards splits the clients of one run into two shards, as two hosts
+// running half of the clients each would report them, and merges them back
+func TestMergeShards(t *testing.T) {
+	data, code := RunWithExitCode(&Config{
+		Embedded:      true,
+		Topic:         "merge",
+		PubQoS:        1,
+		SubQoS:        1,
+		Clients:       4,
+		Count:         50,
+		Size:          64,
+		KeepAlive:     30,
+		Quiet:         true,
+		ExportDigests: true,
+	})
+	if code != ExitOK {
+		t.Fatalf("exit code %d: %s", code, data)
+	}
+	whole := decodeShard(t, data)
+	// clients 0 and 1 on the first host, 2 and 3 on the second; every shard
+	// numbers its clients from 0
+	first, second := decodeShard(t, data), decodeShard(t, data)
+	first.PubRuns, second.PubRuns = nil, nil
+	for _, res := range whole.PubRuns {
+		if res.ID < 2 {
+			first.PubRuns = append(first.PubRuns, res)
+		} else {
+			c := *res
+			c.ID -= 2
+			second.PubRuns = append(second.PubRuns, &c)
+		}
+	}
+	first.SubRuns, second.SubRuns = nil, nil
+	for _, res := range whole.SubRuns {
+		if res.ID < 2 {
+			first.SubRuns = append(first.SubRuns, res)
+		} else {
+			c := *res
+			c.ID -= 2
+			second.SubRuns = append(second.SubRuns, &c)
+		}
+	}
+
+	merged := mergeShards([]string{"first", "second"}, []*JSONResults{first, second})
+	pubIDs, subIDs := make(map[int]bool), make(map[int]bool)
+	for i := range merged.PubRuns {
+		pubIDs[merged.PubRuns[i].ID], subIDs[merged.SubRuns[i].ID] = true, true
+	}
+	if len(merged.PubRuns) != 4 || len(pubIDs) != 4 || len(subIDs) != 4 {
+		t.Errorf("merged publishers %v and subscribers %v, want 0 to 3 each", pubIDs, subIDs)
+	}
+	pub, wantPub := merged.PubTotals, whole.PubTotals
+	if pub.Successes != wantPub.Successes || pub.Failures != wantPub.Failures || pub.PubRatio != wantPub.PubRatio {
+		t.Errorf("%d successes and %d failures, want %d and %d", pub.Successes, pub.Failures, wantPub.Successes, wantPub.Failures)
+	}
+	sub, wantSub := merged.SubTotals, whole.SubTotals
+	if sub.TotalReceived != wantSub.TotalReceived || sub.TotalPublished != wantSub.TotalPublished || sub.TotalFwdRatio != wantSub.TotalFwdRatio {
+		t.Errorf("%d of %d received, want %d of %d", sub.TotalReceived, sub.TotalPublished, wantSub.TotalReceived, wantSub.TotalPublished)
+	}
+	for _, v := range []struct {
+		name      string
+		got, want float64
+	}{
+		{"pub_time_min", pub.PubTimeMin, wantPub.PubTimeMin},
+		{"pub_time_max", pub.PubTimeMax, wantPub.PubTimeMax},
+		{"pub_time_mean_avg", pub.PubTimeMeanAvg, wantPub.PubTimeMeanAvg},
+		{"pub_time_median_avg", pub.PubTimeMedAvg, wantPub.PubTimeMedAvg},
+		{"total_msgs_per_sec", pub.TotalMsgsPerSec, wantPub.TotalMsgsPerSec},
+		{"fwd_latency_min", sub.FwdLatencyMin, wantSub.FwdLatencyMin},
+		{"fwd_latency_max", sub.FwdLatencyMax, wantSub.FwdLatencyMax},
+		{"fwd_latency_mean_avg", sub.FwdLatencyMeanAvg, wantSub.FwdLatencyMeanAvg},
+		{"fwd_latency_median_avg", sub.FwdLatencyMedAvg, wantSub.FwdLatencyMedAvg},
+	} {
+		if !closeTo(v.got, v.want) {
+			t.Errorf("%v %v, want %v", v.name, v.got, v.want)
+		}
+	}
+	for _, p := range []struct {
+		name      string
+		got, want *Percentiles
+	}{
+		{"pub_time", pub.PubTimePct, wantPub.PubTimePct},
+		{"ack_latency", pub.AckLatencyPct, wantPub.AckLatencyPct},
+		{"fwd_latency", sub.FwdLatencyPct, wantSub.FwdLatencyPct},
+	} {
+		if p.got == nil || p.want == nil {
+			t.Errorf("%v percentiles %v, want %v", p.name, p.got, p.want)
+			continue
+		}
+		if !closeTo(p.got.P50, p.want.P50) || !closeTo(p.got.P90, p.want.P90) || !closeTo(p.got.P99, p.want.P99) || !closeTo(p.got.P999, p.want.P999) {
+			t.Errorf("%v percentiles %+v, want %+v", p.name, *p.got, *p.want)
+		}
+	}
+}
+
+func TestMergeShardsWithoutDigests(t *testing.T) {
+	shard := func() *JSONResults {
+		return &JSONResults{
+			Unit:      "ms",
+			PubRuns:   []*PubResults{{Successes: 10, PubTimeMin: 1, PubTimeMax: 2, PubTimeMean: 1.5}},
+			SubRuns:   []*SubResults{{Received: 10, Published: 10, FwdLatencyMin: 2, FwdLatencyMax: 4, FwdLatencyMean: 3}},
+			PubTotals: &TotalPubResults{Successes: 10, TotalRunTime: 1},
+		}
+	}
+	merged := mergeShards([]string{"a", "b"}, []*JSONResults{shard(), shard()})
+	if merged.PubTotals.Successes != 20 || merged.SubTotals.TotalReceived != 20 {
+		t.Errorf("%d published and %d received, want 20 each", merged.PubTotals.Successes, merged.SubTotals.TotalReceived)
+	}
+	if merged.PubTotals.PubTimePct != nil || merged.SubTotals.FwdLatencyPct != nil {
+		t.Error("percentiles merged without digests")
+	}
+}
+
+func decodeShard(t *testing.T, data []byte) *JSONResults {
+	jr, err := loadShard("shard", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jr
+}
+
+// closeTo compares merged statistics, which may differ from the unsplit ones
+// in the last bits of floating point summation order
+func closeTo(got, want float64) bool {
+	return math.Abs(got-want) <= 1e-9*math.Max(1, math.Abs(want))
+}
@@ -2,9 +2,12 @@ package mqttbmlatency
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
-	"github.com/GaryBoone/GoStats/stats"
+	"fmt"
+	"github.com/brunobevilaquaa/mqtt-bm-latency/broker"
 	"log"
+	"net"
 	"strconv"
 	"time"
 )
@@ -13,84 +16,830 @@ import (
 type Message struct {
 	Topic     string
 	QoS       byte
+	Size      int
+	Seq       int64
+	Stage     int // index into the load profile, if any
+	PoolIndex int // index into the topic pool, if any
 	Payload   interface{}
 	Sent      time.Time
+	Handed    time.Time // passed to the client, after encoding and compression
 	Delivered time.Time
 	Error     bool
+	ErrClass  string // see classifyPublishError
+
+	RawSize      int           // encoded payload bytes before compression
+	CompressTime time.Duration // time spent compressing the payload
+
+	Aliased    bool // published by topic alias alone, see Config.TopicAlias
+	WireSize   int  // PUBLISH packet bytes, reported by backends with topic aliases
+	AliasSaved int  // packet bytes the topic alias saved
 }
 
 // SubResults describes results of a single SUBSCRIBER / run
 type SubResults struct {
-	ID             int     `json:"id"`
-	Published      int64   `json:"actual_published"`
-	Received       int64   `json:"received"`
-	FwdRatio       float64 `json:"fwd_success_ratio"`
-	FwdLatencyMin  float64 `json:"fwd_time_min"`
-	FwdLatencyMax  float64 `json:"fwd_time_max"`
-	FwdLatencyMean float64 `json:"fwd_time_mean"`
-	FwdLatencyStd  float64 `json:"fwd_time_std"`
+	ID             int            `json:"id"`
+	Node           string         `json:"node,omitempty"`  // cluster node connected to, see Config.Nodes
+	Group          string         `json:"group,omitempty"` // see Config.Groups
+	Topic          string         `json:"topic"`
+	Slow           bool           `json:"slow,omitempty"` // spent Config.ProcessingDelay on every message
+	Published      int64          `json:"actual_published"`
+	Received       int64          `json:"received"`
+	Redelivered    int64          `json:"redelivered,omitempty"` // messages carrying the DUP flag
+	FwdRatio       float64        `json:"fwd_success_ratio"`
+	FwdLatencyMin  float64        `json:"fwd_time_min,omitempty"` // the latencies are left out without messages
+	FwdLatencyMax  float64        `json:"fwd_time_max,omitempty"`
+	FwdLatencyMean float64        `json:"fwd_time_mean,omitempty"`
+	FwdLatencyStd  float64        `json:"fwd_time_std,omitempty"`
+	FwdLatencyMed  float64        `json:"fwd_time_median,omitempty"`
+	FwdLatencyTrim float64        `json:"fwd_time_trimmed_mean,omitempty"`
+	FwdLatencyPct  *Percentiles   `json:"fwd_time_percentiles,omitempty"`
+	DecompressTime float64        `json:"decompress_time_mean,omitempty"`
+	OutOfOrder     int64          `json:"out_of_order"` // messages behind one already received from their publisher
+	MaxReorder     int64          `json:"max_reorder"`  // the most sequence numbers a message arrived behind
+	ConnectTime    float64        `json:"connect_time"`
+	ConnectRetries int            `json:"connect_retries"`
+	Errors         ErrorCounts    `json:"errors,omitempty"`
+	Disconnects    int64          `json:"disconnects"`
+	Uptime         float64        `json:"uptime_ratio"`                 // connected share of the time since the first connect
+	ConnEvents     []*ConnEvent   `json:"connection_log,omitempty"`     // connects and lost connections, unless it stayed connected
+	Late           int64          `json:"late,omitempty"`               // received after the cutoff, see Config.LateWindow
+	Corrupt        int64          `json:"corrupt,omitempty"`            // failed the checksum, see Config.Checksum
+	GrantedQoS     *int           `json:"granted_qos,omitempty"`        // lowest QoS the SUBACK granted, when the client tells
+	QoSDowngrades  int64          `json:"qos_downgrades,omitempty"`     // delivered below both the publish and the subscribe QoS
+	SizeMismatches int64          `json:"size_mismatches,omitempty"`    // payloads of a size no publisher sent
+	Truncated      int64          `json:"truncated,omitempty"`          // mismatches shorter than any published size
+	GapMean        float64        `json:"inter_arrival_mean,omitempty"` // time between received messages, see Config.StallGap
+	GapMax         float64        `json:"inter_arrival_max,omitempty"`
+	GapPct         *Percentiles   `json:"inter_arrival_percentiles,omitempty"`
+	Stalls         int64          `json:"stalls,omitempty"`          // gaps longer than Config.StallGap
+	ReceiveMaximum int            `json:"receive_maximum,omitempty"` // advertised to the broker, see Config.ReceiveMaximum
+	QueueTimeMean  float64        `json:"queue_time_mean,omitempty"` // latency beyond the fastest message, inferred time queued at the broker
+	QueueTimeMax   float64        `json:"queue_time_max,omitempty"`
+	QueueTimePct   *Percentiles   `json:"queue_time_percentiles,omitempty"`
+	IngressMean    float64        `json:"ingress_latency_mean,omitempty"` // publisher to broker, see Config.IngressProperty
+	EgressMean     float64        `json:"egress_latency_mean,omitempty"`  // broker to subscriber
+	Unstamped      int64          `json:"unstamped,omitempty"`            // received without a valid ingress timestamp
+	Digests        *ClientDigests `json:"digests,omitempty"`              // see Config.ExportDigests
+
+	stages   []bucketStats // per stage of a load profile
+	sizes    []bucketStats // per size class of a size distribution
+	timeline []bucketStats // by send time, in outage scenarios only
+	heat     [][]int64     // see Config.Heatmap
+	digest   *digest
+
+	downgraded bool        // granted below the requested QoS
+	outliers   *outlierSet // see Config.Outliers
+
+	late       accumulator // latencies of the late messages
+	lateDigest *digest
+	gaps       accumulator // times between received messages
+	gapDigest  *digest
+
+	ingress, egress             accumulator // split at the broker's ingress timestamp
+	ingressDigest, egressDigest *digest
 }
 
 // TotalSubResults describes results of all SUBSCRIBER / runs
 type TotalSubResults struct {
-	TotalFwdRatio     float64 `json:"fwd_success_ratio"`
-	TotalReceived     int64   `json:"successes"`
-	TotalPublished    int64   `json:"actual_total_published"`
-	FwdLatencyMin     float64 `json:"fwd_latency_min"`
-	FwdLatencyMax     float64 `json:"fwd_latency_max"`
-	FwdLatencyMeanAvg float64 `json:"fwd_latency_mean_avg"`
-	FwdLatencyMeanStd float64 `json:"fwd_latency_mean_std"`
+	TotalFwdRatio     float64      `json:"fwd_success_ratio"`
+	TotalReceived     int64        `json:"successes"`
+	TotalPublished    int64        `json:"actual_total_published"`
+	FwdLatencyMin     float64      `json:"fwd_latency_min"`
+	FwdLatencyMax     float64      `json:"fwd_latency_max"`
+	FwdLatencyMeanAvg float64      `json:"fwd_latency_mean_avg"`
+	FwdLatencyMeanStd float64      `json:"fwd_latency_mean_std"`
+	FwdLatencyMeanCI  *Interval    `json:"fwd_latency_mean_ci95,omitempty"` // across subscribers
+	FwdLatencyMedAvg  float64      `json:"fwd_latency_median_avg"`
+	FwdLatencyTrimAvg float64      `json:"fwd_latency_trimmed_mean_avg"`
+	FwdLatencyPct     *Percentiles `json:"fwd_latency_percentiles,omitempty"` // of all samples
+	DecompressTime    float64      `json:"decompress_time_mean,omitempty"`
+	OutOfOrder        int64        `json:"out_of_order"`
+	Redelivered       int64        `json:"redelivered,omitempty"`
+	MaxReorder        int64        `json:"max_reorder"`
+	ConnectTimeMean   float64      `json:"connect_time_mean"`
+	ConnectTimeMax    float64      `json:"connect_time_max"`
+	ConnectRetries    int          `json:"connect_retries"`
+	Errors            ErrorCounts  `json:"errors,omitempty"`
+	Disconnects       int64        `json:"disconnects"`
+	Late              int64        `json:"late,omitempty"`                     // see Config.LateWindow
+	Lost              int64        `json:"lost,omitempty"`                     // neither received nor late, with a late window
+	Corrupt           int64        `json:"corrupt,omitempty"`                  // failed the checksum, not counted as received
+	Downgraded        int          `json:"downgraded_subscriptions,omitempty"` // granted below the requested QoS
+	QoSDowngrades     int64        `json:"qos_downgrades,omitempty"`
+	SizeMismatches    int64        `json:"size_mismatches,omitempty"`
+	Truncated         int64        `json:"truncated,omitempty"`
+	LateLatencyMean   float64      `json:"late_latency_mean,omitempty"`
+	LateLatencyMax    float64      `json:"late_latency_max,omitempty"`
+	LateLatencyPct    *Percentiles `json:"late_latency_percentiles,omitempty"`
+	GapMean           float64      `json:"inter_arrival_mean,omitempty"` // across all subscribers, see Config.StallGap
+	GapMax            float64      `json:"inter_arrival_max,omitempty"`
+	GapPct            *Percentiles `json:"inter_arrival_percentiles,omitempty"`
+	Stalls            int64        `json:"stalls,omitempty"`
+	QueueTimeMeanAvg  float64      `json:"queue_time_mean_avg,omitempty"` // see Config.ReceiveMaximum
+	QueueTimeMax      float64      `json:"queue_time_max,omitempty"`
+	UptimeMin         float64      `json:"uptime_ratio_min"` // of the least connected subscriber
 }
 
 // PubResults describes results of a single PUBLISHER / run
 type PubResults struct {
-	ID          int     `json:"id"`
-	Successes   int64   `json:"pub_successes"`
-	Failures    int64   `json:"failures"`
-	RunTime     float64 `json:"run_time"`
-	PubTimeMin  float64 `json:"pub_time_min"`
-	PubTimeMax  float64 `json:"pub_time_max"`
-	PubTimeMean float64 `json:"pub_time_mean"`
-	PubTimeStd  float64 `json:"pub_time_std"`
-	PubsPerSec  float64 `json:"publish_per_sec"`
+	ID             int                 `json:"id"`
+	Node           string              `json:"node,omitempty"`  // cluster node connected to, see Config.Nodes
+	Group          string              `json:"group,omitempty"` // see Config.Groups
+	Topic          string              `json:"topic"`
+	Successes      int64               `json:"pub_successes"`
+	Failures       int64               `json:"failures"`
+	RunTime        float64             `json:"run_time"`
+	PubTimeMin     float64             `json:"pub_time_min,omitempty"` // the publish times are left out without successes
+	PubTimeMax     float64             `json:"pub_time_max,omitempty"`
+	PubTimeMean    float64             `json:"pub_time_mean,omitempty"`
+	PubTimeStd     float64             `json:"pub_time_std,omitempty"`
+	PubTimeMed     float64             `json:"pub_time_median,omitempty"`
+	PubTimeTrim    float64             `json:"pub_time_trimmed_mean,omitempty"`
+	PubTimePct     *Percentiles        `json:"pub_time_percentiles,omitempty"`
+	AckLatencyMin  float64             `json:"ack_latency_min,omitempty"` // QoS 1 and 2 only
+	AckLatencyMax  float64             `json:"ack_latency_max,omitempty"`
+	AckLatencyMean float64             `json:"ack_latency_mean,omitempty"`
+	AckLatencyStd  float64             `json:"ack_latency_std,omitempty"`
+	AckLatencyPct  *Percentiles        `json:"ack_latency_percentiles,omitempty"`
+	AckTrend       float64             `json:"ack_latency_trend,omitempty"` // mean of the last 100 acknowledgements over the first 100
+	Backpressure   bool                `json:"backpressure"`                // acknowledgement latency at least doubled during the run
+	BlockedTime    float64             `json:"blocked_time"`                // seconds the generator waited for the publisher
+	BlockedRatio   float64             `json:"blocked_ratio"`               // share of the run time spent blocked
+	StoreTime      float64             `json:"store_time,omitempty"`        // milliseconds per publish spent in the file store, see Config.StoreDir
+	Compression    *CompressionResults `json:"compression,omitempty"`
+	TopicAlias     *TopicAliasResults  `json:"topic_aliases,omitempty"`
+	Responses      int64               `json:"responses,omitempty"` // request/response mode
+	RTTMin         float64             `json:"rtt_min,omitempty"`
+	RTTMax         float64             `json:"rtt_max,omitempty"`
+	RTTMean        float64             `json:"rtt_mean,omitempty"`
+	RTTStd         float64             `json:"rtt_std,omitempty"`
+	RTTPct         *Percentiles        `json:"rtt_percentiles,omitempty"`
+	PubsPerSec     float64             `json:"publish_per_sec"`
+	ConnectTime    float64             `json:"connect_time"`
+	ConnectRetries int                 `json:"connect_retries"`
+	Errors         ErrorCounts         `json:"errors,omitempty"` // failures by error class
+	Disconnects    int64               `json:"disconnects"`
+	Uptime         float64             `json:"uptime_ratio"`             // connected share of the time since the first connect
+	ConnEvents     []*ConnEvent        `json:"connection_log,omitempty"` // connects and lost connections, unless it stayed connected
+	Digests        *ClientDigests      `json:"digests,omitempty"`        // see Config.ExportDigests
+
+	stages   []bucketStats // per stage of a load profile
+	sizes    []bucketStats // per size class of a size distribution
+	timeline []bucketStats // by send time, in outage scenarios only
+	digest   *digest
+
+	rttDigest *digest
+	ackDigest *digest
 }
 
 // TotalPubResults describes results of all PUBLISHER / runs
 type TotalPubResults struct {
-	PubRatio        float64 `json:"publish_success_ratio"`
-	Successes       int64   `json:"successes"`
-	Failures        int64   `json:"failures"`
-	TotalRunTime    float64 `json:"total_run_time"`
-	AvgRunTime      float64 `json:"avg_run_time"`
-	PubTimeMin      float64 `json:"pub_time_min"`
-	PubTimeMax      float64 `json:"pub_time_max"`
-	PubTimeMeanAvg  float64 `json:"pub_time_mean_avg"`
-	PubTimeMeanStd  float64 `json:"pub_time_mean_std"`
-	TotalMsgsPerSec float64 `json:"total_msgs_per_sec"`
-	AvgMsgsPerSec   float64 `json:"avg_msgs_per_sec"`
+	PubRatio        float64             `json:"publish_success_ratio"`
+	Successes       int64               `json:"successes"`
+	Failures        int64               `json:"failures"`
+	TotalRunTime    float64             `json:"total_run_time"`
+	AvgRunTime      float64             `json:"avg_run_time"`
+	PubTimeMin      float64             `json:"pub_time_min"`
+	PubTimeMax      float64             `json:"pub_time_max"`
+	PubTimeMeanAvg  float64             `json:"pub_time_mean_avg"`
+	PubTimeMeanStd  float64             `json:"pub_time_mean_std"`
+	PubTimeMeanCI   *Interval           `json:"pub_time_mean_ci95,omitempty"` // across publishers
+	PubTimeMedAvg   float64             `json:"pub_time_median_avg"`
+	PubTimeTrimAvg  float64             `json:"pub_time_trimmed_mean_avg"`
+	PubTimePct      *Percentiles        `json:"pub_time_percentiles,omitempty"` // of all samples
+	AckPacket       string              `json:"ack_packet,omitempty"`           // PUBACK or PUBCOMP, none at QoS 0
+	AckLatencyMin   float64             `json:"ack_latency_min,omitempty"`
+	AckLatencyMax   float64             `json:"ack_latency_max,omitempty"`
+	AckLatencyMean  float64             `json:"ack_latency_mean_avg,omitempty"`
+	AckLatencyPct   *Percentiles        `json:"ack_latency_percentiles,omitempty"` // of all acknowledgements
+	Backpressured   int                 `json:"backpressured_publishers"`
+	BlockedTime     float64             `json:"blocked_time"` // summed over publishers
+	StoreTimeMean   float64             `json:"store_time_mean,omitempty"`
+	Compression     *CompressionResults `json:"compression,omitempty"`
+	TopicAlias      *TopicAliasResults  `json:"topic_aliases,omitempty"`
+	Responses       int64               `json:"responses,omitempty"`
+	RTTMin          float64             `json:"rtt_min,omitempty"`
+	RTTMax          float64             `json:"rtt_max,omitempty"`
+	RTTMeanAvg      float64             `json:"rtt_mean_avg,omitempty"`
+	RTTPct          *Percentiles        `json:"rtt_percentiles,omitempty"` // of all round trips
+	TotalMsgsPerSec float64             `json:"total_msgs_per_sec"`
+	AvgMsgsPerSec   float64             `json:"avg_msgs_per_sec"`
+	AvgMsgsPerSecCI *Interval           `json:"avg_msgs_per_sec_ci95,omitempty"`
+	ConnectTimeMean float64             `json:"connect_time_mean"`
+	ConnectTimeMax  float64             `json:"connect_time_max"`
+	ConnectRetries  int                 `json:"connect_retries"`
+	Errors          ErrorCounts         `json:"errors,omitempty"`
+	Disconnects     int64               `json:"disconnects"`
+	UptimeMin       float64             `json:"uptime_ratio_min"` // of the least connected publisher
 }
 
 // JSONResults are used to export results as a JSON document
 type JSONResults struct {
-	PubRuns   []*PubResults    `json:"publish runs"`
-	SubRuns   []*SubResults    `json:"subscribe runs"`
-	PubTotals *TotalPubResults `json:"publish totals"`
-	SubTotals *TotalSubResults `json:"receive totals"`
+	PubRuns   []*PubResults     `json:"publish runs"`
+	SubRuns   []*SubResults     `json:"subscribe runs"`
+	NodeRuns  []*NodeResults    `json:"node breakdown,omitempty"`
+	QoSRuns   []*QoSResults     `json:"qos breakdown,omitempty"`
+	Tenants   []*TenantResults  `json:"tenant breakdown,omitempty"`
+	PubTotals *TotalPubResults  `json:"publish totals"`
+	SubTotals *TotalSubResults  `json:"receive totals"`
+	TopicRuns []*TopicResults   `json:"topic breakdown,omitempty"`
+	StageRuns []*StageResults   `json:"stage results,omitempty"`
+	SizeRuns  []*SizeResults    `json:"size results,omitempty"`
+	Probes    []*ProbeResults   `json:"ping probes,omitempty"`
+	Heatmap   *HeatmapResults   `json:"heatmap,omitempty"`
+	TopicPool *TopicPoolResults `json:"topic_pool,omitempty"`
+	ACL       *ACLResults       `json:"acl,omitempty"`
+	SubOpts   *SubOptsResults   `json:"subscription_options,omitempty"` // broker compliance, see Config.SubOptions
+	QUIC      *QUICResults      `json:"quic,omitempty"`                 // connection setups with quic:// brokers
+	Idle      *IdleResults      `json:"idle_subscribers,omitempty"`
+	Heartbeat *HeartbeatResults `json:"heartbeat,omitempty"`
+	Drain     *DrainResults     `json:"drain,omitempty"` // wait for a drained broker before the run
+	Barrier   *BarrierResults   `json:"start_barrier"`
+	Outage    *OutageResults    `json:"outage,omitempty"`
+	Chaos     []*ChaosEvent     `json:"chaos,omitempty"`
+	Outliers  []*Outlier        `json:"outliers,omitempty"` // worst first, see Config.Outliers
+	Breakdown *LatencyBreakdown `json:"latency_breakdown,omitempty"`
+	SLA       []*SLACheck       `json:"sla,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"` // see Config.Labels
+	Agents    []*AgentStatus    `json:"agents,omitempty"` // see CollectResults
+	ClockSync *ClockSync        `json:"clock_sync,omitempty"`
+	Unit      string            `json:"latency_unit"`      // of every latency, see Config.LatencyUnit
+	Backend   string            `json:"backend,omitempty"` // client backend, when not paho
+	Aborted   bool              `json:"aborted,omitempty"`
+	Reason    string            `json:"abort_reason,omitempty"`
+}
+
+// Config describes a benchmark run
+type Config struct {
+	Broker          string
+	SubBroker       string   // subscribers connect here instead of Broker, to measure bridges and cluster replication
+	Nodes           []string // cluster node URLs; client i connects to node i modulo the count, results are broken down per node
+	Topic           string
+	TopicOffset     int // client i uses topic <Topic>-<TopicOffset+i>, so split or concurrent runs agree on numbering
+	Username        string
+	Password        string
+	CredentialsFile string // CSV or JSON identities, one per client instead of Username and Password
+	CertDir         string // client certificates for TLS brokers, one per connection
+	PubQoS          int
+	SubQoS          int
+	QoSMix          []int // client i publishes and subscribes at QoSMix[i % len], replacing PubQoS and SubQoS; totals are broken down per level
+	Size            int
+	SizeDist        *SizeDist // draw message sizes instead of using Size
+	Compress        string    // compress payloads with gzip or deflate before publishing
+	ZeroCopy        bool      // reuse one payload buffer per publisher and patch only the header fields
+	Checksum        string    // "crc32" or "xxhash" appends a checksum to every payload for subscribers to verify, counting corrupt messages
+
+	TopicAlias     bool              // publish by MQTT 5 topic aliases and report the bytes saved, needs V5Backend
+	ReceiveMaximum int               // MQTT 5 Receive Maximum advertised by subscribers, needs V5Backend; reports inferred queue times
+	SubOptions     *SubscribeOptions // MQTT 5 No Local, Retain As Published and Retain Handling of the subscribers, needs V5Backend; checks compliance
+
+	RequestResponse bool          // subscribers echo every message to its response topic and publishers time the round trip, see responseSuffix
+	ResponseTimeout time.Duration // wait for outstanding responses after publishing, default 5s
+
+	ProcessingDelay time.Duration // subscribers spend this long on every message, simulating slow consumers
+	SlowSubscribers int           // only the first N subscribers are slow, 0 makes all of them slow
+	ManualAck       bool          // subscribers acknowledge QoS 1 and 2 messages themselves instead of on receipt
+	AckDelay        time.Duration // with ManualAck, hold every acknowledgement back this long
+	StallGap        time.Duration // record the gaps between received messages per subscriber, counting longer ones as stalls
+	IdleSubscribers int           // keep this many extra subscribers connected without traffic during the run
+
+	ProbeInterval  time.Duration // ping the broker this often on one extra connection per client, 0 disables
+	QUICReconnects int           // before the run, reconnect one extra client this often to a quic:// broker, timing 0-RTT setups
+	Heartbeat      time.Duration // publish a heartbeat this often on its own connection and report stalls, 0 disables
+	HeartbeatTopic string        // topic of the heartbeats, default <topic>/heartbeat
+	Drain          *Drain        // before the run and every stage, wait until no messages arrive on the benchmark topics
+	SettleDelay    time.Duration // once every subscriber has its SUBACK, wait this long before publishing
+	ACL            *ACLTest      // also try a topic the clients are not authorized for and report the broker's responses
+
+	ReferenceBroker string // loopback URL of the same broker; reference subscribers split latency into broker and network
+	IngressProperty string // MQTT 5 user property carrying the broker's ingress timestamp in unix milliseconds, needs V5Backend
+
+	Outage     *Outage       // ride out a broker restart and report how the clients recovered
+	Chaos      []ChaosAction // scripted actions into publishing: drop client connections, pause publishers
+	Count      int           // messages per publisher
+	TotalCount int           // messages across all publishers, split evenly between them instead of Count each
+	Clients    int
+	KeepAlive  int
+	Quiet      bool
+	DryRun     bool              // validate, test a single round trip and return the plan instead of results
+	Embedded   bool              // run against an in-process broker instead of Broker, for smoke tests
+	Clock      Clock             // time source, the system clock when nil
+	Labels     map[string]string // attached to the results, snapshots, metrics and spans, e.g. broker=emqx5.3
+
+	SkipPreflight bool          // run even if the estimated file descriptors, ports or memory exceed the host's limits
+	ClockCheck    bool          // record the kernel's clock sync estimate before the run
+	NTPServer     string        // also measure the clock offset against this NTP server
+	MaxClockError time.Duration // warn above this clock error or offset, default 1ms
+	Seed          int64         // reproduce random padding and publish gaps, 0 seeds from the clock
+
+	Brokers    []string // compare these brokers with identical workloads instead of testing Broker
+	Concurrent bool     // run the broker comparison concurrently instead of one broker after the other
+
+	Repeat     int           // run the benchmark this many times and aggregate across runs
+	CoolDown   time.Duration // pause between repeated runs
+	ReplayFile string        // trace written by Record, replayed instead of generated messages
+	LocalAddrs []string      // source IPs or interface names, assigned to clients round-robin
+	Groups     []ClientGroup // bind blocks of clients to their own source addresses, before LocalAddrs applies
+	Tenants    []Tenant      // split the clients into tenants with their own topics, credentials and rates, reported per tenant
+
+	ConnectTimeout time.Duration
+	ConnectRate    float64       // new connections per second across all clients, 0 for no limit
+	ConnectJitter  time.Duration // random extra delay of up to this much per connection, needs ConnectRate
+	Nagle          bool          // enable Nagle's algorithm on client sockets
+	SendBuffer     int           // socket send buffer size in bytes
+	RecvBuffer     int           // socket receive buffer size in bytes
+	Backoff        *Backoff      // retry policy for failed initial connections
+	PublishTimeout time.Duration // give up waiting for a publish to complete, 0 waits forever
+	StoreDir       string        // keep the in-flight QoS 1 and 2 messages of every client in a paho file store below this directory
+
+	GlobalRate  float64       // total messages per second across all publishers, 0 for no limit
+	GlobalBurst int           // messages the shared bucket may release at once, default 10ms worth
+	Burst       *Burst        // publish in bursts instead of a steady loop
+	PoissonMean time.Duration // mean of exponentially distributed gaps between publishes
+	ThinkTime   *ThinkTime    // wait between each publisher's successive messages, e.g. 5s ± 500ms
+	Stages      []Stage       // step load profile; replaces Count and reports results per stage
+
+	CheckpointFile string          // run stages one by one, saving results here after each so an interrupted run resumes
+	Capacity       *CapacitySearch // search the highest rate at which SLA holds instead of running once
+
+	Duration         time.Duration // publish for this long instead of Count messages per client
+	LateWindow       time.Duration // after the cutoff, count messages arriving for this much longer as late instead of lost
+	SnapshotInterval time.Duration // soak mode: append a result snapshot every interval
+	SnapshotFile     string        // JSON lines file receiving the snapshots
+	RotateSize       int64         // move the snapshot file aside once it exceeds this many bytes, 0 disables
+	RotateInterval   time.Duration // move the snapshot file aside this often, 0 disables
+	OutputFile       string        // also write the final results to this file
+	ResultsTopic     string        // also publish the final results to this topic at QoS 1, for agents reporting home
+	ResultsBroker    string        // publish them on this control broker instead of Broker
+	ResultsRetain    bool          // publish them retained
+	ResultsHeartbeat time.Duration // until the results are out, publish a heartbeat to <ResultsTopic>/heartbeat this often
+	Format           string        // "json" (default), "markdown" or "junit"; dry runs always return JSON
+	LatencyUnit      string        // "us", "ms" (default) or "s" for reported latencies; SLA limits stay in ms
+	LatencyPrecision int           // round reported latencies to this many decimals, 0 keeps full precision
+	ExportDigests    bool          // include every client's latency digests, so MergeResults can merge the percentiles of shards
+	SLA              *SLA          // limits checked after the run, reported as results and JUnit test cases
+	Heatmap          *Heatmap      // count forward latencies by arrival time and latency bucket, for a latency heatmap
+	Outliers         int           // report the context of this many worst forward latencies of the run
+
+	MaxFailureRatio  float64 // abort once this fraction of publishes failed, 0 disables
+	MaxDisconnects   int64   // abort once more connections than this were lost, 0 disables
+	AbortMinMessages int64   // publishes required before MaxFailureRatio applies, default 100
+
+	TrimFraction float64 // share of latencies dropped at each end for the trimmed mean, default 0.05
+	ExactStats   bool    // keep every latency for an exact median and trimmed mean, at about 32 bytes per message; otherwise they are estimated
+
+	TopicPool int     // publish every message to a random one of this many topics instead of one topic per client
+	TopicSkew float64 // Zipf exponent for picking pool topics, 0 picks uniformly
+
+	TopicBreakdown  bool // aggregate latency and loss per topic
+	TopicGroupDepth int  // group topics by their first N levels, 0 for full topics
+
+	OTLPEndpoint string // OTLP/HTTP collector, e.g. http://localhost:4318; empty disables tracing
+	PacketLog    string // JSON lines file receiving the header of every MQTT control packet
+	StatsDAddr   string // StatsD agent host:port; empty disables metrics
+	StatsDPrefix string
+	DogStatsD    bool // tag metrics with the client ID using the DogStatsD extension
+
+	Backend Backend // client library of publishers and subscribers, Eclipse Paho when nil; see MinimalBackend
+	Hooks   *Hooks  // called by publishers and subscribers as they connect, publish and receive
+
+	PprofAddr   string // serve net/http/pprof here during the run, e.g. :6060
+	CPUProfile  string // write a CPU profile of the run to this file
+	HeapProfile string // write a heap profile to this file after the run
+
+	progress *progress     // live message counts for the server's status polls
+	live     *liveControls // settings changed through the server while running
 }
 
 func Start(broker string, topic string, qos int, size int, count int, clients int, quiet bool) []byte {
+	flag.Parse()
+	return Run(&Config{
+		Broker:    broker,
+		Topic:     topic,
+		PubQoS:    qos,
+		SubQoS:    qos,
+		Size:      size,
+		Count:     count,
+		Clients:   clients,
+		KeepAlive: 60,
+		Quiet:     quiet,
+	})
+}
+
+// Run executes a benchmark described by cfg and returns the JSON results
+func Run(cfg *Config) []byte {
+	data, _ := RunWithExitCode(cfg)
+	return data
+}
+
+// RunWithExitCode is Run, also returning the exit code matching the outcome,
+// see ExitConnect and the other exit codes. A configuration that cannot run,
+// or results that cannot be encoded, are logged and return no results and
+// ExitConfig.
+func RunWithExitCode(cfg *Config) ([]byte, int) {
+	_, data, code, err := execute(cfg)
+	if err != nil {
+		log.Printf("Benchmark failed: %v\n", err)
+	}
+	return data, code
+}
 
+// execute runs cfg on the embedded broker if it asks for one, profiles the
+// run and delivers the results to the output file and results topic. It
+// returns the report, nil for dry runs, with its encoding and exit code. An
+// error means cfg could not run or its results could not be encoded, and
+// comes with ExitConfig.
+func execute(cfg *Config) (report, []byte, int, error) {
+	if cfg.Embedded {
+		if len(cfg.Brokers) > 0 {
+			if err := cfg.validateComparison(); err != nil {
+				return nil, nil, ExitConfig, fmt.Errorf("invalid configuration: %v", err)
+			}
+		}
+		b := broker.New()
+		addr, err := b.Listen("127.0.0.1:0")
+		if err != nil {
+			return nil, nil, ExitConfig, fmt.Errorf("failed to start embedded broker: %v", err)
+		}
+		defer b.Close()
+		embedded := *cfg
+		embedded.Broker = "tcp://" + addr
+		embedded.Embedded = false
+		if !cfg.Quiet {
+			log.Printf("Embedded broker listening on %v\n", addr)
+		}
+		return execute(&embedded)
+	}
+
+	stopProfiling, err := startProfiling(cfg)
+	if err != nil {
+		return nil, nil, ExitConfig, err
+	}
+	var beat *agentBeat
+	if cfg.ResultsTopic != "" && cfg.ResultsHeartbeat > 0 {
+		beat = startAgentBeat(cfg)
+	}
+	defer beat.close()
+	r, data, code, err := dispatch(cfg)
+	stopProfiling()
+	if err != nil {
+		return nil, nil, ExitConfig, err
+	}
+	if cfg.OutputFile != "" {
+		if err := writeOutput(cfg.OutputFile, data); err != nil {
+			log.Printf("Failed to write results to %v: %v\n", cfg.OutputFile, err)
+		} else if !cfg.Quiet {
+			log.Printf("Results written to %v\n", cfg.OutputFile)
+		}
+	}
+	if cfg.ResultsTopic != "" {
+		if err := publishResults(cfg, data); err != nil {
+			log.Printf("Failed to publish results to %v: %v\n", cfg.ResultsTopic, err)
+		} else if !cfg.Quiet {
+			log.Printf("Results published to %v\n", cfg.ResultsTopic)
+		}
+	}
+
+	return r, data, code, nil
+}
+
+// dispatch validates cfg and runs the kind of benchmark it describes
+func dispatch(cfg *Config) (report, []byte, int, error) {
 	var (
-		username  = ""
-		password  = ""
-		pubqos    = qos
-		subqos    = qos
-		keepalive = 60
+		r   report
+		err error
 	)
+	if len(cfg.Brokers) > 0 {
+		cr, err := compareBrokers(cfg)
+		if err != nil {
+			return nil, nil, ExitConfig, err
+		}
+		data, err := encodeResults(cfg.Format, convertUnits(cfg, cr))
+		if err != nil {
+			return nil, nil, ExitConfig, err
+		}
+		return cr, data, cr.ExitCode(), nil
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, ExitConfig, fmt.Errorf("invalid configuration: %v", err)
+	}
+
+	if cfg.DryRun {
+		topics, traces, err := clientTopics(cfg)
+		if err != nil {
+			return nil, nil, ExitConfig, err
+		}
+		p := dryRun(cfg, topics, traces)
+		data, err := json.Marshal(p)
+		if err != nil {
+			return nil, nil, ExitConfig, fmt.Errorf("failed to encode the dry run: %v", err)
+		}
+		if p.Error != "" {
+			return nil, data, ExitConnect, nil
+		}
+		return nil, data, ExitOK, nil
+	}
+	if cfg.Capacity != nil {
+		r, err = searchCapacity(cfg)
+	} else if cfg.CheckpointFile != "" {
+		r, err = checkpointed(cfg)
+	} else if cfg.Repeat > 1 {
+		r, err = repeat(cfg)
+	} else {
+		r, err = benchmark(cfg)
+	}
+	if err != nil {
+		return nil, nil, ExitConfig, err
+	}
+	data, err := encodeResults(cfg.Format, convertUnits(cfg, r))
+	if err != nil {
+		return nil, nil, ExitConfig, err
+	}
+	return r, data, r.ExitCode(), nil
+}
+
+// clientTopics returns the topic of every client, and the traces to replay on
+// them if the run replays a recording
+func clientTopics(cfg *Config) ([]string, map[string][]*TraceRecord, error) {
+	if cfg.ReplayFile != "" {
+		records, err := LoadTrace(cfg.ReplayFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load trace %v: %v", cfg.ReplayFile, err)
+		}
+		topics, traces := groupTrace(records)
+		return topics, traces, nil
+	}
+	topics := make([]string, cfg.Clients)
+	for i := range topics {
+		prefix := cfg.Topic
+		if k := tenantOf(cfg, i); k >= 0 {
+			prefix = tenantTopic(cfg, k)
+		}
+		topics[i] = prefix + "-" + strconv.Itoa(cfg.TopicOffset+i)
+	}
+	return topics, nil, nil
+}
+
+// countOf returns the message count of publisher i, its share of
+// Config.TotalCount if set. The first publishers send one message more when
+// the budget does not divide evenly.
+func countOf(cfg *Config, i int) int {
+	if cfg.TotalCount <= 0 {
+		return cfg.Count
+	}
+	n := cfg.TotalCount / cfg.Clients
+	if i < cfg.TotalCount%cfg.Clients {
+		n++
+	}
+	return n
+}
+
+// totalCount returns the messages the publishers send in all
+func totalCount(cfg *Config, publishers int) int64 {
+	if cfg.TotalCount > 0 {
+		return int64(cfg.TotalCount)
+	}
+	return int64(cfg.Count) * int64(publishers)
+}
+
+// benchmark performs a single run of cfg. It fails before connecting any
+// client if an input file cannot be read or the run would not fit.
+func benchmark(cfg *Config) (*JSONResults, error) {
+	topics, traces, err := clientTopics(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		username  = cfg.Username
+		password  = cfg.Password
+		size      = cfg.Size
+		clients   = cfg.Clients
+		keepalive = cfg.KeepAlive
+		quiet     = cfg.Quiet
+		spans     *spanExporter
+		metrics   *statsdSink
+		packets   *packetLog
+		plan      *stagePlan
+		soak      *soakMonitor
+		abort     = newAbortMonitor(cfg)
+		outage    *outageMonitor
+		clock     = clockOrSystem(cfg.Clock)
+		trim      = cfg.TrimFraction
+		localIPs  []net.IP
+	)
+
+	if traces != nil {
+		clients = len(topics)
+	}
+	if !cfg.SkipPreflight {
+		res := estimateResources(cfg, clients)
+		if err := res.check(); err != nil {
+			return nil, fmt.Errorf("pre-flight check failed: %v; set Config.SkipPreflight to run anyway", err)
+		}
+		if !quiet {
+			log.Printf("Pre-flight: %v connections, about %v file descriptors and %v MiB of memory.\n", res.Connections, res.Files, res.Memory>>20)
+		}
+	}
+	if trim == 0 {
+		trim = defaultTrimFraction
+	}
+	if cfg.SizeDist != nil {
+		cfg.SizeDist.prepare()
+	}
+	respWait := cfg.ResponseTimeout
+	if respWait == 0 {
+		respWait = defaultResponseTimeout
+	}
+	// soak runs are unbounded, so they never keep raw samples
+	streaming := !cfg.ExactStats || cfg.SnapshotInterval > 0
 
-	flag.Parse()
 	if clients < 1 {
-		log.Fatal("Invlalid arguments")
+		return nil, errors.New("no clients to run")
+	}
+
+	creds := make([]*Credentials, clients)
+	for i := range creds {
+		creds[i] = &Credentials{Username: username, Password: password}
+		if k := tenantOf(cfg, i); k >= 0 && cfg.Tenants[k].Username != "" {
+			creds[i] = &Credentials{Username: cfg.Tenants[k].Username, Password: cfg.Tenants[k].Password}
+		}
+	}
+	if cfg.CredentialsFile != "" {
+		loaded, err := LoadCredentials(cfg.CredentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load credentials %v: %v", cfg.CredentialsFile, err)
+		}
+		if creds, err = assignCredentials(loaded, clients); err != nil {
+			return nil, fmt.Errorf("invalid credentials %v: %v", cfg.CredentialsFile, err)
+		}
+	}
+
+	var pool *topicPool
+	if cfg.TopicPool > 0 {
+		pool = newTopicPool(cfg.Topic, cfg.TopicPool, cfg.TopicSkew, clients)
+	}
+	poolFilters := func(i int) []string {
+		if pool == nil {
+			return nil
+		}
+		return pool.filters(i)
+	}
+
+	var limiter *rateLimiter
+	if cfg.GlobalRate > 0 {
+		limiter = newRateLimiter(clock, cfg.GlobalRate, cfg.GlobalBurst)
+	}
+	var liveLimiter *rateLimiter
+	if cfg.live != nil && tunesRate(cfg) {
+		// without a global rate the limiter starts out releasing any number of slots
+		if limiter == nil {
+			limiter = newRateLimiter(clock, 0, cfg.GlobalBurst)
+		}
+		liveLimiter = limiter
+	}
+	tenantRates := tenantLimiters(cfg, clock)
+	limiterOf := func(i int) *rateLimiter {
+		if k := tenantOf(cfg, i); k >= 0 && tenantRates[k] != nil {
+			return tenantRates[k]
+		}
+		return limiter
+	}
+
+	var connects *connectLimiter
+	if cfg.ConnectRate > 0 {
+		connects = newConnectLimiter(cfg, clock)
+	}
+
+	var certs *certSet
+	if cfg.CertDir != "" {
+		if certs, err = newCertSet(cfg.CertDir, clients); err != nil {
+			return nil, fmt.Errorf("invalid client certificates: %v", err)
+		}
+	}
+	var families ipFamilies
+	if len(cfg.LocalAddrs) > 0 || len(cfg.Groups) > 0 {
+		families = brokerFamilies(cfg)
+	}
+	if len(cfg.LocalAddrs) > 0 {
+		if localIPs, err = resolveLocalAddrs(cfg.LocalAddrs, families); err != nil {
+			return nil, fmt.Errorf("invalid local addresses: %v", err)
+		}
+	}
+	var groups *groupPlan
+	if len(cfg.Groups) > 0 {
+		if groups, err = newGroupPlan(cfg.Groups, families); err != nil {
+			return nil, fmt.Errorf("invalid client groups: %v", err)
+		}
+	}
+
+	// the last files and sockets to open, closed again if one fails
+	if cfg.PacketLog != "" {
+		if packets, err = newPacketLog(cfg.PacketLog, clock); err != nil {
+			return nil, fmt.Errorf("failed to create packet log %v: %v", cfg.PacketLog, err)
+		}
+	}
+	if cfg.StatsDAddr != "" {
+		if metrics, err = newStatsdSink(cfg.StatsDAddr, cfg.StatsDPrefix, cfg.DogStatsD, cfg.Labels); err != nil {
+			if packets != nil {
+				packets.close()
+			}
+			return nil, fmt.Errorf("failed to open StatsD sink %v: %v", cfg.StatsDAddr, err)
+		}
+	}
+	if cfg.SnapshotInterval > 0 {
+		if soak, err = newSoakMonitor(clock, cfg.SnapshotFile, cfg.RotateSize, cfg.RotateInterval, cfg.SnapshotInterval, clients, quiet); err != nil {
+			if packets != nil {
+				packets.close()
+			}
+			if metrics != nil {
+				metrics.close()
+			}
+			return nil, fmt.Errorf("failed to open snapshot file %v: %v", cfg.SnapshotFile, err)
+		}
+		soak.labels = cfg.Labels
+	}
+
+	if len(cfg.Stages) > 0 {
+		plan = newStagePlan(cfg.Stages, clients, cfg.Drain, clock)
+	}
+	if cfg.Outage != nil {
+		outage = newOutageMonitor(cfg.Outage, clock, quiet)
+	}
+
+	pubWindow := func(i int) *window {
+		if soak == nil {
+			return nil
+		}
+		return soak.pubs[i]
+	}
+	subWindow := func(i int) *window {
+		if soak == nil {
+			return nil
+		}
+		return soak.subs[i]
+	}
+	var chaos *chaosScript
+	if len(cfg.Chaos) > 0 {
+		chaos = newChaosScript(cfg.Chaos, clients, soak, clock, quiet)
+	}
+
+	localAddr := func(i int) net.IP {
+		if groups != nil {
+			if k, ip := groups.lookup(i); k >= 0 {
+				return ip
+			}
+		}
+		if len(localIPs) == 0 {
+			return nil
+		}
+		return localIPs[i%len(localIPs)]
+	}
+
+	var clockSync *ClockSync
+	if cfg.ClockCheck || cfg.NTPServer != "" {
+		clockSync = checkClock(cfg)
+	}
+
+	if cfg.OTLPEndpoint != "" {
+		spans = newSpanExporter(cfg.OTLPEndpoint, cfg.Labels, quiet)
+	}
+
+	var drained *DrainResults
+	if cfg.Drain != nil {
+		filters := make(map[string]byte)
+		for i := 0; i < clients; i++ {
+			if f := poolFilters(i); f != nil {
+				for _, t := range f {
+					filters[t] = 0
+				}
+			} else {
+				filters[topics[i]] = 0
+			}
+		}
+		drained = drainTopics(cfg, clock, filters, localAddr(0), certs)
+	}
+	var subOpts *SubOptsResults
+	if cfg.SubOptions != nil {
+		subOpts = checkSubOptions(cfg, localAddr(0), certs)
+	}
+	var quicRun *quicStats
+	var quicProbe *QUICResults
+	if usesQUIC(cfg) {
+		quicRun = new(quicStats)
+		if cfg.QUICReconnects > 0 {
+			quicProbe = probeQUIC(cfg, newTransport(cfg, localAddr(0), certs.pub(0)))
+		}
+	}
+	var idle *idleFleet
+	if cfg.IdleSubscribers > 0 {
+		idle = connectIdle(cfg, cfg.IdleSubscribers, clients, localAddr, certs)
+	}
+	sizes := newSizeCheck(size, cfg.SizeDist, traces)
+	var heat *heatmap
+	if cfg.Heatmap != nil {
+		heat = newHeatmap(cfg.Heatmap, clock.Now())
 	}
 
 	//start subscribe
@@ -98,56 +847,191 @@ func Start(broker string, topic string, qos int, size int, count int, clients in
 	subResCh := make(chan *SubResults)
 	jobDone := make(chan bool)
 	subDone := make(chan bool)
-	subCnt := 0
+	subscribers := clients
+	var refResCh chan *SubResults
+	if cfg.ReferenceBroker != "" {
+		subscribers *= 2
+		refResCh = make(chan *SubResults)
+	}
 
 	log.Printf("Starting subscribe..\n")
+	subscribeStart := clock.Now()
 
+	subBroker := func(i int) string {
+		if cfg.SubBroker != "" {
+			return cfg.SubBroker
+		}
+		return nodeOf(cfg, i)
+	}
+	processingDelay := func(i int) time.Duration {
+		if cfg.SlowSubscribers > 0 && i >= cfg.SlowSubscribers {
+			return 0
+		}
+		return cfg.ProcessingDelay
+	}
+	subs := make([]*SubClient, clients)
 	for i := 0; i < clients; i++ {
+		_, subqos := qosOf(cfg, i)
 		sub := &SubClient{
 			ID:         i,
-			BrokerURL:  broker,
-			BrokerUser: username,
-			BrokerPass: password,
-			SubTopic:   topic + "-" + strconv.Itoa(i),
+			BrokerURL:  subBroker(i),
+			BrokerUser: creds[i].Username,
+			BrokerPass: creds[i].Password,
+			ClientID:   derivedID(creds[i].ClientID, "-sub"),
+			SubTopic:   topics[i],
+			Filters:    poolFilters(i),
 			SubQoS:     byte(subqos),
+			PubQoS:     byte(publishedQoS(cfg, i)),
+			Outliers:   cfg.Outliers,
 			KeepAlive:  keepalive,
 			Quiet:      quiet,
+			Transport:  quicRun.attach(chaos.attach(packets.attach(newTransport(cfg, localAddr(i), certs.sub(i)), "sub", i), RoleSubscriber, i)),
+			Backoff:    cfg.Backoff,
+			Trim:       trim,
+			Streaming:  streaming,
+			Sizes:      cfg.SizeDist,
+			Compress:   cfg.Compress,
+			Checksum:   cfg.Checksum,
+			Respond:    cfg.RequestResponse,
+			Delay:      processingDelay(i),
+			StallGap:   cfg.StallGap,
+			Backend:    cfg.Backend,
+			ReceiveMax: cfg.ReceiveMaximum,
+			SubOpts:    cfg.SubOptions,
+			Ingress:    cfg.IngressProperty,
+			ManualAck:  cfg.ManualAck,
+			Hooks:      cfg.Hooks,
+			AckDelay:   cfg.AckDelay,
+			StoreDir:   cfg.StoreDir,
+			clock:      clock,
+			stages:     plan,
+			window:     subWindow(i),
+			abort:      abort,
+			outage:     outage,
+			heat:       heat,
+			sizes:      sizes,
+			spans:      spans,
+			metrics:    metrics,
+			progress:   cfg.progress,
+			connects:   connects,
+			backoffRng: clientRand(cfg, i, randSubBackoff),
 		}
+		subs[i] = sub
 		go sub.run(subResCh, subDone, jobDone)
-	}
-
-SUBJOBDONE:
-	for {
-		select {
-		case <-subDone:
-			subCnt++
-			if subCnt == clients {
-				if !quiet {
-					log.Printf("all subscribe job done.\n")
-				}
-				break SUBJOBDONE
+		if refResCh != nil {
+			ref := &SubClient{
+				ID:         i,
+				BrokerURL:  cfg.ReferenceBroker,
+				BrokerUser: creds[i].Username,
+				BrokerPass: creds[i].Password,
+				ClientID:   derivedID(creds[i].ClientID, "-ref"),
+				SubTopic:   topics[i],
+				Filters:    poolFilters(i),
+				SubQoS:     byte(subqos),
+				KeepAlive:  keepalive,
+				Quiet:      true,
+				Backoff:    cfg.Backoff,
+				Trim:       trim,
+				Streaming:  true,
+				Compress:   cfg.Compress,
+				Checksum:   cfg.Checksum,
+				clock:      clock,
+				connects:   connects,
 			}
+			go ref.run(refResCh, subDone, jobDone)
 		}
 	}
 
+	barrier := awaitSubscribers(clock, subDone, subscribers, cfg.SettleDelay, subscribeStart, quiet)
+
 	//start publish
 	if !quiet {
 		log.Printf("Starting publish..\n")
 	}
 	pubResCh := make(chan *PubResults)
-	start := time.Now()
+	start := clock.Now()
+	replayBase := traceStart(traces)
+	if plan != nil {
+		plan.begin(start)
+	}
+	if outage != nil {
+		outage.begin(start)
+	}
+	if chaos != nil {
+		chaos.begin(start)
+	}
+	cfg.live.attach(cfg, liveLimiter, sizes, soak)
+	if soak != nil {
+		soak.begin()
+	}
+	var probes *prober
+	if cfg.ProbeInterval > 0 {
+		probes = newProber(cfg, clock, clients, localAddr, certs)
+		probes.begin()
+	}
+	var beats *heartbeat
+	if cfg.Heartbeat > 0 {
+		beats = newHeartbeat(cfg, clock, localAddr(0), certs)
+		beats.begin(start)
+	}
+	var acl *aclTester
+	if cfg.ACL != nil {
+		acl = newACLTester(cfg, clients, creds, localAddr, certs)
+		acl.begin()
+	}
 	for i := 0; i < clients; i++ {
+		pubqos, _ := qosOf(cfg, i)
 		c := &PubClient{
 			ID:         i,
-			BrokerURL:  broker,
-			BrokerUser: username,
-			BrokerPass: password,
-			PubTopic:   topic + "-" + strconv.Itoa(i),
+			BrokerURL:  nodeOf(cfg, i),
+			BrokerUser: creds[i].Username,
+			BrokerPass: creds[i].Password,
+			ClientID:   creds[i].ClientID,
+			PubTopic:   topics[i],
 			MsgSize:    size,
-			MsgCount:   count,
+			MsgCount:   countOf(cfg, i),
 			PubQoS:     byte(pubqos),
 			KeepAlive:  keepalive,
 			Quiet:      quiet,
+			Transport:  quicRun.attach(chaos.attach(packets.attach(newTransport(cfg, localAddr(i), certs.pub(i)), "pub", i), RolePublisher, i)),
+			Backoff:    cfg.Backoff,
+			Timeout:    cfg.PublishTimeout,
+			Trim:       trim,
+			Streaming:  streaming,
+			Sizes:      cfg.SizeDist,
+			Compress:   cfg.Compress,
+			TopicAlias: cfg.TopicAlias,
+			Trace:      traces[topics[i]],
+			Pacer:      newPacer(cfg, i),
+			Think:      cfg.ThinkTime,
+			Duration:   cfg.Duration,
+			Responses:  responseTopic(cfg, topics[i]),
+			RespWait:   respWait,
+			Backend:    cfg.Backend,
+			ZeroCopy:   cfg.ZeroCopy,
+			Checksum:   cfg.Checksum,
+			Hooks:      cfg.Hooks,
+			StoreDir:   cfg.StoreDir,
+			clock:      clock,
+			live:       cfg.live,
+			replayAt:   start,
+			replayBase: replayBase,
+			rng:        payloadRand(cfg, i),
+			sizeRng:    clientRand(cfg, i, randSize),
+			stages:     plan,
+			window:     pubWindow(i),
+			abort:      abort,
+			outage:     outage,
+			chaos:      chaos,
+			spans:      spans,
+			metrics:    metrics,
+			progress:   cfg.progress,
+			limiter:    limiterOf(i),
+			connects:   connects,
+			pool:       pool,
+			topicRng:   clientRand(cfg, i, randTopic),
+			thinkRng:   clientRand(cfg, i, randThink),
+			backoffRng: clientRand(cfg, i, randBackoff),
 		}
 		go c.run(pubResCh)
 	}
@@ -157,18 +1041,30 @@ SUBJOBDONE:
 	for i := 0; i < clients; i++ {
 		pubresults[i] = <-pubResCh
 	}
-	totalTime := time.Now().Sub(start)
+	totalTime := clock.Now().Sub(start)
 	pubtotals := calculatePublishResults(pubresults, totalTime)
+	if len(cfg.QoSMix) == 0 {
+		pubtotals.AckPacket = ackPacket(byte(cfg.PubQoS))
+	}
 
 	for i := 0; i < 3; i++ {
-		time.Sleep(1 * time.Second)
+		clock.Sleep(1 * time.Second)
 		if !quiet {
 			log.Printf("Benchmark will stop after %v seconds.\n", 3-i)
 		}
 	}
+	if cfg.LateWindow > 0 {
+		for _, sub := range subs {
+			sub.cutoff()
+		}
+		if !quiet {
+			log.Printf("Counting late messages for %v.\n", cfg.LateWindow)
+		}
+		clock.Sleep(cfg.LateWindow)
+	}
 
 	// notify subscriber that job done
-	for i := 0; i < clients; i++ {
+	for i := 0; i < subscribers; i++ {
 		jobDone <- true
 	}
 
@@ -177,90 +1073,327 @@ SUBJOBDONE:
 	for i := 0; i < clients; i++ {
 		subresults[i] = <-subResCh
 	}
+	var refresults []*SubResults
+	if refResCh != nil {
+		for i := 0; i < clients; i++ {
+			refresults = append(refresults, <-refResCh)
+		}
+	}
 
 	// collect the sub results
 	subtotals := calculateSubscribeResults(subresults, pubresults)
+	if cfg.LateWindow > 0 {
+		calculateLateResults(subtotals, subresults)
+	}
+	if cfg.StallGap > 0 {
+		calculateInterArrival(subtotals, subresults)
+	}
+	if cfg.ReceiveMaximum > 0 {
+		calculateQueueTimes(subtotals, subresults)
+	}
+	if pool != nil {
+		// messages went to the owners of the pool topics, not to the subscriber of the same index
+		for _, res := range subresults {
+			res.Published = pool.expected(res.ID)
+			res.FwdRatio = 0
+			if res.Published > 0 {
+				res.FwdRatio = float64(res.Received) / float64(res.Published)
+			}
+		}
+	}
+
+	if soak != nil {
+		soak.close()
+	}
+	var probeResults []*ProbeResults
+	if probes != nil {
+		probeResults = probes.close()
+	}
+	cfg.live.detach(cfg)
+	var heartbeatResults *HeartbeatResults
+	if beats != nil {
+		heartbeatResults = beats.close()
+	}
+	var aclResults *ACLResults
+	if acl != nil {
+		aclResults = acl.close()
+	}
+	var idleResults *IdleResults
+	if idle != nil {
+		idleResults = idle.close()
+	}
+	var chaosEvents []*ChaosEvent
+	if chaos != nil {
+		chaosEvents = chaos.close()
+	}
+	if spans != nil {
+		spans.close()
+	}
+	if packets != nil {
+		packets.close()
+	}
+	if metrics != nil {
+		metrics.close()
+	}
 
 	if !quiet {
 		log.Printf("All jobs done.\n")
 	}
 
-	jr := JSONResults{
+	jr := &JSONResults{
 		PubRuns:   pubresults,
 		SubRuns:   subresults,
 		PubTotals: pubtotals,
 		SubTotals: subtotals,
 	}
+	jr.Probes = probeResults
+	if heat != nil {
+		jr.Heatmap = heat.results(subresults)
+	}
+	if pool != nil {
+		jr.TopicPool = pool.results()
+	}
+	jr.Heartbeat = heartbeatResults
+	jr.ACL = aclResults
+	jr.SubOpts = subOpts
+	jr.QUIC = quicResults(quicRun, quicProbe)
+	jr.Idle = idleResults
+	jr.Barrier = barrier
+	jr.Chaos = chaosEvents
+	jr.Drain = drained
+	jr.Labels = cfg.Labels
+	jr.ClockSync = clockSync
+	jr.Unit = "ms"
+	if cfg.Backend != nil {
+		jr.Backend = cfg.Backend.Name()
+	}
+	if outage != nil {
+		jr.Outage = calculateOutageResults(outage, pubresults, subresults)
+	}
+	if abort.aborted() {
+		jr.Aborted = true
+		jr.Reason = abort.reason
+	}
+	if plan != nil {
+		jr.StageRuns = calculateStageResults(plan, pubresults, subresults)
+	}
+	if cfg.SizeDist != nil {
+		jr.SizeRuns = calculateSizeResults(cfg.SizeDist, pubresults, subresults)
+	}
+	if groups != nil {
+		for _, res := range pubresults {
+			res.Group = groups.name(res.ID)
+		}
+		for _, res := range subresults {
+			res.Group = groups.name(res.ID)
+		}
+	}
+	if len(cfg.Nodes) > 0 {
+		for _, res := range pubresults {
+			res.Node = nodeOf(cfg, res.ID)
+		}
+		for _, res := range subresults {
+			res.Node = nodeOf(cfg, res.ID)
+		}
+		jr.NodeRuns = calculateNodeResults(cfg.Nodes, pubresults, subresults)
+	}
+	if len(cfg.QoSMix) > 0 {
+		jr.QoSRuns = calculateQoSResults(cfg, pubresults, subresults, totalTime)
+	}
+	if len(cfg.Tenants) > 0 {
+		jr.Tenants = calculateTenantResults(cfg, pubresults, subresults, totalTime)
+	}
+	if refresults != nil || cfg.IngressProperty != "" {
+		jr.Breakdown = calculateBreakdown(cfg.ReferenceBroker, cfg.IngressProperty, refresults, subresults)
+	}
+	if cfg.TopicBreakdown {
+		jr.TopicRuns = calculateTopicResults(subresults, pubresults, cfg.TopicGroupDepth)
+	}
+	if cfg.SLA != nil {
+		jr.SLA = cfg.SLA.check(jr)
+	}
+	if cfg.Outliers > 0 {
+		jr.Outliers = calculateOutliers(cfg.Outliers, pool != nil, pubresults, subresults)
+	}
+	if cfg.ExportDigests {
+		exportDigests(pubresults, subresults)
+	}
 
-	data, _ := json.Marshal(jr)
-
-	return data
+	return jr, nil
 }
 
 func calculatePublishResults(pubresults []*PubResults, totalTime time.Duration) *TotalPubResults {
 	pubtotals := new(TotalPubResults)
+	pubtotals.Errors = make(ErrorCounts)
 	pubtotals.TotalRunTime = totalTime.Seconds()
 
-	pubTimeMeans := make([]float64, len(pubresults))
+	// publishers without successes have no publish times to average
+	pubTimeMeans := []float64{}
+	pubTimeMeds := []float64{}
+	pubTimeTrims := []float64{}
+	digests := make([]*digest, len(pubresults))
+	rttDigests := make([]*digest, len(pubresults))
+	rttMeans := []float64{}
+	ackDigests := make([]*digest, len(pubresults))
+	ackMeans := []float64{}
 	msgsPerSecs := make([]float64, len(pubresults))
 	runTimes := make([]float64, len(pubresults))
 	bws := make([]float64, len(pubresults))
+	connectTimes := make([]float64, len(pubresults))
+	storeTimes := make([]float64, len(pubresults))
 
-	pubtotals.PubTimeMin = pubresults[0].PubTimeMin
 	for i, res := range pubresults {
+		if res.Successes > 0 {
+			if pubtotals.Successes == 0 || res.PubTimeMin < pubtotals.PubTimeMin {
+				pubtotals.PubTimeMin = res.PubTimeMin
+			}
+			if res.PubTimeMax > pubtotals.PubTimeMax {
+				pubtotals.PubTimeMax = res.PubTimeMax
+			}
+			pubTimeMeans = append(pubTimeMeans, res.PubTimeMean)
+			pubTimeMeds = append(pubTimeMeds, res.PubTimeMed)
+			pubTimeTrims = append(pubTimeTrims, res.PubTimeTrim)
+		}
 		pubtotals.Successes += res.Successes
 		pubtotals.Failures += res.Failures
 		pubtotals.TotalMsgsPerSec += res.PubsPerSec
 
-		if res.PubTimeMin < pubtotals.PubTimeMin {
-			pubtotals.PubTimeMin = res.PubTimeMin
+		rttDigests[i] = res.rttDigest
+		ackDigests[i] = res.ackDigest
+		if res.ackDigest != nil && res.Successes > 0 {
+			if len(ackMeans) == 0 || res.AckLatencyMin < pubtotals.AckLatencyMin {
+				pubtotals.AckLatencyMin = res.AckLatencyMin
+			}
+			if res.AckLatencyMax > pubtotals.AckLatencyMax {
+				pubtotals.AckLatencyMax = res.AckLatencyMax
+			}
+			ackMeans = append(ackMeans, res.AckLatencyMean)
 		}
-
-		if res.PubTimeMax > pubtotals.PubTimeMax {
-			pubtotals.PubTimeMax = res.PubTimeMax
+		if res.Responses > 0 {
+			if pubtotals.Responses == 0 || res.RTTMin < pubtotals.RTTMin {
+				pubtotals.RTTMin = res.RTTMin
+			}
+			if res.RTTMax > pubtotals.RTTMax {
+				pubtotals.RTTMax = res.RTTMax
+			}
+			pubtotals.Responses += res.Responses
+			rttMeans = append(rttMeans, res.RTTMean)
 		}
-
-		pubTimeMeans[i] = res.PubTimeMean
+		digests[i] = res.digest
 		msgsPerSecs[i] = res.PubsPerSec
 		runTimes[i] = res.RunTime
 		bws[i] = res.PubsPerSec
+		connectTimes[i] = res.ConnectTime
+		pubtotals.ConnectRetries += res.ConnectRetries
+		pubtotals.Errors.merge(res.Errors)
+		pubtotals.Disconnects += res.Disconnects
+		if i == 0 || res.Uptime < pubtotals.UptimeMin {
+			pubtotals.UptimeMin = res.Uptime
+		}
+		pubtotals.BlockedTime += res.BlockedTime
+		storeTimes[i] = res.StoreTime
+		if res.Backpressure {
+			pubtotals.Backpressured++
+		}
 	}
-	pubtotals.PubRatio = float64(pubtotals.Successes) / float64(pubtotals.Successes+pubtotals.Failures)
-	pubtotals.AvgMsgsPerSec = stats.StatsMean(msgsPerSecs)
-	pubtotals.AvgRunTime = stats.StatsMean(runTimes)
-	pubtotals.PubTimeMeanAvg = stats.StatsMean(pubTimeMeans)
-	pubtotals.PubTimeMeanStd = stats.StatsSampleStandardDeviation(pubTimeMeans)
+	// a ratio of nothing attempted would be NaN, which JSON cannot encode
+	if pubtotals.Successes+pubtotals.Failures > 0 {
+		pubtotals.PubRatio = float64(pubtotals.Successes) / float64(pubtotals.Successes+pubtotals.Failures)
+	}
+	pubtotals.AvgMsgsPerSec = summarize(msgsPerSecs).mean
+	pubtotals.AvgRunTime = summarize(runTimes).mean
+	pubtotals.PubTimeMeanAvg = summarize(pubTimeMeans).mean
+	pubtotals.PubTimeMeanStd = summarize(pubTimeMeans).std()
+	pubtotals.PubTimeMeanCI = confidence95(pubTimeMeans)
+	pubtotals.PubTimeMedAvg = summarize(pubTimeMeds).mean
+	pubtotals.PubTimeTrimAvg = summarize(pubTimeTrims).mean
+	pubtotals.PubTimePct = mergeDigests(digests).percentiles()
+	pubtotals.Compression = calculateCompressionResults(pubresults, pubtotals.TotalRunTime)
+	pubtotals.TopicAlias = calculateTopicAliasResults(pubresults)
+	if len(ackMeans) > 0 {
+		pubtotals.AckLatencyMean = summarize(ackMeans).mean
+		pubtotals.AckLatencyPct = mergeDigests(ackDigests).percentiles()
+	}
+	if pubtotals.Responses > 0 {
+		pubtotals.RTTMeanAvg = summarize(rttMeans).mean
+		pubtotals.RTTPct = mergeDigests(rttDigests).percentiles()
+	}
+	pubtotals.AvgMsgsPerSecCI = confidence95(msgsPerSecs)
+	pubtotals.ConnectTimeMean = summarize(connectTimes).mean
+	pubtotals.StoreTimeMean = summarize(storeTimes).mean
+	pubtotals.ConnectTimeMax = summarize(connectTimes).max
 
 	return pubtotals
 }
 
 func calculateSubscribeResults(subresults []*SubResults, pubresults []*PubResults) *TotalSubResults {
 	subtotals := new(TotalSubResults)
-	fwdLatencyMeans := make([]float64, len(subresults))
+	subtotals.Errors = make(ErrorCounts)
+	// subscribers that received nothing have no latencies to average
+	fwdLatencyMeans := []float64{}
+	fwdLatencyMeds := []float64{}
+	fwdLatencyTrims := []float64{}
+	decompressTimes := make([]float64, len(subresults))
+	digests := make([]*digest, len(subresults))
+	connectTimes := make([]float64, len(subresults))
 
-	subtotals.FwdLatencyMin = subresults[0].FwdLatencyMin
 	for i, res := range subresults {
+		if res.Received > 0 {
+			if subtotals.TotalReceived == 0 || res.FwdLatencyMin < subtotals.FwdLatencyMin {
+				subtotals.FwdLatencyMin = res.FwdLatencyMin
+			}
+			if res.FwdLatencyMax > subtotals.FwdLatencyMax {
+				subtotals.FwdLatencyMax = res.FwdLatencyMax
+			}
+			fwdLatencyMeans = append(fwdLatencyMeans, res.FwdLatencyMean)
+			fwdLatencyMeds = append(fwdLatencyMeds, res.FwdLatencyMed)
+			fwdLatencyTrims = append(fwdLatencyTrims, res.FwdLatencyTrim)
+		}
 		subtotals.TotalReceived += res.Received
 
-		if res.FwdLatencyMin < subtotals.FwdLatencyMin {
-			subtotals.FwdLatencyMin = res.FwdLatencyMin
+		decompressTimes[i] = res.DecompressTime
+		digests[i] = res.digest
+		connectTimes[i] = res.ConnectTime
+		subtotals.ConnectRetries += res.ConnectRetries
+		subtotals.Errors.merge(res.Errors)
+		subtotals.Disconnects += res.Disconnects
+		if i == 0 || res.Uptime < subtotals.UptimeMin {
+			subtotals.UptimeMin = res.Uptime
 		}
-
-		if res.FwdLatencyMax > subtotals.FwdLatencyMax {
-			subtotals.FwdLatencyMax = res.FwdLatencyMax
+		subtotals.OutOfOrder += res.OutOfOrder
+		subtotals.Redelivered += res.Redelivered
+		subtotals.Corrupt += res.Corrupt
+		subtotals.QoSDowngrades += res.QoSDowngrades
+		if res.downgraded {
+			subtotals.Downgraded++
+		}
+		subtotals.SizeMismatches += res.SizeMismatches
+		subtotals.Truncated += res.Truncated
+		if res.MaxReorder > subtotals.MaxReorder {
+			subtotals.MaxReorder = res.MaxReorder
 		}
-
-		fwdLatencyMeans[i] = res.FwdLatencyMean
 		for _, pubres := range pubresults {
 			if pubres.ID == res.ID {
 				subtotals.TotalPublished += pubres.Successes
 				res.Published = pubres.Successes
-				res.FwdRatio = float64(res.Received) / float64(pubres.Successes)
+				if pubres.Successes > 0 {
+					res.FwdRatio = float64(res.Received) / float64(pubres.Successes)
+				}
 			}
 		}
 	}
-	subtotals.FwdLatencyMeanAvg = stats.StatsMean(fwdLatencyMeans)
-	subtotals.FwdLatencyMeanStd = stats.StatsSampleStandardDeviation(fwdLatencyMeans)
-	subtotals.TotalFwdRatio = float64(subtotals.TotalReceived) / float64(subtotals.TotalPublished)
+	subtotals.FwdLatencyMeanAvg = summarize(fwdLatencyMeans).mean
+	subtotals.FwdLatencyMeanStd = summarize(fwdLatencyMeans).std()
+	subtotals.FwdLatencyMeanCI = confidence95(fwdLatencyMeans)
+	subtotals.FwdLatencyMedAvg = summarize(fwdLatencyMeds).mean
+	subtotals.FwdLatencyTrimAvg = summarize(fwdLatencyTrims).mean
+	subtotals.FwdLatencyPct = mergeDigests(digests).percentiles()
+	subtotals.DecompressTime = summarize(decompressTimes).mean
+	subtotals.ConnectTimeMean = summarize(connectTimes).mean
+	subtotals.ConnectTimeMax = summarize(connectTimes).max
+	// a ratio of nothing published would be NaN, which JSON cannot encode
+	if subtotals.TotalPublished > 0 {
+		subtotals.TotalFwdRatio = float64(subtotals.TotalReceived) / float64(subtotals.TotalPublished)
+	}
 	return subtotals
 }
@@ -0,0 +1,82 @@
+package mqttbmlatency
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubscribeTotalsSkipEmptySubscribers(t *testing.T) {
+	subs := []*SubResults{
+		{ID: 0}, // received nothing
+		{ID: 1, Received: 10, FwdLatencyMin: 2, FwdLatencyMax: 8, FwdLatencyMean: 4, FwdLatencyMed: 3, FwdLatencyTrim: 4},
+		{ID: 2, Received: 5, FwdLatencyMin: 3, FwdLatencyMax: 9, FwdLatencyMean: 6, FwdLatencyMed: 5, FwdLatencyTrim: 6},
+	}
+	pubs := []*PubResults{{ID: 0, Successes: 10}, {ID: 1, Successes: 10}, {ID: 2, Successes: 10}}
+	totals := calculateSubscribeResults(subs, pubs)
+	if totals.FwdLatencyMin != 2 || totals.FwdLatencyMax != 9 {
+		t.Errorf("min, max = %v, %v, want 2, 9", totals.FwdLatencyMin, totals.FwdLatencyMax)
+	}
+	if !near(totals.FwdLatencyMeanAvg, 5, 1e-9) || !near(totals.FwdLatencyMedAvg, 4, 1e-9) || !near(totals.FwdLatencyTrimAvg, 5, 1e-9) {
+		t.Errorf("mean, median, trimmed mean averages = %v, %v, %v, want 5, 4, 5",
+			totals.FwdLatencyMeanAvg, totals.FwdLatencyMedAvg, totals.FwdLatencyTrimAvg)
+	}
+	if totals.TotalReceived != 15 || totals.TotalPublished != 30 {
+		t.Errorf("received %d of %d, want 15 of 30", totals.TotalReceived, totals.TotalPublished)
+	}
+
+	data, err := json.Marshal(subs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "fwd_time_") {
+		t.Errorf("subscriber without messages reports latencies: %s", data)
+	}
+}
+
+func TestPublishTotalsSkipEmptyPublishers(t *testing.T) {
+	tests := []struct {
+		name  string
+		pubs  []*PubResults
+		min   float64
+		mean  float64
+		ratio float64
+	}{
+		{"one failed", []*PubResults{
+			{Failures: 3},
+			{Successes: 9, Failures: 0, PubTimeMin: 1, PubTimeMax: 4, PubTimeMean: 2},
+		}, 1, 2, 0.75},
+		{"none connected", []*PubResults{{}, {}}, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			totals := calculatePublishResults(tt.pubs, time.Second)
+			if totals.PubTimeMin != tt.min || !near(totals.PubTimeMeanAvg, tt.mean, 1e-9) {
+				t.Errorf("min, mean average = %v, %v, want %v, %v", totals.PubTimeMin, totals.PubTimeMeanAvg, tt.min, tt.mean)
+			}
+			if !near(totals.PubRatio, tt.ratio, 1e-9) {
+				t.Errorf("publish ratio = %v, want %v", totals.PubRatio, tt.ratio)
+			}
+			if _, err := json.Marshal(totals); err != nil {
+				t.Errorf("totals cannot be encoded: %v", err)
+			}
+		})
+	}
+}
+
+func TestEmbeddedRejectsBrokerComparisons(t *testing.T) {
+	data, code := RunWithExitCode(&Config{
+		Embedded:  true,
+		Brokers:   []string{"tcp://127.0.0.1:1", "tcp://127.0.0.1:2"},
+		Topic:     "embedded",
+		Clients:   1,
+		Count:     1,
+		Size:      64,
+		KeepAlive: 30,
+		Quiet:     true,
+	})
+	if code != ExitConfig || data != nil {
+		t.Errorf("exit code %d with %q, want %d without results", code, data, ExitConfig)
+	}
+}
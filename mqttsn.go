@@ -0,0 +1,372 @@
+package mqttbmlatency
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MQTT-SN v1.2 message types
+const (
+	snConnect    = 0x04
+	snConnack    = 0x05
+	snRegister   = 0x0A
+	snRegack     = 0x0B
+	snPublish    = 0x0C
+	snPuback     = 0x0D
+	snPubcomp    = 0x0E
+	snPubrec     = 0x0F
+	snPubrel     = 0x10
+	snSubscribe  = 0x12
+	snSuback     = 0x13
+	snPingreq    = 0x16
+	snPingresp   = 0x17
+	snDisconnect = 0x18
+)
+
+const (
+	snFlagCleanSession = 0x04
+	snQoSShift         = 5
+
+	snRetryInterval = 5 * time.Second
+	snRetryCount    = 3
+)
+
+// isMQTTSN reports whether brokerURL points at an MQTT-SN gateway (udp:// or mqttsn://)
+func isMQTTSN(brokerURL string) bool {
+	u, err := url.Parse(brokerURL)
+	return err == nil && (u.Scheme == "udp" || u.Scheme == "mqttsn")
+}
+
+// snClient is a minimal MQTT-SN client over UDP, supporting normal topic IDs
+// and QoS 0-2 for both publishing and subscribing.
+type snClient struct {
+	conn      net.Conn
+	keepAlive time.Duration
+	onMessage snMessageHandler
+	onLost    func(err error)
+
+	mu      sync.Mutex
+	msgID   uint16
+	pending map[uint16]chan []byte // replies keyed by message ID
+	topics  map[uint16]string      // topic ID -> topic name
+	connack chan []byte
+	done    chan bool
+}
+
+type snMessageHandler func(topic string, qos byte, payload []byte)
+
+// dialMQTTSN connects to the gateway at brokerURL and performs the CONNECT handshake
+func dialMQTTSN(brokerURL string, clientID string, keepAlive time.Duration, onMessage snMessageHandler, onLost func(error)) (*snClient, error) {
+	u, err := url.Parse(brokerURL)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	c := &snClient{
+		conn:      conn,
+		keepAlive: keepAlive,
+		onMessage: onMessage,
+		onLost:    onLost,
+		pending:   make(map[uint16]chan []byte),
+		topics:    make(map[uint16]string),
+		connack:   make(chan []byte, 1),
+		done:      make(chan bool),
+	}
+	go c.readLoop()
+
+	// CONNECT: flags, protocol id, duration, client id
+	pkt := []byte{snFlagCleanSession, 0x01, 0, 0}
+	binary.BigEndian.PutUint16(pkt[2:], uint16(keepAlive.Seconds()))
+	pkt = append(pkt, clientID...)
+
+	var reply []byte
+	for i := 0; i < snRetryCount && reply == nil; i++ {
+		if err = c.send(snConnect, pkt); err != nil {
+			c.close()
+			return nil, err
+		}
+		select {
+		case reply = <-c.connack:
+		case <-time.After(snRetryInterval):
+		}
+	}
+	if reply == nil {
+		c.close()
+		return nil, errors.New("CONNACK timeout")
+	}
+	if len(reply) < 1 || reply[0] != 0 {
+		c.close()
+		return nil, fmt.Errorf("connection refused, return code %v", reply)
+	}
+	if keepAlive > 0 {
+		go c.pingLoop()
+	}
+	return c, nil
+}
+
+// register obtains the topic ID to publish on topic
+func (c *snClient) register(topic string) (uint16, error) {
+	id := c.nextID()
+	pkt := make([]byte, 4, 4+len(topic))
+	binary.BigEndian.PutUint16(pkt[2:], id)
+	pkt = append(pkt, topic...)
+	reply, err := c.exchange(snRegister, id, pkt)
+	if err != nil {
+		return 0, err
+	}
+	if len(reply) < 5 || reply[4] != 0 {
+		return 0, fmt.Errorf("REGISTER of %v rejected", topic)
+	}
+	return binary.BigEndian.Uint16(reply), nil
+}
+
+// subscribe subscribes to topic and records the topic ID assigned by the
+// gateway, returning the granted QoS
+func (c *snClient) subscribe(topic string, qos byte) (byte, error) {
+	id := c.nextID()
+	pkt := make([]byte, 3, 3+len(topic))
+	pkt[0] = qos << snQoSShift
+	binary.BigEndian.PutUint16(pkt[1:], id)
+	pkt = append(pkt, topic...)
+	reply, err := c.exchange(snSubscribe, id, pkt)
+	if err != nil {
+		return 0, err
+	}
+	if len(reply) < 6 || reply[5] != 0 {
+		return 0, fmt.Errorf("SUBSCRIBE to %v rejected", topic)
+	}
+	c.mu.Lock()
+	c.topics[binary.BigEndian.Uint16(reply[1:])] = topic
+	c.mu.Unlock()
+	return reply[0] >> snQoSShift & 0x03, nil
+}
+
+// publish sends payload on a registered topic and waits for the QoS handshake to complete
+func (c *snClient) publish(topicID uint16, qos byte, payload []byte) error {
+	var id uint16
+	if qos > 0 {
+		id = c.nextID()
+	}
+	pkt := make([]byte, 5, 5+len(payload))
+	pkt[0] = qos << snQoSShift
+	binary.BigEndian.PutUint16(pkt[1:], topicID)
+	binary.BigEndian.PutUint16(pkt[3:], id)
+	pkt = append(pkt, payload...)
+
+	if qos == 0 {
+		return c.send(snPublish, pkt)
+	}
+	reply, err := c.exchange(snPublish, id, pkt)
+	if err != nil {
+		return err
+	}
+	if qos == 1 {
+		if len(reply) < 5 || reply[4] != 0 {
+			return errors.New("PUBLISH rejected")
+		}
+		return nil
+	}
+	rel := make([]byte, 2)
+	binary.BigEndian.PutUint16(rel, id)
+	_, err = c.exchange(snPubrel, id, rel)
+	return err
+}
+
+func (c *snClient) disconnect() {
+	c.send(snDisconnect, nil)
+	c.close()
+}
+
+func (c *snClient) close() {
+	c.mu.Lock()
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+	c.mu.Unlock()
+	c.conn.Close()
+}
+
+func (c *snClient) nextID() uint16 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.msgID++
+	if c.msgID == 0 {
+		c.msgID = 1
+	}
+	return c.msgID
+}
+
+// exchange sends a packet and waits for the reply carrying the same message ID,
+// retransmitting on timeout since UDP gives no delivery guarantees
+func (c *snClient) exchange(msgType byte, id uint16, pkt []byte) ([]byte, error) {
+	ch := make(chan []byte, 1)
+	c.mu.Lock()
+	c.pending[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	for i := 0; i < snRetryCount; i++ {
+		if i > 0 && msgType == snPublish {
+			pkt[0] |= 0x80 // DUP
+		}
+		if err := c.send(msgType, pkt); err != nil {
+			return nil, err
+		}
+		select {
+		case reply := <-ch:
+			return reply, nil
+		case <-c.done:
+			return nil, errors.New("connection closed")
+		case <-time.After(snRetryInterval):
+		}
+	}
+	return nil, fmt.Errorf("no reply to message %v: %w", id, errTimeout)
+}
+
+func (c *snClient) send(msgType byte, body []byte) error {
+	var pkt []byte
+	if n := len(body) + 2; n < 256 {
+		pkt = append([]byte{byte(n), msgType}, body...)
+	} else {
+		pkt = []byte{0x01, 0, 0, msgType}
+		binary.BigEndian.PutUint16(pkt[1:], uint16(n+2))
+		pkt = append(pkt, body...)
+	}
+	_, err := c.conn.Write(pkt)
+	return err
+}
+
+func (c *snClient) reply(id uint16, body []byte) {
+	c.mu.Lock()
+	ch, ok := c.pending[id]
+	c.mu.Unlock()
+	if ok {
+		select {
+		case ch <- body:
+		default:
+		}
+	}
+}
+
+func (c *snClient) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			select {
+			case <-c.done:
+			default:
+				c.close()
+				if c.onLost != nil {
+					c.onLost(err)
+				}
+			}
+			return
+		}
+		pkt := buf[:n]
+		if len(pkt) < 2 {
+			continue
+		}
+		if pkt[0] == 0x01 {
+			if len(pkt) < 4 {
+				continue
+			}
+			pkt = pkt[3:]
+		} else {
+			pkt = pkt[1:]
+		}
+		msgType, body := pkt[0], append([]byte(nil), pkt[1:]...)
+
+		switch msgType {
+		case snConnack:
+			select {
+			case c.connack <- body:
+			default:
+			}
+		case snRegack, snPuback:
+			if len(body) >= 4 {
+				c.reply(binary.BigEndian.Uint16(body[2:]), body)
+			}
+		case snSuback:
+			if len(body) >= 5 {
+				c.reply(binary.BigEndian.Uint16(body[3:]), body)
+			}
+		case snPubrec, snPubcomp:
+			if len(body) >= 2 {
+				c.reply(binary.BigEndian.Uint16(body), body)
+			}
+		case snRegister:
+			// the gateway announces topic IDs for wildcard subscriptions
+			if len(body) >= 4 {
+				c.mu.Lock()
+				c.topics[binary.BigEndian.Uint16(body)] = string(body[4:])
+				c.mu.Unlock()
+				c.send(snRegack, append(body[:4:4], 0))
+			}
+		case snPublish:
+			c.handlePublish(body)
+		case snPubrel:
+			if len(body) >= 2 {
+				c.send(snPubcomp, body[:2])
+			}
+		case snPingresp:
+		}
+	}
+}
+
+func (c *snClient) handlePublish(body []byte) {
+	if len(body) < 5 {
+		return
+	}
+	qos := (body[0] >> snQoSShift) & 0x03
+	topicID := binary.BigEndian.Uint16(body[1:])
+	c.mu.Lock()
+	topic := c.topics[topicID]
+	c.mu.Unlock()
+
+	switch qos {
+	case 1:
+		c.send(snPuback, append(body[1:5:5], 0))
+	case 2:
+		c.send(snPubrec, body[3:5])
+	}
+	if c.onMessage != nil {
+		c.onMessage(topic, qos, body[5:])
+	}
+}
+
+func (c *snClient) pingLoop() {
+	ticker := time.NewTicker(c.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.send(snPingreq, nil); err != nil {
+				log.Printf("MQTT-SN ping failed: %v\n", err)
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// snClientID builds a client ID within the 23 byte MQTT-SN limit
+func snClientID(id int) string {
+	return "bm" + strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.Itoa(id)
+}
@@ -0,0 +1,315 @@
+package mqttbmlatency
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// snGateway is a loopback MQTT-SN gateway routing between its clients. It
+// assigns topic IDs on REGISTER and SUBSCRIBE, announces them with REGISTER
+// to wildcard subscribers, and completes the QoS 1 and 2 flows both ways.
+type snGateway struct {
+	conn *net.UDPConn
+
+	mu       sync.Mutex
+	topics   map[string]uint16
+	subs     map[string][]snSubscription // by client address
+	known    map[string]map[uint16]bool  // topic IDs each client was told about
+	msgID    uint16
+	pubcomps int // PUBCOMPs received from subscribers
+}
+
+type snSubscription struct {
+	filter string
+	qos    byte
+}
+
+func newSNGateway(t *testing.T) *snGateway {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &snGateway{
+		conn:   conn,
+		topics: make(map[string]uint16),
+		subs:   make(map[string][]snSubscription),
+		known:  make(map[string]map[uint16]bool),
+	}
+	go g.serve()
+	t.Cleanup(func() { conn.Close() })
+	return g
+}
+
+func (g *snGateway) url() string {
+	return "udp://" + g.conn.LocalAddr().String()
+}
+
+func (g *snGateway) send(to *net.UDPAddr, msgType byte, body []byte) {
+	g.conn.WriteToUDP(append([]byte{byte(len(body) + 2), msgType}, body...), to)
+}
+
+// topicID must be called with the lock held
+func (g *snGateway) topicID(name string) uint16 {
+	id, ok := g.topics[name]
+	if !ok {
+		id = uint16(len(g.topics) + 1)
+		g.topics[name] = id
+	}
+	return id
+}
+
+// nextID must be called with the lock held
+func (g *snGateway) nextID() uint16 {
+	g.msgID++
+	return g.msgID
+}
+
+func (g *snGateway) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < 2 || int(buf[0]) != n {
+			continue
+		}
+		msgType, body := buf[1], append([]byte(nil), buf[2:n]...)
+		g.handle(from, msgType, body)
+	}
+}
+
+func (g *snGateway) handle(from *net.UDPAddr, msgType byte, body []byte) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch msgType {
+	case snConnect:
+		g.send(from, snConnack, []byte{0})
+	case snRegister:
+		name := string(body[4:])
+		reply := make([]byte, 5)
+		copy(reply[2:4], body[2:4])
+		if name == "denied" {
+			reply[4] = 3 // not supported
+		} else {
+			binary.BigEndian.PutUint16(reply, g.topicID(name))
+		}
+		g.send(from, snRegack, reply)
+	case snSubscribe:
+		qos, filter := body[0]>>snQoSShift&0x03, string(body[3:])
+		g.subs[from.String()] = append(g.subs[from.String()], snSubscription{filter, qos})
+		var id uint16
+		if !strings.ContainsAny(filter, "+#") {
+			id = g.topicID(filter)
+			g.tell(from, id)
+		}
+		reply := make([]byte, 6)
+		reply[0] = qos << snQoSShift
+		binary.BigEndian.PutUint16(reply[1:], id)
+		copy(reply[3:5], body[1:3])
+		g.send(from, snSuback, reply)
+	case snPublish:
+		qos, topicID := body[0]>>snQoSShift&0x03, binary.BigEndian.Uint16(body[1:])
+		switch qos {
+		case 1:
+			g.send(from, snPuback, append(body[1:5:5], 0))
+		case 2:
+			g.send(from, snPubrec, body[3:5])
+		}
+		for name, id := range g.topics {
+			if id == topicID {
+				g.route(name, id, qos, body[5:])
+			}
+		}
+	case snPubrel:
+		g.send(from, snPubcomp, body[:2])
+	case snPubrec:
+		g.send(from, snPubrel, body[:2])
+	case snPubcomp:
+		g.pubcomps++
+	case snPingreq:
+		g.send(from, snPingresp, nil)
+	}
+}
+
+// tell announces topic ID id to a client once; must be called with the lock held
+func (g *snGateway) tell(to *net.UDPAddr, id uint16) bool {
+	known := g.known[to.String()]
+	if known == nil {
+		known = make(map[uint16]bool)
+		g.known[to.String()] = known
+	}
+	if known[id] {
+		return false
+	}
+	known[id] = true
+	return true
+}
+
+// route must be called with the lock held
+func (g *snGateway) route(name string, id uint16, qos byte, payload []byte) {
+	for addr, subs := range g.subs {
+		to, _ := net.ResolveUDPAddr("udp", addr)
+		for _, s := range subs {
+			if !topicMatches(s.filter, name) {
+				continue
+			}
+			if g.tell(to, id) {
+				reg := make([]byte, 4, 4+len(name))
+				binary.BigEndian.PutUint16(reg, id)
+				binary.BigEndian.PutUint16(reg[2:], g.nextID())
+				g.send(to, snRegister, append(reg, name...))
+			}
+			q := minQoS(qos, s.qos)
+			pkt := make([]byte, 5, 5+len(payload))
+			pkt[0] = q << snQoSShift
+			binary.BigEndian.PutUint16(pkt[1:], id)
+			if q > 0 {
+				binary.BigEndian.PutUint16(pkt[3:], g.nextID())
+			}
+			g.send(to, snPublish, append(pkt, payload...))
+			break
+		}
+	}
+}
+
+// topicMatches matches a topic name against a filter with + and # wildcards
+func topicMatches(filter, name string) bool {
+	f, n := strings.Split(filter, "/"), strings.Split(name, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(n) || (level != "+" && level != n[i]) {
+			return false
+		}
+	}
+	return len(f) == len(n)
+}
+
+type snReceived struct {
+	topic   string
+	qos     byte
+	payload string
+}
+
+func TestMQTTSNQoS(t *testing.T) {
+	for _, tt := range []struct {
+		name           string
+		filter         string
+		pubQoS, subQoS byte
+		wantQoS        byte
+		wantPubcomps   int
+	}{
+		{"qos 0", "sn/qos", 0, 0, 0, 0},
+		{"qos 1", "sn/qos", 1, 1, 1, 0},
+		{"qos 2", "sn/qos", 2, 2, 2, 3},
+		{"downgraded", "sn/qos", 2, 1, 1, 0},
+		{"wildcard", "sn/#", 1, 1, 1, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newSNGateway(t)
+			received := make(chan snReceived, 10)
+			sub, err := dialMQTTSN(g.url(), "sub", time.Minute, func(topic string, qos byte, payload []byte) {
+				received <- snReceived{topic, qos, string(payload)}
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.disconnect()
+			granted, err := sub.subscribe(tt.filter, tt.subQoS)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if granted != tt.subQoS {
+				t.Errorf("granted QoS %v, want %v", granted, tt.subQoS)
+			}
+
+			pub, err := dialMQTTSN(g.url(), "pub", time.Minute, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pub.disconnect()
+			topicID, err := pub.register("sn/qos")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range []string{"a", "b", "c"} {
+				if err := pub.publish(topicID, tt.pubQoS, []byte(m)); err != nil {
+					t.Fatalf("publish %v: %v", m, err)
+				}
+			}
+
+			for _, want := range []string{"a", "b", "c"} {
+				select {
+				case m := <-received:
+					if m.topic != "sn/qos" || m.qos != tt.wantQoS || m.payload != want {
+						t.Errorf("received %q on %q at QoS %v, want %q on sn/qos at QoS %v", m.payload, m.topic, m.qos, want, tt.wantQoS)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("message %v not received", want)
+				}
+			}
+			if tt.wantPubcomps > 0 {
+				// the subscriber's PUBCOMP follows its delivery
+				deadline := time.Now().Add(5 * time.Second)
+				for {
+					g.mu.Lock()
+					n := g.pubcomps
+					g.mu.Unlock()
+					if n == tt.wantPubcomps || time.Now().After(deadline) {
+						if n != tt.wantPubcomps {
+							t.Errorf("%d PUBCOMPs from the subscriber, want %d", n, tt.wantPubcomps)
+						}
+						break
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+		})
+	}
+}
+
+func TestMQTTSNRegisterRejected(t *testing.T) {
+	g := newSNGateway(t)
+	c, err := dialMQTTSN(g.url(), "pub", 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.disconnect()
+	if _, err := c.register("denied"); err == nil {
+		t.Error("rejected REGISTER succeeded")
+	}
+	id, err := c.register("allowed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := c.register("allowed"); err != nil || again != id {
+		t.Errorf("registered the topic again as %v (%v), want %v", again, err, id)
+	}
+}
+
+func TestMQTTSNBenchmark(t *testing.T) {
+	g := newSNGateway(t)
+	jr, err := benchmark(&Config{
+		Broker:    g.url(),
+		Topic:     "sn/bench",
+		PubQoS:    1,
+		SubQoS:    1,
+		Clients:   2,
+		Count:     20,
+		Size:      64,
+		KeepAlive: 30,
+		Quiet:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jr.PubTotals.Successes != 40 || jr.SubTotals.TotalReceived != 40 {
+		t.Errorf("%d published and %d received, want 40 each", jr.PubTotals.Successes, jr.SubTotals.TotalReceived)
+	}
+}
@@ -0,0 +1,72 @@
+package mqttbmlatency
+
+// NodeResults describes the clients connected to one node of a cluster
+type NodeResults struct {
+	Node            string       `json:"node"`
+	Clients         int          `json:"clients"`
+	Published       int64        `json:"published"`
+	PubFailures     int64        `json:"pub_failures"`
+	Received        int64        `json:"received"`
+	FwdRatio        float64      `json:"fwd_success_ratio"`
+	PubTimeMean     float64      `json:"pub_time_mean"`    // weighted by messages published
+	FwdLatencyMean  float64      `json:"fwd_latency_mean"` // weighted by messages received
+	FwdLatencyPct   *Percentiles `json:"fwd_latency_percentiles,omitempty"`
+	ConnectTimeMean float64      `json:"connect_time_mean"`
+	Disconnects     int64        `json:"disconnects"`
+}
+
+// nodeOf returns the broker URL client i connects to
+func nodeOf(cfg *Config, i int) string {
+	if len(cfg.Nodes) == 0 {
+		return cfg.Broker
+	}
+	return cfg.Nodes[i%len(cfg.Nodes)]
+}
+
+// calculateNodeResults aggregates per cluster node, in the order of nodes.
+// Publisher and subscriber i both connect to the node of client i.
+func calculateNodeResults(nodes []string, pubresults []*PubResults, subresults []*SubResults) []*NodeResults {
+	results := make([]*NodeResults, len(nodes))
+	digests := make([][]*digest, len(nodes))
+	pubSums := make([]float64, len(nodes))
+	fwdSums := make([]float64, len(nodes))
+	connectSums := make([]float64, len(nodes))
+	for k, node := range nodes {
+		results[k] = &NodeResults{Node: node}
+	}
+
+	for _, res := range pubresults {
+		n := results[res.ID%len(nodes)]
+		n.Clients++
+		n.Published += res.Successes
+		n.PubFailures += res.Failures
+		n.Disconnects += res.Disconnects
+		pubSums[res.ID%len(nodes)] += res.PubTimeMean * float64(res.Successes)
+		connectSums[res.ID%len(nodes)] += res.ConnectTime
+	}
+	for _, res := range subresults {
+		k := res.ID % len(nodes)
+		n := results[k]
+		n.Received += res.Received
+		n.Disconnects += res.Disconnects
+		fwdSums[k] += res.FwdLatencyMean * float64(res.Received)
+		connectSums[k] += res.ConnectTime
+		digests[k] = append(digests[k], res.digest)
+	}
+
+	for k, n := range results {
+		if n.Published > 0 {
+			n.FwdRatio = float64(n.Received) / float64(n.Published)
+			n.PubTimeMean = pubSums[k] / float64(n.Published)
+		}
+		if n.Received > 0 {
+			n.FwdLatencyMean = fwdSums[k] / float64(n.Received)
+		}
+		if n.Clients > 0 {
+			// every client has a publisher and a subscriber connection
+			n.ConnectTimeMean = connectSums[k] / float64(2*n.Clients)
+		}
+		n.FwdLatencyPct = mergeDigests(digests[k]).percentiles()
+	}
+	return results
+}
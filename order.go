@@ -0,0 +1,42 @@
+package mqttbmlatency
+
+import (
+	"sort"
+)
+
+// defaultTrimFraction is the share of samples dropped at each end for the
+// trimmed mean unless Config.TrimFraction says otherwise
+const defaultTrimFraction = 0.05
+
+// median returns the median of sorted samples, 0 for none
+func median(sorted []float64) float64 {
+	n := len(sorted)
+	switch {
+	case n == 0:
+		return 0
+	case n%2 == 1:
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// trimmedMean returns the mean of sorted samples after dropping the given
+// fraction of them at each end, 0 for none
+func trimmedMean(sorted []float64, fraction float64) float64 {
+	k := int(float64(len(sorted)) * fraction)
+	kept := sorted[k : len(sorted)-k]
+	if len(kept) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range kept {
+		sum += v
+	}
+	return sum / float64(len(kept))
+}
+
+// orderStats sorts samples in place and returns their median and trimmed mean
+func orderStats(samples []float64, fraction float64) (float64, float64) {
+	sort.Float64s(samples)
+	return median(samples), trimmedMean(samples, fraction)
+}
@@ -0,0 +1,219 @@
+package mqttbmlatency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spanKindProducer = 4
+	spanKindConsumer = 5
+	spanStatusError  = 2
+
+	spanBatchSize     = 512
+	spanFlushInterval = time.Second
+	spanExportTimeout = 10 * time.Second // per batch, so a stuck collector cannot hold up the end of the run
+)
+
+// otlpSpan is a span in the OTLP/JSON encoding
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code"`
+}
+
+// spanExporter batches publish/receive spans and posts them to an OTLP/HTTP endpoint.
+// Spans of one message share a trace ID derived from the run, topic, sequence
+// number and send time, and the receive span is parented to the publish span, so both sides
+// link up without any context being carried in the payload.
+type spanExporter struct {
+	url    string
+	client *http.Client
+	runID  string
+	quiet  bool
+	// resource attributes: the service name and the run labels
+	resource []otlpAttribute
+	spans    chan *otlpSpan
+	done     chan bool
+
+	// handlers of clients that were not joined may still record spans
+	// while the exporter closes
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newSpanExporter(endpoint string, labels map[string]string, quiet bool) *spanExporter {
+	e := &spanExporter{
+		url:    strings.TrimRight(endpoint, "/") + "/v1/traces",
+		client: &http.Client{Timeout: spanExportTimeout},
+		runID:  strconv.FormatInt(time.Now().UnixNano(), 10),
+		quiet:  quiet,
+		spans:  make(chan *otlpSpan, spanBatchSize*4),
+		done:   make(chan bool),
+	}
+	e.resource = []otlpAttribute{stringAttribute("service.name", "mqtt-bm-latency")}
+	for _, kv := range labelList(labels) {
+		k, v, _ := strings.Cut(kv, "=")
+		e.resource = append(e.resource, stringAttribute(k, v))
+	}
+	go e.run()
+	return e
+}
+
+// spanIDs derives the trace ID and the publish/receive span IDs of a message.
+// Publishers sharing a pool topic send the same sequence numbers, so the send
+// time in unix nanoseconds, the one field of the payload that tells them apart
+// at the subscriber, goes into the IDs too.
+func (e *spanExporter) spanIDs(topic string, seq, sent int64) (traceID, pubID, recvID string) {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%v|%v|%v|%v", e.runID, topic, seq, sent)))
+	return hex.EncodeToString(sum[:16]), hex.EncodeToString(sum[16:24]), hex.EncodeToString(sum[24:32])
+}
+
+func (e *spanExporter) publish(clientID int, m *Message) {
+	traceID, pubID, _ := e.spanIDs(m.Topic, m.Seq, m.Sent.UnixNano())
+	span := &otlpSpan{
+		TraceID:    traceID,
+		SpanID:     pubID,
+		Name:       m.Topic + " publish",
+		Kind:       spanKindProducer,
+		Start:      strconv.FormatInt(m.Sent.UnixNano(), 10),
+		End:        strconv.FormatInt(m.Delivered.UnixNano(), 10),
+		Attributes: messageAttributes(clientID, m.Topic, m.QoS, m.Seq),
+	}
+	if m.Error {
+		span.End = span.Start
+		span.Status = &otlpStatus{Code: spanStatusError}
+	}
+	e.enqueue(span)
+}
+
+func (e *spanExporter) receive(clientID int, topic string, qos byte, seq int64, sent, received int64) {
+	traceID, pubID, recvID := e.spanIDs(topic, seq, sent)
+	e.enqueue(&otlpSpan{
+		TraceID:      traceID,
+		SpanID:       recvID,
+		ParentSpanID: pubID,
+		Name:         topic + " receive",
+		Kind:         spanKindConsumer,
+		Start:        strconv.FormatInt(sent, 10),
+		End:          strconv.FormatInt(received, 10),
+		Attributes:   messageAttributes(clientID, topic, qos, seq),
+	})
+}
+
+// enqueue drops spans rather than stalling the benchmark when the exporter falls behind
+func (e *spanExporter) enqueue(span *otlpSpan) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.spans <- span:
+	default:
+	}
+}
+
+// close flushes pending spans and stops the exporter, dropping spans
+// recorded afterwards
+func (e *spanExporter) close() {
+	e.mu.Lock()
+	e.closed = true
+	close(e.spans)
+	e.mu.Unlock()
+	<-e.done
+}
+
+func (e *spanExporter) run() {
+	batch := make([]*otlpSpan, 0, spanBatchSize)
+	ticker := time.NewTicker(spanFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case span, ok := <-e.spans:
+			if !ok {
+				e.flush(batch)
+				e.done <- true
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) == spanBatchSize {
+				e.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			e.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (e *spanExporter) flush(batch []*otlpSpan) {
+	if len(batch) == 0 {
+		return
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": e.resource,
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "mqtt-bm-latency"},
+				"spans": batch,
+			}},
+		}},
+	})
+	// a failed batch is dropped, not retried
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("OTLP export of %v spans failed: %v\n", len(batch), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 && !e.quiet {
+		log.Printf("OTLP export of %v spans failed: %v\n", len(batch), resp.Status)
+	}
+}
+
+func messageAttributes(clientID int, topic string, qos byte, seq int64) []otlpAttribute {
+	return []otlpAttribute{
+		stringAttribute("messaging.system", "mqtt"),
+		stringAttribute("messaging.destination.name", topic),
+		intAttribute("messaging.mqtt.qos", int64(qos)),
+		intAttribute("messaging.message.sequence", seq),
+		intAttribute("benchmark.client.id", int64(clientID)),
+	}
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: map[string]string{"stringValue": value}}
+}
+
+// intAttribute encodes an int64 attribute; OTLP/JSON carries 64-bit integers as strings
+func intAttribute(key string, value int64) otlpAttribute {
+	return otlpAttribute{Key: key, Value: map[string]string{"intValue": strconv.FormatInt(value, 10)}}
+}
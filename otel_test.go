@@ -0,0 +1,57 @@
+package mqttbmlatency
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSpanExporterDropsStuckBatches(t *testing.T) {
+	release := make(chan bool)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer collector.Close()
+	defer close(release)
+
+	e := newSpanExporter(collector.URL, nil, true)
+	e.client.Timeout = 50 * time.Millisecond
+	now := time.Now()
+	e.publish(0, &Message{Topic: "otel", Seq: 1, Sent: now, Delivered: now})
+
+	closed := make(chan bool)
+	go func() {
+		e.close()
+		closed <- true
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the exporter waits for a collector that does not answer")
+	}
+}
+
+func TestSpanIDsTellPoolPublishersApart(t *testing.T) {
+	e := &spanExporter{runID: "run", spans: make(chan *otlpSpan, 4)}
+	sent := time.Unix(0, 1000)
+	for i, at := range []time.Time{sent, sent.Add(time.Microsecond)} {
+		e.publish(i, &Message{Topic: "pool/0", Seq: 7, Sent: at, Delivered: at.Add(time.Millisecond)})
+		e.receive(2, "pool/0", 1, 7, at.UnixNano(), at.Add(2*time.Millisecond).UnixNano())
+	}
+	close(e.spans)
+	var spans []*otlpSpan
+	for span := range e.spans {
+		spans = append(spans, span)
+	}
+
+	for i := 0; i < 4; i += 2 {
+		pub, recv := spans[i], spans[i+1]
+		if recv.TraceID != pub.TraceID || recv.ParentSpanID != pub.SpanID {
+			t.Errorf("publisher %d: receive span %v/%v is not a child of %v/%v", i/2, recv.TraceID, recv.ParentSpanID, pub.TraceID, pub.SpanID)
+		}
+	}
+	if spans[0].TraceID == spans[2].TraceID || spans[0].SpanID == spans[2].SpanID {
+		t.Errorf("both publishers of seq 7 share trace %v and span %v", spans[0].TraceID, spans[0].SpanID)
+	}
+}
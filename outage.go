@@ -0,0 +1,192 @@
+package mqttbmlatency
+
+import (
+	"log"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// outageBucket is the resolution of the timelines used to attribute
+// messages to the outage window
+const outageBucket = 100 * time.Millisecond
+
+// Outage describes a broker outage the run deliberately rides out. With a
+// Command, it is run At into publishing to restart or pause the broker, e.g.
+// "docker restart mosquitto"; without one the outage is caused externally.
+type Outage struct {
+	At      time.Duration `json:"at"`
+	Command string        `json:"command,omitempty"`
+}
+
+// OutageResults describes how the clients weathered the outage. The window
+// spans from the first lost connection to the last reconnect; messages are
+// attributed to it by the time they were sent.
+type OutageResults struct {
+	Disconnects       int64   `json:"disconnects"`
+	Reconnects        int64   `json:"reconnects"`
+	ReconnectTimeMean float64 `json:"reconnect_time_mean"` // in milliseconds
+	ReconnectTimeMax  float64 `json:"reconnect_time_max"`
+	WindowStart       float64 `json:"window_start"` // seconds into publishing
+	WindowEnd         float64 `json:"window_end"`
+	Sent              int64   `json:"sent_during"`
+	Failed            int64   `json:"failed_during"`
+	Queued            int64   `json:"queued"` // sent during the outage and received
+	Lost              int64   `json:"lost"`   // sent during the outage, neither failed nor received
+	QueuedLatencyMean float64 `json:"queued_latency_mean"`
+	QueuedLatencyMax  float64 `json:"queued_latency_max"`
+	BaselineLatency   float64 `json:"baseline_latency_mean"` // messages sent before the window
+	RecoveryLatency   float64 `json:"recovery_latency_mean"` // messages sent in the second after it
+}
+
+// outageMonitor tracks lost and restored connections of all clients
+type outageMonitor struct {
+	outage *Outage
+	clock  Clock
+	quiet  bool
+	start  int64 // unix nanos when publishing began, accessed atomically
+
+	mu        sync.Mutex
+	lostAt    map[string]time.Time
+	reconnect accumulator
+	first     time.Time
+	last      time.Time
+	lost      int64
+}
+
+func newOutageMonitor(o *Outage, clock Clock, quiet bool) *outageMonitor {
+	return &outageMonitor{outage: o, clock: clock, quiet: quiet, lostAt: make(map[string]time.Time)}
+}
+
+// begin marks the start of publishing and schedules the outage command
+func (m *outageMonitor) begin(t time.Time) {
+	atomic.StoreInt64(&m.start, t.UnixNano())
+	if m.outage.Command == "" {
+		return
+	}
+	m.clock.AfterFunc(m.outage.At, func() {
+		log.Printf("Starting outage: %v\n", m.outage.Command)
+		out, err := exec.Command("sh", "-c", m.outage.Command).CombinedOutput()
+		if err != nil {
+			log.Printf("Outage command failed: %v: %s\n", err, out)
+		} else if !m.quiet {
+			log.Printf("Outage command done: %s\n", out)
+		}
+	})
+}
+
+// disconnected records that client lost its connection
+func (m *outageMonitor) disconnected(client string) {
+	if m == nil {
+		return
+	}
+	now := m.clock.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.lostAt[client]; ok {
+		return
+	}
+	m.lostAt[client] = now
+	m.lost++
+	if m.first.IsZero() {
+		m.first = now
+	}
+}
+
+// reconnected records that client restored its connection
+func (m *outageMonitor) reconnected(client string) {
+	if m == nil {
+		return
+	}
+	now := m.clock.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lost, ok := m.lostAt[client]
+	if !ok {
+		return
+	}
+	delete(m.lostAt, client)
+	m.reconnect.add(now.Sub(lost).Seconds() * 1000)
+	m.last = now
+}
+
+// bucketOf returns the timeline bucket of a message sent at unix nanos sent
+func (m *outageMonitor) bucketOf(sent int64) int {
+	if m == nil {
+		return -1
+	}
+	start := atomic.LoadInt64(&m.start)
+	if start == 0 || sent < start {
+		return -1
+	}
+	return int(time.Duration(sent-start) / outageBucket)
+}
+
+// recordTimeline adds a sample to bucket k of timeline, growing it as needed
+func recordTimeline(timeline *[]bucketStats, k int, v float64, failed bool) {
+	if k < 0 {
+		return
+	}
+	for len(*timeline) <= k {
+		*timeline = append(*timeline, bucketStats{})
+	}
+	if failed {
+		(*timeline)[k].failures++
+	} else {
+		(*timeline)[k].add(v)
+	}
+}
+
+func calculateOutageResults(m *outageMonitor, pubresults []*PubResults, subresults []*SubResults) *OutageResults {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := &OutageResults{
+		Disconnects:       m.lost,
+		Reconnects:        m.reconnect.count,
+		ReconnectTimeMean: m.reconnect.mean,
+		ReconnectTimeMax:  m.reconnect.max,
+	}
+	if m.first.IsZero() {
+		return res
+	}
+	start := time.Unix(0, atomic.LoadInt64(&m.start))
+	last := m.last
+	if last.Before(m.first) {
+		last = m.clock.Now() // some clients never came back
+	}
+	res.WindowStart = m.first.Sub(start).Seconds()
+	res.WindowEnd = last.Sub(start).Seconds()
+	from := int(m.first.Sub(start) / outageBucket)
+	to := int(last.Sub(start) / outageBucket)
+	recovered := to + int(time.Second/outageBucket)
+
+	for _, pr := range pubresults {
+		for k := from; k <= to && k < len(pr.timeline); k++ {
+			res.Sent += pr.timeline[k].count + pr.timeline[k].failures
+			res.Failed += pr.timeline[k].failures
+		}
+	}
+	var queued, baseline, recovery accumulator
+	for _, sr := range subresults {
+		for k, b := range sr.timeline {
+			switch {
+			case k < from:
+				baseline.merge(b.accumulator)
+			case k <= to:
+				queued.merge(b.accumulator)
+			case k <= recovered:
+				recovery.merge(b.accumulator)
+			}
+		}
+	}
+	res.Queued = queued.count
+	if lost := res.Sent - res.Failed - res.Queued; lost > 0 {
+		res.Lost = lost
+	}
+	res.QueuedLatencyMean = queued.mean
+	res.QueuedLatencyMax = queued.max
+	res.BaselineLatency = baseline.mean
+	res.RecoveryLatency = recovery.mean
+	return res
+}
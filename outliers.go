@@ -0,0 +1,97 @@
+package mqttbmlatency
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+)
+
+// Outlier is one of the worst forward latencies of a run, with the context
+// needed to tell a slow broker from a client that was reconnecting
+type Outlier struct {
+	Latency      float64   `json:"latency"`
+	Subscriber   int       `json:"subscriber"`
+	Topic        string    `json:"topic"`
+	Seq          int64     `json:"seq"`
+	QoS          byte      `json:"qos"`
+	Sent         time.Time `json:"sent"`
+	Received     time.Time `json:"received"`
+	SubLost      int       `json:"sub_lost"`                  // connections the subscriber had lost before the message arrived
+	SubConnected float64   `json:"sub_connected_for"`         // seconds since the subscriber's latest connect, 0 while disconnected
+	PubLost      int       `json:"pub_lost,omitempty"`        // connections the publisher had lost before sending, unknown for topic pools
+	PubRecovered bool      `json:"pub_reconnected,omitempty"` // the publisher reconnected between sending and the arrival
+}
+
+// outlierSet keeps the n worst latencies a subscriber saw, as a min-heap
+// so the mildest of them is the one to drop
+type outlierSet struct {
+	n    int
+	heap outlierHeap
+}
+
+func newOutlierSet(n int) *outlierSet {
+	return &outlierSet{n: n}
+}
+
+// qualifies tells whether latency belongs among the worst so far
+func (s *outlierSet) qualifies(latency float64) bool {
+	return len(s.heap) < s.n || latency > s.heap[0].Latency
+}
+
+func (s *outlierSet) add(o *Outlier) {
+	heap.Push(&s.heap, o)
+	if len(s.heap) > s.n {
+		heap.Pop(&s.heap)
+	}
+}
+
+type outlierHeap []*Outlier
+
+func (h outlierHeap) Len() int            { return len(h) }
+func (h outlierHeap) Less(i, j int) bool  { return h[i].Latency < h[j].Latency }
+func (h outlierHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *outlierHeap) Push(x interface{}) { *h = append(*h, x.(*Outlier)) }
+func (h *outlierHeap) Pop() interface{} {
+	old := *h
+	o := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return o
+}
+
+// calculateOutliers returns the n worst latencies across all subscribers,
+// worst first. Without a topic pool subscriber i receives from publisher i,
+// whose connection log tells what the publisher went through.
+func calculateOutliers(n int, pooled bool, pubresults []*PubResults, subresults []*SubResults) []*Outlier {
+	var all []*Outlier
+	for _, res := range subresults {
+		if res.outliers != nil {
+			all = append(all, res.outliers.heap...)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Latency > all[j].Latency })
+	if len(all) > n {
+		all = all[:n]
+	}
+	if pooled {
+		return all
+	}
+	pubs := make(map[int]*PubResults, len(pubresults))
+	for _, res := range pubresults {
+		pubs[res.ID] = res
+	}
+	for _, o := range all {
+		pub := pubs[o.Subscriber]
+		if pub == nil {
+			continue
+		}
+		for _, e := range pub.ConnEvents {
+			switch {
+			case e.Event == EventLost && e.Time.Before(o.Sent):
+				o.PubLost++
+			case e.Event == EventReconnected && e.Time.After(o.Sent) && e.Time.Before(o.Received):
+				o.PubRecovered = true
+			}
+		}
+	}
+	return all
+}
@@ -0,0 +1,196 @@
+package mqttbmlatency
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+import (
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// report is implemented by the results of every kind of run
+type report interface {
+	Markdown() []byte
+	JUnit() []byte
+	ExitCode() int
+}
+
+// encodeResults renders the results of a run in the requested format. JSON
+// has no NaN or infinity, so results holding one fail instead of coming out
+// empty.
+func encodeResults(format string, r report) ([]byte, error) {
+	switch format {
+	case "markdown":
+		return r.Markdown(), nil
+	case "junit":
+		return r.JUnit(), nil
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode the results: %v", err)
+	}
+	return data, nil
+}
+
+// writeOutput stores the results in path through a temporary file, so an
+// interrupted write never leaves a truncated document behind
+func writeOutput(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// publishResults publishes the results of a run to Config.ResultsTopic at
+// QoS 1
+func publishResults(cfg *Config, data []byte) error {
+	c, err := dialResults(cfg, fmt.Sprintf("mqtt-results-%v", time.Now().UnixNano()))
+	if err != nil {
+		return err
+	}
+	defer c.disconnect()
+	return c.publish(cfg.ResultsTopic, 1, cfg.ResultsRetain, data)
+}
+
+// resultsConn is a connection to the broker receiving the results
+type resultsConn struct {
+	publish    func(topic string, qos byte, retain bool, payload []byte) error
+	disconnect func()
+}
+
+// dialResults connects client id to Config.ResultsBroker or the benchmarked
+// broker, through cfg.Backend or paho. Backends cannot publish retained.
+func dialResults(cfg *Config, id string) (*resultsConn, error) {
+	broker := cfg.ResultsBroker
+	if broker == "" {
+		broker = cfg.Broker
+	}
+	if cfg.Backend != nil {
+		conn, err := cfg.Backend.Connect(&BackendOptions{
+			Broker:    broker,
+			ClientID:  id,
+			Username:  cfg.Username,
+			Password:  cfg.Password,
+			KeepAlive: time.Duration(cfg.KeepAlive) * time.Second,
+			Transport: newTransport(cfg, nil, nil),
+			OnLost:    func(reason error) {},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &resultsConn{
+			publish: func(topic string, qos byte, retain bool, payload []byte) error {
+				return conn.Publish(topic, qos, payload)
+			},
+			disconnect: conn.Disconnect,
+		}, nil
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(id).
+		SetCleanSession(true).
+		SetKeepAlive(time.Duration(cfg.KeepAlive) * time.Second)
+	if cfg.Username != "" && cfg.Password != "" {
+		opts.SetUsername(cfg.Username)
+		opts.SetPassword(cfg.Password)
+	}
+	setTransport(opts, broker, newTransport(cfg, nil, nil))
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	return &resultsConn{
+		publish: func(topic string, qos byte, retain bool, payload []byte) error {
+			token := client.Publish(topic, qos, retain, payload)
+			token.Wait()
+			return token.Error()
+		},
+		disconnect: func() { client.Disconnect(250) },
+	}, nil
+}
+
+// rotatingFile appends to path and moves it aside to path.<timestamp> once it
+// grew past maxSize bytes or has been open for maxAge. A zero limit disables
+// that trigger. Every Write lands in a single file, so JSON lines stay whole.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotating(path string, maxSize int64, maxAge time.Duration) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file, r.size, r.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && (r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize ||
+		r.maxAge > 0 && time.Since(r.opened) >= r.maxAge) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate closes the current file, renames it after the time of rotation and
+// starts a new one
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	rotated := r.path + "." + time.Now().Format("20060102T150405.000")
+	if err := os.Rename(r.path, rotated); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
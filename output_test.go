@@ -0,0 +1,35 @@
+package mqttbmlatency
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEncodeResults(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		ratio  float64
+		fails  bool
+	}{
+		{"json", "json", 1, false},
+		{"nan", "json", math.NaN(), true},
+		{"infinity", "", math.Inf(1), true},
+		{"markdown has no trouble with nan", "markdown", math.NaN(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jr := &JSONResults{PubTotals: &TotalPubResults{PubRatio: tt.ratio}, SubTotals: &TotalSubResults{}, Unit: "ms"}
+			data, err := encodeResults(tt.format, jr)
+			if tt.fails {
+				if err == nil || data != nil {
+					t.Errorf("encoded %q, %v, want an error", data, err)
+				}
+				return
+			}
+			if err != nil || len(data) == 0 {
+				t.Errorf("encoded %q, %v, want the results", data, err)
+			}
+		})
+	}
+}
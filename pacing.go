@@ -0,0 +1,77 @@
+package mqttbmlatency
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Pacer shapes the offered load of a publisher. Delay returns the time between
+// generating message i-1 and message i (i starts at 1); messages are scheduled
+// against the time the first one was handed to the publisher, so a slow
+// broker makes a publisher catch up rather than drift.
+type Pacer interface {
+	Delay(i int) time.Duration
+}
+
+// Burst sends Size messages spaced Interval apart, then stays idle for Gap.
+// An Interval of 0 sends each burst back to back.
+type Burst struct {
+	Size     int
+	Interval time.Duration
+	Gap      time.Duration
+}
+
+func (b *Burst) Delay(i int) time.Duration {
+	if b.Size > 0 && i%b.Size == 0 {
+		return b.Gap
+	}
+	return b.Interval
+}
+
+// poissonPacer draws exponentially distributed gaps, so publishes form a
+// Poisson process like independent devices reporting at a mean rate
+type poissonPacer struct {
+	mean float64
+	rng  *rand.Rand
+}
+
+func (p *poissonPacer) Delay(i int) time.Duration {
+	return time.Duration(p.rng.ExpFloat64() * p.mean)
+}
+
+// ThinkTime makes a publisher wait between successive messages, like a
+// sensor reporting every Interval ± Jitter. Unlike a Pacer it counts from the
+// previous message rather than from a schedule, so a slow publish delays every
+// later one; Config.GlobalRate still applies on top.
+type ThinkTime struct {
+	Interval time.Duration
+	Jitter   time.Duration // uniformly distributed, at most Interval
+}
+
+func (t *ThinkTime) delay(rng *rand.Rand) time.Duration {
+	if t.Jitter <= 0 {
+		return t.Interval
+	}
+	return t.Interval + time.Duration((2*rng.Float64()-1)*float64(t.Jitter))
+}
+
+// newPacer builds the pacer of one publisher, or nil to publish as fast as possible
+func newPacer(cfg *Config, clientID int) Pacer {
+	switch {
+	case cfg.Burst != nil:
+		return cfg.Burst
+	case cfg.PoissonMean > 0:
+		return &poissonPacer{
+			mean: float64(cfg.PoissonMean),
+			rng:  clientRand(cfg, clientID, randPacing),
+		}
+	}
+	return nil
+}
+
+// pace blocks until message i is due. start is the time message 0 was sent
+// and next accumulates the schedule.
+func pace(clock Clock, p Pacer, i int, start time.Time, next *time.Duration) {
+	*next += p.Delay(i)
+	sleepUntil(clock, start.Add(*next))
+}
@@ -0,0 +1,261 @@
+package mqttbmlatency
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+import (
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTT control packet types
+var packetTypes = [16]string{
+	"RESERVED", "CONNECT", "CONNACK", "PUBLISH", "PUBACK", "PUBREC", "PUBREL", "PUBCOMP",
+	"SUBSCRIBE", "SUBACK", "UNSUBSCRIBE", "UNSUBACK", "PINGREQ", "PINGRESP", "DISCONNECT", "AUTH",
+}
+
+// PacketRecord is one line of the packet log: the fixed and variable header
+// of a control packet, never its payload
+type PacketRecord struct {
+	Time        time.Time `json:"time"`
+	Client      string    `json:"client"`    // pub-<id> or sub-<id>
+	Direction   string    `json:"direction"` // "out" to the broker, "in" from it
+	Type        string    `json:"type"`
+	Length      int       `json:"length"` // remaining length
+	QoS         byte      `json:"qos,omitempty"`
+	Dup         bool      `json:"dup,omitempty"`
+	Retain      bool      `json:"retain,omitempty"`
+	PacketID    uint16    `json:"packet_id,omitempty"`
+	Topic       string    `json:"topic,omitempty"`
+	ClientID    string    `json:"client_id,omitempty"` // CONNECT
+	KeepAlive   uint16    `json:"keep_alive,omitempty"`
+	ReturnCodes []int     `json:"return_codes,omitempty"` // CONNACK and SUBACK
+}
+
+// packetLog writes the control packets of all clients as JSON lines
+type packetLog struct {
+	clock Clock
+	mu    sync.Mutex
+	f     *os.File
+	w     *bufio.Writer
+	enc   *json.Encoder
+}
+
+func newPacketLog(path string, clock Clock) (*packetLog, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	return &packetLog{clock: clock, f: f, w: w, enc: json.NewEncoder(w)}, nil
+}
+
+func (l *packetLog) write(rec *PacketRecord) {
+	l.mu.Lock()
+	l.enc.Encode(rec)
+	l.mu.Unlock()
+}
+
+func (l *packetLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Flush()
+	l.f.Close()
+}
+
+// attach returns a copy of t that logs the packets of client, creating the
+// transport when the client had none
+func (l *packetLog) attach(t *Transport, kind string, id int) *Transport {
+	if l == nil {
+		return t
+	}
+	attached := &Transport{}
+	if t != nil {
+		*attached = *t
+	}
+	attached.packets = l
+	attached.label = kind + "-" + strconv.Itoa(id)
+	return attached
+}
+
+// logged wraps open so the connections it returns log their packets, if the
+// transport has a packet log, and are handed to its tracker
+func (t *Transport) logged(open mqtt.OpenConnectionFunc) mqtt.OpenConnectionFunc {
+	if t == nil || t.packets == nil && t.track == nil {
+		return open
+	}
+	return func(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+		conn, err := open(uri, options)
+		if err != nil {
+			return nil, err
+		}
+		if t.track != nil {
+			t.track(conn)
+		}
+		if t.packets == nil {
+			return conn, nil
+		}
+		return &packetConn{
+			Conn: conn,
+			in:   packetParser{log: t.packets, client: t.label, direction: "in"},
+			out:  packetParser{log: t.packets, client: t.label, direction: "out"},
+		}, nil
+	}
+}
+
+// packetConn observes the MQTT byte stream in both directions. Reads and
+// writes each come from a single paho goroutine, so the parsers need no lock.
+type packetConn struct {
+	net.Conn
+	in, out packetParser
+}
+
+func (c *packetConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.in.feed(b[:n])
+	return n, err
+}
+
+func (c *packetConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.out.feed(b[:n])
+	return n, err
+}
+
+// packetParser splits one direction of a connection into packets. It buffers
+// headers only; payloads are skipped however large they are.
+type packetParser struct {
+	log       *packetLog
+	client    string
+	direction string
+	head      []byte
+	skip      int // payload bytes left of the current packet
+}
+
+func (p *packetParser) feed(b []byte) {
+	for len(b) > 0 {
+		if p.skip > 0 {
+			n := p.skip
+			if n > len(b) {
+				n = len(b)
+			}
+			p.skip -= n
+			b = b[n:]
+			continue
+		}
+		p.head = append(p.head, b[0])
+		b = b[1:]
+		if rec, total, ok := decodePacketHeader(p.head); ok {
+			rec.Time = p.log.clock.Now()
+			rec.Client = p.client
+			rec.Direction = p.direction
+			p.log.write(rec)
+			p.skip = total - len(p.head)
+			p.head = p.head[:0]
+		}
+	}
+}
+
+// decodePacketHeader decodes the packet starting buf once buf holds all the
+// header bytes of interest, returning the packet's total size
+func decodePacketHeader(buf []byte) (*PacketRecord, int, bool) {
+	if len(buf) < 2 {
+		return nil, 0, false
+	}
+	remaining, shift, hlen := 0, 0, 1
+	for {
+		if hlen >= len(buf) {
+			return nil, 0, false
+		}
+		b := buf[hlen]
+		hlen++
+		remaining |= int(b&0x7f) << shift
+		if b&0x80 == 0 || hlen == 5 {
+			break
+		}
+		shift += 7
+	}
+	rec := &PacketRecord{Type: packetTypes[buf[0]>>4], Length: remaining}
+	body := buf[hlen:]
+	total := hlen + remaining
+
+	// bytes of the variable header needed to describe the packet
+	need := 0
+	switch buf[0] >> 4 {
+	case 1: // CONNECT: protocol name, level, flags, keep alive, client ID
+		need = 2
+		if len(body) >= 2 {
+			need = 2 + int(binary.BigEndian.Uint16(body)) + 6
+			if len(body) >= need {
+				need += int(binary.BigEndian.Uint16(body[need-2:]))
+			}
+		}
+	case 2, 9: // CONNACK flags and code, SUBACK packet ID and codes
+		need = remaining
+	case 3: // PUBLISH: topic, then a packet ID above QoS 0
+		rec.QoS = (buf[0] >> 1) & 0x03
+		rec.Dup = buf[0]&0x08 != 0
+		rec.Retain = buf[0]&0x01 != 0
+		need = 2
+		if len(body) >= 2 {
+			need += int(binary.BigEndian.Uint16(body))
+			if rec.QoS > 0 {
+				need += 2
+			}
+		}
+	case 4, 5, 6, 7, 8, 10, 11:
+		need = 2
+	}
+	if need > remaining {
+		need = remaining
+	}
+	if len(body) < need {
+		return nil, 0, false
+	}
+	body = body[:need]
+
+	switch buf[0] >> 4 {
+	case 1:
+		if n := len(body); n >= 2+6 {
+			name := int(binary.BigEndian.Uint16(body))
+			if n >= 2+name+6 {
+				rec.KeepAlive = binary.BigEndian.Uint16(body[2+name+2:])
+				rec.ClientID = string(body[2+name+6:])
+			}
+		}
+	case 2:
+		for _, code := range body[1:] {
+			rec.ReturnCodes = append(rec.ReturnCodes, int(code))
+		}
+	case 3:
+		if len(body) >= 2 {
+			end := 2 + int(binary.BigEndian.Uint16(body))
+			if end <= len(body) {
+				rec.Topic = string(body[2:end])
+				if len(body) >= end+2 {
+					rec.PacketID = binary.BigEndian.Uint16(body[end:])
+				}
+			}
+		}
+	case 9:
+		if len(body) >= 2 {
+			rec.PacketID = binary.BigEndian.Uint16(body)
+			for _, code := range body[2:] {
+				rec.ReturnCodes = append(rec.ReturnCodes, int(code))
+			}
+		}
+	case 4, 5, 6, 7, 8, 10, 11:
+		if len(body) >= 2 {
+			rec.PacketID = binary.BigEndian.Uint16(body)
+		}
+	}
+	return rec, total, true
+}
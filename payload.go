@@ -0,0 +1,115 @@
+package mqttbmlatency
+
+import (
+	"bytes"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// payloadSep separates the header fields from each other and from the padding
+var payloadSep = []byte("#@#")
+
+// encodePayload builds "<sent unix nano>#@#<seq>#@#<padding>". The padding is
+// zeroed, or drawn from rng when one is given.
+func encodePayload(sent time.Time, seq int64, size int, rng *rand.Rand) []byte {
+	padding := make([]byte, size)
+	if rng != nil {
+		rng.Read(padding)
+	}
+	return bytes.Join([][]byte{
+		[]byte(strconv.FormatInt(sent.UnixNano(), 10)),
+		[]byte(strconv.FormatInt(seq, 10)),
+		padding,
+	}, payloadSep)
+}
+
+// paddingSize returns the padding length of a payload written by encodePayload
+func paddingSize(payload []byte) int {
+	for i := 0; i < 2; i++ {
+		j := bytes.Index(payload, payloadSep)
+		if j < 0 {
+			return len(payload)
+		}
+		payload = payload[j+len(payloadSep):]
+	}
+	return len(payload)
+}
+
+// decodePayload extracts the send timestamp and sequence number written by encodePayload
+func decodePayload(payload []byte) (sent int64, seq int64, ok bool) {
+	i := bytes.Index(payload, payloadSep)
+	if i < 0 {
+		return 0, 0, false
+	}
+	sent, err := strconv.ParseInt(string(payload[:i]), 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	rest := payload[i+len(payloadSep):]
+	j := bytes.Index(rest, payloadSep)
+	if j < 0 {
+		return sent, 0, false
+	}
+	seq, err = strconv.ParseInt(string(rest[:j]), 10, 64)
+	if err != nil {
+		return sent, 0, false
+	}
+	return sent, seq, true
+}
+
+// payloadFieldWidth fits any int64 in decimal, so fixed width fields can be
+// patched in place; decodePayload reads the leading zeros like any digits
+const payloadFieldWidth = 19
+
+// payloadHeaderSize is the length of the header of a payloadTemplate
+var payloadHeaderSize = 2*payloadFieldWidth + 2*len(payloadSep)
+
+// payloadTemplate builds the payloads of one publisher in a single reused
+// buffer. Only the timestamp and sequence number are rewritten per message;
+// the padding is drawn once, so large payloads cost no allocation or copy.
+type payloadTemplate struct {
+	buf []byte
+	rng *rand.Rand
+}
+
+func newPayloadTemplate(rng *rand.Rand) *payloadTemplate {
+	t := &payloadTemplate{rng: rng}
+	t.grow(0)
+	return t
+}
+
+// grow makes room for size bytes of padding, keeping the padding drawn so far
+func (t *payloadTemplate) grow(size int) {
+	if len(t.buf) >= payloadHeaderSize+size {
+		return
+	}
+	buf := make([]byte, payloadHeaderSize+size)
+	n := copy(buf, t.buf)
+	if n == 0 {
+		copy(buf[payloadFieldWidth:], payloadSep)
+		copy(buf[2*payloadFieldWidth+len(payloadSep):], payloadSep)
+		n = payloadHeaderSize
+	}
+	if t.rng != nil {
+		t.rng.Read(buf[n:])
+	}
+	t.buf = buf
+}
+
+// fill returns the payload of a message in the shared buffer, valid until the
+// next call
+func (t *payloadTemplate) fill(sent time.Time, seq int64, size int) []byte {
+	t.grow(size)
+	putDecimal(t.buf[:payloadFieldWidth], sent.UnixNano())
+	putDecimal(t.buf[payloadFieldWidth+len(payloadSep):2*payloadFieldWidth+len(payloadSep)], seq)
+	return t.buf[:payloadHeaderSize+size]
+}
+
+// putDecimal writes v right aligned into b, padded with zeros
+func putDecimal(b []byte, v int64) {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] = '0' + byte(v%10)
+		v /= 10
+	}
+}
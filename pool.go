@@ -0,0 +1,113 @@
+package mqttbmlatency
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// topicPool is a pre-generated set of topics that publishers pick from at
+// random for every message, stressing the broker's routing table like
+// multi-tenant traffic. Subscriber i subscribes to every topic k with
+// k modulo the client count equal to i, so each message has exactly one
+// receiver.
+type topicPool struct {
+	topics    []string
+	clients   int
+	skew      float64
+	cdf       []float64 // cumulative Zipf weights, nil for uniform picks
+	published []int64   // successful publishes per topic, updated atomically
+}
+
+// TopicPoolResults describe how the messages spread over the pool topics
+type TopicPoolResults struct {
+	Topics     int     `json:"topics"`
+	Skew       float64 `json:"skew,omitempty"`
+	Published  int64   `json:"published"`
+	Used       int     `json:"topics_used"`         // topics that got at least one message
+	HotShare   float64 `json:"hottest_topic_share"` // share of the messages on the busiest topic
+	Top10Share float64 `json:"top_10pct_share"`     // share on the busiest tenth of the topics
+}
+
+func newTopicPool(prefix string, size int, skew float64, clients int) *topicPool {
+	p := &topicPool{
+		topics:    make([]string, size),
+		clients:   clients,
+		skew:      skew,
+		published: make([]int64, size),
+	}
+	for k := range p.topics {
+		p.topics[k] = prefix + "-pool-" + strconv.Itoa(k)
+	}
+	if skew > 0 {
+		// topic k is picked with a weight of 1/(k+1)^skew; unlike rand.Zipf
+		// this allows the skews up to 1 seen in real deployments
+		p.cdf = make([]float64, size)
+		total := 0.0
+		for k := range p.cdf {
+			total += math.Pow(float64(k+1), -skew)
+			p.cdf[k] = total
+		}
+	}
+	return p
+}
+
+// picker returns a function drawing topic indexes from rng; with a skew, low
+// indexes are the hot topics
+func (p *topicPool) picker(rng *rand.Rand) func() int {
+	if p.cdf != nil {
+		total := p.cdf[len(p.cdf)-1]
+		return func() int { return sort.SearchFloat64s(p.cdf, rng.Float64()*total) }
+	}
+	return func() int { return rng.Intn(len(p.topics)) }
+}
+
+// filters returns the topics subscriber i subscribes to
+func (p *topicPool) filters(i int) []string {
+	var topics []string
+	for k := i; k < len(p.topics); k += p.clients {
+		topics = append(topics, p.topics[k])
+	}
+	return topics
+}
+
+// sent records a successful publish to topic k
+func (p *topicPool) sent(k int) {
+	atomic.AddInt64(&p.published[k], 1)
+}
+
+// expected returns how many messages subscriber i should have received
+func (p *topicPool) expected(i int) int64 {
+	var n int64
+	for k := i; k < len(p.topics); k += p.clients {
+		n += atomic.LoadInt64(&p.published[k])
+	}
+	return n
+}
+
+// results summarizes the publishes per topic
+func (p *topicPool) results() *TopicPoolResults {
+	counts := make([]int64, len(p.published))
+	res := &TopicPoolResults{Topics: len(p.topics), Skew: p.skew}
+	for k := range counts {
+		counts[k] = atomic.LoadInt64(&p.published[k])
+		res.Published += counts[k]
+		if counts[k] > 0 {
+			res.Used++
+		}
+	}
+	if res.Published == 0 {
+		return res
+	}
+	sort.Slice(counts, func(a, b int) bool { return counts[a] > counts[b] })
+	top := int(math.Ceil(float64(len(counts)) / 10))
+	var topSum int64
+	for _, n := range counts[:top] {
+		topSum += n
+	}
+	res.HotShare = float64(counts[0]) / float64(res.Published)
+	res.Top10Share = float64(topSum) / float64(res.Published)
+	return res
+}
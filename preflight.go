@@ -0,0 +1,103 @@
+package mqttbmlatency
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Rough per-run costs used by the pre-flight estimate
+const (
+	spareFiles    = 64       // stdio, output files, listeners and the resolver
+	connMemory    = 64 << 10 // client goroutines, queues and buffers of one connection
+	messageMemory = 32       // raw publish and forward latency samples of one message, with slice growth
+)
+
+// Resources is the pre-flight estimate of what a run needs, next to the
+// limits of the host where they could be read
+type Resources struct {
+	Connections     int    `json:"connections"`
+	Files           int    `json:"file_descriptors"`
+	FileLimit       uint64 `json:"file_limit,omitempty"` // soft RLIMIT_NOFILE
+	Memory          int64  `json:"memory_bytes"`
+	MemoryAvailable int64  `json:"memory_available,omitempty"`
+	Ports           int    `json:"ephemeral_ports"` // per source address
+	PortRange       int    `json:"ephemeral_port_range,omitempty"`
+}
+
+// estimateResources estimates the file descriptors, memory and ephemeral
+// ports a run of cfg with the given number of clients needs
+func estimateResources(cfg *Config, clients int) *Resources {
+	conns := 2 * clients // a publisher and a subscriber per client
+	if cfg.ReferenceBroker != "" {
+		conns += clients
+	}
+	if cfg.ProbeInterval > 0 {
+		conns += clients
+	}
+	if cfg.Heartbeat > 0 {
+		conns++
+	}
+	if cfg.ACL != nil {
+		conns += cfg.ACL.clients(clients)
+	}
+	conns += cfg.IdleSubscribers
+	r := &Resources{Connections: conns, Files: conns + spareFiles}
+
+	r.Memory = int64(conns) * connMemory
+	if cfg.ExactStats && cfg.SnapshotInterval == 0 {
+		r.Memory += expectedMessages(cfg, clients) * messageMemory
+	}
+
+	if u, err := url.Parse(cfg.Broker); err == nil && u.Scheme != "unix" {
+		sources := len(cfg.LocalAddrs)
+		for _, g := range cfg.Groups {
+			sources += len(g.LocalAddrs)
+		}
+		if sources == 0 {
+			sources = 1
+		}
+		r.Ports = (conns + sources - 1) / sources
+	}
+
+	readLimits(r)
+	return r
+}
+
+// expectedMessages returns how many messages the run publishes, 0 when only
+// the run time is bounded
+func expectedMessages(cfg *Config, clients int) int64 {
+	switch {
+	case len(cfg.Stages) > 0:
+		var n int64
+		for _, st := range cfg.Stages {
+			n += int64(st.Rate * st.Duration.Seconds())
+		}
+		return n
+	case cfg.Duration > 0:
+		return int64(cfg.GlobalRate * cfg.Duration.Seconds())
+	}
+	return totalCount(cfg, clients)
+}
+
+// check returns an error with guidance for every limit the run would exceed
+func (r *Resources) check() error {
+	var problems []string
+	if r.FileLimit > 0 && uint64(r.Files) > r.FileLimit {
+		problems = append(problems, fmt.Sprintf("about %v file descriptors are needed but the limit is %v; raise it with ulimit -n %v or in limits.conf/LimitNOFILE, or use fewer clients",
+			r.Files, r.FileLimit, r.Files))
+	}
+	if r.PortRange > 0 && r.Ports > r.PortRange {
+		problems = append(problems, fmt.Sprintf("%v connections per source address exceed the %v ephemeral ports; widen net.ipv4.ip_local_port_range or spread the clients over Config.LocalAddrs",
+			r.Ports, r.PortRange))
+	}
+	if r.MemoryAvailable > 0 && r.Memory > r.MemoryAvailable {
+		problems = append(problems, fmt.Sprintf("about %v MiB of memory are needed but %v MiB are available; unset Config.ExactStats or publish fewer messages",
+			r.Memory>>20, r.MemoryAvailable>>20))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(problems, "; "))
+}
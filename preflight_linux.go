@@ -0,0 +1,38 @@
+package mqttbmlatency
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// readLimits fills in the open file limit, the ephemeral port range and the
+// available memory; limits that cannot be read stay zero
+func readLimits(r *Resources) {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err == nil {
+		r.FileLimit = lim.Cur
+	}
+	if data, err := os.ReadFile("/proc/sys/net/ipv4/ip_local_port_range"); err == nil {
+		var low, high int
+		if _, err := fmt.Sscan(string(data), &low, &high); err == nil && high >= low {
+			r.PortRange = high - low + 1
+		}
+	}
+	if f, err := os.Open("/proc/meminfo"); err == nil {
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+				if kb, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+					r.MemoryAvailable = kb << 10
+				}
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package mqttbmlatency
+
+// readLimits is only implemented on Linux; elsewhere the estimate is not
+// checked against the host's limits
+func readLimits(r *Resources) {}
@@ -0,0 +1,27 @@
+package mqttbmlatency
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEstimateMemory(t *testing.T) {
+	tests := []struct {
+		name  string
+		exact bool
+		soak  time.Duration
+		want  int64
+	}{
+		{"estimated", false, 0, 20 * connMemory},
+		{"exact", true, 0, 20*connMemory + 10*1000*messageMemory},
+		{"soak", true, time.Minute, 20 * connMemory}, // soak runs always estimate
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Broker: "unix://broker.sock", Clients: 10, Count: 1000, ExactStats: tt.exact, SnapshotInterval: tt.soak}
+			if got := estimateResources(cfg, 10).Memory; got != tt.want {
+				t.Errorf("memory %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
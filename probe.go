@@ -0,0 +1,237 @@
+package mqttbmlatency
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"github.com/brunobevilaquaa/mqtt-bm-latency/internal/packet"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ProbeResults describes the keepalive round trips of one probe connection
+type ProbeResults struct {
+	ID      int          `json:"id"`
+	Pings   int64        `json:"pings"`
+	Lost    int64        `json:"lost"` // PINGREQs unanswered for more than an interval
+	RTTMin  float64      `json:"rtt_min"`
+	RTTMax  float64      `json:"rtt_max"`
+	RTTMean float64      `json:"rtt_mean"`
+	RTTStd  float64      `json:"rtt_std"`
+	RTTPct  *Percentiles `json:"rtt_percentiles,omitempty"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// prober keeps one extra connection per client that does nothing but send
+// PINGREQ every interval, giving a network and broker responsiveness baseline
+// next to the message latencies. paho only pings idle connections, so the
+// benchmark connections themselves cannot be probed reliably.
+type prober struct {
+	probes []*probe
+	wg     sync.WaitGroup
+}
+
+type probe struct {
+	cfg       *Config
+	clock     Clock
+	id        int
+	transport *Transport
+	res       *ProbeResults
+	stop      chan bool
+}
+
+func newProber(cfg *Config, clock Clock, clients int, localAddr func(int) net.IP, certs *certSet) *prober {
+	p := &prober{}
+	for i := 0; i < clients; i++ {
+		p.probes = append(p.probes, &probe{
+			cfg:       cfg,
+			clock:     clock,
+			id:        i,
+			transport: newTransport(cfg, localAddr(i), certs.pub(i)),
+			res:       &ProbeResults{ID: i},
+			stop:      make(chan bool),
+		})
+	}
+	return p
+}
+
+func (p *prober) begin() {
+	for _, pr := range p.probes {
+		p.wg.Add(1)
+		go func(pr *probe) {
+			defer p.wg.Done()
+			pr.run()
+		}(pr)
+	}
+}
+
+// close stops all probes and returns their results
+func (p *prober) close() []*ProbeResults {
+	results := make([]*ProbeResults, len(p.probes))
+	for i, pr := range p.probes {
+		close(pr.stop)
+		results[i] = pr.res
+	}
+	p.wg.Wait()
+	return results
+}
+
+func (pr *probe) run() {
+	conn, err := dialProbe(pr.cfg, pr.id, pr.transport)
+	if err != nil {
+		log.Printf("PROBE %v had error connecting to the broker: %v\n", pr.id, err)
+		pr.res.Error = err.Error()
+		return
+	}
+	defer conn.Close()
+
+	// closed on return, so the reader never blocks on responses no one reads
+	done := make(chan bool)
+	defer close(done)
+	responses := make(chan time.Time, 16)
+	go readPingResponses(conn, pr.clock, responses, done)
+
+	var (
+		rtt     accumulator
+		rtts    = newDigest()
+		pending []time.Time // send times of unanswered pings, answered in order
+	)
+	ticker := pr.clock.NewTicker(pr.cfg.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			if _, err := conn.Write([]byte{0xC0, 0x00}); err != nil {
+				log.Printf("PROBE %v lost connection to the broker: %v\n", pr.id, err)
+				pr.res.Error = err.Error()
+				pr.finish(&rtt, rtts, pending)
+				return
+			}
+			pending = append(pending, pr.clock.Now())
+			pr.res.Pings++
+		case t, ok := <-responses:
+			if !ok {
+				pr.finish(&rtt, rtts, pending)
+				return
+			}
+			if len(pending) > 0 {
+				ms := t.Sub(pending[0]).Seconds() * 1000
+				rtt.add(ms)
+				rtts.add(ms)
+				pending = pending[1:]
+			}
+		case <-pr.stop:
+			conn.Write([]byte{0xE0, 0x00}) // DISCONNECT
+			pr.finish(&rtt, rtts, pending)
+			return
+		}
+	}
+}
+
+func (pr *probe) finish(rtt *accumulator, rtts *digest, pending []time.Time) {
+	for _, sent := range pending {
+		if pr.clock.Now().Sub(sent) > pr.cfg.ProbeInterval {
+			pr.res.Lost++
+		}
+	}
+	pr.res.RTTMin = rtt.min
+	pr.res.RTTMax = rtt.max
+	pr.res.RTTMean = rtt.mean
+	pr.res.RTTStd = rtt.std()
+	pr.res.RTTPct = rtts.percentiles()
+}
+
+// readPingResponses reads MQTT packets from conn and reports the arrival time
+// of every PINGRESP on clock until the connection closes or done is closed
+func readPingResponses(conn net.Conn, clock Clock, responses chan time.Time, done chan bool) {
+	defer close(responses)
+	r := bufio.NewReader(conn)
+	for {
+		header, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		now := clock.Now()
+		n, err := packet.ReadLength(r)
+		if err != nil {
+			return
+		}
+		if _, err := r.Discard(n); err != nil {
+			return
+		}
+		if header>>4 == 13 { // PINGRESP
+			select {
+			case responses <- now:
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+// dialProbe opens a raw MQTT 3.1.1 connection and completes the CONNECT handshake
+func dialProbe(cfg *Config, id int, t *Transport) (net.Conn, error) {
+	u, err := url.Parse(cfg.Broker)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: cfg.ConnectTimeout}
+	if t != nil {
+		dialer = t.dialer(cfg.ConnectTimeout)
+	}
+	var conn net.Conn
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		conn, err = dialer.Dial("tcp", u.Host)
+	case "ssl", "tls", "mqtts", "tcps":
+		conn, err = tls.DialWithDialer(dialer, "tcp", u.Host, t.tlsConfig(u.Hostname()))
+	case "unix":
+		conn, err = net.DialTimeout("unix", u.Host+u.Path, cfg.ConnectTimeout)
+	case "quic":
+		conn, err = t.openQUIC(t.session())(u, mqtt.ClientOptions{ConnectTimeout: cfg.ConnectTimeout, TLSConfig: t.tlsConfig("")})
+	default:
+		return nil, fmt.Errorf("ping probes do not support %v brokers", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var flags byte = 0x02 // clean session
+	payload := packet.AppendString(nil, fmt.Sprintf("mqtt-probe-%v-%v", time.Now().UnixNano(), id))
+	if cfg.Username != "" && cfg.Password != "" {
+		flags |= 0xC0
+		payload = packet.AppendString(payload, cfg.Username)
+		payload = packet.AppendString(payload, cfg.Password)
+	}
+	body := packet.AppendString(nil, "MQTT")
+	body = append(body, 4, flags, 0, 0)
+	binary.BigEndian.PutUint16(body[len(body)-2:], uint16(cfg.KeepAlive))
+	body = append(body, payload...)
+	pkt := packet.AppendLength([]byte{0x10}, len(body))
+	pkt = append(pkt, body...)
+
+	if cfg.ConnectTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(cfg.ConnectTimeout))
+	}
+	if _, err := conn.Write(pkt); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ack[0] != 0x20 || ack[3] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("connection refused, return code %v", ack[3])
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
@@ -0,0 +1,82 @@
+package mqttbmlatency
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	runtimepprof "runtime/pprof"
+)
+
+// startProfiling serves net/http/pprof on cfg.PprofAddr and starts the CPU
+// profile, so users scaling to many clients can tell whether the load
+// generator itself is the bottleneck. The returned function stops both and
+// writes the heap profile.
+func startProfiling(cfg *Config) (func(), error) {
+	var srv *http.Server
+	if cfg.PprofAddr != "" {
+		l, err := net.Listen("tcp", cfg.PprofAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for pprof on %v: %v", cfg.PprofAddr, err)
+		}
+		// a mux of its own keeps the handlers off http.DefaultServeMux
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		srv = &http.Server{Handler: mux}
+		go srv.Serve(l)
+		if !cfg.Quiet {
+			log.Printf("pprof listening on http://%v/debug/pprof/\n", l.Addr())
+		}
+	}
+	var cpu *os.File
+	if cfg.CPUProfile != "" {
+		var err error
+		if cpu, err = os.Create(cfg.CPUProfile); err == nil {
+			if err = runtimepprof.StartCPUProfile(cpu); err != nil {
+				cpu.Close()
+				err = fmt.Errorf("failed to start CPU profile: %v", err)
+			}
+		} else {
+			err = fmt.Errorf("failed to create CPU profile %v: %v", cfg.CPUProfile, err)
+		}
+		if err != nil {
+			if srv != nil {
+				srv.Close()
+			}
+			return nil, err
+		}
+	}
+
+	return func() {
+		if cpu != nil {
+			runtimepprof.StopCPUProfile()
+			cpu.Close()
+		}
+		if cfg.HeapProfile != "" {
+			writeHeapProfile(cfg.HeapProfile)
+		}
+		if srv != nil {
+			srv.Close()
+		}
+	}, nil
+}
+
+func writeHeapProfile(path string) {
+	f, err := os.Create(path)
+	if err != nil {
+		log.Printf("Failed to create heap profile %v: %v\n", path, err)
+		return
+	}
+	defer f.Close()
+	runtime.GC() // up to date statistics of live objects
+	if err := runtimepprof.WriteHeapProfile(f); err != nil {
+		log.Printf("Failed to write heap profile %v: %v\n", path, err)
+	}
+}
@@ -1,29 +1,85 @@
 package mqttbmlatency
 
 import (
-	"bytes"
-	"fmt"
 	"log"
+	"math/rand"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
 import (
-	"github.com/GaryBoone/GoStats/stats"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
+// PubClient publishes timestamped messages to PubTopic and times every
+// publish. Benchmark runs set it up from Config; to compose custom topologies,
+// fill in the exported fields and drive it with Connect, Run and Stop.
 type PubClient struct {
 	ID         int
 	BrokerURL  string
 	BrokerUser string
 	BrokerPass string
+	ClientID   string // generated when empty
 	PubTopic   string
 	MsgSize    int
 	MsgCount   int
 	PubQoS     byte
 	KeepAlive  int
 	Quiet      bool
+	Transport  *Transport    // optional socket settings
+	Backoff    *Backoff      // optional connection retry policy
+	Timeout    time.Duration // optional publish completion timeout
+	Trace      []*TraceRecord
+	Pacer      Pacer         // optional load shape, publishes back to back when nil
+	Think      *ThinkTime    // optional wait between messages, see Config.ThinkTime
+	Duration   time.Duration // publish for this long instead of MsgCount messages
+	Trim       float64       // trimmed mean fraction, see Config.TrimFraction
+	Streaming  bool          // drop raw samples to keep memory constant, unless Config.ExactStats
+	Sizes      *SizeDist     // optional message size distribution, replaces MsgSize
+	Compress   string        // payload compression, see Config.Compress
+	TopicAlias bool          // publish by topic alias, see Config.TopicAlias
+	Responses  string        // request/response mode: time the echoes arriving on this topic
+	RespWait   time.Duration // how long to wait for outstanding responses
+	Backend    Backend       // connect through this client instead of paho, see Config.Backend
+	ZeroCopy   bool          // reuse one payload buffer, see Config.ZeroCopy
+	Checksum   string        // append a checksum of every payload, see Config.Checksum
+	Hooks      *Hooks        // optional callbacks, see Config.Hooks
+	StoreDir   string        // keep in-flight messages in a file store below this directory, see Config.StoreDir
+
+	clock          Clock
+	replayAt       time.Time // shared time of the first recorded message across all replaying publishers
+	replayBase     int64     // offset of that message in the trace
+	tracker        *responseTracker
+	rng            *rand.Rand // random payload padding, zeroes when nil
+	sizeRng        *rand.Rand // draws from Sizes
+	stages         *stagePlan
+	window         *window // soak mode: streamed statistics instead of samples
+	abort          *abortMonitor
+	outage         *outageMonitor
+	chaos          *chaosScript
+	spans          *spanExporter
+	metrics        *statsdSink
+	progress       *progress
+	limiter        *rateLimiter  // shared by all publishers, see Config.GlobalRate
+	live           *liveControls // payload size changed through the server
+	connects       *connectLimiter
+	pool           *topicPool
+	topicRng       *rand.Rand // picks pool topics
+	thinkRng       *rand.Rand // draws the think time jitter
+	backoffRng     *rand.Rand // draws the connection retry jitter
+	pickTopic      func() int
+	conns          *connLog
+	store          *timedStore   // paho file store, nil without StoreDir
+	connectTime    time.Duration // set before publishing starts
+	aliasMax       int           // topic aliases granted by the broker, likewise
+	connectRetries int64         // counted atomically as retries start, before a connect can succeed
+	disconnects    int64         // updated atomically by the connection lost handler
+	blocked        time.Duration // generator waiting on the publisher, see hand
+	handed         int64
+	life           *lifecycle // nil inside a benchmark run
+	resCh          chan *PubResults
+	results        *PubResults
 }
 
 func (c *PubClient) run(res chan *PubResults) {
@@ -32,35 +88,147 @@ func (c *PubClient) run(res chan *PubResults) {
 	doneGen := make(chan bool)
 	donePub := make(chan bool)
 	runResults := new(PubResults)
+	c.clock = clockOrSystem(c.clock)
+	c.conns = newConnLog(c.clock)
+	if c.Responses != "" {
+		c.tracker = newResponseTracker(c.Compress)
+	}
 
-	started := time.Now()
+	// start publisher, which connects first
+	go c.pubMessages(newMsgs, pubMsgs, doneGen, donePub)
+	c.life.wait()
+	started := c.clock.Now()
 	// start generator
 	go c.genMessages(newMsgs, doneGen)
-	// start publisher
-	go c.pubMessages(newMsgs, pubMsgs, doneGen, donePub)
 
 	runResults.ID = c.ID
-	times := []float64{}
+	runResults.Topic = c.PubTopic
+	runResults.Errors = make(ErrorCounts)
+	if c.stages != nil {
+		runResults.stages = make([]bucketStats, len(c.stages.stages))
+	}
+	if c.Sizes != nil {
+		runResults.sizes = make([]bucketStats, len(c.Sizes.bounds))
+	}
+	var total accumulator
+	var times []float64 // raw samples for order statistics, unless streaming
+	runResults.digest = newDigest()
+	// at QoS 1 and 2 the token completes on PUBACK or PUBCOMP; timing it from
+	// the hand-off leaves payload preparation out of the broker's share
+	var ack accumulator
+	var trend ackTrend
+	if c.PubQoS > 0 {
+		runResults.ackDigest = newDigest()
+	}
+	if c.Compress != "" {
+		runResults.Compression = &CompressionResults{Algorithm: c.Compress}
+	}
+	if c.TopicAlias {
+		runResults.TopicAlias = &TopicAliasResults{}
+	}
 	for {
 		select {
 		case m := <-pubMsgs:
 			if m.Error {
 				log.Printf("PUBLISHER %v ERROR publishing message: %v: at %v\n", c.ID, m.Topic, m.Sent.Unix())
 				runResults.Failures++
+				runResults.Errors.add(m.ErrClass, 1)
+				if runResults.stages != nil {
+					runResults.stages[m.Stage].failures++
+				}
+				if k := c.sizeClass(m.Size); k >= 0 {
+					runResults.sizes[k].failures++
+				}
+				if c.window != nil {
+					c.window.fail()
+				}
+				if c.outage != nil {
+					recordTimeline(&runResults.timeline, c.outage.bucketOf(m.Sent.UnixNano()), 0, true)
+				}
 			} else {
 				// log.Printf("Message published: %v: sent: %v delivered: %v flight time: %v\n", m.Topic, m.Sent, m.Delivered, m.Delivered.Sub(m.Sent))
 				runResults.Successes++
-				times = append(times, m.Delivered.Sub(m.Sent).Seconds()*1000) // in milliseconds
+				c.progress.publish()
+				if c.pool != nil {
+					c.pool.sent(m.PoolIndex)
+				}
+				pubTime := m.Delivered.Sub(m.Sent).Seconds() * 1000 // in milliseconds
+				total.add(pubTime)
+				runResults.digest.add(pubTime)
+				if runResults.ackDigest != nil {
+					ackTime := m.Delivered.Sub(m.Handed).Seconds() * 1000 // in milliseconds
+					ack.add(ackTime)
+					trend.add(ackTime)
+					runResults.ackDigest.add(ackTime)
+				}
+				if c.window != nil {
+					c.window.add(pubTime)
+				}
+				if !c.Streaming {
+					times = append(times, pubTime)
+				}
+				if runResults.stages != nil {
+					runResults.stages[m.Stage].add(pubTime)
+					c.stages.published()
+				}
+				if k := c.sizeClass(m.Size); k >= 0 {
+					runResults.sizes[k].add(pubTime)
+				}
+				if c.outage != nil {
+					recordTimeline(&runResults.timeline, c.outage.bucketOf(m.Sent.UnixNano()), pubTime, false)
+				}
+				if runResults.Compression != nil {
+					runResults.Compression.add(m.RawSize, len(m.Payload.([]byte)), m.CompressTime)
+				}
+				if runResults.TopicAlias != nil {
+					runResults.TopicAlias.add(m, pubTime)
+				}
 			}
 		case <-donePub:
 			// calculate results
-			duration := time.Now().Sub(started)
-			runResults.PubTimeMin = stats.StatsMin(times)
-			runResults.PubTimeMax = stats.StatsMax(times)
-			runResults.PubTimeMean = stats.StatsMean(times)
-			runResults.PubTimeStd = stats.StatsSampleStandardDeviation(times)
+			duration := c.clock.Now().Sub(started)
+			runResults.PubTimeMin = total.min
+			runResults.PubTimeMax = total.max
+			runResults.PubTimeMean = total.mean
+			runResults.PubTimeStd = total.std()
+			if c.Streaming {
+				runResults.PubTimeMed = runResults.digest.quantile(0.5)
+				runResults.PubTimeTrim = runResults.digest.trimmedMean(c.Trim)
+			} else {
+				runResults.PubTimeMed, runResults.PubTimeTrim = orderStats(times, c.Trim)
+			}
+			runResults.PubTimePct = runResults.digest.percentiles()
+			if runResults.ackDigest != nil {
+				runResults.AckLatencyMin = ack.min
+				runResults.AckLatencyMax = ack.max
+				runResults.AckLatencyMean = ack.mean
+				runResults.AckLatencyStd = ack.std()
+				runResults.AckLatencyPct = runResults.ackDigest.percentiles()
+				runResults.AckTrend = trend.ratio()
+				runResults.Backpressure = runResults.AckTrend >= backpressureTrend
+			}
 			runResults.RunTime = duration.Seconds()
-			runResults.PubsPerSec = float64(runResults.Successes) / duration.Seconds()
+			runResults.BlockedTime = c.blocked.Seconds()
+			// a clock that did not move gives no run time to derive rates from
+			if runResults.RunTime > 0 {
+				runResults.BlockedRatio = runResults.BlockedTime / runResults.RunTime
+				runResults.PubsPerSec = float64(runResults.Successes) / runResults.RunTime
+			}
+			runResults.StoreTime = c.store.perMessage(runResults.Successes)
+			if runResults.Compression != nil {
+				runResults.Compression.finish(runResults.RunTime)
+			}
+			if runResults.TopicAlias != nil {
+				runResults.TopicAlias.Maximum = c.aliasMax
+				runResults.TopicAlias.finish()
+			}
+			if c.tracker != nil {
+				c.tracker.results(runResults)
+			}
+			runResults.ConnectTime = c.connectTime.Seconds() * 1000 // in milliseconds
+			runResults.ConnectRetries = int(atomic.LoadInt64(&c.connectRetries))
+			runResults.Disconnects = atomic.LoadInt64(&c.disconnects)
+			runResults.ConnEvents, runResults.Uptime = c.conns.results()
 
 			// report results and exit
 			res <- runResults
@@ -70,11 +238,50 @@ func (c *PubClient) run(res chan *PubResults) {
 }
 
 func (c *PubClient) genMessages(ch chan *Message, done chan bool) {
-	for i := 0; i < c.MsgCount; i++ {
-		ch <- &Message{
-			Topic: c.PubTopic,
-			QoS:   c.PubQoS,
+	if c.Trace != nil {
+		c.replayMessages(ch)
+		done <- true
+		return
+	}
+	if c.stages != nil {
+		c.stageMessages(ch)
+		done <- true
+		return
+	}
+	var (
+		start time.Time
+		next  time.Duration
+	)
+	if c.Think != nil && c.thinkRng == nil {
+		c.thinkRng = rand.New(rand.NewSource(c.clock.Now().UnixNano() + int64(c.ID)))
+	}
+	for i := 0; c.Duration > 0 || i < c.MsgCount; i++ {
+		if c.Think != nil && i > 0 {
+			c.clock.Sleep(c.Think.delay(c.thinkRng))
+		}
+		if c.Duration > 0 && i > 0 && c.clock.Now().Sub(start) >= c.Duration {
+			break
+		}
+		if c.halted() {
+			break
+		}
+		if c.Pacer != nil && i > 0 {
+			pace(c.clock, c.Pacer, i, start, &next)
+		}
+		if c.limiter != nil {
+			c.limiter.wait()
+		}
+		topic, k := c.topic()
+		c.hand(ch, &Message{
+			Topic:     topic,
+			PoolIndex: k,
+			QoS:       c.PubQoS,
+			Size:      c.msgSize(),
+			Seq:       int64(i),
 			//Payload: make([]byte, c.MsgSize),
+		})
+		if i == 0 {
+			start = c.clock.Now()
 		}
 	}
 	done <- true
@@ -82,57 +289,328 @@ func (c *PubClient) genMessages(ch chan *Message, done chan bool) {
 	return
 }
 
-func (c *PubClient) pubMessages(in, out chan *Message, doneGen, donePub chan bool) {
-	onConnected := func(client mqtt.Client) {
-		ctr := 0
-		for {
-			select {
-			case m := <-in:
-				m.Sent = time.Now()
-				m.Payload = bytes.Join([][]byte{[]byte(strconv.FormatInt(m.Sent.UnixNano(), 10)), make([]byte, c.MsgSize)}, []byte("#@#"))
-				token := client.Publish(m.Topic, m.QoS, false, m.Payload)
-				token.Wait()
-				if token.Error() != nil {
-					log.Printf("PUBLISHER %v Error sending message: %v\n", c.ID, token.Error())
-					m.Error = true
+// ackPacket names the packet completing a publish at qos
+func ackPacket(qos byte) string {
+	switch qos {
+	case 1:
+		return "PUBACK"
+	case 2:
+		return "PUBCOMP"
+	}
+	return ""
+}
+
+// topic returns the topic of the next message and its index into the topic
+// pool, or the client's own topic
+func (c *PubClient) topic() (string, int) {
+	if c.pool == nil {
+		return c.PubTopic, 0
+	}
+	if c.pickTopic == nil {
+		c.pickTopic = c.pool.picker(c.topicRng)
+	}
+	k := c.pickTopic()
+	return c.pool.topics[k], k
+}
+
+// publishLoop publishes generated messages until the generator is done.
+// publish sends one payload and blocks until the broker acknowledged it.
+func (c *PubClient) publishLoop(publish func(m *Message) error, disconnect func(), in, out chan *Message, doneGen, donePub chan bool) {
+	c.connected(nil)
+	ctr := 0
+	var delivered int64
+	comp := newCompressor(c.Compress)
+	var tmpl *payloadTemplate
+	if c.ZeroCopy {
+		tmpl = newPayloadTemplate(c.rng)
+	}
+	for {
+		select {
+		case m := <-in:
+			m.Sent = c.clock.Now()
+			var payload []byte
+			if tmpl != nil {
+				payload = tmpl.fill(m.Sent, m.Seq, m.Size)
+			} else {
+				payload = encodePayload(m.Sent, m.Seq, m.Size, c.rng)
+			}
+			if c.Checksum != "" {
+				payload = appendChecksum(c.Checksum, payload)
+			}
+			m.RawSize = len(payload)
+			if comp != nil {
+				start := c.clock.Now()
+				payload = comp.compress(payload)
+				m.CompressTime = c.clock.Now().Sub(start)
+			}
+			m.Payload = payload
+			m.Handed = c.clock.Now()
+			if err := publish(m); err != nil {
+				log.Printf("PUBLISHER %v Error sending message: %v\n", c.ID, err)
+				m.Error = true
+				m.ErrClass = classifyPublishError(err, m.QoS)
+				c.Hooks.fail(RolePublisher, c.ID, err)
+			} else {
+				m.Delivered = c.clock.Now()
+				m.Error = false
+				delivered++
+			}
+			if c.abort != nil {
+				c.abort.publish(m.Error)
+			}
+			if c.spans != nil {
+				c.spans.publish(c.ID, m)
+			}
+			if c.metrics != nil {
+				if m.Error {
+					c.metrics.count("publish.failures", 1, c.ID)
 				} else {
-					m.Delivered = time.Now()
-					m.Error = false
+					c.metrics.count("publish.successes", 1, c.ID)
+					c.metrics.timing("publish.time", m.Delivered.Sub(m.Sent).Seconds()*1000, c.ID)
 				}
-				out <- m
-				ctr++
-			case <-doneGen:
-				if !c.Quiet {
-					log.Printf("PUBLISHER %v had connected to the broker %v and done publishing for topic: %v\n", c.ID, c.BrokerURL, c.PubTopic)
-				}
-				donePub <- true
-				client.Disconnect(250)
-				return
 			}
+			c.Hooks.publish(c.ID, m)
+			out <- m
+			ctr++
+		case <-doneGen:
+			if !c.Quiet {
+				log.Printf("PUBLISHER %v had connected to the broker %v and done publishing for topic: %v\n", c.ID, c.BrokerURL, c.PubTopic)
+			}
+			if c.tracker != nil {
+				c.tracker.wait(c.clock, delivered, c.RespWait)
+			}
+			donePub <- true
+			disconnect()
+			return
 		}
 	}
+}
 
+func (c *PubClient) pubMessages(in, out chan *Message, doneGen, donePub chan bool) {
 	ka, _ := time.ParseDuration(strconv.Itoa(c.KeepAlive) + "s")
 
+	if isMQTTSN(c.BrokerURL) {
+		c.pubMessagesSN(ka, in, out, doneGen, donePub)
+		return
+	}
+	if c.Backend != nil {
+		c.pubMessagesBackend(ka, in, out, doneGen, donePub)
+		return
+	}
+
+	connectStart := c.clock.Now()
+	var connects int32
+	onConnected := func(client mqtt.Client) {
+		if atomic.AddInt32(&connects, 1) > 1 {
+			// paho calls this again after reconnecting; the first call still runs the publish loop
+			c.outage.reconnected(c.outageKey())
+			c.conns.reconnected()
+			c.Hooks.connect(RolePublisher, c.ID)
+			if c.tracker != nil {
+				client.Subscribe(c.Responses, c.PubQoS, func(client mqtt.Client, msg mqtt.Message) {
+					c.tracker.receive(msg.Payload(), c.clock.Now())
+				})
+			}
+			return
+		}
+		if c.connectTime == 0 {
+			c.connectTime = c.clock.Now().Sub(connectStart)
+		}
+		if c.tracker != nil {
+			token := client.Subscribe(c.Responses, c.PubQoS, func(client mqtt.Client, msg mqtt.Message) {
+				c.tracker.receive(msg.Payload(), c.clock.Now())
+			})
+			if token.Wait() && token.Error() != nil {
+				log.Printf("PUBLISHER %v had error subscribe with response topic: %v\n", c.ID, token.Error())
+			}
+		}
+		publish := func(m *Message) error {
+			token := client.Publish(m.Topic, m.QoS, false, m.Payload)
+			if c.Timeout > 0 {
+				if !token.WaitTimeout(c.Timeout) {
+					return errTimeout
+				}
+			} else {
+				token.Wait()
+			}
+			return token.Error()
+		}
+		c.publishLoop(publish, func() { client.Disconnect(250) }, in, out, doneGen, donePub)
+	}
+
 	opts := mqtt.NewClientOptions().
 		AddBroker(c.BrokerURL).
-		SetClientID(fmt.Sprintf("mqtt-benchmark-%v-%v", time.Now(), c.ID)).
+		SetClientID(clientID(c.ClientID, c.ID)).
 		SetCleanSession(true).
 		SetAutoReconnect(true).
 		SetOnConnectHandler(onConnected).
 		SetKeepAlive(ka).
 		SetConnectionLostHandler(func(client mqtt.Client, reason error) {
+			atomic.AddInt64(&c.disconnects, 1)
+			if c.abort != nil {
+				c.abort.disconnect()
+			}
+			c.outage.disconnected(c.outageKey())
 			log.Printf("PUBLISHER %v lost connection to the broker: %v. Will reconnect...\n", c.ID, reason.Error())
+			c.conns.lost(reason)
+			c.Hooks.fail(RolePublisher, c.ID, reason)
 		})
+	if c.StoreDir != "" {
+		c.store = newTimedStore(c.StoreDir, "pub", c.ID)
+		opts.SetStore(c.store)
+	}
 	if c.BrokerUser != "" && c.BrokerPass != "" {
 		opts.SetUsername(c.BrokerUser)
 		opts.SetPassword(c.BrokerPass)
 	}
+	setTransport(opts, c.BrokerURL, c.Transport)
 	client := mqtt.NewClient(opts)
-	token := client.Connect()
-	token.Wait()
 
-	if token.Error() != nil {
-		log.Printf("PUBLISHER %v had error connecting to the broker: %v\n", c.ID, token.Error())
+	_, err := connectWithRetry(c.clock, c.Backoff, c.backoffRng, func() error {
+		c.connects.wait()
+		connectStart = c.clock.Now()
+		token := client.Connect()
+		token.Wait()
+		return token.Error()
+	}, c.logRetry)
+	if err != nil {
+		log.Printf("PUBLISHER %v had error connecting to the broker: %v\n", c.ID, err)
+		c.connected(err)
+		c.failMessages(classifyConnectError(err), in, out, doneGen, donePub)
+	}
+}
+
+func (c *PubClient) outageKey() string {
+	return "pub-" + strconv.Itoa(c.ID)
+}
+
+func (c *PubClient) logRetry(retry int, err error) {
+	atomic.AddInt64(&c.connectRetries, 1)
+	log.Printf("PUBLISHER %v had error connecting to the broker: %v. Retry %v/%v...\n", c.ID, err, retry, c.Backoff.Retries)
+}
+
+// failMessages reports every generated message as failed when the client never connected
+func (c *PubClient) failMessages(class string, in, out chan *Message, doneGen, donePub chan bool) {
+	for {
+		select {
+		case m := <-in:
+			m.Sent = c.clock.Now()
+			m.Error = true
+			m.ErrClass = class
+			if c.abort != nil {
+				c.abort.publish(true)
+			}
+			c.Hooks.publish(c.ID, m)
+			out <- m
+		case <-doneGen:
+			donePub <- true
+			return
+		}
+	}
+}
+
+// pubMessagesSN publishes through an MQTT-SN gateway
+func (c *PubClient) pubMessagesSN(ka time.Duration, in, out chan *Message, doneGen, donePub chan bool) {
+	var client *snClient
+	_, err := connectWithRetry(c.clock, c.Backoff, c.backoffRng, func() (err error) {
+		c.connects.wait()
+		connectStart := c.clock.Now()
+		client, err = dialMQTTSN(c.BrokerURL, snClientID(c.ID), ka, nil, func(reason error) {
+			atomic.AddInt64(&c.disconnects, 1)
+			if c.abort != nil {
+				c.abort.disconnect()
+			}
+			log.Printf("PUBLISHER %v lost connection to the gateway: %v\n", c.ID, reason.Error())
+			c.conns.lost(reason)
+			c.Hooks.fail(RolePublisher, c.ID, reason)
+		})
+		c.connectTime = c.clock.Now().Sub(connectStart)
+		return err
+	}, c.logRetry)
+	if err != nil {
+		log.Printf("PUBLISHER %v had error connecting to the gateway: %v\n", c.ID, err)
+		c.connected(err)
+		c.failMessages(classifyConnectError(err), in, out, doneGen, donePub)
+		return
+	}
+	topicID, err := client.register(c.PubTopic)
+	if err != nil {
+		log.Printf("PUBLISHER %v had error registering topic %v: %v\n", c.ID, c.PubTopic, err)
+		client.disconnect()
+		c.connected(err)
+		c.failMessages(ErrOther, in, out, doneGen, donePub)
+		return
+	}
+	publish := func(m *Message) error {
+		return client.publish(topicID, m.QoS, m.Payload.([]byte))
+	}
+	c.publishLoop(publish, client.disconnect, in, out, doneGen, donePub)
+}
+
+// pubMessagesBackend publishes through a client Backend
+func (c *PubClient) pubMessagesBackend(ka time.Duration, in, out chan *Message, doneGen, donePub chan bool) {
+	var onResponse func(topic string, qos byte, payload []byte)
+	if c.tracker != nil {
+		onResponse = func(topic string, qos byte, payload []byte) {
+			c.tracker.receive(payload, c.clock.Now())
+		}
+	}
+	var conn BackendConn
+	_, err := connectWithRetry(c.clock, c.Backoff, c.backoffRng, func() (err error) {
+		c.connects.wait()
+		connectStart := c.clock.Now()
+		conn, err = c.Backend.Connect(&BackendOptions{
+			Broker:    c.BrokerURL,
+			ClientID:  clientID(c.ClientID, c.ID),
+			Username:  c.BrokerUser,
+			Password:  c.BrokerPass,
+			KeepAlive: ka,
+			Timeout:   c.Timeout,
+			Transport: c.Transport,
+			Aliases:   c.TopicAlias,
+			OnMessage: onResponse,
+			OnLost: func(reason error) {
+				atomic.AddInt64(&c.disconnects, 1)
+				if c.abort != nil {
+					c.abort.disconnect()
+				}
+				log.Printf("PUBLISHER %v lost connection to the broker: %v\n", c.ID, reason.Error())
+				c.conns.lost(reason)
+				c.Hooks.fail(RolePublisher, c.ID, reason)
+			},
+		})
+		c.connectTime = c.clock.Now().Sub(connectStart)
+		return err
+	}, c.logRetry)
+	if err != nil {
+		log.Printf("PUBLISHER %v had error connecting to the broker: %v\n", c.ID, err)
+		c.connected(err)
+		c.failMessages(classifyConnectError(err), in, out, doneGen, donePub)
+		return
+	}
+	publish := func(m *Message) error {
+		return conn.Publish(m.Topic, m.QoS, m.Payload.([]byte))
+	}
+	if r, ok := conn.(Requester); ok && c.tracker != nil {
+		if err := conn.Subscribe(map[string]byte{c.Responses: c.PubQoS}); err != nil {
+			log.Printf("PUBLISHER %v had error subscribe with response topic: %v\n", c.ID, err)
+		}
+		// the sequence number is the correlation data, as in the payload
+		publish = func(m *Message) error {
+			return r.Request(m.Topic, m.QoS, m.Payload.([]byte), c.Responses, strconv.AppendInt(nil, m.Seq, 10))
+		}
+	}
+	if ar, ok := conn.(AliasReporter); ok && c.TopicAlias {
+		c.aliasMax = int(ar.AliasMaximum())
+		if c.aliasMax == 0 {
+			log.Printf("PUBLISHER %v: the broker allows no topic aliases, publishing full topic names\n", c.ID)
+		}
+		send := publish
+		publish = func(m *Message) error {
+			err := send(m)
+			m.Aliased, m.WireSize, m.AliasSaved = ar.LastAlias()
+			return err
+		}
 	}
+	c.publishLoop(publish, conn.Disconnect, in, out, doneGen, donePub)
 }
@@ -0,0 +1,91 @@
+package mqttbmlatency
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// QoSResults aggregates the clients of one QoS level of a mixed QoS run
+type QoSResults struct {
+	QoS       int              `json:"qos"`
+	Clients   int              `json:"clients"`
+	PubTotals *TotalPubResults `json:"publish totals"`
+	SubTotals *TotalSubResults `json:"receive totals"`
+}
+
+// qosOf returns the publish and subscribe QoS of client i
+func qosOf(cfg *Config, i int) (int, int) {
+	if len(cfg.QoSMix) == 0 {
+		return cfg.PubQoS, cfg.SubQoS
+	}
+	qos := cfg.QoSMix[i%len(cfg.QoSMix)]
+	return qos, qos
+}
+
+// publishedQoS returns the lowest QoS the messages for subscriber i are
+// published at; pool topics carry the messages of every publisher
+func publishedQoS(cfg *Config, i int) int {
+	qos, _ := qosOf(cfg, i)
+	if cfg.TopicPool > 0 {
+		for _, q := range cfg.QoSMix {
+			if q < qos {
+				qos = q
+			}
+		}
+	}
+	return qos
+}
+
+func minQoS(a, b byte) byte {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// granted records the lowest QoS the broker granted in the SUBACK return
+// codes, by filter, warning about a subscription granted below SubQoS
+func (c *SubClient) granted(res *SubResults, codes map[string]byte) {
+	lowest := -1
+	for _, code := range codes {
+		if code <= 2 && (lowest < 0 || int(code) < lowest) {
+			lowest = int(code)
+		}
+	}
+	if lowest < 0 {
+		return
+	}
+	res.GrantedQoS = &lowest
+	res.downgraded = lowest < int(c.SubQoS)
+	if res.downgraded {
+		log.Printf("SUBSCRIBER %v was granted QoS %v instead of %v\n", c.ID, lowest, c.SubQoS)
+	}
+}
+
+// calculateQoSResults aggregates per QoS level, in ascending order. Publisher
+// and subscriber i both use the level of client i.
+func calculateQoSResults(cfg *Config, pubresults []*PubResults, subresults []*SubResults, totalTime time.Duration) []*QoSResults {
+	pubs := make(map[int][]*PubResults)
+	subs := make(map[int][]*SubResults)
+	for _, res := range pubresults {
+		qos, _ := qosOf(cfg, res.ID)
+		pubs[qos] = append(pubs[qos], res)
+	}
+	for _, res := range subresults {
+		qos, _ := qosOf(cfg, res.ID)
+		subs[qos] = append(subs[qos], res)
+	}
+
+	var results []*QoSResults
+	for qos, p := range pubs {
+		r := &QoSResults{QoS: qos, Clients: len(p), PubTotals: calculatePublishResults(p, totalTime)}
+		r.PubTotals.AckPacket = ackPacket(byte(qos))
+		if s := subs[qos]; len(s) > 0 {
+			r.SubTotals = calculateSubscribeResults(s, p)
+		}
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].QoS < results[j].QoS })
+	return results
+}
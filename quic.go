@@ -0,0 +1,278 @@
+package mqttbmlatency
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/quic-go/quic-go"
+)
+
+// quicALPN is the application protocol EMQX serves MQTT over QUIC on
+const quicALPN = "mqtt"
+
+// quicKeepAlive keeps QUIC's 30 second idle timeout from closing connections
+// whose MQTT keep alive is longer
+const quicKeepAlive = 15 * time.Second
+
+// quicQuiesce bounds the wait for the broker to close a QUIC connection once
+// the client finished its stream, so the last packets are not discarded
+const quicQuiesce = 250 * time.Millisecond
+
+// QUICResults describes the connections of a run to a quic:// broker. Each
+// client keeps the TLS session of its last connection, so that a reconnect
+// resumes it and sends the MQTT CONNECT as 0-RTT early data, a round trip
+// sooner than after a full handshake.
+type QUICResults struct {
+	Connections  int64        `json:"connections"`             // that received their first packet
+	Resumed      int64        `json:"resumed"`                 // resumed an earlier TLS session of the client
+	ZeroRTT      int64        `json:"zero_rtt"`                // whose 0-RTT early data the broker accepted
+	Rejected     int64        `json:"zero_rtt_rejected"`       // 0-RTT attempts the broker refused, which reconnect
+	SetupFull    float64      `json:"setup_time_mean_full"`    // dial to CONNACK in milliseconds, after a full handshake
+	SetupResumed float64      `json:"setup_time_mean_resumed"` // after a resumption without 0-RTT
+	Setup0RTT    float64      `json:"setup_time_mean_0rtt"`
+	Probe        *QUICResults `json:"reconnect_probe,omitempty"` // see Config.QUICReconnects
+}
+
+// quicStats collects the QUIC connections of many clients
+type quicStats struct {
+	mu                   sync.Mutex
+	res                  QUICResults
+	full, resumed, early accumulator // setup times
+}
+
+// attach returns a copy of t whose QUIC connections are counted in s, with a
+// TLS session cache of their own, creating the transport when the client had none
+func (s *quicStats) attach(t *Transport) *Transport {
+	if s == nil {
+		return t
+	}
+	attached := &Transport{}
+	if t != nil {
+		*attached = *t
+	}
+	attached.quic = newQUICSession()
+	attached.quic.stats = s
+	return attached
+}
+
+// connected accounts a connection once its first packet arrived
+func (s *quicStats) connected(setup time.Duration, state quic.ConnectionState) {
+	ms := setup.Seconds() * 1000
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.res.Connections++
+	if state.TLS.DidResume {
+		s.res.Resumed++
+	}
+	switch {
+	case state.Used0RTT:
+		s.res.ZeroRTT++
+		s.early.add(ms)
+	case state.TLS.DidResume:
+		s.resumed.add(ms)
+	default:
+		s.full.add(ms)
+	}
+}
+
+func (s *quicStats) rejected() {
+	s.mu.Lock()
+	s.res.Rejected++
+	s.mu.Unlock()
+}
+
+// results returns the totals, or nil if no QUIC connection was dialed
+func (s *quicStats) results() *QUICResults {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.res.Connections == 0 && s.res.Rejected == 0 {
+		return nil
+	}
+	res := s.res
+	res.SetupFull = s.full.mean
+	res.SetupResumed = s.resumed.mean
+	res.Setup0RTT = s.early.mean
+	return &res
+}
+
+// quicResults reports the run's QUIC connections along with the reconnect
+// probe, or nil with neither
+func quicResults(run *quicStats, probe *QUICResults) *QUICResults {
+	res := run.results()
+	if probe != nil {
+		if res == nil {
+			res = &QUICResults{}
+		}
+		res.Probe = probe
+	}
+	return res
+}
+
+// quicSession dials the QUIC connections of one client, keeping its TLS
+// session for the next connection
+type quicSession struct {
+	cache tls.ClientSessionCache
+	stats *quicStats // nil for connections not reported
+}
+
+func newQUICSession() *quicSession {
+	return &quicSession{cache: tls.NewLRUClientSessionCache(1)}
+}
+
+// session returns the QUIC session of t, or a new unreported one
+func (t *Transport) session() *quicSession {
+	if t != nil && t.quic != nil {
+		return t.quic
+	}
+	return newQUICSession()
+}
+
+// openQUIC returns a connection function that dials MQTT over a single
+// bidirectional QUIC stream, as EMQX serves it, attempting 0-RTT whenever s
+// holds a session of the broker
+func (t *Transport) openQUIC(s *quicSession) mqtt.OpenConnectionFunc {
+	return func(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+		tlsCfg := &tls.Config{}
+		if options.TLSConfig != nil {
+			tlsCfg = options.TLSConfig.Clone()
+		}
+		if tlsCfg.ServerName == "" {
+			tlsCfg.ServerName = uri.Hostname()
+		}
+		tlsCfg.NextProtos = []string{quicALPN}
+		tlsCfg.ClientSessionCache = s.cache
+
+		ctx := context.Background()
+		if options.ConnectTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, options.ConnectTimeout)
+			defer cancel()
+		}
+		raddr, err := net.ResolveUDPAddr("udp", uri.Host)
+		if err != nil {
+			return nil, err
+		}
+		laddr := &net.UDPAddr{}
+		if t != nil && t.LocalAddr != nil {
+			laddr.IP = t.LocalAddr
+		}
+		udp, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		conn, err := quic.DialEarly(ctx, udp, raddr, tlsCfg, &quic.Config{KeepAlivePeriod: quicKeepAlive})
+		if err != nil {
+			udp.Close()
+			return nil, err
+		}
+		stream, err := conn.OpenStreamSync(ctx)
+		if err != nil {
+			conn.CloseWithError(0, "")
+			udp.Close()
+			if errors.Is(err, quic.Err0RTTRejected) && s.stats != nil {
+				s.stats.rejected()
+			}
+			return nil, err
+		}
+		return &quicConn{Stream: stream, conn: conn, udp: udp, session: s, start: start}, nil
+	}
+}
+
+// quicConn is MQTT over one QUIC stream. It times the connection until its
+// first packet, the CONNACK, which reads from a single goroutine.
+type quicConn struct {
+	*quic.Stream
+	conn    *quic.Conn
+	udp     *net.UDPConn
+	session *quicSession
+	start   time.Time
+	read    bool
+	refused int32 // set once 0-RTT was rejected, accessed atomically
+}
+
+func (c *quicConn) Read(b []byte) (int, error) {
+	n, err := c.Stream.Read(b)
+	if n > 0 && !c.read {
+		c.read = true
+		if c.session.stats != nil {
+			c.session.stats.connected(time.Since(c.start), c.conn.ConnectionState())
+		}
+	}
+	c.check(err)
+	return n, err
+}
+
+func (c *quicConn) Write(b []byte) (int, error) {
+	n, err := c.Stream.Write(b)
+	c.check(err)
+	return n, err
+}
+
+// check counts a rejected 0-RTT attempt once. The early data is lost then,
+// including the CONNECT, so the client sees the connection fail.
+func (c *quicConn) check(err error) {
+	if errors.Is(err, quic.Err0RTTRejected) && atomic.CompareAndSwapInt32(&c.refused, 0, 1) && c.session.stats != nil {
+		c.session.stats.rejected()
+	}
+}
+
+// Close finishes the stream and gives the broker a moment to close the
+// connection, which acknowledges what the client sent last
+func (c *quicConn) Close() error {
+	c.Stream.Close()
+	t := time.NewTimer(quicQuiesce)
+	select {
+	case <-c.conn.Context().Done():
+	case <-t.C:
+	}
+	t.Stop()
+	err := c.conn.CloseWithError(0, "")
+	c.udp.Close()
+	return err
+}
+
+func (c *quicConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *quicConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// usesQUIC reports whether the publishers or subscribers of cfg dial a
+// quic:// broker
+func usesQUIC(cfg *Config) bool {
+	for _, b := range append([]string{cfg.Broker, cfg.SubBroker}, cfg.Nodes...) {
+		if u, err := url.Parse(b); err == nil && u.Scheme == "quic" {
+			return true
+		}
+	}
+	return false
+}
+
+// probeQUIC connects one extra client cfg.QUICReconnects times more after
+// its first connection, so that every reconnect can use 0-RTT
+func probeQUIC(cfg *Config, t *Transport) *QUICResults {
+	stats := new(quicStats)
+	t = stats.attach(t)
+	for i := 0; i <= cfg.QUICReconnects; i++ {
+		conn, err := dialProbe(cfg, i, t)
+		if err != nil {
+			log.Printf("QUIC probe had error connecting to the broker: %v\n", err)
+			break
+		}
+		// DISCONNECT, so the broker closes the connection right away
+		conn.Write([]byte{0xE0, 0x00})
+		conn.Close()
+	}
+	return stats.results()
+}
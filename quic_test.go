@@ -0,0 +1,144 @@
+package mqttbmlatency
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/quic-go/quic-go"
+
+	"github.com/brunobevilaquaa/mqtt-bm-latency/broker"
+)
+
+// quicListener serves MQTT over QUIC on loopback, relaying every stream to
+// a TCP broker at tcpAddr, and returns its address and its certificate
+func quicListener(t *testing.T, tcpAddr string, allow0RTT bool) (string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	tlsCfg := &tls.Config{NextProtos: []string{quicALPN}, Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	l, err := quic.ListenAddrEarly("127.0.0.1:0", tlsCfg, &quic.Config{Allow0RTT: allow0RTT})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.CloseWithError(0, "")
+				stream, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				tcp, err := net.Dial("tcp", tcpAddr)
+				if err != nil {
+					return
+				}
+				defer tcp.Close()
+				go func() {
+					io.Copy(tcp, stream)
+					tcp.(*net.TCPConn).CloseWrite()
+				}()
+				io.Copy(stream, tcp)
+			}()
+		}
+	}()
+	return l.Addr().String(), roots
+}
+
+func TestQUICReconnects(t *testing.T) {
+	b := broker.New()
+	tcpAddr, err := b.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	const connects = 3
+	tests := []struct {
+		name      string
+		allow0RTT bool
+		zeroRTT   int64
+	}{
+		{"0-RTT", true, connects - 1},
+		{"1-RTT resumption", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, roots := quicListener(t, tcpAddr, tt.allow0RTT)
+			stats := new(quicStats)
+			transport := stats.attach(nil)
+			for i := 0; i < connects; i++ {
+				opts := mqtt.NewClientOptions().
+					AddBroker("quic://" + addr).
+					SetClientID("quic-" + tt.name).
+					SetAutoReconnect(false).
+					SetConnectTimeout(5 * time.Second).
+					SetTLSConfig(&tls.Config{RootCAs: roots})
+				opts.SetCustomOpenConnectionFn(transport.openQUIC(transport.session()))
+				client := mqtt.NewClient(opts)
+				if token := client.Connect(); !token.WaitTimeout(10*time.Second) || token.Error() != nil {
+					t.Fatalf("connect %d: %v", i+1, token.Error())
+				}
+				if token := client.Publish("quic", 1, false, "ping"); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+					t.Fatalf("publish %d: %v", i+1, token.Error())
+				}
+				client.Disconnect(250)
+			}
+
+			res := stats.results()
+			if res == nil {
+				t.Fatal("no QUIC connections counted")
+			}
+			if res.Connections != connects || res.Resumed != connects-1 || res.ZeroRTT != tt.zeroRTT || res.Rejected != 0 {
+				t.Errorf("%d connections, %d resumed, %d with 0-RTT, %d rejected, want %d, %d, %d, 0",
+					res.Connections, res.Resumed, res.ZeroRTT, res.Rejected, connects, connects-1, tt.zeroRTT)
+			}
+			if res.SetupFull <= 0 {
+				t.Errorf("full handshake setup time %v", res.SetupFull)
+			}
+			if tt.zeroRTT > 0 && (res.Setup0RTT <= 0 || res.SetupResumed != 0) {
+				t.Errorf("setup times %v with 0-RTT, %v resumed without", res.Setup0RTT, res.SetupResumed)
+			}
+			if tt.zeroRTT == 0 && (res.SetupResumed <= 0 || res.Setup0RTT != 0) {
+				t.Errorf("setup times %v resumed, %v with 0-RTT", res.SetupResumed, res.Setup0RTT)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package mqttbmlatency
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// defaultBurstWindow sizes the shared token bucket when Config.GlobalBurst is
+// not set: enough tokens to absorb this much scheduling jitter
+const defaultBurstWindow = 10 * time.Millisecond
+
+// rateLimiter is a token bucket shared by all publishers, so the total offered
+// load stays at rate no matter how many clients share it. It hands out send
+// slots on a fixed schedule; idle time earns at most burst tokens of credit.
+type rateLimiter struct {
+	mu       sync.Mutex
+	clock    Clock
+	burst    int     // as configured, 0 for the default window
+	interval float64 // between slots, in nanoseconds, 0 for no limit
+	credit   float64 // the most a late schedule may catch up, in nanoseconds
+	start    time.Time
+	slot     float64 // next free slot, in nanoseconds since start
+}
+
+// newRateLimiter returns a limiter releasing rate slots per second, or any
+// number of them at a rate of 0
+func newRateLimiter(clock Clock, rate float64, burst int) *rateLimiter {
+	l := &rateLimiter{clock: clock, burst: burst}
+	l.configure(rate)
+	return l
+}
+
+func (l *rateLimiter) configure(rate float64) {
+	l.interval, l.credit = 0, 0
+	if rate <= 0 {
+		return
+	}
+	l.interval = float64(time.Second) / rate
+	burst := l.burst
+	if burst <= 0 {
+		burst = int(float64(defaultBurstWindow) / l.interval)
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	l.credit = float64(burst-1) * l.interval
+}
+
+// setRate changes the rate of a running limiter. The schedule restarts now,
+// so slots already handed out keep their time but no backlog is caught up.
+func (l *rateLimiter) setRate(rate float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.configure(rate)
+	if !l.start.IsZero() {
+		l.start, l.slot = l.clock.Now(), 0
+	}
+}
+
+// wait blocks until the caller may send one message
+func (l *rateLimiter) wait() {
+	l.mu.Lock()
+	now := l.clock.Now()
+	if l.start.IsZero() {
+		l.start = now
+	}
+	if elapsed := float64(now.Sub(l.start)); l.slot < elapsed-l.credit {
+		l.slot = elapsed - l.credit
+	}
+	at := l.start.Add(time.Duration(l.slot))
+	l.slot += l.interval
+	l.mu.Unlock()
+	sleepUntil(l.clock, at)
+}
+
+// connectLimiter paces new connections across all clients, independent of the
+// publish rate, so a large run does not open its sockets in one burst that
+// broker or firewall rate limits would punish
+type connectLimiter struct {
+	slots  *rateLimiter
+	clock  Clock
+	jitter time.Duration
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func newConnectLimiter(cfg *Config, clock Clock) *connectLimiter {
+	return &connectLimiter{
+		slots:  newRateLimiter(clock, cfg.ConnectRate, 1),
+		clock:  clock,
+		jitter: cfg.ConnectJitter,
+		rng:    clientRand(cfg, cfg.Clients*2, randPacing), // an ID no client uses
+	}
+}
+
+// wait blocks until the caller may open one connection; a nil limiter never blocks
+func (l *connectLimiter) wait() {
+	if l == nil {
+		return
+	}
+	l.slots.wait()
+	if l.jitter > 0 {
+		l.mu.Lock()
+		d := time.Duration(l.rng.Int63n(int64(l.jitter)))
+		l.mu.Unlock()
+		l.clock.Sleep(d)
+	}
+}
@@ -0,0 +1,32 @@
+package mqttbmlatency
+
+// finishQueue infers how long the messages of res waited at the broker for
+// the subscriber's Receive Maximum window. The fastest message found the
+// window open, so whatever the others took beyond it counts as queueing.
+func (res *SubResults) finishQueue(receiveMax int) {
+	if receiveMax == 0 || res.Received == 0 {
+		return
+	}
+	res.ReceiveMaximum = receiveMax
+	min := res.FwdLatencyMin
+	res.QueueTimeMean = res.FwdLatencyMean - min
+	res.QueueTimeMax = res.FwdLatencyMax - min
+	if p := res.FwdLatencyPct; p != nil {
+		res.QueueTimePct = &Percentiles{P50: p.P50 - min, P90: p.P90 - min, P95: p.P95 - min, P99: p.P99 - min, P999: p.P999 - min}
+	}
+}
+
+// calculateQueueTimes totals the inferred queue times across all subscribers
+func calculateQueueTimes(subtotals *TotalSubResults, subresults []*SubResults) {
+	var means []float64
+	for _, res := range subresults {
+		if res.ReceiveMaximum == 0 {
+			continue
+		}
+		means = append(means, res.QueueTimeMean)
+		if res.QueueTimeMax > subtotals.QueueTimeMax {
+			subtotals.QueueTimeMax = res.QueueTimeMax
+		}
+	}
+	subtotals.QueueTimeMeanAvg = summarize(means).mean
+}
@@ -0,0 +1,89 @@
+package mqttbmlatency
+
+import (
+	"testing"
+	"time"
+)
+
+// windowBackend connects a single subscriber and records the Receive Maximum
+// it advertised; the test delivers its messages as a broker holding them for
+// the window would
+type windowBackend struct {
+	opts *BackendOptions
+}
+
+type windowConn struct{}
+
+func (*windowBackend) Name() string { return "window" }
+
+func (b *windowBackend) Connect(opts *BackendOptions) (BackendConn, error) {
+	b.opts = opts
+	return windowConn{}, nil
+}
+
+func (windowConn) Publish(topic string, qos byte, payload []byte) error { return nil }
+func (windowConn) Subscribe(filters map[string]byte) error              { return nil }
+func (windowConn) Disconnect()                                          {}
+
+func TestQueueTimeInference(t *testing.T) {
+	const (
+		messages = 6
+		network  = time.Millisecond      // to the subscriber, without queueing
+		service  = 10 * time.Millisecond // until the subscriber acknowledges a message
+	)
+	tests := []struct {
+		name      string
+		window    int
+		queueMean float64 // in milliseconds
+		queueMax  float64
+	}{
+		{"window fits the burst", messages, 0, 0},
+		{"two in flight", 2, 10, 20},
+		{"one in flight", 1, 25, 50},
+	}
+	var subresults []*SubResults
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			backend := &windowBackend{}
+			c := &SubClient{SubTopic: "queue", PubQoS: 1, SubQoS: 1, Quiet: true, Backend: backend, ReceiveMax: tt.window, clock: clock}
+			if err := c.Connect(); err != nil {
+				t.Fatal(err)
+			}
+			if got := backend.opts.Window; got != uint16(tt.window) {
+				t.Errorf("receive maximum %d advertised, want %d", got, tt.window)
+			}
+
+			// the publisher sent all messages at once; each waits at the
+			// broker until the messages a window ahead of it were acknowledged
+			sent := clock.Now()
+			for i := 0; i < messages; i++ {
+				at := sent.Add(network + time.Duration(i/tt.window)*service)
+				clock.Advance(at.Sub(clock.Now()))
+				backend.opts.OnMessage("queue", 1, encodePayload(sent, int64(i), 16, nil))
+			}
+			c.Stop()
+			res, err := c.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Received != messages || res.ReceiveMaximum != tt.window {
+				t.Fatalf("received %d with receive maximum %d, want %d with %d", res.Received, res.ReceiveMaximum, messages, tt.window)
+			}
+			if !near(res.QueueTimeMean, tt.queueMean, 1e-9) || !near(res.QueueTimeMax, tt.queueMax, 1e-9) {
+				t.Errorf("queue time mean, max = %v, %v, want %v, %v", res.QueueTimeMean, res.QueueTimeMax, tt.queueMean, tt.queueMax)
+			}
+			if res.QueueTimePct == nil || res.QueueTimePct.P50 < 0 || res.QueueTimePct.P99 > tt.queueMax+1e-9 {
+				t.Errorf("queue time percentiles %+v outside 0-%v", res.QueueTimePct, tt.queueMax)
+			}
+			subresults = append(subresults, res)
+		})
+	}
+
+	// subscribers without a window are left out of the totals
+	subtotals := new(TotalSubResults)
+	calculateQueueTimes(subtotals, append(subresults, &SubResults{Received: messages, FwdLatencyMean: 100}))
+	if !near(subtotals.QueueTimeMeanAvg, 35.0/3, 1e-9) || !near(subtotals.QueueTimeMax, 50, 1e-9) {
+		t.Errorf("total queue time mean, max = %v, %v, want %v, 50", subtotals.QueueTimeMeanAvg, subtotals.QueueTimeMax, 35.0/3)
+	}
+}
@@ -0,0 +1,98 @@
+package mqttbmlatency
+
+import (
+	"log"
+)
+
+// RepeatResults are exported instead of JSONResults when a benchmark is
+// repeated, or checkpointed with one run per stage
+type RepeatResults struct {
+	Runs    []*JSONResults    `json:"runs"`
+	Summary *RepeatSummary    `json:"summary"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Unit    string            `json:"latency_unit"`
+}
+
+// RepeatSummary aggregates the totals of repeated runs
+type RepeatSummary struct {
+	Runs       int       `json:"runs"`
+	MsgsPerSec *RunStats `json:"total_msgs_per_sec"`
+	PubTime    *RunStats `json:"pub_time_mean_avg"`
+	FwdLatency *RunStats `json:"fwd_latency_mean_avg"`
+	FwdRatio   *RunStats `json:"fwd_success_ratio"`
+}
+
+// RunStats describes one total across runs. Best and Worst take the
+// direction of the metric into account, e.g. Best is the lowest latency but
+// the highest throughput.
+type RunStats struct {
+	Mean  float64   `json:"mean"`
+	Std   float64   `json:"std"`
+	Best  float64   `json:"best"`
+	Worst float64   `json:"worst"`
+	CI    *Interval `json:"ci95,omitempty"` // of the mean across runs
+}
+
+// repeat executes cfg.Repeat runs, separated by cfg.CoolDown
+func repeat(cfg *Config) (*RepeatResults, error) {
+	clock := clockOrSystem(cfg.Clock)
+	rr := &RepeatResults{Runs: make([]*JSONResults, 0, cfg.Repeat), Labels: cfg.Labels, Unit: "ms"}
+	for i := 0; i < cfg.Repeat; i++ {
+		if i > 0 && cfg.CoolDown > 0 {
+			if !cfg.Quiet {
+				log.Printf("Cooling down for %v before run %v/%v.\n", cfg.CoolDown, i+1, cfg.Repeat)
+			}
+			clock.Sleep(cfg.CoolDown)
+		}
+		if !cfg.Quiet {
+			log.Printf("Starting run %v/%v..\n", i+1, cfg.Repeat)
+		}
+		jr, err := benchmark(cfg)
+		if err != nil {
+			return nil, err
+		}
+		rr.Runs = append(rr.Runs, jr)
+		if jr.Aborted {
+			log.Printf("Run %v/%v aborted: %v. Skipping remaining runs.\n", i+1, cfg.Repeat, jr.Reason)
+			break
+		}
+	}
+	rr.Summary = summarizeRuns(rr.Runs)
+
+	return rr, nil
+}
+
+func summarizeRuns(runs []*JSONResults) *RepeatSummary {
+	msgsPerSec := make([]float64, len(runs))
+	pubTimes := make([]float64, len(runs))
+	fwdLatencies := make([]float64, len(runs))
+	fwdRatios := make([]float64, len(runs))
+	for i, jr := range runs {
+		msgsPerSec[i] = jr.PubTotals.TotalMsgsPerSec
+		pubTimes[i] = jr.PubTotals.PubTimeMeanAvg
+		fwdLatencies[i] = jr.SubTotals.FwdLatencyMeanAvg
+		fwdRatios[i] = jr.SubTotals.TotalFwdRatio
+	}
+	return &RepeatSummary{
+		Runs:       len(runs),
+		MsgsPerSec: newRunStats(msgsPerSec, true),
+		PubTime:    newRunStats(pubTimes, false),
+		FwdLatency: newRunStats(fwdLatencies, false),
+		FwdRatio:   newRunStats(fwdRatios, true),
+	}
+}
+
+func newRunStats(values []float64, higherIsBetter bool) *RunStats {
+	s := summarize(values)
+	rs := &RunStats{
+		Mean:  s.mean,
+		Std:   s.std(),
+		Best:  s.min,
+		Worst: s.max,
+		CI:    confidence95(values),
+	}
+	if higherIsBetter {
+		rs.Best, rs.Worst = rs.Worst, rs.Best
+	}
+	return rs
+}
@@ -0,0 +1,219 @@
+package mqttbmlatency
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+import (
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// TraceRecord describes a single message observed while recording
+type TraceRecord struct {
+	Topic  string `json:"topic"`
+	Size   int    `json:"size"`      // padding to replay, see traceSize
+	Offset int64  `json:"offset_ns"` // since the first recorded message
+}
+
+// Record subscribes to cfg.Topic (wildcards allowed) and writes every message
+// received during the given duration to path, one JSON record per line. It
+// connects like the first subscriber of a run of cfg, with the first
+// certificate of cfg.CertDir, and times messages on cfg.Clock.
+func Record(cfg *Config, path string, duration time.Duration) error {
+	transport, err := recorderTransport(cfg)
+	if err != nil {
+		return err
+	}
+	clock := clockOrSystem(cfg.Clock)
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+
+	var (
+		mu      sync.Mutex
+		first   time.Time
+		count   int
+		sizeSum int
+		encErr  error
+	)
+
+	ka, _ := time.ParseDuration(strconv.Itoa(cfg.KeepAlive) + "s")
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(fmt.Sprintf("mqtt-benchmark-recorder-%v", clock.Now().UnixNano())).
+		SetCleanSession(true).
+		SetAutoReconnect(true).
+		SetKeepAlive(ka).
+		SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
+			now := clock.Now()
+			mu.Lock()
+			defer mu.Unlock()
+			if first.IsZero() {
+				first = now
+			}
+			rec := &TraceRecord{
+				Topic:  msg.Topic(),
+				Size:   traceSize(msg.Payload()),
+				Offset: now.Sub(first).Nanoseconds(),
+			}
+			if err := enc.Encode(rec); err != nil && encErr == nil {
+				encErr = err
+			}
+			count++
+			sizeSum += rec.Size
+		}).
+		SetConnectionLostHandler(func(client mqtt.Client, reason error) {
+			log.Printf("RECORDER lost connection to the broker: %v. Will reconnect...\n", reason.Error())
+		})
+	if cfg.Username != "" && cfg.Password != "" {
+		opts.SetUsername(cfg.Username)
+		opts.SetPassword(cfg.Password)
+	}
+	setTransport(opts, cfg.Broker, transport)
+	client := mqtt.NewClient(opts)
+
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	if token := client.Subscribe(cfg.Topic, byte(cfg.SubQoS), nil); token.Wait() && token.Error() != nil {
+		client.Disconnect(250)
+		return token.Error()
+	}
+	if !cfg.Quiet {
+		log.Printf("RECORDER had connected to the broker: %v and subscribed with topic: %v\n", cfg.Broker, cfg.Topic)
+	}
+
+	clock.Sleep(duration)
+	client.Disconnect(250)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !cfg.Quiet {
+		log.Printf("RECORDER captured %v messages (%v bytes of padding) in %v\n", count, sizeSum, duration)
+	}
+	if encErr != nil {
+		return encErr
+	}
+	return w.Flush()
+}
+
+// recorderTransport builds the transport of the recorder like that of a
+// benchmark client, or nil when cfg leaves all defaults
+func recorderTransport(cfg *Config) (*Transport, error) {
+	var cert *tls.Certificate
+	if cfg.CertDir != "" {
+		certs, err := loadCertDir(cfg.CertDir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificates: %v", err)
+		}
+		if len(certs) == 0 {
+			return nil, fmt.Errorf("invalid client certificates: %v holds none", cfg.CertDir)
+		}
+		cert = &certs[0]
+	}
+	var localAddr net.IP
+	if len(cfg.LocalAddrs) > 0 {
+		ips, err := resolveLocalAddrs(cfg.LocalAddrs, brokerFamilies(cfg))
+		if err != nil {
+			return nil, fmt.Errorf("invalid local addresses: %v", err)
+		}
+		localAddr = ips[0]
+	}
+	return newTransport(cfg, localAddr, cert), nil
+}
+
+// traceSize returns the padding that replays payload at its recorded size.
+// A payload of this tool keeps its padding. Any other payload loses the
+// length of the zero-copy header, which the replay puts in front of it.
+func traceSize(payload []byte) int {
+	if _, _, ok := decodePayload(payload); ok {
+		return paddingSize(payload)
+	}
+	if n := len(payload) - payloadHeaderSize; n > 0 {
+		return n
+	}
+	return 0
+}
+
+// LoadTrace reads a trace written by Record
+func LoadTrace(path string) ([]*TraceRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := []*TraceRecord{}
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		rec := new(TraceRecord)
+		if err := dec.Decode(rec); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// groupTrace splits records by topic, keeping topics in order of first appearance
+func groupTrace(records []*TraceRecord) ([]string, map[string][]*TraceRecord) {
+	topics := []string{}
+	traces := make(map[string][]*TraceRecord)
+	for _, rec := range records {
+		if _, ok := traces[rec.Topic]; !ok {
+			topics = append(topics, rec.Topic)
+		}
+		traces[rec.Topic] = append(traces[rec.Topic], rec)
+	}
+	return topics, traces
+}
+
+// traceStart returns the offset of the first recorded message of all traces
+func traceStart(traces map[string][]*TraceRecord) int64 {
+	var start int64
+	first := true
+	for _, recs := range traces {
+		if len(recs) > 0 && (first || recs[0].Offset < start) {
+			start, first = recs[0].Offset, false
+		}
+	}
+	return start
+}
+
+// replayMessages emits the client's trace with its original timing. Inside a
+// run every publisher is anchored to the shared replayAt, so traces on
+// different topics keep their offsets to each other. A client replaying on
+// its own starts its trace right away.
+func (c *PubClient) replayMessages(ch chan *Message) {
+	start, base := c.replayAt, c.replayBase
+	if start.IsZero() && len(c.Trace) > 0 {
+		start, base = c.clock.Now(), c.Trace[0].Offset
+	}
+	for i, rec := range c.Trace {
+		sleepUntil(c.clock, start.Add(time.Duration(rec.Offset-base)))
+		if c.halted() {
+			return
+		}
+		c.hand(ch, &Message{
+			Topic: c.PubTopic,
+			QoS:   c.PubQoS,
+			Size:  rec.Size,
+			Seq:   int64(i),
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package mqttbmlatency
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brunobevilaquaa/mqtt-bm-latency/broker"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestTraceSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    int
+	}{
+		{"benchmark", encodePayload(time.Now(), 12345, 100, nil), 100},
+		{"zero-copy", newPayloadTemplate(nil).fill(time.Now(), 7, 100), 100},
+		{"foreign", make([]byte, 200), 200 - payloadHeaderSize},
+		{"short foreign", []byte("on"), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := traceSize(tt.payload); got != tt.want {
+				t.Errorf("traceSize = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRecordReplaysSizes records benchmark payloads and checks that a replay
+// of the trace publishes them at their original size
+func TestRecordReplaysSizes(t *testing.T) {
+	b := broker.New()
+	addr, err := b.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	opts := mqtt.NewClientOptions().AddBroker("tcp://" + addr).SetClientID("device")
+	device := mqtt.NewClient(opts)
+	if token := device.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("connect: %v", token.Error())
+	}
+	defer device.Disconnect(0)
+
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	recorded := make(chan error)
+	go func() {
+		recorded <- Record(&Config{Broker: "tcp://" + addr, Topic: "sensors/#", SubQoS: 1, KeepAlive: 30, Quiet: true}, path, time.Second)
+	}()
+	// the recorder subscribes within its first second
+	time.Sleep(300 * time.Millisecond)
+	for i, size := range []int{64, 512} {
+		device.Publish("sensors/a", 1, false, encodePayload(time.Now(), int64(i), size, nil)).Wait()
+	}
+	if err := <-recorded; err != nil {
+		t.Fatal(err)
+	}
+	records, err := LoadTrace(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Size != 64 || records[1].Size != 512 {
+		t.Fatalf("recorded %d messages, want sizes 64 and 512", len(records))
+	}
+
+	// a replay publishes the recorded messages at their original length
+	lengths := make(chan int, 10)
+	device.Subscribe("sensors/#", 1, func(c mqtt.Client, m mqtt.Message) { lengths <- len(m.Payload()) }).Wait()
+	jr, err := benchmark(&Config{
+		Broker:     "tcp://" + addr,
+		ReplayFile: path,
+		PubQoS:     1,
+		SubQoS:     1,
+		KeepAlive:  30,
+		Quiet:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jr.SubTotals.TotalReceived != 2 || jr.SubTotals.SizeMismatches != 0 {
+		t.Errorf("%d received with %d size mismatches, want 2 and none", jr.SubTotals.TotalReceived, jr.SubTotals.SizeMismatches)
+	}
+	for i, size := range []int{64, 512} {
+		want := len(encodePayload(time.Now(), int64(i), size, nil))
+		if got := <-lengths; got != want {
+			t.Errorf("replayed message %d is %d bytes, want %d", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package mqttbmlatency
+
+import (
+	"sync"
+	"time"
+)
+
+// responseSuffix is appended to a request topic to form its response topic.
+// With V5Backend, requests name it in their Response Topic property and carry
+// their sequence number as Correlation Data, and responders answer on the
+// topic a request names. MQTT 3.1.1 has neither property, so there the
+// pairing is by convention and the sequence number embedded in the payload
+// serves as correlation data.
+const responseSuffix = "/response"
+
+// defaultResponseTimeout bounds how long a publisher waits for outstanding responses
+const defaultResponseTimeout = 5 * time.Second
+
+// responseTracker collects the round trips of one publisher's requests
+type responseTracker struct {
+	compress string
+
+	mu     sync.Mutex
+	rtt    accumulator
+	digest *digest
+}
+
+func newResponseTracker(compress string) *responseTracker {
+	return &responseTracker{compress: compress, digest: newDigest()}
+}
+
+// receive accounts one echoed request, received at recvTime
+func (t *responseTracker) receive(payload []byte, recvTime time.Time) {
+	raw, err := decompress(t.compress, payload)
+	if err != nil {
+		return
+	}
+	sent, _, ok := decodePayload(raw)
+	if !ok {
+		return
+	}
+	rtt := float64(recvTime.UnixNano()-sent) / 1000000 // in milliseconds
+	t.mu.Lock()
+	t.rtt.add(rtt)
+	t.digest.add(rtt)
+	t.mu.Unlock()
+}
+
+func (t *responseTracker) count() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rtt.count
+}
+
+// wait blocks until n responses arrived or timeout elapsed
+func (t *responseTracker) wait(clock Clock, n int64, timeout time.Duration) {
+	deadline := clock.Now().Add(timeout)
+	for t.count() < n && clock.Now().Before(deadline) {
+		clock.Sleep(10 * time.Millisecond)
+	}
+}
+
+// results copies the round trip statistics into res
+func (t *responseTracker) results(res *PubResults) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	res.Responses = t.rtt.count
+	res.RTTMin = t.rtt.min
+	res.RTTMax = t.rtt.max
+	res.RTTMean = t.rtt.mean
+	res.RTTStd = t.rtt.std()
+	res.RTTPct = t.digest.percentiles()
+	res.rttDigest = t.digest
+}
+
+// responseTopic returns the topic a publisher of topic receives responses on,
+// or "" outside request/response mode
+func responseTopic(cfg *Config, topic string) string {
+	if !cfg.RequestResponse {
+		return ""
+	}
+	return topic + responseSuffix
+}
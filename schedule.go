@@ -0,0 +1,138 @@
+package mqttbmlatency
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+// SeriesPoint is the record a scheduled run appends to its time series, one
+// per broker
+type SeriesPoint struct {
+	Time           string  `json:"time"`
+	Broker         string  `json:"broker"`
+	MsgsPerSec     float64 `json:"total_msgs_per_sec"`
+	PubTimeMean    float64 `json:"pub_time_mean_avg"`
+	FwdLatencyMean float64 `json:"fwd_latency_mean_avg"`
+	FwdLatencyP50  float64 `json:"fwd_latency_p50"`
+	FwdLatencyP99  float64 `json:"fwd_latency_p99"`
+	Loss           float64 `json:"loss"`
+	ExitCode       int     `json:"exit_code"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// RunScheduled reruns cfg whenever the cron expression spec matches, and
+// appends a SeriesPoint per broker to the JSON lines file at path. If
+// cfg.StatsDAddr is set the points are also sent as gauges. Runs never
+// overlap: the times that pass while a run is in progress are skipped, and
+// the next run is the first match after it ends. It returns when stop is
+// closed, or right away if spec or cfg are invalid.
+func RunScheduled(spec string, cfg *Config, path string, stop <-chan struct{}) error {
+	sched, err := parseCron(spec)
+	if err != nil {
+		return err
+	}
+	run := *cfg
+	if run.SnapshotFile == "" {
+		// the rotation limits are meant for the series file then
+		run.RotateSize, run.RotateInterval = 0, 0
+	}
+	if err := run.validateSubmission(); err != nil {
+		return err
+	}
+	if cfg.Repeat > 1 || cfg.DryRun || cfg.CheckpointFile != "" || cfg.Capacity != nil {
+		return errors.New("scheduled runs cannot be repeated, checkpointed, dry run or capacity searches")
+	}
+	f, err := openRotating(path, cfg.RotateSize, cfg.RotateInterval)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	var gauges *statsdSink
+	if cfg.StatsDAddr != "" {
+		if gauges, err = newStatsdSink(cfg.StatsDAddr, cfg.StatsDPrefix, cfg.DogStatsD, cfg.Labels); err != nil {
+			return err
+		}
+		defer gauges.close()
+	}
+
+	for {
+		// counted from now, so times missed during the last run are skipped
+		next := sched.next(time.Now())
+		if next.IsZero() {
+			return errors.New("cron expression " + spec + " never matches")
+		}
+		if !cfg.Quiet {
+			log.Printf("Next scheduled run at %v\n", next.Format(time.RFC3339))
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-stop:
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+
+		points, err := scheduledRun(&run, next)
+		if err != nil {
+			log.Printf("Scheduled run failed: %v\n", err)
+		}
+		for _, p := range points {
+			if err := enc.Encode(p); err != nil {
+				log.Printf("Failed to append to time series %v: %v\n", path, err)
+			}
+			if gauges != nil {
+				gauges.gauge("run.msgs_per_sec", p.MsgsPerSec)
+				gauges.gauge("run.fwd_latency_p50", p.FwdLatencyP50)
+				gauges.gauge("run.fwd_latency_p99", p.FwdLatencyP99)
+				gauges.gauge("run.loss", p.Loss)
+			}
+		}
+	}
+}
+
+// scheduledRun performs one run of cfg, like Run with the embedded broker,
+// output file and results topic it asks for, and condenses it into series
+// points
+func scheduledRun(cfg *Config, at time.Time) ([]*SeriesPoint, error) {
+	r, _, _, err := execute(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var runs []*BrokerResults
+	switch r := r.(type) {
+	case *CompareResults:
+		runs = r.Runs
+	case *JSONResults:
+		broker := cfg.Broker
+		if cfg.Embedded {
+			broker = "embedded"
+		}
+		runs = []*BrokerResults{{Broker: broker, Results: r}}
+	}
+	points := make([]*SeriesPoint, len(runs))
+	for i, br := range runs {
+		jr := br.Results
+		p := &SeriesPoint{
+			Time:           at.Format(time.RFC3339),
+			Broker:         br.Broker,
+			MsgsPerSec:     jr.PubTotals.TotalMsgsPerSec,
+			PubTimeMean:    jr.PubTotals.PubTimeMeanAvg,
+			FwdLatencyMean: jr.SubTotals.FwdLatencyMeanAvg,
+			ExitCode:       jr.ExitCode(),
+			Labels:         jr.Labels,
+		}
+		// nothing published leaves the ratio undefined, and nothing was lost
+		if jr.SubTotals.TotalPublished > 0 && jr.SubTotals.TotalFwdRatio < 1 {
+			p.Loss = 1 - jr.SubTotals.TotalFwdRatio
+		}
+		if pct := jr.SubTotals.FwdLatencyPct; pct != nil {
+			p.FwdLatencyP50, p.FwdLatencyP99 = pct.P50, pct.P99
+		}
+		points[i] = p
+	}
+	return points, nil
+}
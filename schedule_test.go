@@ -0,0 +1,55 @@
+package mqttbmlatency
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScheduledRun(t *testing.T) {
+	at := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	points, err := scheduledRun(&Config{
+		Embedded:  true,
+		Topic:     "scheduled",
+		Clients:   2,
+		Count:     10,
+		Size:      64,
+		KeepAlive: 30,
+		Quiet:     true,
+		Labels:    map[string]string{"env": "test"},
+	}, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 1 {
+		t.Fatalf("%d points, want 1", len(points))
+	}
+	p := points[0]
+	if p.Broker != "embedded" || p.Time != "2026-01-02T00:00:00Z" || p.Labels["env"] != "test" {
+		t.Errorf("point for %v at %v with labels %v", p.Broker, p.Time, p.Labels)
+	}
+	if p.MsgsPerSec <= 0 || p.Loss != 0 || p.ExitCode != ExitOK {
+		t.Errorf("%v msg/s, loss %v and exit code %d", p.MsgsPerSec, p.Loss, p.ExitCode)
+	}
+}
+
+func TestRunScheduledStops(t *testing.T) {
+	cfg := &Config{Broker: "tcp://127.0.0.1:1883", Topic: "scheduled", Clients: 1, Count: 1, Size: 64, KeepAlive: 30, Quiet: true}
+	path := filepath.Join(t.TempDir(), "series.jsonl")
+	if err := RunScheduled("0 0 31 4 *", cfg, path, nil); err == nil {
+		t.Error("a schedule that never matches was accepted")
+	}
+	if err := RunScheduled("* * *", cfg, path, nil); err == nil {
+		t.Error("an invalid schedule was accepted")
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	if err := RunScheduled("@daily", cfg, path, stop); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("no time series: %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package mqttbmlatency
+
+import (
+	"math/rand"
+	"time"
+)
+
+// random streams of a client, kept apart so that the goroutines generating
+// and publishing messages never share a source
+const (
+	randPacing = iota
+	randPayload
+	randSize
+	randTopic
+	randThink
+	randBackoff
+	randSubBackoff
+	randStreams
+)
+
+// clientRand returns the random source of one stream of a client. With a
+// non-zero Config.Seed every run draws the same sequence, so runs against
+// different brokers offer identical traffic.
+func clientRand(cfg *Config, clientID int, stream int) *rand.Rand {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed + int64(clientID*randStreams+stream)))
+}
+
+// payloadRand returns the padding source of a publisher. Padding stays zeroed
+// unless a seed was given, as in earlier releases.
+func payloadRand(cfg *Config, clientID int) *rand.Rand {
+	if cfg.Seed == 0 {
+		return nil
+	}
+	return clientRand(cfg, clientID, randPayload)
+}
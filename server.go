@@ -0,0 +1,362 @@
+package mqttbmlatency
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Benchmark states reported by the server
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed" // the configuration could not run, see JobStatus.Error
+)
+
+// maxFinishedJobs is the number of finished jobs the server keeps with their
+// results, older ones are forgotten
+const maxFinishedJobs = 100
+
+// progress counts messages while a run is in flight, for status polls
+type progress struct {
+	published int64
+	received  int64
+}
+
+func (p *progress) publish() {
+	if p != nil {
+		atomic.AddInt64(&p.published, 1)
+	}
+}
+
+func (p *progress) receive() {
+	if p != nil {
+		atomic.AddInt64(&p.received, 1)
+	}
+}
+
+// JobStatus describes a benchmark submitted to the server
+type JobStatus struct {
+	ID        string `json:"id"`
+	State     string `json:"state"`
+	Submitted string `json:"submitted"`
+	Started   string `json:"started,omitempty"`
+	Finished  string `json:"finished,omitempty"`
+	Published int64  `json:"published"`
+	Received  int64  `json:"received"`
+	ExitCode  *int   `json:"exit_code,omitempty"` // once done or failed
+	Error     string `json:"error,omitempty"`     // why the job failed
+}
+
+type job struct {
+	id        string
+	cfg       *Config
+	submitted time.Time
+	progress  *progress
+
+	// guarded by Server.mu
+	state    string
+	started  time.Time
+	finished time.Time
+	results  []byte
+	exitCode int
+	err      error
+}
+
+// Server runs benchmarks submitted over HTTP, one at a time in submission
+// order, so the load of one run does not skew another:
+//
+//	POST  /benchmarks               submit a Config as JSON, returns the job status
+//	GET   /benchmarks               list all jobs
+//	GET   /benchmarks/{id}          poll the status and message counts of a job
+//	PATCH /benchmarks/{id}          change the rate or size of a running job, see LiveSettings
+//	GET   /benchmarks/{id}/results  download the results once the job is done
+//
+// Configurations are validated on submission. Settings that would act on the
+// server's host, such as files, profiles or outage commands, are rejected.
+// Some checks only happen when a job starts, such as the pre-flight check or
+// resolving local addresses; a job failing them ends in JobFailed with the
+// reason. The last maxFinishedJobs finished jobs are kept.
+type Server struct {
+	mu     sync.Mutex
+	jobs   map[string]*job
+	order  []*job
+	nextID int
+	queue  chan *job
+}
+
+// NewServer returns a Server and starts its worker
+func NewServer() *Server {
+	s := &Server{
+		jobs:  make(map[string]*job),
+		queue: make(chan *job, 1024),
+	}
+	go s.work()
+	return s
+}
+
+// Serve runs a benchmark server listening on addr
+func Serve(addr string) error {
+	log.Printf("Benchmark server listening on %v\n", addr)
+	return http.ListenAndServe(addr, NewServer())
+}
+
+func (s *Server) work() {
+	for j := range s.queue {
+		s.mu.Lock()
+		j.state, j.started = JobRunning, time.Now()
+		s.mu.Unlock()
+
+		_, data, code, err := execute(j.cfg)
+
+		s.mu.Lock()
+		j.state, j.finished = JobDone, time.Now()
+		j.results, j.exitCode, j.err = data, code, err
+		if err != nil {
+			j.state = JobFailed
+			if !j.cfg.Quiet {
+				log.Printf("Benchmark %v failed: %v\n", j.id, err)
+			}
+		}
+		s.evict()
+		s.mu.Unlock()
+	}
+}
+
+// evict forgets the oldest finished jobs beyond maxFinishedJobs, it must be
+// called with the lock held
+func (s *Server) evict() {
+	finished := 0
+	for _, j := range s.order {
+		if j.finished.IsZero() {
+			continue
+		}
+		finished++
+	}
+	kept := s.order[:0]
+	for _, j := range s.order {
+		if finished > maxFinishedJobs && !j.finished.IsZero() {
+			delete(s.jobs, j.id)
+			finished--
+			continue
+		}
+		kept = append(kept, j)
+	}
+	for i := len(kept); i < len(s.order); i++ {
+		s.order[i] = nil
+	}
+	s.order = kept
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "benchmarks" || len(parts) > 3 || len(parts) == 3 && parts[2] != "results" {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		s.submit(w, r)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		s.mu.Lock()
+		list := make([]*JobStatus, len(s.order))
+		for i, j := range s.order {
+			list[i] = j.status()
+		}
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, list)
+	case len(parts) == 2 && r.Method == http.MethodPatch:
+		s.tune(w, r, parts[1])
+	case r.Method != http.MethodGet:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		j, ok := s.jobs[parts[1]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if len(parts) == 2 {
+			writeJSON(w, http.StatusOK, j.status())
+			return
+		}
+		if j.state == JobFailed {
+			http.Error(w, "benchmark failed: "+j.err.Error(), http.StatusConflict)
+			return
+		}
+		if j.state != JobDone {
+			http.Error(w, "benchmark is "+j.state, http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", contentType(j.cfg.Format))
+		w.Write(j.results)
+	}
+}
+
+func (s *Server) submit(w http.ResponseWriter, r *http.Request) {
+	cfg := new(Config)
+	if err := json.NewDecoder(r.Body).Decode(cfg); err != nil {
+		http.Error(w, fmt.Sprintf("invalid configuration: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := cfg.validateRemote(); err != nil {
+		http.Error(w, fmt.Sprintf("invalid configuration: %v", err), http.StatusBadRequest)
+		return
+	}
+	j := &job{cfg: cfg, submitted: time.Now(), progress: new(progress), state: JobQueued}
+	cfg.progress = j.progress
+	cfg.live = newLiveControls()
+
+	// queued under the lock, so the worker finds the job registered
+	s.mu.Lock()
+	j.id = strconv.Itoa(s.nextID + 1)
+	select {
+	case s.queue <- j:
+	default:
+		s.mu.Unlock()
+		http.Error(w, "too many queued benchmarks", http.StatusServiceUnavailable)
+		return
+	}
+	s.nextID++
+	s.jobs[j.id] = j
+	s.order = append(s.order, j)
+	status := j.status()
+	s.mu.Unlock()
+
+	w.Header().Set("Location", "/benchmarks/"+j.id)
+	writeJSON(w, http.StatusAccepted, status)
+}
+
+func (s *Server) tune(w http.ResponseWriter, r *http.Request, id string) {
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	var state string
+	if ok {
+		state = j.state
+	}
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if state != JobRunning {
+		http.Error(w, "benchmark is "+state, http.StatusConflict)
+		return
+	}
+	settings := new(LiveSettings)
+	if err := json.NewDecoder(r.Body).Decode(settings); err != nil {
+		http.Error(w, fmt.Sprintf("invalid settings: %v", err), http.StatusBadRequest)
+		return
+	}
+	current, err := j.cfg.live.apply(settings)
+	switch {
+	case err == errNotPublishing:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, fmt.Sprintf("invalid settings: %v", err), http.StatusBadRequest)
+	default:
+		writeJSON(w, http.StatusOK, current)
+	}
+}
+
+// validateSubmission runs the checks Run would otherwise end the process on
+func (cfg *Config) validateSubmission() error {
+	if len(cfg.Brokers) == 0 {
+		if cfg.Embedded {
+			// the broker address is only known once the embedded broker runs
+			c := *cfg
+			c.Broker = "tcp://127.0.0.1:1883"
+			return c.Validate()
+		}
+		return cfg.Validate()
+	}
+	if err := cfg.validateComparison(); err != nil {
+		return err
+	}
+	for _, b := range cfg.Brokers {
+		c := *cfg
+		c.Broker, c.Brokers = b, nil
+		if err := c.Validate(); err != nil {
+			return fmt.Errorf("broker %v: %v", b, err)
+		}
+	}
+	return nil
+}
+
+// validateRemote is validateSubmission for configurations sent to the
+// server, which must not act on the server's own host
+func (cfg *Config) validateRemote() error {
+	var fields []string
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"Outage.Command", cfg.Outage != nil && cfg.Outage.Command != ""},
+		{"OutputFile", cfg.OutputFile != ""},
+		{"CheckpointFile", cfg.CheckpointFile != ""},
+		{"SnapshotFile", cfg.SnapshotFile != ""},
+		{"PacketLog", cfg.PacketLog != ""},
+		{"StoreDir", cfg.StoreDir != ""},
+		{"ReplayFile", cfg.ReplayFile != ""},
+		{"CredentialsFile", cfg.CredentialsFile != ""},
+		{"CertDir", cfg.CertDir != ""},
+		{"PprofAddr", cfg.PprofAddr != ""},
+		{"CPUProfile", cfg.CPUProfile != ""},
+		{"HeapProfile", cfg.HeapProfile != ""},
+	} {
+		if f.set {
+			fields = append(fields, f.name)
+		}
+	}
+	if len(fields) > 0 {
+		return fmt.Errorf("%v cannot be set on a server", strings.Join(fields, ", "))
+	}
+	return cfg.validateSubmission()
+}
+
+// status must be called with the server's lock held
+func (j *job) status() *JobStatus {
+	st := &JobStatus{
+		ID:        j.id,
+		State:     j.state,
+		Submitted: j.submitted.Format(time.RFC3339),
+		Published: atomic.LoadInt64(&j.progress.published),
+		Received:  atomic.LoadInt64(&j.progress.received),
+	}
+	if !j.started.IsZero() {
+		st.Started = j.started.Format(time.RFC3339)
+	}
+	if !j.finished.IsZero() {
+		st.Finished = j.finished.Format(time.RFC3339)
+		code := j.exitCode
+		st.ExitCode = &code
+	}
+	if j.err != nil {
+		st.Error = j.err.Error()
+	}
+	return st
+}
+
+func contentType(format string) string {
+	switch format {
+	case "markdown":
+		return "text/markdown; charset=utf-8"
+	case "junit":
+		return "application/xml"
+	}
+	return "application/json"
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
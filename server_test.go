@@ -0,0 +1,302 @@
+package mqttbmlatency
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// embeddedJob is a configuration the server can run without a broker
+func embeddedJob() *Config {
+	return &Config{Embedded: true, Topic: "server", Clients: 1, Count: 10, Size: 64, KeepAlive: 30, Quiet: true}
+}
+
+func submitJob(t *testing.T, url string, cfg interface{}) (*http.Response, *JobStatus) {
+	body, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(url+"/benchmarks", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return resp, nil
+	}
+	st := new(JobStatus)
+	if err := json.NewDecoder(resp.Body).Decode(st); err != nil {
+		t.Fatal(err)
+	}
+	return resp, st
+}
+
+func jobStatus(t *testing.T, url, id string) *JobStatus {
+	resp, err := http.Get(url + "/benchmarks/" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status of %v: %v", id, resp.Status)
+	}
+	st := new(JobStatus)
+	if err := json.NewDecoder(resp.Body).Decode(st); err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+// waitJob polls the job until it is in one of states
+func waitJob(t *testing.T, url, id string, states ...string) *JobStatus {
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		st := jobStatus(t, url, id)
+		for _, s := range states {
+			if st.State == s {
+				return st
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %v is still %v", id, st.State)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func patchJob(t *testing.T, url, id string, settings string) (int, string) {
+	req, err := http.NewRequest(http.MethodPatch, url+"/benchmarks/"+id, strings.NewReader(settings))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body bytes.Buffer
+	body.ReadFrom(resp.Body)
+	return resp.StatusCode, body.String()
+}
+
+func TestServerRejectsSubmissions(t *testing.T) {
+	srv := httptest.NewServer(NewServer())
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/benchmarks", "application/json", strings.NewReader("{"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("malformed JSON: %v", resp.Status)
+	}
+
+	tests := []struct {
+		name  string
+		cfg   func(*Config)
+		field string
+	}{
+		{"output file", func(c *Config) { c.OutputFile = "/tmp/results.json" }, "OutputFile"},
+		{"outage command", func(c *Config) { c.Outage = &Outage{Command: "systemctl restart mosquitto"} }, "Outage.Command"},
+		{"profiles", func(c *Config) { c.CPUProfile, c.PprofAddr = "cpu.out", ":6060" }, "PprofAddr, CPUProfile"},
+		{"credentials", func(c *Config) { c.CredentialsFile = "/etc/passwd" }, "CredentialsFile"},
+		{"invalid", func(c *Config) { c.Clients = 0 }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := embeddedJob()
+			tt.cfg(cfg)
+			body, _ := json.Marshal(cfg)
+			resp, err := http.Post(srv.URL+"/benchmarks", "application/json", bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var msg bytes.Buffer
+			msg.ReadFrom(resp.Body)
+			if resp.StatusCode != http.StatusBadRequest || !strings.Contains(msg.String(), tt.field) {
+				t.Errorf("%v: %v", resp.Status, msg.String())
+			}
+		})
+	}
+
+	list, err := http.Get(srv.URL + "/benchmarks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Body.Close()
+	var jobs []*JobStatus
+	if err := json.NewDecoder(list.Body).Decode(&jobs); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 0 {
+		t.Errorf("rejected submissions left %d jobs", len(jobs))
+	}
+}
+
+func TestServerJobs(t *testing.T) {
+	srv := httptest.NewServer(NewServer())
+	defer srv.Close()
+
+	// the first job runs while the second one waits
+	slow := embeddedJob()
+	slow.Count, slow.GlobalRate = 50, 100
+	resp, first := submitJob(t, srv.URL, slow)
+	if first == nil {
+		t.Fatalf("submission: %v", resp.Status)
+	}
+	if loc := resp.Header.Get("Location"); loc != "/benchmarks/"+first.ID {
+		t.Errorf("location %q", loc)
+	}
+	_, second := submitJob(t, srv.URL, embeddedJob())
+	if second == nil || second.State != JobQueued {
+		t.Fatalf("second job %+v, want it queued", second)
+	}
+	if code, _ := patchJob(t, srv.URL, second.ID, `{"rate": 10}`); code != http.StatusConflict {
+		t.Errorf("changed a queued job: %d", code)
+	}
+	resp, err := http.Get(srv.URL + "/benchmarks/" + second.ID + "/results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("results of a queued job: %v", resp.Status)
+	}
+
+	st := waitJob(t, srv.URL, second.ID, JobDone, JobFailed)
+	if st.State != JobDone || st.ExitCode == nil || *st.ExitCode != ExitOK || st.Published != 10 || st.Received != 10 {
+		t.Fatalf("second job %+v", st)
+	}
+	if st := jobStatus(t, srv.URL, first.ID); st.State != JobDone || st.Finished == "" {
+		t.Errorf("first job %+v finished after the second", st)
+	}
+	resp, err = http.Get(srv.URL + "/benchmarks/" + second.ID + "/results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var jr JSONResults
+	if err := json.NewDecoder(resp.Body).Decode(&jr); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get("Content-Type") != "application/json" || jr.SubTotals == nil || jr.SubTotals.TotalReceived != 10 {
+		t.Errorf("results %v with %+v", resp.Header.Get("Content-Type"), jr.SubTotals)
+	}
+	if code, _ := patchJob(t, srv.URL, "404", `{"rate": 10}`); code != http.StatusNotFound {
+		t.Errorf("changed an unknown job: %d", code)
+	}
+}
+
+func TestServerJobFails(t *testing.T) {
+	srv := httptest.NewServer(NewServer())
+	defer srv.Close()
+
+	// interfaces are only resolved when the job starts
+	cfg := embeddedJob()
+	cfg.LocalAddrs = []string{"no-such-interface0"}
+	resp, st := submitJob(t, srv.URL, cfg)
+	if st == nil {
+		t.Fatalf("submission: %v", resp.Status)
+	}
+	st = waitJob(t, srv.URL, st.ID, JobDone, JobFailed)
+	if st.State != JobFailed || st.Error == "" || st.ExitCode == nil || *st.ExitCode != ExitConfig {
+		t.Errorf("job %+v, want it failed with exit code %d", st, ExitConfig)
+	}
+	results, err := http.Get(srv.URL + "/benchmarks/" + st.ID + "/results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results.Body.Close()
+	if results.StatusCode != http.StatusConflict {
+		t.Errorf("results of a failed job: %v", results.Status)
+	}
+}
+
+func TestServerChangesRunningJob(t *testing.T) {
+	srv := httptest.NewServer(NewServer())
+	defer srv.Close()
+
+	cfg := embeddedJob()
+	cfg.Count, cfg.GlobalRate = 300, 100
+	_, st := submitJob(t, srv.URL, cfg)
+	if st == nil {
+		t.Fatal("submission rejected")
+	}
+	waitJob(t, srv.URL, st.ID, JobRunning)
+
+	// until the clients publish, changes are turned away
+	deadline := time.Now().Add(30 * time.Second)
+	var code int
+	var body string
+	for {
+		if code, body = patchJob(t, srv.URL, st.ID, `{"rate": 1000}`); code != http.StatusConflict || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("%d: %v", code, body)
+	}
+	var current LiveSettings
+	if err := json.Unmarshal([]byte(body), &current); err != nil {
+		t.Fatal(err)
+	}
+	if current.Rate == nil || *current.Rate != 1000 || current.Size == nil || *current.Size != 64 {
+		t.Errorf("current settings %v", body)
+	}
+	if code, body := patchJob(t, srv.URL, st.ID, `{"rate": -1}`); code != http.StatusBadRequest {
+		t.Errorf("negative rate: %d %v", code, body)
+	}
+	if code, body := patchJob(t, srv.URL, st.ID, `{"rate":`); code != http.StatusBadRequest {
+		t.Errorf("malformed settings: %d %v", code, body)
+	}
+
+	if st := waitJob(t, srv.URL, st.ID, JobDone, JobFailed); st.State != JobDone || st.Received != 300 {
+		t.Errorf("job %+v", st)
+	}
+	if code, _ := patchJob(t, srv.URL, st.ID, `{"rate": 10}`); code != http.StatusConflict {
+		t.Errorf("changed a finished job: %d", code)
+	}
+}
+
+func TestServerKeepsFinishedJobs(t *testing.T) {
+	s := &Server{jobs: make(map[string]*job)}
+	add := func(finished bool) *job {
+		j := &job{id: strconv.Itoa(len(s.order) + 1), progress: new(progress), state: JobQueued}
+		if finished {
+			j.state, j.finished = JobDone, time.Now()
+		}
+		s.jobs[j.id] = j
+		s.order = append(s.order, j)
+		return j
+	}
+	running := add(false)
+	running.state = JobRunning
+	for i := 0; i < maxFinishedJobs+5; i++ {
+		add(true)
+	}
+	queued := add(false)
+	s.evict()
+
+	if len(s.order) != maxFinishedJobs+2 || len(s.jobs) != maxFinishedJobs+2 {
+		t.Fatalf("%d jobs listed and %d kept, want %d", len(s.order), len(s.jobs), maxFinishedJobs+2)
+	}
+	if s.order[0] != running || s.order[len(s.order)-1] != queued {
+		t.Error("unfinished jobs were forgotten")
+	}
+	for _, id := range []string{"2", "6"} {
+		if _, ok := s.jobs[id]; ok {
+			t.Errorf("kept old job %v", id)
+		}
+	}
+	if s.order[1].id != "7" {
+		t.Errorf("oldest kept finished job is %v, want 7", s.order[1].id)
+	}
+}
@@ -0,0 +1,249 @@
+package mqttbmlatency
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// SizeDist draws message sizes instead of using a single fixed size, to
+// reflect heterogeneous device fleets. Sizes is a list of sizes picked with
+// the relative Weights (equal weights when empty); without Sizes, sizes are
+// uniform between Min and Max inclusive.
+type SizeDist struct {
+	Min     int       `json:"min,omitempty"`
+	Max     int       `json:"max,omitempty"`
+	Sizes   []int     `json:"sizes,omitempty"`
+	Weights []float64 `json:"weights,omitempty"`
+
+	cumulative []float64 // cumulative weights, built by prepare
+	bounds     []int     // upper bounds of the size classes
+}
+
+// SizeResults describes results of the messages of one size class
+type SizeResults struct {
+	MinSize        int     `json:"size_min"`
+	MaxSize        int     `json:"size_max"`
+	Published      int64   `json:"pub_successes"`
+	Failures       int64   `json:"failures"`
+	Received       int64   `json:"received"`
+	FwdRatio       float64 `json:"fwd_success_ratio"`
+	PubTimeMean    float64 `json:"pub_time_mean"`
+	FwdLatencyMin  float64 `json:"fwd_latency_min"`
+	FwdLatencyMax  float64 `json:"fwd_latency_max"`
+	FwdLatencyMean float64 `json:"fwd_latency_mean"`
+}
+
+func (d *SizeDist) validate() error {
+	if len(d.Sizes) == 0 {
+		if d.Min < 0 || d.Max < d.Min {
+			return errors.New("size distribution needs 0 <= min <= max")
+		}
+		if d.Max == 0 {
+			return errors.New("size distribution needs sizes or a max above 0")
+		}
+		return nil
+	}
+	if len(d.Weights) > 0 && len(d.Weights) != len(d.Sizes) {
+		return errors.New("size distribution needs one weight per size")
+	}
+	total := 0.0
+	for i, s := range d.Sizes {
+		if s < 0 || (len(d.Weights) > 0 && d.Weights[i] < 0) {
+			return errors.New("sizes and weights must not be negative")
+		}
+		if len(d.Weights) > 0 {
+			total += d.Weights[i]
+		}
+	}
+	if len(d.Weights) > 0 && total == 0 {
+		return errors.New("size distribution needs a weight above 0")
+	}
+	return nil
+}
+
+// prepare builds the lookup tables; it must be called before the
+// distribution is shared between clients
+func (d *SizeDist) prepare() {
+	d.bounds = nil
+	if len(d.Sizes) == 0 {
+		// power of two classes, the last one closed by Max
+		for b := 1; b < d.Max; b *= 2 {
+			if b >= d.Min {
+				d.bounds = append(d.bounds, b)
+			}
+		}
+		d.bounds = append(d.bounds, d.Max)
+		return
+	}
+	var sum float64
+	d.cumulative = make([]float64, len(d.Sizes))
+	for i := range d.Sizes {
+		if len(d.Weights) > 0 {
+			sum += d.Weights[i]
+		} else {
+			sum++
+		}
+		d.cumulative[i] = sum
+	}
+	d.bounds = append([]int(nil), d.Sizes...)
+	sort.Ints(d.bounds)
+	n := 0
+	for _, b := range d.bounds {
+		if n == 0 || b != d.bounds[n-1] {
+			d.bounds[n] = b
+			n++
+		}
+	}
+	d.bounds = d.bounds[:n]
+}
+
+func (d *SizeDist) draw(rng *rand.Rand) int {
+	if len(d.Sizes) == 0 {
+		return d.Min + rng.Intn(d.Max-d.Min+1)
+	}
+	x := rng.Float64() * d.cumulative[len(d.cumulative)-1]
+	return d.Sizes[sort.SearchFloat64s(d.cumulative, x)]
+}
+
+// classOf returns the size class of size, or -1 if it is outside the distribution
+func (d *SizeDist) classOf(size int) int {
+	k := sort.SearchInts(d.bounds, size)
+	if k == len(d.bounds) {
+		return -1
+	}
+	return k
+}
+
+// msgSize returns the size of the next generated message
+func (c *PubClient) msgSize() int {
+	if c.Sizes == nil {
+		return c.live.sizeOr(c.MsgSize)
+	}
+	return c.Sizes.draw(c.sizeRng)
+}
+
+// sizeCheck holds the payload sizes the publishers of a run send, so that
+// subscribers notice payloads a broker or gateway truncated or re-encoded
+type sizeCheck struct {
+	mu       sync.RWMutex
+	exact    map[int]bool // sizes of a list or a trace, nil for a range
+	min, max int
+}
+
+// newSizeCheck returns the sizes of a run publishing size bytes, drawing from
+// dist or replaying traces
+func newSizeCheck(size int, dist *SizeDist, traces map[string][]*TraceRecord) *sizeCheck {
+	s := &sizeCheck{exact: make(map[int]bool)}
+	switch {
+	case traces != nil:
+		for _, records := range traces {
+			for _, rec := range records {
+				s.exact[rec.Size] = true
+			}
+		}
+	case dist != nil && len(dist.Sizes) == 0:
+		s.exact, s.min, s.max = nil, dist.Min, dist.Max
+		return s
+	case dist != nil:
+		for _, n := range dist.Sizes {
+			s.exact[n] = true
+		}
+	default:
+		s.exact[size] = true
+	}
+	s.min = -1
+	for n := range s.exact {
+		if s.min < 0 || n < s.min {
+			s.min = n
+		}
+	}
+	return s
+}
+
+// check reports whether a padding of n bytes was never published, and
+// whether it is shorter than anything published
+func (s *sizeCheck) check(n int) (mismatch, truncated bool) {
+	if s == nil {
+		return false, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.exact != nil {
+		mismatch = !s.exact[n]
+	} else {
+		mismatch = n < s.min || n > s.max
+	}
+	return mismatch, mismatch && n < s.min
+}
+
+// allow adds a size publishers switched to during the run
+func (s *sizeCheck) allow(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.exact != nil {
+		s.exact[n] = true
+		if n < s.min {
+			s.min = n
+		}
+	}
+}
+
+func (c *PubClient) sizeClass(size int) int {
+	if c.Sizes == nil {
+		return -1
+	}
+	return c.Sizes.classOf(size)
+}
+
+func calculateSizeResults(d *SizeDist, pubresults []*PubResults, subresults []*SubResults) []*SizeResults {
+	results := make([]*SizeResults, len(d.bounds))
+	for k, b := range d.bounds {
+		res := &SizeResults{MaxSize: b}
+		switch {
+		case k > 0:
+			res.MinSize = d.bounds[k-1] + 1
+		case len(d.Sizes) == 0:
+			res.MinSize = d.Min
+		default:
+			res.MinSize = b
+		}
+		var pubTimeSum, fwdSum float64
+		for _, pr := range pubresults {
+			if k >= len(pr.sizes) {
+				continue
+			}
+			s := pr.sizes[k]
+			res.Published += s.count
+			res.Failures += s.failures
+			pubTimeSum += s.sum()
+		}
+		for _, sr := range subresults {
+			if k >= len(sr.sizes) {
+				continue
+			}
+			s := sr.sizes[k]
+			if s.count == 0 {
+				continue
+			}
+			if res.Received == 0 || s.min < res.FwdLatencyMin {
+				res.FwdLatencyMin = s.min
+			}
+			if s.max > res.FwdLatencyMax {
+				res.FwdLatencyMax = s.max
+			}
+			res.Received += s.count
+			fwdSum += s.sum()
+		}
+		if res.Published > 0 {
+			res.PubTimeMean = pubTimeSum / float64(res.Published)
+			res.FwdRatio = float64(res.Received) / float64(res.Published)
+		}
+		if res.Received > 0 {
+			res.FwdLatencyMean = fwdSum / float64(res.Received)
+		}
+		results[k] = res
+	}
+	return results
+}
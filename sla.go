@@ -0,0 +1,65 @@
+package mqttbmlatency
+
+import (
+	"errors"
+)
+
+// SLA sets limits a run is checked against. A zero limit is not checked.
+// Latencies are in milliseconds.
+type SLA struct {
+	MinMsgsPerSec    float64 // total publish throughput
+	MaxLoss          float64 // share of published messages not forwarded, 0.01 for 1%
+	MaxPubTimeP99    float64
+	MaxFwdLatencyP99 float64
+}
+
+// SLACheck is the outcome of one SLA limit
+type SLACheck struct {
+	Name   string  `json:"name"`
+	Limit  float64 `json:"limit"`
+	Value  float64 `json:"value"`
+	Passed bool    `json:"passed"`
+}
+
+func (s *SLA) validate() error {
+	if s.MinMsgsPerSec < 0 || s.MaxPubTimeP99 < 0 || s.MaxFwdLatencyP99 < 0 {
+		return errors.New("SLA limits must not be negative")
+	}
+	if s.MaxLoss < 0 || s.MaxLoss > 1 {
+		return errors.New("SLA loss limit must be between 0 and 1")
+	}
+	return nil
+}
+
+// check evaluates every limit that is set against the totals of jr. A
+// percentile limit fails if there were no samples to compute it from.
+func (s *SLA) check(jr *JSONResults) []*SLACheck {
+	var checks []*SLACheck
+	atMost := func(name string, limit, value float64) {
+		if limit > 0 {
+			checks = append(checks, &SLACheck{Name: name, Limit: limit, Value: value, Passed: value <= limit})
+		}
+	}
+	p99 := func(name string, limit float64, p *Percentiles) {
+		if limit > 0 && p == nil {
+			checks = append(checks, &SLACheck{Name: name, Limit: limit})
+		} else if p != nil {
+			atMost(name, limit, p.P99)
+		}
+	}
+
+	if s.MinMsgsPerSec > 0 {
+		v := jr.PubTotals.TotalMsgsPerSec
+		checks = append(checks, &SLACheck{Name: "min_msgs_per_sec", Limit: s.MinMsgsPerSec, Value: v, Passed: v >= s.MinMsgsPerSec})
+	}
+	if s.MaxLoss > 0 {
+		loss := 1 - jr.SubTotals.TotalFwdRatio
+		if loss < 0 {
+			loss = 0
+		}
+		atMost("max_loss", s.MaxLoss, loss)
+	}
+	p99("max_pub_time_p99", s.MaxPubTimeP99, jr.PubTotals.PubTimePct)
+	p99("max_fwd_latency_p99", s.MaxFwdLatencyP99, jr.SubTotals.FwdLatencyPct)
+	return checks
+}
@@ -0,0 +1,154 @@
+package mqttbmlatency
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// Snapshot describes one window of a soak run
+type Snapshot struct {
+	Time           string  `json:"time"`
+	Elapsed        float64 `json:"elapsed"`
+	Window         float64 `json:"window"`
+	Published      int64   `json:"pub_successes"`
+	Failures       int64   `json:"failures"`
+	Received       int64   `json:"received"`
+	PubsPerSec     float64 `json:"publish_per_sec"`
+	PubTimeMean    float64 `json:"pub_time_mean"`
+	PubTimeMax     float64 `json:"pub_time_max"`
+	FwdLatencyMin  float64 `json:"fwd_latency_min"`
+	FwdLatencyMax  float64 `json:"fwd_latency_max"`
+	FwdLatencyMean float64 `json:"fwd_latency_mean"`
+	FwdLatencyStd  float64 `json:"fwd_latency_std"`
+
+	Markers []string          `json:"markers,omitempty"` // chaos actions performed during the window
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// soakMonitor periodically drains the clients' windows into a snapshot and
+// appends it to a file as one JSON line, so a long run's progress survives a
+// crash and slow degradation shows up as a trend
+type soakMonitor struct {
+	pubs     []*window
+	subs     []*window
+	interval time.Duration
+	clock    Clock
+	file     *rotatingFile
+	enc      *json.Encoder
+	start    time.Time
+	last     time.Time
+	quiet    bool
+	labels   map[string]string // copied into every snapshot
+	stop     chan bool
+	done     chan bool
+
+	mu      sync.Mutex
+	markers []string // for the next snapshot
+}
+
+func newSoakMonitor(clock Clock, path string, rotateSize int64, rotateInterval time.Duration, interval time.Duration, clients int, quiet bool) (*soakMonitor, error) {
+	f, err := openRotating(path, rotateSize, rotateInterval)
+	if err != nil {
+		return nil, err
+	}
+	m := &soakMonitor{
+		pubs:     make([]*window, clients),
+		subs:     make([]*window, clients),
+		interval: interval,
+		clock:    clock,
+		file:     f,
+		enc:      json.NewEncoder(f),
+		quiet:    quiet,
+		stop:     make(chan bool),
+		done:     make(chan bool),
+	}
+	for i := 0; i < clients; i++ {
+		m.pubs[i] = new(window)
+		m.subs[i] = new(window)
+	}
+	return m, nil
+}
+
+// begin starts taking snapshots
+func (m *soakMonitor) begin() {
+	m.start = m.clock.Now()
+	m.last = m.start
+	go m.run()
+}
+
+// mark adds a marker to the next snapshot
+func (m *soakMonitor) mark(marker string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.markers = append(m.markers, marker)
+	m.mu.Unlock()
+}
+
+// close writes the last partial window and closes the file
+func (m *soakMonitor) close() {
+	m.stop <- true
+	<-m.done
+	m.file.Close()
+}
+
+func (m *soakMonitor) run() {
+	ticker := m.clock.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			m.snapshot()
+		case <-m.stop:
+			m.snapshot()
+			m.done <- true
+			return
+		}
+	}
+}
+
+func (m *soakMonitor) snapshot() {
+	now := m.clock.Now()
+	var pub, sub accumulator
+	snap := &Snapshot{
+		Time:    now.Format(time.RFC3339),
+		Elapsed: now.Sub(m.start).Seconds(),
+		Window:  now.Sub(m.last).Seconds(),
+		Labels:  m.labels,
+	}
+	m.last = now
+	m.mu.Lock()
+	snap.Markers, m.markers = m.markers, nil
+	m.mu.Unlock()
+	for _, w := range m.pubs {
+		acc, failures := w.take()
+		pub.merge(acc)
+		snap.Failures += failures
+	}
+	for _, w := range m.subs {
+		acc, _ := w.take()
+		sub.merge(acc)
+	}
+	snap.Published = pub.count
+	snap.Received = sub.count
+	if snap.Window > 0 {
+		snap.PubsPerSec = float64(pub.count) / snap.Window
+	}
+	snap.PubTimeMean = pub.mean
+	snap.PubTimeMax = pub.max
+	snap.FwdLatencyMin = sub.min
+	snap.FwdLatencyMax = sub.max
+	snap.FwdLatencyMean = sub.mean
+	snap.FwdLatencyStd = sub.std()
+
+	if err := m.enc.Encode(snap); err != nil {
+		log.Printf("Failed to write snapshot: %v\n", err)
+	}
+	if !m.quiet {
+		log.Printf("Snapshot at %.0fs: %v published, %v failed, %v received, mean forward latency %.3f ms\n",
+			snap.Elapsed, snap.Published, snap.Failures, snap.Received, snap.FwdLatencyMean)
+	}
+}
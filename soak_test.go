@@ -0,0 +1,78 @@
+package mqttbmlatency
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSoakSnapshotsFollowTheClock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshots.jsonl")
+	clock := newFakeClock()
+	m, err := newSoakMonitor(clock, path, 0, 0, 10*time.Second, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.start = clock.Now()
+	m.last = m.start
+
+	m.pubs[0].add(2)
+	m.pubs[0].add(4)
+	m.subs[0].add(10)
+	clock.Advance(10 * time.Second)
+	m.snapshot()
+	m.mark("pause")
+	m.pubs[0].fail()
+	clock.Advance(5 * time.Second)
+	m.snapshot()
+	m.file.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var snaps []Snapshot
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var snap Snapshot
+		if err := json.Unmarshal(scanner.Bytes(), &snap); err != nil {
+			t.Fatal(err)
+		}
+		snaps = append(snaps, snap)
+	}
+
+	tests := []struct {
+		elapsed, window float64
+		published       int64
+		failures        int64
+		received        int64
+		pubsPerSec      float64
+		markers         int
+	}{
+		{10, 10, 2, 0, 1, 0.2, 0},
+		{15, 5, 0, 1, 0, 0, 1},
+	}
+	if len(snaps) != len(tests) {
+		t.Fatalf("%d snapshots, want %d", len(snaps), len(tests))
+	}
+	for i, tt := range tests {
+		s := snaps[i]
+		if s.Elapsed != tt.elapsed || s.Window != tt.window {
+			t.Errorf("snapshot %d: elapsed %v, window %v, want %v, %v", i, s.Elapsed, s.Window, tt.elapsed, tt.window)
+		}
+		if s.Published != tt.published || s.Failures != tt.failures || s.Received != tt.received {
+			t.Errorf("snapshot %d: %v published, %v failed, %v received, want %v, %v, %v",
+				i, s.Published, s.Failures, s.Received, tt.published, tt.failures, tt.received)
+		}
+		if !near(s.PubsPerSec, tt.pubsPerSec, 1e-9) || len(s.Markers) != tt.markers {
+			t.Errorf("snapshot %d: %v publish/s, markers %v, want %v, %d", i, s.PubsPerSec, s.Markers, tt.pubsPerSec, tt.markers)
+		}
+	}
+	if want := clock.Now().Add(-5 * time.Second).Format(time.RFC3339); snaps[0].Time != want {
+		t.Errorf("first snapshot at %v, want %v", snaps[0].Time, want)
+	}
+}
@@ -0,0 +1,229 @@
+package mqttbmlatency
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stage is one step of a load profile: Rate messages per second across all
+// publishers, sustained for Duration
+type Stage struct {
+	Rate     float64       `json:"rate"`
+	Duration time.Duration `json:"duration"`
+}
+
+// StageResults describes results of a single stage of a load profile
+type StageResults struct {
+	Stage          int     `json:"stage"`
+	Rate           float64 `json:"target_rate"`
+	Duration       float64 `json:"duration"`
+	Published      int64   `json:"pub_successes"`
+	Failures       int64   `json:"failures"`
+	Received       int64   `json:"received"`
+	FwdRatio       float64 `json:"fwd_success_ratio"`
+	MsgsPerSec     float64 `json:"received_per_sec"`
+	PubTimeMean    float64 `json:"pub_time_mean"`
+	FwdLatencyMin  float64 `json:"fwd_latency_min"`
+	FwdLatencyMax  float64 `json:"fwd_latency_max"`
+	FwdLatencyMean float64 `json:"fwd_latency_mean"`
+	DrainWait      float64 `json:"drain_wait,omitempty"` // seconds waited for the previous stage to drain
+	Undrained      bool    `json:"undrained,omitempty"`  // the previous stage had not drained by the timeout
+}
+
+// stagePlan is the schedule shared by all clients of a staged run. Subscribers
+// attribute each message to a stage by its embedded send time.
+type stagePlan struct {
+	stages  []Stage
+	offsets []int64 // start of each stage in nanos after start, accessed atomically
+	clients int
+	start   int64 // unix nanos when publishing began, accessed atomically
+
+	// with a drain, every stage after the first waits for its predecessor
+	drain     *Drain
+	clock     Clock
+	settled   []sync.Once
+	waits     []time.Duration
+	undrained []bool
+	sent      int64 // messages of the profile published, then received, accessed atomically
+	received  int64
+}
+
+func newStagePlan(stages []Stage, clients int, drain *Drain, clock Clock) *stagePlan {
+	p := &stagePlan{stages: stages, clients: clients, drain: drain, clock: clock}
+	var offset time.Duration
+	for _, st := range stages {
+		p.offsets = append(p.offsets, int64(offset))
+		offset += st.Duration
+	}
+	p.settled = make([]sync.Once, len(stages))
+	p.waits = make([]time.Duration, len(stages))
+	p.undrained = make([]bool, len(stages))
+	return p
+}
+
+func (p *stagePlan) offset(k int) time.Duration {
+	return time.Duration(atomic.LoadInt64(&p.offsets[k]))
+}
+
+// published and delivered count the messages of the profile for drains
+func (p *stagePlan) published() {
+	if p.drain != nil {
+		atomic.AddInt64(&p.sent, 1)
+	}
+}
+
+func (p *stagePlan) delivered() {
+	if p.drain != nil {
+		atomic.AddInt64(&p.received, 1)
+	}
+}
+
+// settle blocks the publishers before stage k until the messages of the
+// earlier stages were received or stopped arriving, then moves the remaining
+// stages back by the wait. The first publisher to arrive waits for all.
+func (p *stagePlan) settle(k int) {
+	if p.drain == nil || k == 0 {
+		return
+	}
+	p.settled[k].Do(func() {
+		start := p.startTime()
+		received := func() int64 { return atomic.LoadInt64(&p.received) }
+		caughtUp := func() bool { return received() >= atomic.LoadInt64(&p.sent) }
+		wait, drained := p.drain.settle(p.clock, received, caughtUp)
+		p.waits[k], p.undrained[k] = wait, !drained
+		if !drained {
+			log.Printf("STAGE %v messages of earlier stages still arriving after %v\n", k+1, p.drain.timeout())
+		}
+		if shift := p.clock.Now().Sub(start.Add(p.offset(k))); shift > 0 {
+			for j := k; j < len(p.offsets); j++ {
+				atomic.AddInt64(&p.offsets[j], int64(shift))
+			}
+		}
+	})
+}
+
+func (p *stagePlan) begin(t time.Time) {
+	atomic.StoreInt64(&p.start, t.UnixNano())
+}
+
+func (p *stagePlan) startTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&p.start))
+}
+
+// stageOf returns the stage a message sent at the given unix nano time belongs to,
+// or -1 when it falls outside the profile
+func (p *stagePlan) stageOf(sent int64) int {
+	start := atomic.LoadInt64(&p.start)
+	if start == 0 || sent < start {
+		return -1
+	}
+	offset := time.Duration(sent - start)
+	for k := len(p.stages) - 1; k >= 0; k-- {
+		if begin := p.offset(k); offset >= begin {
+			if offset < begin+p.stages[k].Duration {
+				return k
+			}
+			return -1
+		}
+	}
+	return -1
+}
+
+// bucketStats accumulates counts and latencies of one stage or size class on one client
+type bucketStats struct {
+	accumulator
+	failures int64
+}
+
+// stageMessages publishes each stage at this client's share of the target rate.
+// Clients are phase shifted so their publishes interleave instead of firing together.
+func (c *PubClient) stageMessages(ch chan *Message) {
+	plan := c.stages
+	start := plan.startTime()
+	seq := int64(0)
+	for k, st := range plan.stages {
+		plan.settle(k)
+		begin := plan.offset(k)
+		end := start.Add(begin + st.Duration)
+		if st.Rate > 0 {
+			interval := time.Duration(float64(time.Second) * float64(plan.clients) / st.Rate)
+			t := start.Add(begin + interval*time.Duration(c.ID%plan.clients)/time.Duration(plan.clients))
+			for ; t.Before(end); t = t.Add(interval) {
+				sleepUntil(c.clock, t)
+				if c.clock.Now().After(end) || c.halted() {
+					break
+				}
+				topic, pk := c.topic()
+				c.hand(ch, &Message{
+					Topic:     topic,
+					PoolIndex: pk,
+					QoS:       c.PubQoS,
+					Size:      c.msgSize(),
+					Seq:       seq,
+					Stage:     k,
+				})
+				seq++
+			}
+		}
+		if c.halted() {
+			return
+		}
+		sleepUntil(c.clock, end)
+	}
+}
+
+func calculateStageResults(plan *stagePlan, pubresults []*PubResults, subresults []*SubResults) []*StageResults {
+	results := make([]*StageResults, len(plan.stages))
+	for k, st := range plan.stages {
+		res := &StageResults{
+			Stage:    k,
+			Rate:     st.Rate,
+			Duration: st.Duration.Seconds(),
+		}
+		if plan.drain != nil {
+			res.DrainWait = plan.waits[k].Seconds()
+			res.Undrained = plan.undrained[k]
+		}
+		var pubTimeSum, fwdSum float64
+		for _, pr := range pubresults {
+			if k >= len(pr.stages) {
+				continue
+			}
+			s := pr.stages[k]
+			res.Published += s.count
+			res.Failures += s.failures
+			pubTimeSum += s.sum()
+		}
+		for _, sr := range subresults {
+			if k >= len(sr.stages) {
+				continue
+			}
+			s := sr.stages[k]
+			if s.count == 0 {
+				continue
+			}
+			if res.Received == 0 || s.min < res.FwdLatencyMin {
+				res.FwdLatencyMin = s.min
+			}
+			if s.max > res.FwdLatencyMax {
+				res.FwdLatencyMax = s.max
+			}
+			res.Received += s.count
+			fwdSum += s.sum()
+		}
+		if res.Published > 0 {
+			res.PubTimeMean = pubTimeSum / float64(res.Published)
+			res.FwdRatio = float64(res.Received) / float64(res.Published)
+		}
+		if res.Received > 0 {
+			res.FwdLatencyMean = fwdSum / float64(res.Received)
+		}
+		if st.Duration > 0 {
+			res.MsgsPerSec = float64(res.Received) / st.Duration.Seconds()
+		}
+		results[k] = res
+	}
+	return results
+}
@@ -0,0 +1,89 @@
+package mqttbmlatency
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStageOf(t *testing.T) {
+	p := newStagePlan([]Stage{
+		{Rate: 100, Duration: time.Second},
+		{Rate: 0, Duration: 500 * time.Millisecond},
+		{Rate: 200, Duration: 2 * time.Second},
+	}, 2, nil, nil)
+	start := time.Unix(1600000000, 0)
+	if got := p.stageOf(start.UnixNano()); got != -1 {
+		t.Fatalf("stage %d before the profile began, want -1", got)
+	}
+	p.begin(start)
+
+	tests := []struct {
+		offset time.Duration
+		want   int
+	}{
+		{-time.Nanosecond, -1},
+		{0, 0},
+		{999 * time.Millisecond, 0},
+		{time.Second, 1},
+		{1500*time.Millisecond - time.Nanosecond, 1},
+		{1500 * time.Millisecond, 2},
+		{3500*time.Millisecond - time.Nanosecond, 2},
+		{3500 * time.Millisecond, -1},
+	}
+	for _, tt := range tests {
+		if got := p.stageOf(start.Add(tt.offset).UnixNano()); got != tt.want {
+			t.Errorf("stage %d at %v, want %d", got, tt.offset, tt.want)
+		}
+	}
+}
+
+func TestCalculateStageResults(t *testing.T) {
+	p := newStagePlan([]Stage{
+		{Rate: 100, Duration: 2 * time.Second},
+		{Rate: 400, Duration: 4 * time.Second},
+	}, 2, nil, nil)
+	stats := func(failures int64, values ...float64) bucketStats {
+		s := bucketStats{failures: failures}
+		for _, v := range values {
+			s.add(v)
+		}
+		return s
+	}
+	pubs := []*PubResults{
+		{stages: []bucketStats{stats(1, 1, 3), stats(0, 2, 2, 2)}},
+		// this publisher never reached the second stage
+		{stages: []bucketStats{stats(0, 2)}},
+	}
+	subs := []*SubResults{
+		{stages: []bucketStats{stats(0, 10, 20), stats(0, 30)}},
+		{stages: []bucketStats{stats(0), stats(0, 5, 40)}},
+	}
+	results := calculateStageResults(p, pubs, subs)
+	if len(results) != 2 {
+		t.Fatalf("%d stage results, want 2", len(results))
+	}
+
+	first, second := results[0], results[1]
+	if first.Stage != 0 || first.Rate != 100 || first.Duration != 2 {
+		t.Errorf("first stage %d at %v msgs/s for %vs", first.Stage, first.Rate, first.Duration)
+	}
+	if first.Published != 3 || first.Failures != 1 || first.Received != 2 {
+		t.Errorf("first stage published %d, failed %d, received %d, want 3, 1, 2", first.Published, first.Failures, first.Received)
+	}
+	if first.PubTimeMean != 2 || first.FwdRatio != 2.0/3 || first.MsgsPerSec != 1 {
+		t.Errorf("first stage publish time %v, forward ratio %v, %v msgs/s", first.PubTimeMean, first.FwdRatio, first.MsgsPerSec)
+	}
+	if first.FwdLatencyMin != 10 || first.FwdLatencyMax != 20 || first.FwdLatencyMean != 15 {
+		t.Errorf("first stage forward latency min, max, mean = %v, %v, %v, want 10, 20, 15",
+			first.FwdLatencyMin, first.FwdLatencyMax, first.FwdLatencyMean)
+	}
+
+	if second.Published != 3 || second.Received != 3 || second.FwdRatio != 1 || second.MsgsPerSec != 0.75 {
+		t.Errorf("second stage published %d, received %d, forward ratio %v, %v msgs/s",
+			second.Published, second.Received, second.FwdRatio, second.MsgsPerSec)
+	}
+	if second.FwdLatencyMin != 5 || second.FwdLatencyMax != 40 || second.FwdLatencyMean != 25 {
+		t.Errorf("second stage forward latency min, max, mean = %v, %v, %v, want 5, 40, 25",
+			second.FwdLatencyMin, second.FwdLatencyMax, second.FwdLatencyMean)
+	}
+}
@@ -0,0 +1,141 @@
+package mqttbmlatency
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	statsdMaxPacket     = 1432 // stay below a typical MTU
+	statsdFlushInterval = 100 * time.Millisecond
+)
+
+// statsdSink emits counters and timings to a StatsD or DogStatsD agent over UDP.
+// Metrics are batched into newline separated packets by a background goroutine.
+type statsdSink struct {
+	conn    net.Conn
+	prefix  string
+	tagged  bool   // DogStatsD tag extension
+	tags    string // run labels as DogStatsD tags, with a leading comma
+	metrics chan string
+	done    chan bool
+
+	// handlers of clients that were not joined may still emit while the
+	// sink closes
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newStatsdSink(addr string, prefix string, dogstatsd bool, labels map[string]string) (*statsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && prefix[len(prefix)-1] != '.' {
+		prefix += "."
+	}
+	s := &statsdSink{
+		conn:    conn,
+		prefix:  prefix,
+		tagged:  dogstatsd,
+		tags:    dogstatsdTags(labels),
+		metrics: make(chan string, 8192),
+		done:    make(chan bool),
+	}
+	go s.run()
+	return s, nil
+}
+
+// count increments a counter
+func (s *statsdSink) count(name string, n int64, clientID int) {
+	s.emit(name, strconv.FormatInt(n, 10), "c", clientID)
+}
+
+// timing records a duration in milliseconds
+func (s *statsdSink) timing(name string, ms float64, clientID int) {
+	s.emit(name, strconv.FormatFloat(ms, 'f', 3, 64), "ms", clientID)
+}
+
+// gauge sets a value that is not tied to a client
+func (s *statsdSink) gauge(name string, v float64) {
+	s.emit(name, strconv.FormatFloat(v, 'f', 3, 64), "g", -1)
+}
+
+func (s *statsdSink) emit(name, value, kind string, clientID int) {
+	line := s.prefix + name + ":" + value + "|" + kind
+	if s.tagged && clientID >= 0 {
+		line += "|#client:" + strconv.Itoa(clientID) + s.tags
+	} else if s.tagged && s.tags != "" {
+		line += "|#" + s.tags[1:]
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	// drop metrics rather than stalling the benchmark when the sink falls behind
+	select {
+	case s.metrics <- line:
+	default:
+	}
+}
+
+// dogstatsdTags formats labels as key:value tags, each after a comma
+func dogstatsdTags(labels map[string]string) string {
+	var tags string
+	for _, kv := range labelList(labels) {
+		tags += "," + strings.Replace(kv, "=", ":", 1)
+	}
+	return tags
+}
+
+// close flushes pending metrics and releases the socket, dropping metrics
+// emitted afterwards
+func (s *statsdSink) close() {
+	s.mu.Lock()
+	s.closed = true
+	close(s.metrics)
+	s.mu.Unlock()
+	<-s.done
+	s.conn.Close()
+}
+
+func (s *statsdSink) run() {
+	var buf bytes.Buffer
+	ticker := time.NewTicker(statsdFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case line, ok := <-s.metrics:
+			if !ok {
+				s.flush(&buf)
+				s.done <- true
+				return
+			}
+			if buf.Len() > 0 && buf.Len()+1+len(line) > statsdMaxPacket {
+				s.flush(&buf)
+			}
+			if buf.Len() > 0 {
+				buf.WriteByte('\n')
+			}
+			buf.WriteString(line)
+		case <-ticker.C:
+			s.flush(&buf)
+		}
+	}
+}
+
+func (s *statsdSink) flush(buf *bytes.Buffer) {
+	if buf.Len() == 0 {
+		return
+	}
+	if _, err := s.conn.Write(buf.Bytes()); err != nil {
+		log.Printf("StatsD write failed: %v\n", err)
+	}
+	buf.Reset()
+}
@@ -0,0 +1,49 @@
+package mqttbmlatency
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// timedStore is the paho file store of one client. paho writes every QoS 1
+// and 2 message to the store before sending it and deletes it once the
+// handshake completed, so the time spent here is the persistence overhead
+// on the publish latency.
+type timedStore struct {
+	*mqtt.FileStore
+	spent int64 // nanoseconds in Put and Del, updated atomically
+}
+
+// newTimedStore returns the store of client id in role below dir, removing
+// what an earlier run left there so its messages are not resent
+func newTimedStore(dir, role string, id int) *timedStore {
+	path := filepath.Join(dir, role+"-"+strconv.Itoa(id))
+	os.RemoveAll(path)
+	return &timedStore{FileStore: mqtt.NewFileStore(path)}
+}
+
+func (s *timedStore) Put(key string, m packets.ControlPacket) {
+	start := time.Now()
+	s.FileStore.Put(key, m)
+	atomic.AddInt64(&s.spent, int64(time.Since(start)))
+}
+
+func (s *timedStore) Del(key string) {
+	start := time.Now()
+	s.FileStore.Del(key)
+	atomic.AddInt64(&s.spent, int64(time.Since(start)))
+}
+
+// perMessage returns the milliseconds spent in the store per message
+func (s *timedStore) perMessage(messages int64) float64 {
+	if s == nil || messages == 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&s.spent)) / 1e6 / float64(messages)
+}
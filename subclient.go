@@ -1,88 +1,356 @@
 package mqttbmlatency
 
 import (
-	"fmt"
 	"log"
+	"math/rand"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 import (
-	"github.com/GaryBoone/GoStats/stats"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
+// SubClient subscribes to SubTopic, or to Filters, and times the delivery of
+// every message. Benchmark runs set it up from Config; to compose custom
+// topologies, fill in the exported fields and drive it with Connect, Run and
+// Stop.
 type SubClient struct {
 	ID         int
 	BrokerURL  string
 	BrokerUser string
 	BrokerPass string
+	ClientID   string // generated when empty
 	SubTopic   string
+	Filters    []string // subscribe to these topics instead of SubTopic
 	SubQoS     byte
+	PubQoS     byte // QoS the messages are published at, deliveries below it and SubQoS are downgrades
+	Outliers   int  // keep the context of this many worst latencies, see Config.Outliers
 	KeepAlive  int
 	Quiet      bool
+	Transport  *Transport    // optional socket settings
+	Backoff    *Backoff      // optional connection retry policy
+	Trim       float64       // trimmed mean fraction, see Config.TrimFraction
+	Streaming  bool          // drop raw samples to keep memory constant, unless Config.ExactStats
+	Sizes      *SizeDist     // attribute latencies to the size classes of this distribution
+	Compress   string        // decompress payloads, see Config.Compress
+	Checksum   string        // verify and strip payload checksums, see Config.Checksum
+	Respond    bool          // request/response mode: echo every message to its response topic
+	Delay      time.Duration // processing time spent on every message after timing it
+	StallGap   time.Duration // record inter-arrival times, counting longer gaps as stalls
+	ManualAck  bool          // acknowledge messages from the handler, see Config.ManualAck
+	AckDelay   time.Duration
+	Backend    Backend           // connect through this client instead of paho, see Config.Backend
+	Hooks      *Hooks            // optional callbacks, see Config.Hooks
+	StoreDir   string            // keep in-flight messages in a file store below this directory, see Config.StoreDir
+	ReceiveMax int               // MQTT 5 Receive Maximum advertised by a backend, see Config.ReceiveMaximum
+	SubOpts    *SubscribeOptions // MQTT 5 subscription options of a backend, see Config.SubOptions
+	Ingress    string            // MQTT 5 user property with the broker's ingress timestamp, see Config.IngressProperty
+
+	clock      Clock
+	stages     *stagePlan
+	window     *window // soak mode: streamed statistics instead of samples
+	abort      *abortMonitor
+	outage     *outageMonitor
+	heat       *heatmap
+	sizes      *sizeCheck // nil skips the size check
+	spans      *spanExporter
+	metrics    *statsdSink
+	progress   *progress
+	connects   *connectLimiter
+	backoffRng *rand.Rand // draws the connection retry jitter
+	conns      *connLog
+	late       int32 // late window state, accessed atomically
+	lateMu     sync.Mutex
+	life       *lifecycle // nil inside a benchmark run
+	resCh      chan *SubResults
+	results    *SubResults
 }
 
 func (c *SubClient) run(res chan *SubResults, subDone chan bool, jobDone chan bool) {
 	runResults := new(SubResults)
+	c.clock = clockOrSystem(c.clock)
+	c.conns = newConnLog(c.clock)
 	runResults.ID = c.ID
+	runResults.Topic = c.SubTopic
+	runResults.Slow = c.Delay > 0
+	runResults.Errors = make(ErrorCounts)
+	if c.stages != nil {
+		runResults.stages = make([]bucketStats, len(c.stages.stages))
+	}
+	if c.Sizes != nil {
+		runResults.sizes = make([]bucketStats, len(c.Sizes.bounds))
+	}
+	var disconnects int64 // updated atomically by the connection lost handler
 
-	forwardLatency := []float64{}
-
-	ka, _ := time.ParseDuration(strconv.Itoa(c.KeepAlive) + "s")
+	var total accumulator
+	var forwardLatency []float64 // raw samples for order statistics, unless streaming
+	runResults.digest = newDigest()
+	if c.Outliers > 0 {
+		runResults.outliers = newOutlierSet(c.Outliers)
+	}
+	var decompressTime accumulator
+	// highest sequence number per topic; each topic has a single publisher
+	// unless a topic pool mixes them, which leaves ordering unverifiable
+	lastSeq := make(map[string]int64)
+	var lastRecv int64
+	verifyOrder := len(c.Filters) == 0
+	var stamp string // ingress timestamp of the message being handled, see onIngress
 
-	opts := mqtt.NewClientOptions().
-		AddBroker(c.BrokerURL).
-		SetClientID(fmt.Sprintf("mqtt-benchmark-%v-%v", time.Now(), c.ID)).
-		SetCleanSession(true).
-		SetAutoReconnect(true).
-		SetKeepAlive(ka).
-		SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
-			recvTime := time.Now().UnixNano()
-			payload := msg.Payload()
-			i := 0
-			for ; i < len(payload)-3; i++ {
-				if payload[i] == '#' && payload[i+1] == '@' && payload[i+2] == '#' {
-					sendTime, _ := strconv.ParseInt(string(payload[:i]), 10, 64)
-					forwardLatency = append(forwardLatency, float64(recvTime-sendTime)/1000000) // in milliseconds
-					break
+	onMessage := func(topic string, qos byte, payload []byte) {
+		recvTime := c.clock.Now().UnixNano()
+		if expected := minQoS(c.PubQoS, c.SubQoS); qos < expected {
+			runResults.QoSDowngrades++
+			if runResults.QoSDowngrades == 1 {
+				log.Printf("SUBSCRIBER %v received a message on %v at QoS %v instead of %v\n", c.ID, topic, qos, expected)
+			}
+		}
+		if c.Compress != "" {
+			start := c.clock.Now()
+			raw, err := decompress(c.Compress, payload)
+			if err != nil {
+				log.Printf("SUBSCRIBER %v could not decompress a message on %v: %v\n", c.ID, topic, err)
+			}
+			payload = raw
+			decompressTime.add(c.clock.Now().Sub(start).Seconds() * 1000)
+		}
+		if c.Checksum != "" {
+			var valid bool
+			if payload, valid = verifyChecksum(c.Checksum, payload); !valid {
+				// the header may be damaged too, so the message is not timed
+				runResults.Corrupt++
+				return
+			}
+		}
+		if err := c.Hooks.receive(c.ID, topic, payload); err != nil {
+			runResults.Errors.add(ErrInvalid, 1)
+		}
+		if sendTime, seq, ok := decodePayload(payload); ok {
+			latency := float64(recvTime-sendTime) / 1000000 // in milliseconds
+			if mismatch, truncated := c.sizes.check(paddingSize(payload)); mismatch {
+				runResults.SizeMismatches++
+				if truncated {
+					runResults.Truncated++
+				}
+				if !c.Quiet && runResults.SizeMismatches == 1 {
+					log.Printf("SUBSCRIBER %v received a payload of unexpected size on %v\n", c.ID, topic)
 				}
 			}
-			runResults.Received++
-		}).
-		SetConnectionLostHandler(func(client mqtt.Client, reason error) {
-			log.Printf("SUBSCRIBER %v lost connection to the broker: %v. Will reconnect...\n", c.ID, reason.Error())
-		})
-	if c.BrokerUser != "" && c.BrokerPass != "" {
-		opts.SetUsername(c.BrokerUser)
-		opts.SetPassword(c.BrokerPass)
+			if c.pastCutoff() {
+				c.recordLate(runResults, latency)
+				if c.Delay > 0 {
+					c.clock.Sleep(c.Delay)
+				}
+				return
+			}
+			if c.StallGap > 0 {
+				if lastRecv > 0 {
+					runResults.addGap(float64(recvTime-lastRecv)/1000000, c.StallGap)
+				}
+				lastRecv = recvTime
+			}
+			if verifyOrder {
+				if last, seen := lastSeq[topic]; seen && seq < last {
+					runResults.OutOfOrder++
+					if last-seq > runResults.MaxReorder {
+						runResults.MaxReorder = last - seq
+					}
+				} else {
+					lastSeq[topic] = seq
+				}
+			}
+			total.add(latency)
+			runResults.digest.add(latency)
+			if c.Ingress != "" {
+				runResults.addIngress(stamp, sendTime, recvTime)
+			}
+			if runResults.outliers != nil && runResults.outliers.qualifies(latency) {
+				lost, up := c.conns.state(time.Unix(0, recvTime))
+				runResults.outliers.add(&Outlier{
+					Latency:      latency,
+					Subscriber:   c.ID,
+					Topic:        topic,
+					Seq:          seq,
+					QoS:          qos,
+					Sent:         time.Unix(0, sendTime),
+					Received:     time.Unix(0, recvTime),
+					SubLost:      lost,
+					SubConnected: up.Seconds(),
+				})
+			}
+			if c.window != nil {
+				c.window.add(latency)
+			}
+			if !c.Streaming {
+				forwardLatency = append(forwardLatency, latency)
+			}
+			if c.stages != nil {
+				if k := c.stages.stageOf(sendTime); k >= 0 {
+					runResults.stages[k].add(latency)
+				}
+				c.stages.delivered()
+			}
+			if c.Sizes != nil {
+				if k := c.Sizes.classOf(paddingSize(payload)); k >= 0 {
+					runResults.sizes[k].add(latency)
+				}
+			}
+			if c.outage != nil {
+				recordTimeline(&runResults.timeline, c.outage.bucketOf(sendTime), latency, false)
+			}
+			if c.heat != nil {
+				runResults.heat = c.heat.add(runResults.heat, recvTime, latency)
+			}
+			if c.spans != nil {
+				c.spans.receive(c.ID, topic, qos, seq, sendTime, recvTime)
+			}
+			if c.metrics != nil {
+				c.metrics.timing("forward.latency", latency, c.ID)
+			}
+		}
+		runResults.Received++
+		c.progress.receive()
+		if c.metrics != nil {
+			c.metrics.count("received", 1, c.ID)
+		}
+		if c.Delay > 0 {
+			// sleeping in the handler holds up the client's delivery, so the
+			// broker sees a consumer that falls behind
+			c.clock.Sleep(c.Delay)
+		}
 	}
-	client := mqtt.NewClient(opts)
 
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		log.Printf("SUBSCRIBER %v had error connecting to the broker: %v\n", c.ID, token.Error())
-		return
-	}
+	ka, _ := time.ParseDuration(strconv.Itoa(c.KeepAlive) + "s")
 
-	if token := client.Subscribe(c.SubTopic, c.SubQoS, nil); token.Wait() && token.Error() != nil {
-		log.Printf("SUBSCRIBER %v had error subscribe with topic: %v\n", c.ID, token.Error())
-		return
-	}
+	// a client that could not connect still reports (empty) results so the run completes
+	disconnect := func() {}
+	outageKey := "sub-" + strconv.Itoa(c.ID)
+	var connects int32
+	if isMQTTSN(c.BrokerURL) {
+		if d := c.subscribeSN(ka, onMessage, runResults, &disconnects); d != nil {
+			disconnect = d
+		}
+	} else if c.Backend != nil {
+		var onIngress func(value string)
+		if c.Ingress != "" {
+			onIngress = func(value string) { stamp = value }
+		}
+		if d := c.subscribeBackend(ka, onMessage, onIngress, runResults, &disconnects); d != nil {
+			disconnect = d
+		}
+	} else {
+		opts := mqtt.NewClientOptions().
+			AddBroker(c.BrokerURL).
+			SetClientID(clientID(c.ClientID, c.ID)).
+			SetCleanSession(true).
+			SetAutoReconnect(true).
+			SetKeepAlive(ka).
+			SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
+				if c.Respond {
+					// not waiting for the token: blocking in the handler stalls delivery
+					client.Publish(msg.Topic()+responseSuffix, msg.Qos(), false, msg.Payload())
+				}
+				if msg.Duplicate() {
+					runResults.Redelivered++
+				}
+				onMessage(msg.Topic(), msg.Qos(), msg.Payload())
+				if c.ManualAck {
+					c.ack(msg)
+				}
+			}).
+			SetOnConnectHandler(func(client mqtt.Client) {
+				if atomic.AddInt32(&connects, 1) == 1 {
+					return
+				}
+				// the clean session dropped the subscription along with the connection
+				if token := c.subscribe(client); token.Wait() && token.Error() != nil {
+					log.Printf("SUBSCRIBER %v had error resubscribing with topic: %v\n", c.ID, token.Error())
+					c.Hooks.fail(RoleSubscriber, c.ID, token.Error())
+				} else {
+					c.conns.reconnected()
+					c.Hooks.connect(RoleSubscriber, c.ID)
+					c.Hooks.subscribe(c.ID, c.filters())
+				}
+				c.outage.reconnected(outageKey)
+			}).
+			SetConnectionLostHandler(func(client mqtt.Client, reason error) {
+				atomic.AddInt64(&disconnects, 1)
+				if c.abort != nil {
+					c.abort.disconnect()
+				}
+				c.outage.disconnected(outageKey)
+				log.Printf("SUBSCRIBER %v lost connection to the broker: %v. Will reconnect...\n", c.ID, reason.Error())
+				c.conns.lost(reason)
+				c.Hooks.fail(RoleSubscriber, c.ID, reason)
+			})
+		if c.ManualAck {
+			opts.SetAutoAckDisabled(true)
+		}
+		if c.StoreDir != "" {
+			opts.SetStore(newTimedStore(c.StoreDir, "sub", c.ID))
+		}
+		if c.BrokerUser != "" && c.BrokerPass != "" {
+			opts.SetUsername(c.BrokerUser)
+			opts.SetPassword(c.BrokerPass)
+		}
+		setTransport(opts, c.BrokerURL, c.Transport)
+		client := mqtt.NewClient(opts)
 
-	if !c.Quiet {
-		log.Printf("SUBSCRIBER %v had connected to the broker: %v and subscribed with topic: %v\n", c.ID, c.BrokerURL, c.SubTopic)
+		var err error
+		runResults.ConnectRetries, err = connectWithRetry(c.clock, c.Backoff, c.backoffRng, func() error {
+			c.connects.wait()
+			connectStart := c.clock.Now()
+			token := client.Connect()
+			token.Wait()
+			runResults.ConnectTime = c.clock.Now().Sub(connectStart).Seconds() * 1000 // in milliseconds
+			return token.Error()
+		}, c.logRetry)
+		if err != nil {
+			log.Printf("SUBSCRIBER %v had error connecting to the broker: %v\n", c.ID, err)
+			runResults.Errors.add(classifyConnectError(err), 1)
+		} else if token := c.subscribe(client); token.Wait() && token.Error() != nil {
+			log.Printf("SUBSCRIBER %v had error subscribe with topic: %v\n", c.ID, token.Error())
+			runResults.Errors.add(ErrSubscribe, 1)
+			client.Disconnect(250)
+		} else {
+			if st, ok := token.(*mqtt.SubscribeToken); ok {
+				c.granted(runResults, st.Result())
+			}
+			disconnect = func() { client.Disconnect(250) }
+			if !c.Quiet {
+				log.Printf("SUBSCRIBER %v had connected to the broker: %v and subscribed with topic: %v\n", c.ID, c.BrokerURL, c.SubTopic)
+			}
+		}
 	}
 
-	subDone <- true
+	err := subscribeError(c.ID, runResults.Errors)
+	c.connected(err)
+	subDone <- err == nil
 	//加各项统计
 	for {
 		select {
 		case <-jobDone:
-			client.Disconnect(250)
-			runResults.FwdLatencyMin = stats.StatsMin(forwardLatency)
-			runResults.FwdLatencyMax = stats.StatsMax(forwardLatency)
-			runResults.FwdLatencyMean = stats.StatsMean(forwardLatency)
-			runResults.FwdLatencyStd = stats.StatsSampleStandardDeviation(forwardLatency)
+			disconnect()
+			c.closeLate()
+			runResults.Disconnects = atomic.LoadInt64(&disconnects)
+			runResults.ConnEvents, runResults.Uptime = c.conns.results()
+			runResults.FwdLatencyMin = total.min
+			runResults.FwdLatencyMax = total.max
+			runResults.FwdLatencyMean = total.mean
+			runResults.FwdLatencyStd = total.std()
+			if c.Streaming {
+				runResults.FwdLatencyMed = runResults.digest.quantile(0.5)
+				runResults.FwdLatencyTrim = runResults.digest.trimmedMean(c.Trim)
+			} else {
+				runResults.FwdLatencyMed, runResults.FwdLatencyTrim = orderStats(forwardLatency, c.Trim)
+			}
+			runResults.FwdLatencyPct = runResults.digest.percentiles()
+			runResults.DecompressTime = decompressTime.mean
+			runResults.finishGaps()
+			runResults.finishQueue(c.ReceiveMax)
+			runResults.finishIngress()
 			res <- runResults
 			if !c.Quiet {
 				log.Printf("SUBSCRIBER %v is done subscribe\n", c.ID)
@@ -91,3 +359,133 @@ func (c *SubClient) run(res chan *SubResults, subDone chan bool, jobDone chan bo
 		}
 	}
 }
+
+// subscribeSN connects and subscribes through an MQTT-SN gateway, returning
+// the disconnect function or nil on failure
+func (c *SubClient) subscribeSN(ka time.Duration, onMessage snMessageHandler, runResults *SubResults, disconnects *int64) func() {
+	var client *snClient
+	var err error
+	runResults.ConnectRetries, err = connectWithRetry(c.clock, c.Backoff, c.backoffRng, func() (err error) {
+		c.connects.wait()
+		connectStart := c.clock.Now()
+		client, err = dialMQTTSN(c.BrokerURL, snClientID(c.ID), ka, onMessage, func(reason error) {
+			atomic.AddInt64(disconnects, 1)
+			if c.abort != nil {
+				c.abort.disconnect()
+			}
+			log.Printf("SUBSCRIBER %v lost connection to the gateway: %v\n", c.ID, reason.Error())
+			c.conns.lost(reason)
+			c.Hooks.fail(RoleSubscriber, c.ID, reason)
+		})
+		runResults.ConnectTime = c.clock.Now().Sub(connectStart).Seconds() * 1000 // in milliseconds
+		return err
+	}, c.logRetry)
+	if err != nil {
+		log.Printf("SUBSCRIBER %v had error connecting to the gateway: %v\n", c.ID, err)
+		runResults.Errors.add(classifyConnectError(err), 1)
+		return nil
+	}
+	qos, err := client.subscribe(c.SubTopic, c.SubQoS)
+	if err != nil {
+		log.Printf("SUBSCRIBER %v had error subscribe with topic: %v\n", c.ID, err)
+		runResults.Errors.add(ErrSubscribe, 1)
+		client.disconnect()
+		return nil
+	}
+	c.granted(runResults, map[string]byte{c.SubTopic: qos})
+	if !c.Quiet {
+		log.Printf("SUBSCRIBER %v had connected to the gateway: %v and subscribed with topic: %v\n", c.ID, c.BrokerURL, c.SubTopic)
+	}
+	return client.disconnect
+}
+
+// subscribeBackend connects and subscribes through a client Backend, returning
+// the disconnect function or nil on failure
+func (c *SubClient) subscribeBackend(ka time.Duration, onMessage snMessageHandler, onIngress func(string), runResults *SubResults, disconnects *int64) func() {
+	var conn BackendConn
+	var err error
+	runResults.ConnectRetries, err = connectWithRetry(c.clock, c.Backoff, c.backoffRng, func() (err error) {
+		c.connects.wait()
+		connectStart := c.clock.Now()
+		conn, err = c.Backend.Connect(&BackendOptions{
+			Broker:    c.BrokerURL,
+			ClientID:  clientID(c.ClientID, c.ID),
+			Username:  c.BrokerUser,
+			Password:  c.BrokerPass,
+			KeepAlive: ka,
+			Transport: c.Transport,
+			OnMessage: onMessage,
+			Ingress:   c.Ingress,
+			OnIngress: onIngress,
+			Window:    uint16(c.ReceiveMax),
+			SubOpts:   c.SubOpts,
+			Respond:   c.Respond,
+			OnLost: func(reason error) {
+				atomic.AddInt64(disconnects, 1)
+				if c.abort != nil {
+					c.abort.disconnect()
+				}
+				log.Printf("SUBSCRIBER %v lost connection to the broker: %v\n", c.ID, reason.Error())
+				c.conns.lost(reason)
+				c.Hooks.fail(RoleSubscriber, c.ID, reason)
+			},
+		})
+		runResults.ConnectTime = c.clock.Now().Sub(connectStart).Seconds() * 1000 // in milliseconds
+		return err
+	}, c.logRetry)
+	if err != nil {
+		log.Printf("SUBSCRIBER %v had error connecting to the broker: %v\n", c.ID, err)
+		runResults.Errors.add(classifyConnectError(err), 1)
+		return nil
+	}
+	if err := conn.Subscribe(c.filters()); err != nil {
+		log.Printf("SUBSCRIBER %v had error subscribe with topic: %v\n", c.ID, err)
+		runResults.Errors.add(ErrSubscribe, 1)
+		conn.Disconnect()
+		return nil
+	}
+	if g, ok := conn.(GrantReporter); ok {
+		c.granted(runResults, g.Granted())
+	}
+	if !c.Quiet {
+		log.Printf("SUBSCRIBER %v had connected to the broker: %v and subscribed with topic: %v\n", c.ID, c.BrokerURL, c.SubTopic)
+	}
+	return conn.Disconnect
+}
+
+// filters returns the topic filters of the subscriber with their QoS
+func (c *SubClient) filters() map[string]byte {
+	if len(c.Filters) == 0 {
+		return map[string]byte{c.SubTopic: c.SubQoS}
+	}
+	filters := make(map[string]byte, len(c.Filters))
+	for _, f := range c.Filters {
+		filters[f] = c.SubQoS
+	}
+	return filters
+}
+
+// subscribe subscribes client to SubTopic, or to all Filters in one request
+func (c *SubClient) subscribe(client mqtt.Client) mqtt.Token {
+	if len(c.Filters) == 0 {
+		return client.Subscribe(c.SubTopic, c.SubQoS, nil)
+	}
+	return client.SubscribeMultiple(c.filters(), nil)
+}
+
+// ack acknowledges msg after AckDelay without holding up the delivery of the
+// messages behind it
+func (c *SubClient) ack(msg mqtt.Message) {
+	if c.AckDelay <= 0 {
+		msg.Ack()
+		return
+	}
+	go func() {
+		c.clock.Sleep(c.AckDelay)
+		msg.Ack()
+	}()
+}
+
+func (c *SubClient) logRetry(retry int, err error) {
+	log.Printf("SUBSCRIBER %v had error connecting to the broker: %v. Retry %v/%v...\n", c.ID, err, retry, c.Backoff.Retries)
+}
@@ -0,0 +1,177 @@
+package mqttbmlatency
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+import (
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// SubscribeOptions are the MQTT 5 subscription options of the subscribers.
+// They need V5Backend. Before the run, the benchmark checks on topics of its
+// own that the broker honours them and reports the deviations.
+type SubscribeOptions struct {
+	NoLocal           bool `json:"no_local"`            // the broker must not send a client its own publishes
+	RetainAsPublished bool `json:"retain_as_published"` // keep the retain flag of forwarded messages
+	RetainHandling    byte `json:"retain_handling"`     // 0 sends retained messages on every subscribe, 1 only on new subscriptions, 2 never
+}
+
+// SubOptsResults tell whether the broker honoured the subscription options
+type SubOptsResults struct {
+	Options    SubscribeOptions `json:"options"`
+	Deviations []string         `json:"deviations,omitempty"` // none when the broker complied
+	Error      string           `json:"error,omitempty"`      // the check could not run
+}
+
+// subOptsQuiet is how long the check waits for messages that are not due,
+// or for more after the first
+const subOptsQuiet = 500 * time.Millisecond
+
+func (o *SubscribeOptions) subscription(topic string, qos byte) paho.SubscribeOptions {
+	return paho.SubscribeOptions{
+		Topic:             topic,
+		QoS:               qos,
+		NoLocal:           o.NoLocal,
+		RetainAsPublished: o.RetainAsPublished,
+		RetainHandling:    o.RetainHandling,
+	}
+}
+
+// checkSubOptions subscribes with cfg.SubOptions below the benchmark topic
+// and records where the broker does not behave as MQTT 5 requires
+func checkSubOptions(cfg *Config, localAddr net.IP, certs *certSet) *SubOptsResults {
+	res := &SubOptsResults{Options: *cfg.SubOptions}
+	if err := res.check(cfg, localAddr, certs); err != nil {
+		log.Printf("SUBSCRIPTION OPTIONS check failed: %v\n", err)
+		res.Error = err.Error()
+	}
+	for _, d := range res.Deviations {
+		log.Printf("SUBSCRIPTION OPTIONS the broker deviates: %v\n", d)
+	}
+	return res
+}
+
+func (res *SubOptsResults) deviate(format string, args ...interface{}) {
+	res.Deviations = append(res.Deviations, fmt.Sprintf(format, args...))
+}
+
+func (res *SubOptsResults) check(cfg *Config, localAddr net.IP, certs *certSet) error {
+	o := &res.Options
+	timeout := cfg.PublishTimeout
+	if timeout <= 0 {
+		timeout = minimalTimeout
+	}
+	connect := func(role string, transport *Transport) (*v5Conn, error) {
+		conn, err := V5Backend{}.Connect(&BackendOptions{
+			Broker:    cfg.Broker,
+			ClientID:  fmt.Sprintf("mqtt-subopts-%v-%v", time.Now().UnixNano(), role),
+			Username:  cfg.Username,
+			Password:  cfg.Password,
+			KeepAlive: time.Duration(cfg.KeepAlive) * time.Second,
+			Timeout:   timeout,
+			Transport: transport,
+			SubOpts:   o,
+			OnLost:    func(reason error) {},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return conn.(*v5Conn), nil
+	}
+	sub, err := connect("sub", newTransport(cfg, localAddr, certs.sub(0)))
+	if err != nil {
+		return err
+	}
+	defer sub.Disconnect()
+	pub, err := connect("pub", newTransport(cfg, localAddr, certs.pub(0)))
+	if err != nil {
+		return err
+	}
+	defer pub.Disconnect()
+
+	got := make(chan *paho.Publish, 16)
+	sub.client.AddOnPublishReceived(func(m paho.PublishReceived) (bool, error) {
+		select {
+		case got <- m.Packet:
+		default:
+		}
+		return true, nil
+	})
+	publish := func(c *v5Conn, topic, payload string, retain bool) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		_, err := c.client.Publish(ctx, &paho.Publish{Topic: topic, QoS: 1, Retain: retain, Payload: []byte(payload)})
+		return err
+	}
+	// collect returns the deliveries of payload, waiting up to the timeout
+	// for the first one if it is due
+	collect := func(payload string, due bool) []*paho.Publish {
+		var msgs []*paho.Publish
+		wait := subOptsQuiet
+		if due {
+			wait = timeout
+		}
+		deadline := time.After(wait)
+		for {
+			select {
+			case p := <-got:
+				if string(p.Payload) == payload {
+					msgs = append(msgs, p)
+					deadline = time.After(subOptsQuiet)
+				}
+			case <-deadline:
+				return msgs
+			}
+		}
+	}
+	tag := fmt.Sprint(time.Now().UnixNano())
+
+	// Retain Handling: subscribe twice to a topic with a retained message
+	retained := cfg.Topic + "/subopts/retained"
+	if err := publish(pub, retained, tag, true); err != nil {
+		return err
+	}
+	defer publish(pub, retained, "", true)
+	for i, due := range []bool{o.RetainHandling < 2, o.RetainHandling == 0} {
+		if err := sub.Subscribe(map[string]byte{retained: 1}); err != nil {
+			return err
+		}
+		if n := len(collect(tag, due)); (n > 0) != due {
+			which := "new"
+			if i > 0 {
+				which = "repeated"
+			}
+			res.deviate("retain handling %v: %v retained messages on a %v subscription", o.RetainHandling, n, which)
+		}
+	}
+
+	// Retain As Published: a retained publish forwarded to the subscription
+	if err := publish(pub, retained, tag+"-live", true); err != nil {
+		return err
+	}
+	msgs := collect(tag+"-live", true)
+	switch {
+	case len(msgs) == 0:
+		res.deviate("retain as published: a retained publish was not forwarded")
+	case msgs[0].Retain != o.RetainAsPublished:
+		res.deviate("retain as published %v: a retained publish was forwarded with the retain flag %v", o.RetainAsPublished, msgs[0].Retain)
+	}
+
+	// No Local: the subscriber publishes to its own subscription
+	local := cfg.Topic + "/subopts/local"
+	if err := sub.Subscribe(map[string]byte{local: 1}); err != nil {
+		return err
+	}
+	if err := publish(sub, local, tag+"-local", false); err != nil {
+		return err
+	}
+	if n := len(collect(tag+"-local", !o.NoLocal)); (n > 0) == o.NoLocal {
+		res.deviate("no local %v: %v of the client's own publishes were forwarded to it", o.NoLocal, n)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package mqttbmlatency
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+// optsBroker is an MQTT 5 broker just capable of the subscription options
+// check and request/response. Unless it honours the options, it treats every
+// subscription as if it had the default options.
+type optsBroker struct {
+	honour bool
+	l      net.Listener
+
+	mu        sync.Mutex
+	retained  map[string]*packets.Publish
+	sessions  []*optsSession
+	published []*packets.Publish
+}
+
+type optsSession struct {
+	conn   net.Conn
+	mu     sync.Mutex // serializes writes
+	nextID uint16
+	subs   map[string]packets.SubOptions // by topic, only exact filters
+}
+
+func newOptsBroker(t *testing.T, honour bool) *optsBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &optsBroker{honour: honour, l: l, retained: make(map[string]*packets.Publish)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s := &optsSession{conn: conn, subs: make(map[string]packets.SubOptions)}
+			go b.serve(s)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return b
+}
+
+func (b *optsBroker) serve(s *optsSession) {
+	defer s.conn.Close()
+	for {
+		cp, err := packets.ReadPacket(s.conn)
+		if err != nil {
+			return
+		}
+		switch p := cp.Content.(type) {
+		case *packets.Connect:
+			b.mu.Lock()
+			b.sessions = append(b.sessions, s)
+			b.mu.Unlock()
+			s.write(packets.CONNACK, &packets.Connack{Properties: &packets.Properties{}})
+		case *packets.Subscribe:
+			reasons := make([]byte, len(p.Subscriptions))
+			var due []*packets.Publish
+			b.mu.Lock()
+			for i, o := range p.Subscriptions {
+				_, existed := s.subs[o.Topic]
+				s.subs[o.Topic] = o
+				reasons[i] = o.QoS
+				handling := o.RetainHandling
+				if !b.honour {
+					handling = 0
+				}
+				if r := b.retained[o.Topic]; r != nil && (handling == 0 || handling == 1 && !existed) {
+					due = append(due, r)
+				}
+			}
+			b.mu.Unlock()
+			s.write(packets.SUBACK, &packets.Suback{PacketID: p.PacketID, Reasons: reasons, Properties: &packets.Properties{}})
+			for _, r := range due {
+				s.deliver(r, true)
+			}
+		case *packets.Publish:
+			if p.QoS > 0 {
+				s.write(packets.PUBACK, &packets.Puback{PacketID: p.PacketID, Properties: &packets.Properties{}})
+			}
+			b.route(s, p)
+		case *packets.Pingreq:
+			s.write(packets.PINGRESP, &packets.Pingresp{})
+		case *packets.Disconnect:
+			return
+		}
+	}
+}
+
+func (b *optsBroker) route(from *optsSession, p *packets.Publish) {
+	type delivery struct {
+		s      *optsSession
+		retain bool
+	}
+	var out []delivery
+	b.mu.Lock()
+	b.published = append(b.published, p)
+	if p.Retain {
+		if len(p.Payload) == 0 {
+			delete(b.retained, p.Topic)
+		} else {
+			b.retained[p.Topic] = p
+		}
+	}
+	for _, s := range b.sessions {
+		o, ok := s.subs[p.Topic]
+		switch {
+		case !ok:
+		case !b.honour:
+			out = append(out, delivery{s, false})
+		case o.NoLocal && s == from:
+		default:
+			out = append(out, delivery{s, p.Retain && o.RetainAsPublished})
+		}
+	}
+	b.mu.Unlock()
+	for _, d := range out {
+		d.s.deliver(p, d.retain)
+	}
+}
+
+func (s *optsSession) deliver(p *packets.Publish, retain bool) {
+	s.mu.Lock()
+	s.nextID++
+	id := s.nextID
+	s.mu.Unlock()
+	props := &packets.Properties{}
+	if p.Properties != nil {
+		props.ResponseTopic, props.CorrelationData = p.Properties.ResponseTopic, p.Properties.CorrelationData
+	}
+	s.write(packets.PUBLISH, &packets.Publish{Topic: p.Topic, QoS: 1, PacketID: id, Retain: retain, Payload: p.Payload, Properties: props})
+}
+
+func (s *optsSession) write(kind byte, content packets.Packet) {
+	cp := packets.NewControlPacket(kind)
+	cp.Content = content
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp.WriteTo(s.conn)
+}
+
+func TestCheckSubOptions(t *testing.T) {
+	strict := SubscribeOptions{NoLocal: true, RetainAsPublished: true, RetainHandling: 2}
+	tests := []struct {
+		name       string
+		honour     bool
+		opts       SubscribeOptions
+		deviations []string
+	}{
+		{"defaults", false, SubscribeOptions{}, nil},
+		{"compliant", true, strict, nil},
+		{"new subscriptions only", true, SubscribeOptions{RetainHandling: 1}, nil},
+		{"ignored", false, strict, []string{
+			"retain handling 2: 1 retained messages on a new subscription",
+			"retain handling 2: 1 retained messages on a repeated subscription",
+			"retain as published true: a retained publish was forwarded with the retain flag false",
+			"no local true: 1 of the client's own publishes were forwarded to it",
+		}},
+		{"retained on every subscription", false, SubscribeOptions{RetainHandling: 1}, []string{
+			"retain handling 1: 1 retained messages on a repeated subscription",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel() // every check waits out its quiet periods
+			b := newOptsBroker(t, tt.honour)
+			opts := tt.opts
+			res := checkSubOptions(&Config{
+				Broker:         "tcp://" + b.l.Addr().String(),
+				Topic:          "bench",
+				KeepAlive:      30,
+				PublishTimeout: 2 * time.Second,
+				SubOptions:     &opts,
+			}, nil, nil)
+			if res.Error != "" {
+				t.Fatal(res.Error)
+			}
+			if !reflect.DeepEqual(res.Deviations, tt.deviations) {
+				t.Errorf("deviations %q, want %q", res.Deviations, tt.deviations)
+			}
+		})
+	}
+}
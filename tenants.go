@@ -0,0 +1,116 @@
+package mqttbmlatency
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Tenant is a named block of clients sharing the broker with the other
+// tenants, with its own topics, credentials and offered load, so
+// noisy-neighbor effects show up in the per-tenant results
+type Tenant struct {
+	Name     string
+	Clients  int    // number of consecutive clients of the tenant
+	Topic    string // topic prefix of its clients, default <Topic>/<Name>
+	Username string // credentials of its clients, default Config.Username and Config.Password
+	Password string
+	Rate     float64 // total messages per second of its publishers, 0 for no limit
+}
+
+// TenantResults aggregates the clients of one tenant
+type TenantResults struct {
+	Tenant    string           `json:"tenant"`
+	Clients   int              `json:"clients"`
+	PubTotals *TotalPubResults `json:"publish totals"`
+	SubTotals *TotalSubResults `json:"receive totals"`
+}
+
+// tenantOf returns the index of the tenant of client i, or -1 without tenants
+func tenantOf(cfg *Config, i int) int {
+	first := 0
+	for k, t := range cfg.Tenants {
+		if i < first+t.Clients {
+			return k
+		}
+		first += t.Clients
+	}
+	return -1
+}
+
+// tenantTopic returns the topic prefix of tenant k
+func tenantTopic(cfg *Config, k int) string {
+	if t := cfg.Tenants[k]; t.Topic != "" {
+		return t.Topic
+	}
+	return cfg.Topic + "/" + cfg.Tenants[k].Name
+}
+
+// tenantLimiters returns the rate limiter of every tenant, nil for tenants
+// without a rate
+func tenantLimiters(cfg *Config, clock Clock) []*rateLimiter {
+	limiters := make([]*rateLimiter, len(cfg.Tenants))
+	for k, t := range cfg.Tenants {
+		if t.Rate > 0 {
+			limiters[k] = newRateLimiter(clock, t.Rate, cfg.GlobalBurst)
+		}
+	}
+	return limiters
+}
+
+func validateTenants(cfg *Config) error {
+	names := make(map[string]bool)
+	clients := 0
+	for _, t := range cfg.Tenants {
+		if t.Name == "" || names[t.Name] {
+			return errors.New("every tenant needs a unique name")
+		}
+		names[t.Name] = true
+		if t.Clients < 1 || t.Rate < 0 {
+			return fmt.Errorf("tenant %q needs clients and a rate that is not negative", t.Name)
+		}
+		if t.Username != "" && cfg.CredentialsFile != "" {
+			return fmt.Errorf("tenant %q has credentials, which a credentials file would override", t.Name)
+		}
+		if t.Rate > 0 && (cfg.GlobalRate > 0 || len(cfg.Stages) > 0) {
+			return errors.New("tenant rates cannot be combined with a global rate or a load profile")
+		}
+		clients += t.Clients
+	}
+	if clients != cfg.Clients {
+		return fmt.Errorf("the tenants have %v clients in total, but Clients is %v", clients, cfg.Clients)
+	}
+	if cfg.ReplayFile != "" || cfg.TopicPool > 0 {
+		return errors.New("tenants have topics of their own and cannot be combined with a replay or a topic pool")
+	}
+	return nil
+}
+
+// calculateTenantResults aggregates per tenant, in the order of
+// Config.Tenants. Publisher and subscriber i both belong to the tenant of
+// client i.
+func calculateTenantResults(cfg *Config, pubresults []*PubResults, subresults []*SubResults, totalTime time.Duration) []*TenantResults {
+	pubs := make([][]*PubResults, len(cfg.Tenants))
+	subs := make([][]*SubResults, len(cfg.Tenants))
+	for _, res := range pubresults {
+		if k := tenantOf(cfg, res.ID); k >= 0 {
+			pubs[k] = append(pubs[k], res)
+		}
+	}
+	for _, res := range subresults {
+		if k := tenantOf(cfg, res.ID); k >= 0 {
+			subs[k] = append(subs[k], res)
+		}
+	}
+
+	results := make([]*TenantResults, len(cfg.Tenants))
+	for k, t := range cfg.Tenants {
+		results[k] = &TenantResults{
+			Tenant:    t.Name,
+			Clients:   len(pubs[k]),
+			PubTotals: calculatePublishResults(pubs[k], totalTime),
+			SubTotals: calculateSubscribeResults(subs[k], pubs[k]),
+		}
+	}
+	return results
+}
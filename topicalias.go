@@ -0,0 +1,63 @@
+package mqttbmlatency
+
+// TopicAliasResults describes what MQTT 5 topic aliases saved one publisher
+// or, in the totals, all of them
+type TopicAliasResults struct {
+	Maximum        int     `json:"alias_maximum"` // granted by the broker, the lowest across publishers in the totals
+	Aliased        int64   `json:"aliased"`       // publishes that named their topic by alias alone
+	Full           int64   `json:"full_topic"`    // publishes that carried the topic name
+	WireBytes      int64   `json:"wire_bytes"`    // PUBLISH packets as sent
+	BytesSaved     int64   `json:"bytes_saved"`   // against the same packets without aliases
+	SavedRatio     float64 `json:"saved_ratio"`   // bytes_saved over the bytes without aliases
+	PubTimeAliased float64 `json:"pub_time_mean_aliased"`
+	PubTimeFull    float64 `json:"pub_time_mean_full"`
+
+	aliased, full accumulator
+}
+
+// add accounts one published message
+func (ta *TopicAliasResults) add(m *Message, pubTime float64) {
+	ta.WireBytes += int64(m.WireSize)
+	ta.BytesSaved += int64(m.AliasSaved)
+	if m.Aliased {
+		ta.Aliased++
+		ta.aliased.add(pubTime)
+	} else {
+		ta.Full++
+		ta.full.add(pubTime)
+	}
+}
+
+// finish derives the ratio and means once all messages were accounted for
+func (ta *TopicAliasResults) finish() {
+	if n := ta.WireBytes + ta.BytesSaved; n > 0 {
+		ta.SavedRatio = float64(ta.BytesSaved) / float64(n)
+	}
+	ta.PubTimeAliased = ta.aliased.mean
+	ta.PubTimeFull = ta.full.mean
+}
+
+func calculateTopicAliasResults(pubresults []*PubResults) *TopicAliasResults {
+	var total *TopicAliasResults
+	for _, res := range pubresults {
+		if res.TopicAlias == nil {
+			continue
+		}
+		if total == nil {
+			total = &TopicAliasResults{Maximum: res.TopicAlias.Maximum}
+		}
+		if res.TopicAlias.Maximum < total.Maximum {
+			total.Maximum = res.TopicAlias.Maximum
+		}
+		total.Aliased += res.TopicAlias.Aliased
+		total.Full += res.TopicAlias.Full
+		total.WireBytes += res.TopicAlias.WireBytes
+		total.BytesSaved += res.TopicAlias.BytesSaved
+		total.aliased.merge(res.TopicAlias.aliased)
+		total.full.merge(res.TopicAlias.full)
+	}
+	if total != nil {
+		total.finish()
+	}
+	return total
+}
@@ -0,0 +1,81 @@
+package mqttbmlatency
+
+import (
+	"sort"
+	"strings"
+)
+
+// TopicResults describes results of all runs sharing a topic (or topic prefix)
+type TopicResults struct {
+	Topic          string  `json:"topic"`
+	Publishers     int     `json:"publishers"`
+	Subscribers    int     `json:"subscribers"`
+	Published      int64   `json:"published"`
+	PubFailures    int64   `json:"pub_failures"`
+	Received       int64   `json:"received"`
+	FwdRatio       float64 `json:"fwd_success_ratio"`
+	FwdLatencyMin  float64 `json:"fwd_latency_min"`
+	FwdLatencyMax  float64 `json:"fwd_latency_max"`
+	FwdLatencyMean float64 `json:"fwd_latency_mean"` // weighted by messages received
+}
+
+// topicGroup returns the first depth levels of topic, or topic itself when depth is 0
+func topicGroup(topic string, depth int) string {
+	if depth <= 0 {
+		return topic
+	}
+	levels := strings.SplitN(topic, "/", depth+1)
+	if len(levels) <= depth {
+		return topic
+	}
+	return strings.Join(levels[:depth], "/")
+}
+
+func calculateTopicResults(subresults []*SubResults, pubresults []*PubResults, depth int) []*TopicResults {
+	groups := make(map[string]*TopicResults)
+	group := func(topic string) *TopicResults {
+		key := topicGroup(topic, depth)
+		g, ok := groups[key]
+		if !ok {
+			g = &TopicResults{Topic: key}
+			groups[key] = g
+		}
+		return g
+	}
+
+	for _, res := range pubresults {
+		g := group(res.Topic)
+		g.Publishers++
+		g.Published += res.Successes
+		g.PubFailures += res.Failures
+	}
+
+	latencySums := make(map[string]float64)
+	for _, res := range subresults {
+		g := group(res.Topic)
+		if res.Received > 0 {
+			if g.Received == 0 || res.FwdLatencyMin < g.FwdLatencyMin {
+				g.FwdLatencyMin = res.FwdLatencyMin
+			}
+			if res.FwdLatencyMax > g.FwdLatencyMax {
+				g.FwdLatencyMax = res.FwdLatencyMax
+			}
+			latencySums[g.Topic] += res.FwdLatencyMean * float64(res.Received)
+		}
+		g.Subscribers++
+		g.Received += res.Received
+	}
+
+	topics := make([]*TopicResults, 0, len(groups))
+	for key, g := range groups {
+		if g.Published > 0 {
+			g.FwdRatio = float64(g.Received) / float64(g.Published)
+		}
+		if g.Received > 0 {
+			g.FwdLatencyMean = latencySums[key] / float64(g.Received)
+		}
+		topics = append(topics, g)
+	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i].Topic < topics[j].Topic })
+	return topics
+}
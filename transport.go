@@ -0,0 +1,236 @@
+package mqttbmlatency
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+import (
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Transport holds socket level settings of a single client.
+// Zero values keep the Go and OS defaults.
+type Transport struct {
+	LocalAddr      net.IP // source address to bind
+	ConnectTimeout time.Duration
+	Nagle          bool             // enable Nagle's algorithm; Go sets TCP_NODELAY by default
+	SendBuffer     int              // SO_SNDBUF in bytes
+	RecvBuffer     int              // SO_RCVBUF in bytes
+	Certificate    *tls.Certificate // client certificate for TLS brokers
+
+	packets *packetLog     // see Config.PacketLog
+	label   string         // names the client in the packet log
+	track   func(net.Conn) // receives every connection, see Config.Chaos
+	quic    *quicSession   // TLS session and statistics of quic:// brokers
+}
+
+// newTransport builds the transport of one client, or nil when cfg leaves all defaults
+func newTransport(cfg *Config, localAddr net.IP, cert *tls.Certificate) *Transport {
+	if localAddr == nil && cert == nil && cfg.ConnectTimeout == 0 && !cfg.Nagle && cfg.SendBuffer == 0 && cfg.RecvBuffer == 0 {
+		return nil
+	}
+	return &Transport{
+		LocalAddr:      localAddr,
+		ConnectTimeout: cfg.ConnectTimeout,
+		Nagle:          cfg.Nagle,
+		SendBuffer:     cfg.SendBuffer,
+		RecvBuffer:     cfg.RecvBuffer,
+		Certificate:    cert,
+	}
+}
+
+// tlsConfig returns the TLS settings for dialing host
+func (t *Transport) tlsConfig(host string) *tls.Config {
+	cfg := &tls.Config{ServerName: host}
+	if t != nil && t.Certificate != nil {
+		cfg.Certificates = []tls.Certificate{*t.Certificate}
+	}
+	return cfg
+}
+
+// setTransport configures how opts dials brokerURL. unix:///path/to/socket
+// connects to a co-located broker over a Unix domain socket, taking the network
+// stack out of the measurement. Socket options are applied to TCP and TLS
+// connections by dialing them ourselves; WebSocket connections only honor the
+// source address and timeout. quic:// connects over QUIC.
+func setTransport(opts *mqtt.ClientOptions, brokerURL string, t *Transport) {
+	if t != nil && t.ConnectTimeout > 0 {
+		opts.SetConnectTimeout(t.ConnectTimeout)
+	}
+	u, err := url.Parse(brokerURL)
+	if err != nil {
+		return
+	}
+	if u.Scheme == "unix" {
+		opts.SetCustomOpenConnectionFn(t.logged(dialUnix))
+		return
+	}
+	if u.Scheme == "quic" {
+		if t != nil && t.Certificate != nil {
+			opts.SetTLSConfig(t.tlsConfig(""))
+		}
+		opts.SetCustomOpenConnectionFn(t.logged(t.openQUIC(t.session())))
+		return
+	}
+	if t == nil {
+		return
+	}
+	if t.Certificate != nil {
+		opts.SetTLSConfig(t.tlsConfig(""))
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts", "tcps":
+		if t.Nagle || t.SendBuffer > 0 || t.RecvBuffer > 0 || t.packets != nil || t.track != nil {
+			opts.SetCustomOpenConnectionFn(t.logged(t.open))
+			return
+		}
+	}
+	opts.SetDialer(t.dialer(opts.ConnectTimeout))
+}
+
+func dialUnix(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+	// unix://broker.sock is a path relative to the working directory
+	path := uri.Host + uri.Path
+	return net.DialTimeout("unix", path, options.ConnectTimeout)
+}
+
+func (t *Transport) dialer(timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout}
+	if t.LocalAddr != nil {
+		d.LocalAddr = &net.TCPAddr{IP: t.LocalAddr}
+	}
+	return d
+}
+
+// open dials a TCP connection with the socket options applied, adding TLS for secure schemes
+func (t *Transport) open(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+	conn, err := t.dialer(options.ConnectTimeout).Dial("tcp", uri.Host)
+	if err != nil {
+		return nil, err
+	}
+	tcp := conn.(*net.TCPConn)
+	if err := t.apply(tcp); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	switch uri.Scheme {
+	case "ssl", "tls", "mqtts", "tcps":
+		tlsCfg := &tls.Config{}
+		if options.TLSConfig != nil {
+			tlsCfg = options.TLSConfig.Clone()
+		}
+		if tlsCfg.ServerName == "" {
+			tlsCfg.ServerName = uri.Hostname()
+		}
+		tlsConn := tls.Client(conn, tlsCfg)
+		if options.ConnectTimeout > 0 {
+			tlsConn.SetDeadline(time.Now().Add(options.ConnectTimeout))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		return tlsConn, nil
+	}
+	return conn, nil
+}
+
+func (t *Transport) apply(conn *net.TCPConn) error {
+	if err := conn.SetNoDelay(!t.Nagle); err != nil {
+		return err
+	}
+	if t.SendBuffer > 0 {
+		if err := conn.SetWriteBuffer(t.SendBuffer); err != nil {
+			return err
+		}
+	}
+	if t.RecvBuffer > 0 {
+		if err := conn.SetReadBuffer(t.RecvBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ipFamilies are the address families the brokers of a run can be dialed on
+type ipFamilies struct {
+	v4, v6 bool
+}
+
+func (f ipFamilies) allows(ip net.IP) bool {
+	if ip.To4() != nil {
+		return f.v4
+	}
+	return f.v6
+}
+
+// brokerFamilies resolves the brokers clients connect to into the address
+// families they are reachable on. Unix sockets and names that do not resolve
+// allow both, the dial fails on its own then.
+func brokerFamilies(cfg *Config) ipFamilies {
+	brokers := append([]string{cfg.Broker, cfg.SubBroker}, cfg.Nodes...)
+	var f ipFamilies
+	for _, b := range brokers {
+		if b == "" {
+			continue
+		}
+		u, err := url.Parse(b)
+		if err != nil || u.Scheme == "unix" {
+			return ipFamilies{true, true}
+		}
+		ips, err := net.LookupIP(u.Hostname())
+		if err != nil {
+			return ipFamilies{true, true}
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				f.v4 = true
+			} else {
+				f.v6 = true
+			}
+		}
+	}
+	if !f.v4 && !f.v6 {
+		return ipFamilies{true, true}
+	}
+	return f
+}
+
+// resolveLocalAddrs expands a list of IP addresses and interface names into
+// source addresses. Interfaces contribute all their global unicast addresses
+// of the families the brokers are reachable on, so aliases configured on one
+// NIC each get their own ephemeral port range.
+func resolveLocalAddrs(specs []string, families ipFamilies) ([]net.IP, error) {
+	ips := []net.IP{}
+	for _, spec := range specs {
+		if ip := net.ParseIP(spec); ip != nil {
+			ips = append(ips, ip)
+			continue
+		}
+		iface, err := net.InterfaceByName(spec)
+		if err != nil {
+			return nil, fmt.Errorf("%v is neither an IP address nor an interface", spec)
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() && families.allows(ipnet.IP) {
+				ips = append(ips, ipnet.IP)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("interface %v has no usable address in the address family of the broker", spec)
+		}
+	}
+	return ips, nil
+}
@@ -0,0 +1,158 @@
+package mqttbmlatency
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// latencyUnits maps the units of Config.LatencyUnit to their factor from
+// milliseconds, the unit every latency is measured in
+var latencyUnits = map[string]float64{"us": 1000, "µs": 1000, "ms": 1, "s": 0.001}
+
+// latencyStems mark a result field as a latency
+var latencyStems = []string{"latency", "pub_time", "fwd_time", "connect_time", "compress_time", "rtt_", "inter_arrival"}
+
+// statFields are the fields of percentiles, intervals and run statistics,
+// latencies whenever the object holding them is one
+var statFields = map[string]bool{
+	"p50": true, "p90": true, "p95": true, "p99": true, "p99_9": true,
+	"low": true, "high": true, "mean": true, "std": true, "best": true, "worst": true, "ci95": true,
+}
+
+func isLatencyField(name string) bool {
+	if strings.HasSuffix(name, "_trend") {
+		return false // a ratio of latencies
+	}
+	for _, stem := range latencyStems {
+		if strings.Contains(name, stem) {
+			return true
+		}
+	}
+	return false
+}
+
+// latencyUnit returns the unit results are reported in
+func latencyUnit(cfg *Config) string {
+	switch cfg.LatencyUnit {
+	case "":
+		return "ms"
+	case "µs":
+		return "us"
+	}
+	return cfg.LatencyUnit
+}
+
+// convertUnits returns r with its latencies in cfg.LatencyUnit, rounded to
+// cfg.LatencyPrecision decimals. Fields are recognized by their JSON names, so
+// r is converted through its JSON encoding; the field order is kept.
+func convertUnits(cfg *Config, r report) report {
+	unit := latencyUnit(cfg)
+	if unit == "ms" && cfg.LatencyPrecision == 0 {
+		return r
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return r
+	}
+	var out bytes.Buffer
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	s := &unitScaler{dec: dec, out: &out, unit: unit, factor: latencyUnits[unit], precision: cfg.LatencyPrecision}
+	if _, err := s.value("", false, false); err != nil {
+		return r
+	}
+	converted := reflect.New(reflect.TypeOf(r).Elem()).Interface().(report)
+	if err := json.Unmarshal(out.Bytes(), converted); err != nil {
+		return r
+	}
+	return converted
+}
+
+type unitScaler struct {
+	dec       *json.Decoder
+	out       *bytes.Buffer
+	unit      string
+	factor    float64
+	precision int
+}
+
+// value copies the next JSON value. scale marks a number as a latency;
+// inherit makes the statistics fields of an object latencies. Strings are
+// returned so SLA checks can be recognized by name.
+func (s *unitScaler) value(name string, scale, inherit bool) (string, error) {
+	tok, err := s.dec.Token()
+	if err != nil {
+		return "", err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		if t == '[' {
+			s.out.WriteByte('[')
+			for i := 0; s.dec.More(); i++ {
+				if i > 0 {
+					s.out.WriteByte(',')
+				}
+				if _, err := s.value(name, scale, inherit); err != nil {
+					return "", err
+				}
+			}
+			s.out.WriteByte(']')
+		} else {
+			s.out.WriteByte('{')
+			named := false // an SLA check of a latency limit
+			for i := 0; s.dec.More(); i++ {
+				tok, err := s.dec.Token()
+				if err != nil {
+					return "", err
+				}
+				key := tok.(string)
+				if i > 0 {
+					s.out.WriteByte(',')
+				}
+				k, _ := json.Marshal(key)
+				s.out.Write(k)
+				s.out.WriteByte(':')
+				latency := isLatencyField(key) || inherit && statFields[key] || named && (key == "limit" || key == "value")
+				str, err := s.value(key, latency, latency)
+				if err != nil {
+					return "", err
+				}
+				if key == "name" && isLatencyField(str) {
+					named = true
+				}
+			}
+			s.out.WriteByte('}')
+		}
+		_, err := s.dec.Token() // the closing delimiter
+		return "", err
+	case json.Number:
+		if !scale {
+			s.out.WriteString(t.String())
+			return "", nil
+		}
+		v, err := t.Float64()
+		if err != nil {
+			return "", err
+		}
+		prec := -1
+		if s.precision > 0 {
+			prec = s.precision
+		}
+		s.out.WriteString(strconv.FormatFloat(v*s.factor, 'f', prec, 64))
+	case string:
+		if name == "latency_unit" {
+			t = s.unit
+		}
+		b, _ := json.Marshal(t)
+		s.out.Write(b)
+		return t, nil
+	case bool:
+		s.out.WriteString(strconv.FormatBool(t))
+	case nil:
+		s.out.WriteString("null")
+	}
+	return "", nil
+}
@@ -0,0 +1,285 @@
+package mqttbmlatency
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	"github.com/brunobevilaquaa/mqtt-bm-latency/internal/packet"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// V5Backend connects through paho.golang, the Eclipse Paho MQTT 5 client. It
+// supports TCP, TLS, QUIC and Unix socket brokers, QoS 0 to 2, and honors
+// Transport settings and the packet log. Its connections are Requesters. Like
+// MinimalBackend it does not reconnect.
+type V5Backend struct{}
+
+// v5Quiesce bounds the wait for the broker to close the connection after a
+// DISCONNECT, like the quiesce time the paho client disconnects with
+const v5Quiesce = 250 * time.Millisecond
+
+func (V5Backend) Name() string { return "paho.golang" }
+
+// v5Conn is a connection of V5Backend
+type v5Conn struct {
+	client  *paho.Client
+	conn    net.Conn // shared with client
+	timeout time.Duration
+	onLost  func(err error)
+	closed  int32 // set once the connection was lost or disconnected, accessed atomically
+
+	subOpts *SubscribeOptions
+
+	mu      sync.Mutex
+	granted map[string]byte // by the last SUBACK
+
+	// topic aliases, used by the publishing goroutine only
+	aliasMax  uint16
+	aliases   map[string]uint16 // nil without BackendOptions.Aliases
+	lastAlias bool
+	lastWire  int
+	lastSaved int
+}
+
+func (V5Backend) Connect(opts *BackendOptions) (BackendConn, error) {
+	conn, t, err := dialBackend("paho.golang", opts)
+	if err != nil {
+		return nil, err
+	}
+	c := &v5Conn{conn: packets.NewThreadSafeConn(conn), timeout: opts.Timeout, onLost: opts.OnLost, subOpts: opts.SubOpts}
+	if c.timeout <= 0 {
+		c.timeout = minimalTimeout
+	}
+	connectTimeout := t.ConnectTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = c.timeout
+	}
+	onMessage, respond := opts.OnMessage, opts.Respond
+	ingress, onIngress := opts.Ingress, opts.OnIngress
+	c.client = paho.NewClient(paho.ClientConfig{
+		Conn:          c.conn,
+		PacketTimeout: connectTimeout,
+		OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+			func(m paho.PublishReceived) (bool, error) {
+				if respond && m.Packet.Properties != nil && m.Packet.Properties.ResponseTopic != "" {
+					// not waiting for the acknowledgement: blocking here stalls delivery
+					go c.respond(m.Packet)
+				}
+				if onIngress != nil {
+					var value string
+					if m.Packet.Properties != nil {
+						value = m.Packet.Properties.User.Get(ingress)
+					}
+					onIngress(value)
+				}
+				if onMessage != nil {
+					onMessage(m.Packet.Topic, m.Packet.QoS, m.Packet.Payload)
+				}
+				return true, nil
+			},
+		},
+		OnClientError: c.lose,
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			c.lose(fmt.Errorf("disconnected by the broker, reason code %v", d.ReasonCode))
+		},
+	})
+
+	cp := &paho.Connect{
+		ClientID:     opts.ClientID,
+		KeepAlive:    uint16(opts.KeepAlive.Seconds()),
+		CleanStart:   true,
+		Username:     opts.Username,
+		UsernameFlag: opts.Username != "",
+		Password:     []byte(opts.Password),
+		PasswordFlag: opts.Password != "",
+	}
+	if opts.Window > 0 {
+		cp.Properties = &paho.ConnectProperties{ReceiveMaximum: &opts.Window}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+	ack, err := c.client.Connect(ctx, cp)
+	if err != nil {
+		if ack != nil {
+			return nil, fmt.Errorf("connection refused, reason code %v", ack.ReasonCode)
+		}
+		return nil, err
+	}
+	if opts.Aliases {
+		c.aliases = make(map[string]uint16)
+		if ack.Properties != nil && ack.Properties.TopicAliasMaximum != nil {
+			c.aliasMax = *ack.Properties.TopicAliasMaximum
+		}
+	}
+	return c, nil
+}
+
+func (c *v5Conn) Publish(topic string, qos byte, payload []byte) error {
+	return c.publish(&paho.Publish{Topic: topic, QoS: qos, Payload: payload})
+}
+
+func (c *v5Conn) Request(topic string, qos byte, payload []byte, responseTopic string, correlation []byte) error {
+	return c.publish(&paho.Publish{Topic: topic, QoS: qos, Payload: payload, Properties: &paho.PublishProperties{
+		ResponseTopic:   responseTopic,
+		CorrelationData: correlation,
+	}})
+}
+
+// respond echoes request to its Response Topic with its Correlation Data
+func (c *v5Conn) respond(request *paho.Publish) {
+	c.publish(&paho.Publish{Topic: request.Properties.ResponseTopic, QoS: request.QoS, Payload: request.Payload, Properties: &paho.PublishProperties{
+		CorrelationData: request.Properties.CorrelationData,
+	}})
+}
+
+func (c *v5Conn) publish(p *paho.Publish) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	if c.aliases != nil {
+		c.alias(p)
+	}
+	res, err := c.client.Publish(ctx, p)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return errTimeout
+	case err != nil:
+		return err
+	case res != nil && res.ReasonCode >= 0x80:
+		return fmt.Errorf("publish refused, reason code %v", res.ReasonCode)
+	}
+	return nil
+}
+
+func (c *v5Conn) Subscribe(filters map[string]byte) error {
+	sub := &paho.Subscribe{}
+	for f, qos := range filters {
+		o := paho.SubscribeOptions{Topic: f, QoS: qos}
+		if c.subOpts != nil {
+			o = c.subOpts.subscription(f, qos)
+		}
+		sub.Subscriptions = append(sub.Subscriptions, o)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	ack, err := c.client.Subscribe(ctx, sub)
+	if ack != nil {
+		// the reason codes follow the order of the subscriptions
+		granted := make(map[string]byte, len(sub.Subscriptions))
+		for i, code := range ack.Reasons {
+			if i < len(sub.Subscriptions) {
+				granted[sub.Subscriptions[i].Topic] = code
+			}
+		}
+		c.mu.Lock()
+		c.granted = granted
+		c.mu.Unlock()
+		if err != nil {
+			return errSubscribeRefused
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errTimeout
+	}
+	return err
+}
+
+// alias names the topic of p by alias once the broker knows the alias, and
+// assigns the next free alias to a new topic
+func (c *v5Conn) alias(p *paho.Publish) {
+	props := v5RequestSize(p.Properties)
+	full := v5PublishSize(p.Topic, p.QoS, len(p.Payload), props, false)
+	a, ok := c.aliases[p.Topic]
+	switch {
+	case ok:
+		c.lastWire = v5PublishSize("", p.QoS, len(p.Payload), props, true)
+		p.Topic = ""
+	case len(c.aliases) < int(c.aliasMax):
+		a = uint16(len(c.aliases) + 1)
+		c.aliases[p.Topic] = a
+		c.lastWire = v5PublishSize(p.Topic, p.QoS, len(p.Payload), props, true)
+	default:
+		c.lastAlias, c.lastWire, c.lastSaved = false, full, 0
+		return
+	}
+	if p.Properties == nil {
+		p.Properties = &paho.PublishProperties{}
+	}
+	p.Properties.TopicAlias = &a
+	c.lastAlias = ok
+	c.lastSaved = full - c.lastWire
+}
+
+// v5RequestSize is the length of the Response Topic and Correlation Data
+// properties of a request
+func v5RequestSize(props *paho.PublishProperties) int {
+	if props == nil {
+		return 0
+	}
+	var n int
+	if props.ResponseTopic != "" {
+		n += 3 + len(props.ResponseTopic)
+	}
+	if len(props.CorrelationData) > 0 {
+		n += 3 + len(props.CorrelationData)
+	}
+	return n
+}
+
+// v5PublishSize is the length of a PUBLISH packet with props bytes of request
+// properties and possibly a topic alias
+func v5PublishSize(topic string, qos byte, payload, props int, alias bool) int {
+	if alias {
+		props += 3
+	}
+	n := 2 + len(topic) + len(packet.AppendLength(nil, props)) + props + payload
+	if qos > 0 {
+		n += 2
+	}
+	return 1 + len(packet.AppendLength(nil, n)) + n
+}
+
+func (c *v5Conn) AliasMaximum() uint16 { return c.aliasMax }
+
+func (c *v5Conn) LastAlias() (aliased bool, wire, saved int) {
+	return c.lastAlias, c.lastWire, c.lastSaved
+}
+
+func (c *v5Conn) Granted() map[string]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.granted
+}
+
+// Disconnect returns once the client stopped, with its message handler.
+// paho.golang closes the socket right after the DISCONNECT, and a close with
+// unread input resets the connection, discarding the publishes the broker has
+// not read yet. So the broker closes the connection first, as MQTT 5 asks.
+func (c *v5Conn) Disconnect() {
+	atomic.StoreInt32(&c.closed, 1)
+	if _, err := (&paho.Disconnect{ReasonCode: 0}).Packet().WriteTo(c.conn); err == nil {
+		t := time.NewTimer(v5Quiesce)
+		select {
+		case <-c.client.Done():
+		case <-t.C:
+		}
+		t.Stop()
+	}
+	c.conn.Close()
+	<-c.client.Done()
+}
+
+// lose reports a lost connection once, unless the client disconnected first.
+// paho.golang reports client errors again after a disconnect.
+func (c *v5Conn) lose(err error) {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) && c.onLost != nil {
+		c.onLost(err)
+	}
+}
@@ -0,0 +1,147 @@
+package mqttbmlatency
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+func TestV5Aliases(t *testing.T) {
+	c := &v5Conn{aliasMax: 1, aliases: make(map[string]uint16)}
+	payload := make([]byte, 200)
+	tests := []struct {
+		topic   string
+		aliased bool
+		alias   uint16 // 0 for none
+		saved   int
+	}{
+		{"bench/long/topic/name", false, 1, -3}, // assigns the alias
+		{"bench/long/topic/name", true, 1, len("bench/long/topic/name") - 3},
+		{"bench/other", false, 0, 0}, // no alias left
+		{"bench/long/topic/name", true, 1, len("bench/long/topic/name") - 3},
+	}
+	for i, tt := range tests {
+		p := &paho.Publish{Topic: tt.topic, QoS: 1, PacketID: 1, Payload: payload}
+		c.alias(p)
+		aliased, wire, saved := c.LastAlias()
+		if aliased != tt.aliased || saved != tt.saved {
+			t.Errorf("%v: publish %v: aliased %v, saved %v, want %v, %v", i, tt.topic, aliased, saved, tt.aliased, tt.saved)
+		}
+		var alias uint16
+		if p.Properties != nil && p.Properties.TopicAlias != nil {
+			alias = *p.Properties.TopicAlias
+		}
+		if alias != tt.alias || (p.Topic == "") != tt.aliased {
+			t.Errorf("%v: publish %v: alias %v and topic %q", i, tt.topic, alias, p.Topic)
+		}
+		var buf bytes.Buffer
+		if _, err := p.Packet().WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if wire != buf.Len() {
+			t.Errorf("%v: publish %v: wire size %v, want %v", i, tt.topic, wire, buf.Len())
+		}
+	}
+}
+
+func TestV5RequestResponse(t *testing.T) {
+	b := newOptsBroker(t, true)
+	url := "tcp://" + b.l.Addr().String()
+	responder, err := V5Backend{}.Connect(&BackendOptions{Broker: url, ClientID: "responder", KeepAlive: time.Minute, Respond: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Disconnect()
+	if err := responder.Subscribe(map[string]byte{"rpc/request": 1}); err != nil {
+		t.Fatal(err)
+	}
+	responses := make(chan string, 1)
+	requester, err := V5Backend{}.Connect(&BackendOptions{
+		Broker:    url,
+		ClientID:  "requester",
+		KeepAlive: time.Minute,
+		OnMessage: func(topic string, qos byte, payload []byte) { responses <- topic + " " + string(payload) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer requester.Disconnect()
+	// not <topic>/response: the responder answers where the request asks
+	if err := requester.Subscribe(map[string]byte{"rpc/replies": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := requester.(Requester).Request("rpc/request", 1, []byte("ping"), "rpc/replies", []byte("42")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-responses:
+		if got != "rpc/replies ping" {
+			t.Errorf("response %q, want ping on rpc/replies", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no response")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var found bool
+	for _, p := range b.published {
+		if p.Topic == "rpc/replies" {
+			found = true
+			if p.Properties == nil || string(p.Properties.CorrelationData) != "42" {
+				t.Errorf("response properties %+v, want correlation data 42", p.Properties)
+			}
+		}
+	}
+	if !found {
+		t.Error("the broker saw no response")
+	}
+}
+
+func TestV5AliasedRequestSize(t *testing.T) {
+	c := &v5Conn{aliasMax: 1, aliases: make(map[string]uint16)}
+	for i := 0; i < 2; i++ {
+		p := &paho.Publish{Topic: "rpc/request", QoS: 1, PacketID: 1, Payload: make([]byte, 100), Properties: &paho.PublishProperties{
+			ResponseTopic:   "rpc/request/response",
+			CorrelationData: []byte("7"),
+		}}
+		c.alias(p)
+		_, wire, _ := c.LastAlias()
+		var buf bytes.Buffer
+		if _, err := p.Packet().WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if wire != buf.Len() || p.Properties.ResponseTopic == "" {
+			t.Errorf("publish %d: wire size %v, want %v, with properties %+v", i, wire, buf.Len(), p.Properties)
+		}
+	}
+}
+
+func TestV5RequestResponseRun(t *testing.T) {
+	b := newOptsBroker(t, true)
+	cfg := &Config{
+		Broker:          "tcp://" + b.l.Addr().String(),
+		Backend:         V5Backend{},
+		RequestResponse: true,
+		Topic:           "rpc",
+		PubQoS:          1,
+		SubQoS:          1,
+		Clients:         2,
+		Count:           10,
+		Size:            64,
+		KeepAlive:       30,
+		Quiet:           true,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	jr, err := benchmark(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jr.PubTotals.Responses != 20 {
+		t.Errorf("%d responses, want 20", jr.PubTotals.Responses)
+	}
+}
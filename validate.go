@@ -0,0 +1,453 @@
+package mqttbmlatency
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// validateMQTT5 rejects options that need MQTT 5 unless the clients connect
+// through V5Backend, as the vendored paho client speaks MQTT 3.1.1 only
+func (cfg *Config) validateMQTT5() error {
+	var opts []string
+	if cfg.TopicAlias {
+		opts = append(opts, "topic aliases")
+	}
+	if cfg.ReceiveMaximum < 0 || cfg.ReceiveMaximum > 65535 {
+		return errors.New("the receive maximum must be between 1 and 65535")
+	}
+	if cfg.ReceiveMaximum != 0 {
+		opts = append(opts, "receive maximum")
+	}
+	if cfg.IngressProperty != "" {
+		opts = append(opts, "ingress timestamps")
+	}
+	if cfg.SubOptions != nil {
+		if cfg.SubOptions.RetainHandling > 2 {
+			return errors.New("retain handling must be 0, 1 or 2")
+		}
+		opts = append(opts, "subscription options")
+	}
+	if len(opts) == 0 || speaksMQTT5(cfg.Backend) {
+		return nil
+	}
+	return fmt.Errorf("%v need MQTT 5, which only V5Backend speaks", strings.Join(opts, ", "))
+}
+
+func speaksMQTT5(b Backend) bool {
+	switch b.(type) {
+	case V5Backend, *V5Backend:
+		return true
+	}
+	return false
+}
+
+// validateComparison checks the options of a multi-broker run, before each
+// broker's configuration runs through Validate
+func (cfg *Config) validateComparison() error {
+	if cfg.Repeat > 1 || cfg.DryRun || cfg.CheckpointFile != "" || cfg.Capacity != nil {
+		return errors.New("broker comparisons cannot be repeated, checkpointed, dry run or capacity searches")
+	}
+	if cfg.Embedded {
+		return errors.New("broker comparisons run against Brokers and cannot use the embedded broker")
+	}
+	if cfg.Concurrent && cfg.SnapshotFile != "" {
+		return errors.New("concurrent broker comparisons cannot share a snapshot file")
+	}
+	if cfg.ResultsTopic != "" && cfg.ResultsBroker == "" {
+		return errors.New("broker comparisons publish their results on ResultsBroker, which is not set")
+	}
+	return nil
+}
+
+// parseBroker parses a broker URL and checks that its scheme can be dialed
+func parseBroker(broker string) (*url.URL, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker URL %v: %v", broker, err)
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts", "tcps", "ws", "wss", "unix", "udp", "mqttsn", "quic":
+	default:
+		return nil, fmt.Errorf("unsupported broker scheme %q", u.Scheme)
+	}
+	return u, nil
+}
+
+// validResults checks where the results are published
+func validResults(cfg *Config) error {
+	if cfg.ResultsTopic == "" {
+		return errors.New("a results broker or heartbeat needs a results topic")
+	}
+	if strings.ContainsAny(cfg.ResultsTopic, "+#") {
+		return errors.New("the results topic must not contain wildcards")
+	}
+	broker := cfg.ResultsBroker
+	if broker == "" {
+		broker = cfg.Broker
+	}
+	u, err := parseBroker(broker)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "udp" || u.Scheme == "mqttsn" {
+		return errors.New("results cannot be published over MQTT-SN")
+	}
+	if cfg.ResultsRetain && cfg.Backend != nil {
+		return errors.New("client backends cannot publish retained results")
+	}
+	if cfg.ResultsHeartbeat < 0 {
+		return errors.New("the results heartbeat must not be negative")
+	}
+	return nil
+}
+
+// usesMQTTSN reports whether publishers or subscribers talk to an MQTT-SN gateway
+func (cfg *Config) usesMQTTSN() bool {
+	return isMQTTSN(cfg.Broker) || isMQTTSN(cfg.SubBroker)
+}
+
+// Validate checks cfg for settings that would make a run fail or meaningless
+func (cfg *Config) Validate() error {
+	u, err := parseBroker(cfg.Broker)
+	if err != nil {
+		return err
+	}
+	if cfg.SubBroker != "" {
+		if _, err := parseBroker(cfg.SubBroker); err != nil {
+			return err
+		}
+		if cfg.DryRun {
+			return errors.New("dry runs test a single broker and cannot be combined with a subscriber broker")
+		}
+	}
+	for _, node := range cfg.Nodes {
+		if _, err := parseBroker(node); err != nil {
+			return err
+		}
+		if isMQTTSN(node) != isMQTTSN(cfg.Broker) {
+			return errors.New("cluster nodes must all speak the protocol of Broker")
+		}
+	}
+	if len(cfg.Nodes) > 0 && cfg.SubBroker != "" {
+		return errors.New("cluster nodes and a subscriber broker are mutually exclusive")
+	}
+	if err := cfg.validateMQTT5(); err != nil {
+		return err
+	}
+	if cfg.ResultsBroker != "" || cfg.ResultsTopic != "" || cfg.ResultsHeartbeat != 0 {
+		if err := validResults(cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.ReplayFile == "" && cfg.Clients < 1 {
+		return errors.New("at least one client is required")
+	}
+	if cfg.PubQoS < 0 || cfg.PubQoS > 2 || cfg.SubQoS < 0 || cfg.SubQoS > 2 {
+		return errors.New("QoS must be 0, 1 or 2")
+	}
+	for _, qos := range cfg.QoSMix {
+		if qos < 0 || qos > 2 {
+			return errors.New("QoS must be 0, 1 or 2")
+		}
+		if qos == 0 && cfg.ManualAck {
+			return errors.New("manual acknowledgements need a subscriber QoS of 1 or 2")
+		}
+	}
+	if cfg.Size < 0 {
+		return errors.New("message size must not be negative")
+	}
+	if cfg.ReplayFile == "" && len(cfg.Stages) == 0 && cfg.Duration <= 0 && cfg.Count < 1 && cfg.TotalCount < 1 && cfg.Capacity == nil {
+		return errors.New("a message count, a duration or a load profile is required")
+	}
+	if cfg.Outliers < 0 {
+		return errors.New("the outlier count must not be negative")
+	}
+	if cfg.TotalCount != 0 {
+		if cfg.TotalCount < cfg.Clients || cfg.Count > 0 {
+			return errors.New("a total message count needs at least one message per publisher and replaces the count per publisher")
+		}
+		if cfg.ReplayFile != "" || len(cfg.Stages) > 0 || cfg.Duration > 0 || cfg.Capacity != nil {
+			return errors.New("a total message count cannot be combined with replays, load profiles, durations or capacity searches")
+		}
+	}
+	if cfg.SizeDist != nil {
+		if err := cfg.SizeDist.validate(); err != nil {
+			return err
+		}
+	}
+	if cfg.RequestResponse && cfg.usesMQTTSN() {
+		return errors.New("request/response mode is not supported over MQTT-SN")
+	}
+	if cfg.MaxClockError < 0 {
+		return errors.New("maximum clock error must not be negative")
+	}
+	if err := validateLabels(cfg.Labels); err != nil {
+		return err
+	}
+	if cfg.ZeroCopy && (cfg.Compress != "" || cfg.Checksum != "" || cfg.PublishTimeout > 0) {
+		// a timed out publish may still be writing the shared buffer
+		return errors.New("zero-copy payloads do not support compression, checksums or publish timeouts")
+	}
+	if cfg.Backend != nil {
+		if cfg.usesMQTTSN() {
+			return errors.New("client backends do not support MQTT-SN")
+		}
+		if cfg.ManualAck || cfg.Outage != nil {
+			return errors.New("manual acknowledgements and outages need the paho client")
+		}
+		if cfg.RequestResponse && !speaksMQTT5(cfg.Backend) {
+			return errors.New("request/response mode needs the paho client or V5Backend")
+		}
+	}
+	if cfg.StoreDir != "" && (cfg.Backend != nil || cfg.usesMQTTSN()) {
+		return errors.New("file stores need the paho client and an MQTT broker")
+	}
+	if cfg.PacketLog != "" {
+		switch u.Scheme {
+		case "ws", "wss", "udp", "mqttsn":
+			return fmt.Errorf("the packet log does not support %v brokers", u.Scheme)
+		}
+	}
+	if cfg.QUICReconnects < 0 {
+		return errors.New("QUIC reconnects must not be negative")
+	}
+	if cfg.QUICReconnects > 0 && u.Scheme != "quic" {
+		return errors.New("QUIC reconnects need a quic:// broker")
+	}
+	if cfg.ProbeInterval > 0 {
+		switch u.Scheme {
+		case "ws", "wss", "udp", "mqttsn":
+			return fmt.Errorf("ping probes do not support %v brokers", u.Scheme)
+		}
+	}
+	if a := cfg.ACL; a != nil {
+		if a.Topic == "" {
+			return errors.New("an ACL test needs a topic the clients are not authorized for")
+		}
+		if a.Fraction < 0 || a.Fraction > 1 || a.Attempts < 0 || a.Timeout < 0 {
+			return errors.New("ACL test fraction must be between 0 and 1, attempts and timeout must not be negative")
+		}
+		switch u.Scheme {
+		case "ws", "wss", "udp", "mqttsn":
+			return fmt.Errorf("ACL tests do not support %v brokers", u.Scheme)
+		}
+	}
+	for _, a := range cfg.Chaos {
+		if err := a.validate(u.Scheme); err != nil {
+			return err
+		}
+	}
+	if cfg.SettleDelay < 0 {
+		return errors.New("settle delay must not be negative")
+	}
+	if cfg.IdleSubscribers < 0 {
+		return errors.New("idle subscribers must not be negative")
+	}
+	if cfg.IdleSubscribers > 0 {
+		switch u.Scheme {
+		case "ws", "wss", "udp", "mqttsn":
+			return fmt.Errorf("idle subscribers do not support %v brokers", u.Scheme)
+		}
+	}
+	if cfg.Heartbeat < 0 {
+		return errors.New("heartbeat interval must not be negative")
+	}
+	if cfg.Heartbeat > 0 && cfg.usesMQTTSN() {
+		return errors.New("heartbeats are not supported over MQTT-SN")
+	}
+	if cfg.Drain != nil && (cfg.Drain.Quiet < 0 || cfg.Drain.Timeout < 0) {
+		return errors.New("drain quiet period and timeout must not be negative")
+	}
+	if cfg.Drain != nil && cfg.usesMQTTSN() {
+		return errors.New("drain checks are not supported over MQTT-SN")
+	}
+	if cfg.ReferenceBroker != "" {
+		if cfg.usesMQTTSN() || isMQTTSN(cfg.ReferenceBroker) {
+			return errors.New("reference subscribers are not supported over MQTT-SN")
+		}
+		if _, err := parseBroker(cfg.ReferenceBroker); err != nil {
+			return err
+		}
+	}
+	if cfg.CredentialsFile != "" && cfg.usesMQTTSN() {
+		return errors.New("MQTT-SN has no authentication to use credentials with")
+	}
+	if cfg.Outage != nil && cfg.usesMQTTSN() {
+		return errors.New("outage scenarios need reconnecting clients, which MQTT-SN does not support")
+	}
+	if err := validChecksum(cfg.Checksum); err != nil {
+		return err
+	}
+	if err := validCompression(cfg.Compress); err != nil {
+		return err
+	}
+	if cfg.KeepAlive < 0 {
+		return errors.New("keep alive must not be negative")
+	}
+	for i, st := range cfg.Stages {
+		if st.Rate < 0 || st.Duration <= 0 {
+			return fmt.Errorf("stage %v needs a non-negative rate and a positive duration", i)
+		}
+	}
+	if cfg.TopicPool > 0 {
+		if cfg.TopicPool < cfg.Clients {
+			return errors.New("a topic pool needs at least one topic per subscriber")
+		}
+		if cfg.ReplayFile != "" || cfg.RequestResponse || cfg.usesMQTTSN() {
+			return errors.New("a topic pool cannot be combined with replays, request/response mode or MQTT-SN")
+		}
+	}
+	if cfg.TopicPool < 0 || cfg.TopicSkew < 0 {
+		return errors.New("topic pool size and skew must not be negative")
+	}
+	if cfg.TopicOffset < 0 {
+		return errors.New("topic offset must not be negative")
+	}
+	if cfg.TopicOffset > 0 && (cfg.ReplayFile != "" || cfg.TopicPool > 0) {
+		return errors.New("the topic offset applies to per-client topics, not to replayed traces or topic pools")
+	}
+	for _, g := range cfg.Groups {
+		if g.Clients < 1 || len(g.LocalAddrs) == 0 {
+			return fmt.Errorf("client group %q needs clients and local addresses", g.Name)
+		}
+	}
+	if len(cfg.Tenants) > 0 {
+		if err := validateTenants(cfg); err != nil {
+			return err
+		}
+	}
+	if len(cfg.Groups) > 0 && cfg.usesMQTTSN() {
+		return errors.New("client groups are not supported over MQTT-SN")
+	}
+	if cfg.ProcessingDelay < 0 || cfg.SlowSubscribers < 0 {
+		return errors.New("processing delay and slow subscribers must not be negative")
+	}
+	if cfg.SlowSubscribers > 0 && cfg.ProcessingDelay == 0 {
+		return errors.New("slow subscribers need a processing delay")
+	}
+	if cfg.AckDelay < 0 {
+		return errors.New("acknowledgement delay must not be negative")
+	}
+	if cfg.AckDelay > 0 && !cfg.ManualAck {
+		return errors.New("acknowledgement delay needs manual acknowledgements")
+	}
+	if cfg.ManualAck && cfg.SubQoS == 0 && len(cfg.QoSMix) == 0 {
+		return errors.New("manual acknowledgements need a subscriber QoS of 1 or 2")
+	}
+	if cfg.ManualAck && cfg.usesMQTTSN() {
+		return errors.New("manual acknowledgements are not supported over MQTT-SN")
+	}
+	if cfg.ConnectRate < 0 || cfg.ConnectJitter < 0 {
+		return errors.New("connection rate and jitter must not be negative")
+	}
+	if cfg.ConnectJitter > 0 && cfg.ConnectRate == 0 {
+		return errors.New("connection jitter needs a connection rate")
+	}
+	if cfg.GlobalRate < 0 || cfg.GlobalBurst < 0 {
+		return errors.New("global rate and burst must not be negative")
+	}
+	if cfg.GlobalRate > 0 && (len(cfg.Stages) > 0 || cfg.ReplayFile != "") {
+		return errors.New("a global rate cannot be combined with a load profile or a replay")
+	}
+	if cfg.PoissonMean < 0 {
+		return errors.New("Poisson mean must not be negative")
+	}
+	if b := cfg.Burst; b != nil && (b.Size <= 0 || b.Interval < 0 || b.Gap <= 0) {
+		return errors.New("bursts need a positive size and gap, and an interval that is not negative")
+	}
+	if cfg.Burst != nil && cfg.PoissonMean > 0 {
+		return errors.New("burst and Poisson load shapes are mutually exclusive")
+	}
+	if t := cfg.ThinkTime; t != nil {
+		if t.Interval <= 0 || t.Jitter < 0 || t.Jitter > t.Interval {
+			return errors.New("think time needs a positive interval and a jitter between 0 and the interval")
+		}
+		if cfg.Burst != nil || cfg.PoissonMean > 0 || len(cfg.Stages) > 0 || cfg.ReplayFile != "" {
+			return errors.New("think time cannot be combined with another load shape, a load profile or a replay")
+		}
+	}
+	if cfg.SnapshotInterval > 0 && cfg.SnapshotFile == "" {
+		return errors.New("soak mode needs a snapshot file")
+	}
+	if cfg.RotateSize < 0 || cfg.RotateInterval < 0 {
+		return errors.New("rotation limits must not be negative")
+	}
+	if (cfg.RotateSize > 0 || cfg.RotateInterval > 0) && cfg.SnapshotFile == "" {
+		return errors.New("rotation applies to the snapshot file, which is not set")
+	}
+	for _, path := range []string{cfg.OutputFile, cfg.HeapProfile, cfg.CheckpointFile} {
+		if path == "" {
+			continue
+		}
+		// fail now rather than after a long run
+		if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+			return fmt.Errorf("output directory of %v does not exist", path)
+		}
+	}
+	if _, ok := latencyUnits[latencyUnit(cfg)]; !ok {
+		return fmt.Errorf("unsupported latency unit %q", cfg.LatencyUnit)
+	}
+	if cfg.LatencyPrecision < 0 {
+		return errors.New("latency precision must not be negative")
+	}
+	switch cfg.Format {
+	case "", "json", "markdown", "junit":
+	default:
+		return fmt.Errorf("unsupported output format %q", cfg.Format)
+	}
+	if cfg.SLA != nil {
+		if err := cfg.SLA.validate(); err != nil {
+			return err
+		}
+	}
+	if h := cfg.Heatmap; h != nil {
+		if h.Interval < 0 {
+			return errors.New("heatmap interval must not be negative")
+		}
+		for i, b := range h.Bounds {
+			if b <= 0 || i > 0 && b <= h.Bounds[i-1] {
+				return errors.New("heatmap bounds must be positive and ascending")
+			}
+		}
+	}
+	if cfg.StallGap < 0 {
+		return errors.New("stall gap must not be negative")
+	}
+	if cfg.LateWindow < 0 {
+		return errors.New("late window must not be negative")
+	}
+	if cfg.Repeat < 0 || cfg.CoolDown < 0 {
+		return errors.New("repeat count and cool-down must not be negative")
+	}
+	if cfg.CheckpointFile != "" && (len(cfg.Stages) == 0 || cfg.Repeat > 1) {
+		return errors.New("checkpoints need a load profile and cannot be combined with repeated runs")
+	}
+	if cs := cfg.Capacity; cs != nil {
+		if cfg.SLA == nil {
+			return errors.New("a capacity search needs an SLA to hold")
+		}
+		if cs.MinRate < 0 || cs.MaxRate <= cs.MinRate {
+			return errors.New("capacity search needs a maximum rate above a non-negative minimum rate")
+		}
+		if cs.Window < 0 || cs.Precision < 0 || cs.Precision >= 1 || cs.MaxSteps < 0 {
+			return errors.New("capacity search window, precision and steps must not be negative, precision below 1")
+		}
+		if cfg.GlobalRate > 0 || cfg.Duration > 0 || len(cfg.Stages) > 0 || cfg.ReplayFile != "" || cfg.Repeat > 1 || cfg.CheckpointFile != "" {
+			return errors.New("a capacity search sets the rate and duration itself and cannot be combined with a global rate, duration, load profile, replay, repeated runs or checkpoints")
+		}
+	}
+	if cfg.TrimFraction < 0 || cfg.TrimFraction >= 0.5 {
+		return errors.New("trim fraction must be at least 0 and below 0.5")
+	}
+	if cfg.MaxFailureRatio < 0 || cfg.MaxFailureRatio > 1 {
+		return errors.New("failure ratio limit must be between 0 and 1")
+	}
+	if cfg.Backoff != nil && (cfg.Backoff.Retries < 0 || cfg.Backoff.Jitter < 0 || cfg.Backoff.Jitter > 1) {
+		return errors.New("backoff needs non-negative retries and a jitter between 0 and 1")
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package mqttbmlatency
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateLoadShapes(t *testing.T) {
+	tests := []struct {
+		name    string
+		burst   *Burst
+		poisson time.Duration
+		valid   bool
+	}{
+		{"steady", nil, 0, true},
+		{"burst", &Burst{Size: 10, Interval: time.Millisecond, Gap: time.Second}, 0, true},
+		{"empty burst", &Burst{Size: 0, Interval: time.Millisecond, Gap: time.Second}, 0, false},
+		{"negative size", &Burst{Size: -1, Interval: time.Millisecond, Gap: time.Second}, 0, false},
+		{"back to back", &Burst{Size: 10, Gap: time.Second}, 0, true},
+		{"negative interval", &Burst{Size: 10, Interval: -time.Millisecond, Gap: time.Second}, 0, false},
+		{"no gap", &Burst{Size: 10, Interval: time.Millisecond}, 0, false},
+		{"negative gap", &Burst{Size: 10, Interval: time.Millisecond, Gap: -time.Second}, 0, false},
+		{"poisson", nil, 10 * time.Millisecond, true},
+		{"negative poisson mean", nil, -10 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Broker:      "tcp://127.0.0.1:1883",
+				Topic:       "shape",
+				Clients:     1,
+				Count:       1,
+				Size:        64,
+				KeepAlive:   30,
+				Burst:       tt.burst,
+				PoissonMean: tt.poisson,
+			}
+			if err := cfg.Validate(); (err == nil) != tt.valid {
+				t.Errorf("validation error %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
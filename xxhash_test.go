@@ -0,0 +1,23 @@
+package mqttbmlatency
+
+import "testing"
+
+// TestXXH64 checks the reference vectors of XXH64 with seed 0, covering the
+// short input path and the 32 byte stripes
+func TestXXH64(t *testing.T) {
+	tests := []struct {
+		input string
+		want  uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"abc", 0x44bc2cf5ad770999},
+		{"Nobody inspects the spammish repetition", 0xfbcea83c8a378bf1},
+		{"The quick brown fox jumps over the lazy dog", 0x0b242d361fda71bc},
+	}
+	for _, tt := range tests {
+		if got := xxh64([]byte(tt.input)); got != tt.want {
+			t.Errorf("xxh64(%q) = %#016x, want %#016x", tt.input, got, tt.want)
+		}
+	}
+}